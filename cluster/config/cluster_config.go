@@ -6,7 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/QuarkChain/goquarkchain/account"
 	"github.com/QuarkChain/goquarkchain/common"
@@ -40,6 +43,7 @@ type ClusterConfig struct {
 	CheckDBRBlockFrom        int
 	CheckDBRBlockTo          int
 	CheckDBRBlockBatch       int
+	ConfigVersion            uint32 `json:"CONFIG_VERSION,omitempty"`
 	// TODO KafkaSampleLogger
 }
 
@@ -89,6 +93,131 @@ func (c *ClusterConfig) GetSlaveConfig(id string) (*SlaveConfig, error) {
 	return nil, fmt.Errorf("slave %s is not in cluster config", id)
 }
 
+// GetSlaveConfigByFullShardID returns the slave serving fullShardID.
+func (c *ClusterConfig) GetSlaveConfigByFullShardID(fullShardID uint32) (*SlaveConfig, error) {
+	return FindSlaveByFullShardID(c.SlaveList, fullShardID)
+}
+
+// ShardRouting maps each shard of the cluster to the slave serving it, see
+// BuildShardRouting.
+func (c *ClusterConfig) ShardRouting() (map[uint32]*SlaveConfig, error) {
+	return BuildShardRouting(c.SlaveList, c.Quarkchain.GetGenesisShardIds())
+}
+
+// ValidateSlaves checks the chain masks of the slave list against the chains
+// of the cluster, see ValidateSlaveList.
+func (c *ClusterConfig) ValidateSlaves() error {
+	return ValidateSlaveList(c.SlaveList, c.Quarkchain.ChainSize)
+}
+
+// ValidationErrors lists every problem found in a config.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	return fmt.Sprintf("%d problems: %s", len(msgs), strings.Join(msgs, "; "))
+}
+
+// Validate checks the whole cluster: the config version, every slave, that
+// slave IDs and addresses are unique, that the websocket ports of the slaves
+// of a host collide neither with each other nor with the master, and that
+// the chain masks of the slaves cover each chain exactly once. Instead of
+// failing on the first problem it returns a ValidationErrors listing all of
+// them.
+func (c *ClusterConfig) Validate() error {
+	var errs ValidationErrors
+	if err := checkConfigVersion(c.ConfigVersion); err != nil {
+		errs = append(errs, err)
+	}
+	if len(c.SlaveList) == 0 {
+		errs = append(errs, errors.New("slave list is empty"))
+	}
+	var (
+		ids     = make(map[string]bool)
+		addrs   = make(map[string]string)
+		wsAddrs = make(map[string]string)
+	)
+	for i, slave := range c.SlaveList {
+		if slave == nil {
+			errs = append(errs, fmt.Errorf("slave at index %d is empty", i))
+			continue
+		}
+		if err := slave.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+		if ids[slave.ID] {
+			errs = append(errs, fmt.Errorf("slave ID %s is used more than once", slave.ID))
+		}
+		ids[slave.ID] = true
+		addr := slave.Address()
+		if other, ok := addrs[addr]; ok {
+			errs = append(errs, fmt.Errorf("slaves %s and %s both listen on %s", other, slave.ID, addr))
+		} else {
+			addrs[addr] = slave.ID
+		}
+		wsPort := slave.WSEndpointPort()
+		wsAddr := net.JoinHostPort(slave.host(), strconv.Itoa(int(wsPort)))
+		if other, ok := wsAddrs[wsAddr]; ok {
+			errs = append(errs, fmt.Errorf("slaves %s and %s both use websocket port %d on %s", other, slave.ID, wsPort, slave.IP))
+		} else {
+			wsAddrs[wsAddr] = slave.ID
+		}
+		if name, ok := c.masterListener(slave.IP, wsPort); ok {
+			errs = append(errs, fmt.Errorf("slave %s uses websocket port %d of master %s on %s", slave.ID, wsPort, name, slave.IP))
+		}
+	}
+	if c.Quarkchain == nil {
+		errs = append(errs, errors.New("quarkchain config is missing"))
+	} else {
+		errs = append(errs, slaveMaskErrors(c.SlaveList, c.Quarkchain.ChainSize)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// masterListener returns the JSON name of the master listener bound to port
+// on host. The master has no websocket endpoint, its JSON-RPC listeners are
+// the ports it may share with a slave. A slave reached on a loopback address
+// runs on the host of the master, so a master listener on the unspecified
+// address binds its port too.
+func (c *ClusterConfig) masterListener(host string, port uint16) (string, bool) {
+	listeners := []struct {
+		name string
+		host string
+		port uint16
+	}{
+		{"JSON_RPC_PORT", c.JSONRPCHOST, c.JSONRPCPort},
+		{"PRIVATE_JSON_RPC_PORT", c.PrivateJSONRPCHOST, c.PrivateJSONRPCPort},
+	}
+	for _, l := range listeners {
+		if l.port != port {
+			continue
+		}
+		if l.host == host || (isUnspecifiedHost(l.host) && isLoopbackHost(host)) {
+			return l.name, true
+		}
+	}
+	return "", false
+}
+
+func isUnspecifiedHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
 type QuarkChainConfig struct {
 	ChainSize                         uint32      `json:"CHAIN_SIZE"`
 	MaxNeighbors                      uint32      `json:"MAX_NEIGHBORS"`
@@ -204,11 +204,19 @@ type NetWorkId struct {
 type MasterConfig struct {
 	// default 1.0
 	MasterToSlaveConnectRetryDelay float32 `json:"MASTER_TO_SLAVE_CONNECT_RETRY_DELAY"`
+	// MasterToSlaveConnectMaxDelay caps in seconds the delay between the
+	// attempts to reach a slave, which doubles after each failure.
+	MasterToSlaveConnectMaxDelay float32 `json:"MASTER_TO_SLAVE_CONNECT_MAX_DELAY"`
+	// MasterToSlaveConnectAttempts is the number of attempts to reach a
+	// slave before the master gives up, 0 retries forever.
+	MasterToSlaveConnectAttempts uint32 `json:"MASTER_TO_SLAVE_CONNECT_ATTEMPTS"`
 }
 
 func NewMasterConfig() *MasterConfig {
 	return &MasterConfig{
 		MasterToSlaveConnectRetryDelay: 1.0,
+		MasterToSlaveConnectMaxDelay:   30.0,
+		MasterToSlaveConnectAttempts:   10,
 	}
 }
 
@@ -221,16 +229,136 @@ type P2PConfig struct {
 	UPnP             bool    `json:"UPNP"`
 	AllowDialInRatio float32 `json:"ALLOW_DIAL_IN_RATIO"`
 	PreferredNodes   string  `json:"PREFERRED_NODES"`
+	// AllowedPeers is a comma separated list of enode URLs, public keys or
+	// node IDs. When set, only these nodes may connect.
+	AllowedPeers string `json:"ALLOWED_PEERS"`
+	// DeniedPeers lists, in the same format, the nodes which may never
+	// connect, it takes precedence over AllowedPeers.
+	DeniedPeers string `json:"DENIED_PEERS"`
+	// PeerEviction is the policy making room for a peer connecting while
+	// MaxPeers are connected: "none" rejects it, "idle" drops the peer
+	// silent for the longest and "reputation" the one with the lowest score,
+	// unless that peer scores better than the new one.
+	PeerEviction string `json:"PEER_EVICTION"`
+	// MinEvictIdle is the number of seconds a peer must have been silent to
+	// be dropped by the "idle" eviction policy.
+	MinEvictIdle uint64 `json:"MIN_EVICT_IDLE"`
+	// IgnoreUnknownMsg makes peers skip messages with unknown op codes
+	// instead of being disconnected.
+	IgnoreUnknownMsg bool `json:"IGNORE_UNKNOWN_MSG"`
+	// SkipBadPayload makes peers skip messages whose payload cannot be
+	// decoded, at a reputation cost, instead of being disconnected. Frames
+	// failing their MAC always disconnect the peer.
+	SkipBadPayload bool `json:"SKIP_BAD_PAYLOAD"`
+	// PingInterval is the number of seconds a peer may stay silent before
+	// it is pinged, 0 disables the keepalive.
+	PingInterval uint64 `json:"PING_INTERVAL"`
+	// PingTimeout is the number of seconds to wait for the pong before the
+	// peer is disconnected.
+	PingTimeout uint64 `json:"PING_TIMEOUT"`
+	// MsgWorkers is the number of goroutines handling the messages of each
+	// peer off its read loop.
+	MsgWorkers uint32 `json:"MSG_WORKERS"`
+	// DropOnBusy disconnects a peer sending messages faster than the workers
+	// handle them, instead of blocking its read loop.
+	DropOnBusy bool `json:"DROP_ON_BUSY"`
+	// WriteQueueSize is the number of messages queued in each priority lane
+	// of a peer before senders are held back.
+	WriteQueueSize uint32 `json:"WRITE_QUEUE_SIZE"`
+	// WriteTimeout is the number of milliseconds a send waits for room in a
+	// full write queue before it fails, 0 fails it at once.
+	WriteTimeout uint64 `json:"WRITE_TIMEOUT"`
+	// HandshakeTimeout is the number of seconds the qkc hello exchange with
+	// a connected peer may take before it is dropped.
+	HandshakeTimeout uint64 `json:"HANDSHAKE_TIMEOUT"`
+	// ReadTimeout is the number of seconds a peer may stay silent before it
+	// is dropped, it should exceed PingInterval.
+	ReadTimeout uint64 `json:"READ_TIMEOUT"`
+	// FrameWriteTimeout is the number of seconds writing a frame to a peer
+	// may take before it is dropped, longer for peers across slow links.
+	FrameWriteTimeout uint64 `json:"FRAME_WRITE_TIMEOUT"`
+	// MsgRateLimit is the number of messages per second read from each
+	// peer, reads are paused while a peer exceeds it. 0 disables the limit.
+	MsgRateLimit uint32 `json:"MSG_RATE_LIMIT"`
+	// ByteRateLimit is the number of bytes per second read from each peer,
+	// 0 disables the limit.
+	ByteRateLimit uint64 `json:"BYTE_RATE_LIMIT"`
+	// MaxThrottleTime is the number of seconds a peer may stay over its rate
+	// limit before it is disconnected, 0 only pauses its reads.
+	MaxThrottleTime uint64 `json:"MAX_THROTTLE_TIME"`
+	// CompressionDict offers peers to deflate frames with a preset
+	// dictionary, which shrinks header heavy traffic more than snappy.
+	// Peers not offering it keep using snappy.
+	CompressionDict bool `json:"COMPRESSION_DICT"`
+	// DecodeBufferSize is the largest compressed frame, in bytes, read into
+	// a buffer each peer connection reuses rather than allocating one per
+	// frame. 0 uses the preset size.
+	DecodeBufferSize uint32 `json:"DECODE_BUFFER_SIZE"`
+	// TipUpdateInterval is the number of seconds between the summaries of
+	// our root tip sent to the peers, besides the one sent on each tip
+	// change. 0 only sends them on tip changes.
+	TipUpdateInterval uint64 `json:"TIP_UPDATE_INTERVAL"`
+	// ClockSkewWarn is the number of seconds the clock a peer sends in the
+	// handshake may be off ours before a warning is logged, 0 never warns.
+	ClockSkewWarn uint64 `json:"CLOCK_SKEW_WARN"`
+	// MaxClockSkew is the number of seconds the clock of a peer may be off
+	// ours before the peer is rejected, 0 accepts any offset.
+	MaxClockSkew uint64 `json:"MAX_CLOCK_SKEW"`
+	// DedupCacheSize is the number of recent block and transaction
+	// announcements remembered to drop the copies relayed by other peers,
+	// 0 handles every copy.
+	DedupCacheSize uint32 `json:"DEDUP_CACHE_SIZE"`
+	// DedupTTL is the number of seconds an announcement is remembered.
+	DedupTTL uint64 `json:"DEDUP_TTL"`
+	// MaxPendingRPCs is the number of requests to each peer which may be
+	// pending their response at once, the next ones fail until responses
+	// arrive or requests time out. 0 does not bound them.
+	MaxPendingRPCs uint32 `json:"MAX_PENDING_RPCS"`
+	// RequestTimeout is the number of seconds a request to a peer waits for
+	// its response, unless the call sets its own timeout.
+	RequestTimeout uint64 `json:"REQUEST_TIMEOUT"`
+	// DrainTimeout is the number of seconds shutdown waits for the
+	// responses to our pending requests before disconnecting the peers,
+	// 0 disconnects them at once.
+	DrainTimeout uint64 `json:"DRAIN_TIMEOUT"`
 }
 
 func NewP2PConfig() *P2PConfig {
 	return &P2PConfig{
-		BootNodes:        "",
-		PrivKey:          "",
-		MaxPeers:         25,
-		UPnP:             false,
-		AllowDialInRatio: 1.0,
-		PreferredNodes:   "",
+		BootNodes:         "",
+		PrivKey:           "",
+		MaxPeers:          25,
+		UPnP:              false,
+		AllowDialInRatio:  1.0,
+		PreferredNodes:    "",
+		AllowedPeers:      "",
+		DeniedPeers:       "",
+		PeerEviction:      "none",
+		MinEvictIdle:      60,
+		IgnoreUnknownMsg:  false,
+		SkipBadPayload:    false,
+		PingInterval:      30,
+		PingTimeout:       10,
+		MsgWorkers:        4,
+		DropOnBusy:        false,
+		WriteQueueSize:    64,
+		WriteTimeout:      5000,
+		HandshakeTimeout:  10,
+		ReadTimeout:       60,
+		FrameWriteTimeout: 20,
+		MsgRateLimit:      1000,
+		ByteRateLimit:     16 << 20,
+		MaxThrottleTime:   30,
+		CompressionDict:   false,
+		DecodeBufferSize:  1 << 20,
+		TipUpdateInterval: 30,
+		ClockSkewWarn:     10,
+		MaxClockSkew:      0,
+		DedupCacheSize:    8192,
+		DedupTTL:          120,
+		MaxPendingRPCs:    256,
+		RequestTimeout:    10,
+		DrainTimeout:      5,
 	}
 }
 
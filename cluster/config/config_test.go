@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/QuarkChain/goquarkchain/account"
+	"github.com/QuarkChain/goquarkchain/core/types"
 	"github.com/ethereum/go-ethereum/common"
 	"io/ioutil"
 	"math/big"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -112,6 +114,497 @@ func TestSlaveConfig(t *testing.T) {
 	assert.True(t, strings.Contains(string(jsonConfig), "MASK_LIST\":[4]"))
 }
 
+func TestSlaveConfigWSPort(t *testing.T) {
+	var sc SlaveConfig
+	assert.NoError(t, json.Unmarshal([]byte(`{"ID": "S1", "CHAIN_MASK_LIST": [4]}`), &sc))
+	assert.Equal(t, DefaultWSPort, sc.WSPort)
+
+	sc.WSPort = DefaultWSPort + 1
+	jsonConfig, err := json.Marshal(&sc)
+	assert.NoError(t, err)
+	var decoded SlaveConfig
+	assert.NoError(t, json.Unmarshal(jsonConfig, &decoded))
+	assert.Equal(t, sc, decoded)
+}
+
+func TestSlaveConfigFormats(t *testing.T) {
+	files := map[string]string{
+		FormatJSON: `{"HOST": "1.2.3.4", "PORT": 123, "ID": "S1", "CHAIN_MASK_LIST": [4, 5]}`,
+		FormatTOML: "HOST = \"1.2.3.4\"\nPORT = 123\nID = \"S1\"\nCHAIN_MASK_LIST = [4, 5]\n",
+		FormatYAML: "HOST: 1.2.3.4\nPORT: 123\nID: S1\nCHAIN_MASK_LIST: [4, 5]\n",
+	}
+	want, err := UnmarshalSlaveConfig([]byte(files[FormatJSON]), FormatJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultWSPort, want.WSPort)
+	assert.Equal(t, uint32(5), want.ChainMaskList[1].GetMask())
+
+	dir, err := ioutil.TempDir("", "slave-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for format, content := range files {
+		sc, err := UnmarshalSlaveConfig([]byte(content), format)
+		assert.NoError(t, err, format)
+		assert.Equal(t, want, sc, format)
+
+		encoded, err := MarshalSlaveConfig(sc, format)
+		assert.NoError(t, err, format)
+		decoded, err := UnmarshalSlaveConfig(encoded, format)
+		assert.NoError(t, err, format)
+		assert.Equal(t, want, decoded, format)
+
+		file := dir + "/slave." + format
+		assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+		loaded, err := LoadSlaveConfig(file)
+		assert.NoError(t, err, format)
+		assert.Equal(t, want, loaded, format)
+	}
+
+	format, err := SlaveConfigFormat("slave.YML")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatYAML, format)
+	_, err = LoadSlaveConfig("slave.ini")
+	assert.Error(t, err)
+}
+
+func TestSlaveConfigDisabledShards(t *testing.T) {
+	var sc SlaveConfig
+	assert.NoError(t, json.Unmarshal([]byte(`{"ID": "S1", "CHAIN_MASK_LIST": [5], "DISABLED_FULL_SHARD_IDS": [65537]}`), &sc))
+	assert.Equal(t, []uint32{1<<16 | 1}, sc.DisabledShards)
+	assert.True(t, sc.ShardDisabled(1<<16|1))
+	assert.False(t, sc.ServesFullShard(1<<16|1))
+	assert.True(t, sc.ServesFullShard(5<<16|1))
+	assert.False(t, sc.ServesFullShard(2<<16|1))
+	assert.NoError(t, sc.Validate())
+
+	jsonConfig, err := json.Marshal(&sc)
+	assert.NoError(t, err)
+	var decoded SlaveConfig
+	assert.NoError(t, json.Unmarshal(jsonConfig, &decoded))
+	assert.Equal(t, sc, decoded)
+
+	// nothing disabled is left out
+	sc.DisabledShards = nil
+	jsonConfig, err = json.Marshal(&sc)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(jsonConfig), "DISABLED_FULL_SHARD_IDS")
+
+	// only shards the chain masks cover can be disabled
+	sc.DisabledShards = []uint32{2<<16 | 1}
+	assert.Error(t, sc.Validate())
+}
+
+func TestSlaveConfigApplyEnv(t *testing.T) {
+	var sc SlaveConfig
+	assert.NoError(t, json.Unmarshal([]byte(`{"HOST": "1.2.3.4", "PORT": 123, "ID": "S1"}`), &sc))
+
+	// nothing set, the file and default values are kept
+	assert.NoError(t, sc.ApplyEnv())
+	assert.Equal(t, "1.2.3.4", sc.IP)
+	assert.Equal(t, uint16(123), sc.Port)
+	assert.Equal(t, "S1", sc.ID)
+	assert.Equal(t, DefaultWSPort, sc.WSPort)
+
+	for key, value := range map[string]string{
+		EnvSlaveHost:   "5.6.7.8",
+		EnvSlavePort:   "456",
+		EnvSlaveID:     "S2",
+		EnvSlaveWSPort: "789",
+	} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	assert.NoError(t, sc.ApplyEnv())
+	assert.Equal(t, "5.6.7.8", sc.IP)
+	assert.Equal(t, uint16(456), sc.Port)
+	assert.Equal(t, uint16(789), sc.WSPort)
+	// the id selects the slave config rather than renaming the one loaded
+	assert.Equal(t, "S1", sc.ID)
+	assert.Equal(t, "S2", SlaveIDFromEnv("S1"))
+	os.Unsetenv(EnvSlaveID)
+	assert.Equal(t, "S1", SlaveIDFromEnv("S1"))
+
+	os.Setenv(EnvSlavePort, "65536")
+	assert.Error(t, sc.ApplyEnv())
+}
+
+func newTestSlaveConfig(id string, masks ...uint32) *SlaveConfig {
+	slave := NewDefaultSlaveConfig()
+	slave.ID = id
+	for _, mask := range masks {
+		slave.ChainMaskList = append(slave.ChainMaskList, types.NewChainMask(mask))
+	}
+	return slave
+}
+
+func TestValidateSlaveList(t *testing.T) {
+	// full coverage of 4 chains
+	slaves := []*SlaveConfig{
+		newTestSlaveConfig("S0", 4),
+		newTestSlaveConfig("S1", 5),
+		newTestSlaveConfig("S2", 6),
+		newTestSlaveConfig("S3", 7),
+	}
+	assert.NoError(t, ValidateSlaveList(slaves, 4))
+	assert.NoError(t, NewClusterConfig().ValidateSlaves())
+
+	// masks 2 and 6 both match chain 2
+	slaves = []*SlaveConfig{
+		newTestSlaveConfig("S0", 2),
+		newTestSlaveConfig("S1", 6),
+	}
+	err := ValidateSlaveList(slaves, 4)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "chain mask 6 of slave S1 overlaps with chain mask 2 of slave S0")
+
+	// chain 3 is not served
+	slaves = []*SlaveConfig{
+		newTestSlaveConfig("S0", 2),
+		newTestSlaveConfig("S1", 5),
+	}
+	err = ValidateSlaveList(slaves, 4)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "chain 3 is not served")
+
+	// overlap inside a single slave
+	err = newTestSlaveConfig("S0", 2, 6).Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "slave S0 has overlapping chain masks 2 and 6")
+
+	assert.Error(t, newTestSlaveConfig("S0").Validate())
+	assert.Error(t, newTestSlaveConfig("S0", 0).Validate())
+}
+
+func TestClusterConfigValidate(t *testing.T) {
+	cfg := NewClusterConfig()
+	assert.NoError(t, cfg.Validate())
+
+	// S1 reuses the ID, the address and so the websocket port of S0, chain 3
+	// is not served and S2 has no port
+	cfg.Quarkchain.ChainSize = 4
+	cfg.SlaveList = []*SlaveConfig{
+		newTestSlaveConfig("S0", 4),
+		newTestSlaveConfig("S0", 5),
+		newTestSlaveConfig("S2", 6),
+	}
+	cfg.SlaveList[2].Port = 0
+	err := cfg.Validate()
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 5)
+	assert.True(t, errors.Is(errs[3], errInvalidSlavePort))
+	assert.Contains(t, err.Error(), "slave ID S0 is used more than once")
+	assert.Contains(t, err.Error(), "slaves S0 and S0 both listen on localhost:38000")
+	assert.Contains(t, err.Error(), "slaves S0 and S0 both use websocket port 38590 on localhost")
+	assert.Contains(t, err.Error(), "chain 3 is not served")
+
+	cfg.SlaveList = nil
+	assert.Error(t, cfg.Validate())
+}
+
+func TestClusterConfigValidateWSPorts(t *testing.T) {
+	cfg := NewClusterConfig()
+	cfg.Quarkchain.ChainSize = 2
+	cfg.SlaveList = []*SlaveConfig{newTestSlaveConfig("S0", 2), newTestSlaveConfig("S1", 3)}
+	cfg.SlaveList[1].Port++
+	// the ID offsets the default port
+	assert.Equal(t, DefaultWSPort+1, cfg.SlaveList[1].WSEndpointPort())
+	assert.NoError(t, cfg.Validate())
+
+	cfg.SlaveList[1].WSPort = DefaultWSPort - 1
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "slaves S0 and S1 both use websocket port 38590 on localhost")
+
+	// the same port on another host is fine
+	cfg.SlaveList[1].IP = "127.0.0.2"
+	assert.NoError(t, cfg.Validate())
+
+	// the public JSON-RPC listener of the master binds every interface
+	cfg.SlaveList[1].WSPort = cfg.JSONRPCPort - 1
+	err = cfg.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "slave S1 uses websocket port 38391 of master JSON_RPC_PORT on 127.0.0.2")
+}
+
+func TestConfigVersion(t *testing.T) {
+	slave := `{"HOST": "127.0.0.1", "PORT": 38000, "ID": "S0", "CHAIN_MASK_LIST": [1]%s}`
+	cluster := `{"CONFIG_VERSION": %d, "SLAVE_LIST": [` + slave + `]}`
+	load := func(clusterVersion uint32, slaveVersion string) error {
+		cfg := NewClusterConfig()
+		cfg.Quarkchain.ChainSize = 1
+		if err := json.Unmarshal([]byte(fmt.Sprintf(cluster, clusterVersion, slaveVersion)), cfg); err != nil {
+			return err
+		}
+		return cfg.Validate()
+	}
+
+	// absent versions are the current one
+	assert.NoError(t, load(0, ""))
+	assert.NoError(t, load(CurrentConfigVersion, fmt.Sprintf(`, "CONFIG_VERSION": %d`, MinConfigVersion)))
+
+	err := load(CurrentConfigVersion+1, "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("config version %d not supported", CurrentConfigVersion+1))
+
+	err = load(0, fmt.Sprintf(`, "CONFIG_VERSION": %d`, CurrentConfigVersion+1))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("slave S0: config version %d not supported", CurrentConfigVersion+1))
+
+	// the version survives a round trip, and an absent one stays absent
+	sc := newTestSlaveConfig("S0", 1)
+	enc, err := json.Marshal(sc)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(enc), "CONFIG_VERSION")
+	sc.ConfigVersion = CurrentConfigVersion + 1
+	enc, err = json.Marshal(sc)
+	assert.NoError(t, err)
+	var decoded SlaveConfig
+	assert.NoError(t, json.Unmarshal(enc, &decoded))
+	assert.Error(t, decoded.Validate())
+}
+
+func TestValidateAndSummarize(t *testing.T) {
+	cfg := NewClusterConfig()
+	report, err := ValidateAndSummarize(cfg)
+	assert.NoError(t, err)
+	assert.Contains(t, report, "network 3: 3 chains, 4 slaves")
+	assert.Contains(t, report, "chain 1 shard 0x10003: S1")
+	assert.Contains(t, report, "slave S2: localhost:38002, websocket 38592, chain masks [6]")
+
+	// chain 1 loses its slave and chain 3 has no shards
+	cfg.Quarkchain.ChainSize = 4
+	cfg.SlaveList = append(cfg.SlaveList[:1], cfg.SlaveList[2:]...)
+	report, err = ValidateAndSummarize(cfg)
+	assert.Contains(t, report, "chain 1 shard 0x10003: -")
+	errs, ok := err.(ValidationErrors)
+	assert.True(t, ok)
+	assert.Contains(t, errs.Error(), "chain 1 is not served")
+	assert.Contains(t, errs.Error(), "full shard id 65539 is not served by any slave")
+	assert.Contains(t, errs.Error(), "chain 3 has no shard")
+}
+
+func TestSlaveConfigValidateAddr(t *testing.T) {
+	slave := newTestSlaveConfig("S0", 4)
+	assert.NoError(t, slave.Validate())
+
+	slave.IP = ""
+	err := slave.Validate()
+	assert.True(t, errors.Is(err, errInvalidSlaveHost))
+	assert.Contains(t, err.Error(), "slave S0")
+
+	// host names are checked for their syntax only, not resolved
+	for host, valid := range map[string]bool{
+		"slave-0.cluster.invalid": true,
+		"slave0.":                 true,
+		"[::1]":                   true,
+		"slave_0":                 true,
+		"slave/0":                 false,
+		"-slave":                  false,
+		"slave..cluster":          false,
+		"slave 0":                 false,
+	} {
+		slave.IP = host
+		assert.Equal(t, valid, slave.Validate() == nil, host)
+	}
+
+	slave = newTestSlaveConfig("S1", 4)
+	slave.Port = 0
+	assert.True(t, errors.Is(slave.Validate(), errInvalidSlavePort))
+
+	slave = newTestSlaveConfig("S2", 4)
+	slave.WSPort = slave.Port
+	assert.True(t, errors.Is(slave.Validate(), errSlaveWSPortInUse))
+}
+
+func TestSlaveConfigAddress(t *testing.T) {
+	tests := []struct {
+		host string
+		addr string
+	}{
+		{"127.0.0.1", "127.0.0.1:38000"},
+		{"::1", "[::1]:38000"},
+		{"[::1]", "[::1]:38000"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:38000"},
+		{"localhost", "localhost:38000"},
+		{"slave0.example.com", "slave0.example.com:38000"},
+	}
+	for _, tt := range tests {
+		slave := newTestSlaveConfig("S0", 4)
+		slave.IP = tt.host
+		slave.Port = 38000
+		assert.Equal(t, tt.addr, slave.Address(), "host %s", tt.host)
+	}
+
+	slave := newTestSlaveConfig("S0", 4)
+	slave.IP = "[::1]"
+	assert.NoError(t, slave.Validate())
+}
+
+func TestSlaveConfigStoreReload(t *testing.T) {
+	slave := newTestSlaveConfig("S0", 4)
+	store := NewSlaveConfigStore(slave)
+	var changes []uint16
+	store.Subscribe(SlaveConfigSubscriberFunc(func(old, new *SlaveConfig) {
+		assert.Equal(t, slave.WSPort, old.WSPort)
+		changes = append(changes, new.WSPort)
+	}))
+
+	next := newTestSlaveConfig("S0", 4)
+	next.WSPort = slave.WSPort + 1
+	assert.NoError(t, store.Reload(next))
+	assert.Equal(t, []uint16{next.WSPort}, changes)
+	assert.Equal(t, next.WSPort, store.Get().WSPort)
+
+	// chain mask and port changes need a restart
+	moved := newTestSlaveConfig("S0", 5)
+	moved.Port++
+	err := store.Reload(moved)
+	assert.True(t, errors.Is(err, ErrSlaveConfigNeedsRestart))
+	assert.Contains(t, err.Error(), "PORT, CHAIN_MASK_LIST changed")
+	assert.Equal(t, uint32(4), store.Get().ChainMaskList[0].GetMask())
+	assert.Len(t, changes, 1)
+
+	assert.Error(t, store.Reload(newTestSlaveConfig("S0")))
+
+	disabled := newTestSlaveConfig("S0", 4)
+	disabled.DisabledShards = []uint32{4 << 16}
+	err = store.Reload(disabled)
+	assert.True(t, errors.Is(err, ErrSlaveConfigNeedsRestart))
+	assert.Contains(t, err.Error(), "DISABLED_FULL_SHARD_IDS changed")
+
+	// the log level is applied while running
+	store = NewSlaveConfigStore(newTestSlaveConfig("S0", 4))
+	verbose := newTestSlaveConfig("S0", 4)
+	verbose.LogLevel = "debug"
+	assert.NoError(t, store.Reload(verbose))
+	assert.Equal(t, "debug", store.Get().LogLevel)
+	verbose.LogLevel = "chatty"
+	assert.Error(t, store.Reload(verbose))
+}
+
+func TestFindSlaveByFullShardID(t *testing.T) {
+	slaves := []*SlaveConfig{
+		newTestSlaveConfig("S0", 2),
+		newTestSlaveConfig("S1", 5, 7),
+	}
+	for _, tt := range []struct {
+		chainID uint32
+		id      string
+	}{{0, "S0"}, {1, "S1"}, {2, "S0"}, {3, "S1"}, {6, "S0"}, {7, "S1"}} {
+		slave, err := FindSlaveByFullShardID(slaves, tt.chainID<<16|1)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.id, slave.ID)
+	}
+
+	slave, err := NewClusterConfig().GetSlaveConfigByFullShardID(2<<16 | 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "S2", slave.ID)
+
+	// without S0 even chains are not served
+	_, err = FindSlaveByFullShardID(slaves[1:], 5<<16)
+	assert.NoError(t, err)
+	_, err = FindSlaveByFullShardID(slaves[1:], 4<<16)
+	assert.Error(t, err)
+
+	// chain 2 is served twice
+	_, err = FindSlaveByFullShardID(append(slaves, newTestSlaveConfig("S2", 6)), 2<<16)
+	assert.Error(t, err)
+
+	// a disabled shard is not served, the other shards of its slave are
+	slaves[1].DisabledShards = []uint32{3<<16 | 1}
+	_, err = FindSlaveByFullShardID(slaves, 3<<16|1)
+	assert.Error(t, err)
+	slave, err = FindSlaveByFullShardID(slaves, 1<<16|1)
+	assert.NoError(t, err)
+	assert.Equal(t, "S1", slave.ID)
+}
+
+func TestBuildShardRouting(t *testing.T) {
+	slaves := []*SlaveConfig{
+		newTestSlaveConfig("S0", 2),
+		newTestSlaveConfig("S1", 5, 7),
+	}
+	var ids []uint32
+	for chainID := uint32(0); chainID < 8; chainID++ {
+		ids = append(ids, chainID<<16, chainID<<16|1)
+	}
+	routing, err := BuildShardRouting(slaves, ids)
+	assert.NoError(t, err)
+	assert.Len(t, routing, len(ids))
+	for _, id := range ids {
+		want := "S0"
+		if (id>>16)%2 == 1 {
+			want = "S1"
+		}
+		assert.Equal(t, want, routing[id].ID, "full shard id %d", id)
+	}
+
+	// disabled shards are not routed
+	slaves[1].DisabledShards = []uint32{3<<16 | 1}
+	routing, err = BuildShardRouting(slaves, ids)
+	assert.NoError(t, err)
+	assert.Len(t, routing, len(ids)-1)
+	assert.Nil(t, routing[3<<16|1])
+	assert.Equal(t, "S1", routing[3<<16].ID)
+	slaves[1].DisabledShards = nil
+
+	// every shard needs exactly one slave
+	_, err = BuildShardRouting(slaves[1:], ids)
+	assert.EqualError(t, err, "full shard id 0 is not served by any slave")
+	_, err = BuildShardRouting(append(slaves, newTestSlaveConfig("S2", 6)), ids)
+	assert.EqualError(t, err, "full shard id 131072 is served by both slave S0 and slave S2")
+
+	cluster := NewClusterConfig()
+	routing, err = cluster.ShardRouting()
+	assert.NoError(t, err)
+	assert.Len(t, routing, len(cluster.Quarkchain.GetGenesisShardIds()))
+	for id, slave := range routing {
+		owner, err := cluster.GetSlaveConfigByFullShardID(id)
+		assert.NoError(t, err)
+		assert.Equal(t, owner, slave)
+	}
+}
+
+func TestGenerateSlaveConfigs(t *testing.T) {
+	for _, tt := range []struct {
+		chainSize uint32
+		numSlaves int
+		masks     [][]uint32
+	}{
+		{3, 4, [][]uint32{{4}, {5}, {6}, {7}}},
+		{4, 3, [][]uint32{{4, 7}, {5}, {6}}},
+		{8, 2, [][]uint32{{2}, {3}}},
+		{5, 1, [][]uint32{{1}}},
+		{8, 3, [][]uint32{{8, 11, 14}, {9, 12, 15}, {10, 13}}},
+	} {
+		slaves, err := GenerateSlaveConfigs(tt.chainSize, tt.numSlaves)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.numSlaves, len(slaves))
+		for i, slave := range slaves {
+			masks := make([]uint32, len(slave.ChainMaskList))
+			for j, mask := range slave.ChainMaskList {
+				masks[j] = mask.GetMask()
+			}
+			assert.Equal(t, tt.masks[i], masks)
+		}
+		assert.NoError(t, ValidateSlaveList(slaves, tt.chainSize))
+		for chainID := uint32(0); chainID < tt.chainSize; chainID++ {
+			slave, err := FindSlaveByFullShardID(slaves, chainID<<16)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("S%d", int(chainID)%tt.numSlaves), slave.ID)
+		}
+
+		jsonConfig, err := json.Marshal(slaves)
+		assert.NoError(t, err)
+		var decoded []*SlaveConfig
+		assert.NoError(t, json.Unmarshal(jsonConfig, &decoded))
+		assert.Equal(t, slaves, decoded)
+	}
+
+	_, err := GenerateSlaveConfigs(4, 0)
+	assert.Error(t, err)
+}
+
 func TestLoadClusterConfig(t *testing.T) {
 	var (
 		goClstr ClusterConfig
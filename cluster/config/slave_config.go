@@ -2,45 +2,87 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/log"
 )
 
+// Environment variables overriding the config of the slave being started.
+// Values set in the environment take precedence over the config file, which
+// takes precedence over the defaults.
+const (
+	EnvSlaveHost   = "QKC_SLAVE_HOST"
+	EnvSlavePort   = "QKC_SLAVE_PORT"
+	EnvSlaveID     = "QKC_SLAVE_ID"
+	EnvSlaveWSPort = "QKC_SLAVE_WS_PORT"
+)
+
+var (
+	errInvalidSlaveHost = errors.New("invalid host")
+	errInvalidSlavePort = errors.New("invalid port")
+	errSlaveWSPortInUse = errors.New("websocket port is the same as port")
+)
+
+// Versions of the config format this binary loads. A config without
+// CONFIG_VERSION is taken to be of the current version, as are all configs
+// written before the field existed.
+const (
+	MinConfigVersion     uint32 = 1
+	CurrentConfigVersion uint32 = 1
+)
+
+// checkConfigVersion fails for a version outside of the supported range, 0
+// stands for an absent version.
+func checkConfigVersion(version uint32) error {
+	if version == 0 {
+		return nil
+	}
+	if version < MinConfigVersion || version > CurrentConfigVersion {
+		return fmt.Errorf("config version %d not supported, supported versions are %d to %d",
+			version, MinConfigVersion, CurrentConfigVersion)
+	}
+	return nil
+}
+
 type SlaveConfig struct {
 	IP            string             `json:"HOST"` // DEFAULT_HOST
 	Port          uint16             `json:"PORT"` // 38392
 	ID            string             `json:"ID"`
 	WSPort        uint16             `json:"WEBSOCKET_JSON_RPC_PORT"`
-	ChainMaskList []*types.ChainMask `json:"-"`
+	ChainMaskList []*types.ChainMask `json:"CHAIN_MASK_LIST"`
+	ConfigVersion uint32             `json:"CONFIG_VERSION,omitempty"`
+	// DisabledShards are full shard ids covered by ChainMaskList which the
+	// slave does not serve for now, e.g. during maintenance.
+	DisabledShards []uint32 `json:"DISABLED_FULL_SHARD_IDS,omitempty"`
+	// Critical slaves must be reachable and report healthy shards before
+	// the master serves traffic, the others are connected in the background,
+	// retrying until they come up. If no slave sets it, every slave is
+	// treated as critical.
+	Critical bool `json:"CRITICAL,omitempty"`
+	// LogLevel overrides the log verbosity of the slave, e.g. "debug". It
+	// can be changed by reloading the config; empty keeps the verbosity set
+	// on the command line.
+	LogLevel string `json:"LOG_LEVEL,omitempty"`
 }
 
 type SlaveConfigAlias SlaveConfig
 
-func (s *SlaveConfig) MarshalJSON() ([]byte, error) {
-	shardMaskList := make([]uint32, len(s.ChainMaskList))
-	for i, m := range s.ChainMaskList {
-		shardMaskList[i] = m.GetMask()
-	}
-	jsonConfig := struct {
-		SlaveConfigAlias
-		ShardMaskList []uint32 `json:"CHAIN_MASK_LIST"`
-	}{SlaveConfigAlias(*s), shardMaskList}
-	return json.Marshal(jsonConfig)
-}
-
 func (s *SlaveConfig) UnmarshalJSON(input []byte) error {
-	var jsonConfig struct {
-		SlaveConfigAlias
-		ChainMaskList []uint32 `json:"CHAIN_MASK_LIST"`
-	}
+	var jsonConfig SlaveConfigAlias
 	if err := json.Unmarshal(input, &jsonConfig); err != nil {
 		return err
 	}
-	*s = SlaveConfig(jsonConfig.SlaveConfigAlias)
-	s.WSPort = DefaultWSPort
-	s.ChainMaskList = make([]*types.ChainMask, len(jsonConfig.ChainMaskList))
-	for i, value := range jsonConfig.ChainMaskList {
-		s.ChainMaskList[i] = types.NewChainMask(value)
+	*s = SlaveConfig(jsonConfig)
+	if s.WSPort == 0 {
+		s.WSPort = DefaultWSPort
 	}
 	return nil
 }
@@ -53,3 +95,345 @@ func NewDefaultSlaveConfig() *SlaveConfig {
 	}
 	return &slaveConfig
 }
+
+// WSEndpointPort returns the port the websocket endpoint of the slave listens
+// on: WSPort offset by the number in the ID of the slave, so that the slaves
+// of a host can share the default WSPort.
+func (s *SlaveConfig) WSEndpointPort() uint16 {
+	if len(s.ID) < 2 {
+		return s.WSPort
+	}
+	suffix, _ := strconv.Atoi(s.ID[1:])
+	return s.WSPort + uint16(suffix)
+}
+
+// Address returns the host and port the slave listens on, joined so that it
+// can be dialed. The host may be an IPv4 address, an IPv6 literal, bracketed
+// or not, or a hostname.
+func (s *SlaveConfig) Address() string {
+	return net.JoinHostPort(s.host(), strconv.Itoa(int(s.Port)))
+}
+
+// host returns IP without the brackets an IPv6 literal may be written with.
+func (s *SlaveConfig) host() string {
+	if strings.HasPrefix(s.IP, "[") && strings.HasSuffix(s.IP, "]") {
+		return s.IP[1 : len(s.IP)-1]
+	}
+	return s.IP
+}
+
+// validHostname reports whether host is a syntactically valid host name:
+// dot separated labels of letters, digits, underscores, as container names
+// have, and inner hyphens, up to 63 bytes each and 253 in total.
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ServesFullShard reports whether the slave serves the shard fullShardID, which
+// one of its chain masks covers and is not disabled.
+func (s *SlaveConfig) ServesFullShard(fullShardID uint32) bool {
+	return s.coversFullShard(fullShardID) && !s.ShardDisabled(fullShardID)
+}
+
+// ShardDisabled reports whether fullShardID is one of the DisabledShards.
+func (s *SlaveConfig) ShardDisabled(fullShardID uint32) bool {
+	for _, id := range s.DisabledShards {
+		if id == fullShardID {
+			return true
+		}
+	}
+	return false
+}
+
+// SlaveIDFromEnv returns the id of the slave being started, EnvSlaveID if it
+// is set and id otherwise. It selects the config of the slave in the cluster
+// config, the master knowing the slaves by their ids.
+func SlaveIDFromEnv(id string) string {
+	if envID, ok := os.LookupEnv(EnvSlaveID); ok {
+		return envID
+	}
+	return id
+}
+
+// ApplyEnv overrides the fields of the slave with the environment variables
+// which are set, see EnvSlaveHost and friends. EnvSlaveID is not applied
+// here, it selects the slave through SlaveIDFromEnv.
+func (s *SlaveConfig) ApplyEnv() error {
+	if host, ok := os.LookupEnv(EnvSlaveHost); ok {
+		s.IP = host
+	}
+	if err := portFromEnv(EnvSlavePort, &s.Port); err != nil {
+		return err
+	}
+	return portFromEnv(EnvSlaveWSPort, &s.WSPort)
+}
+
+func portFromEnv(key string, port *uint16) error {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	p, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	*port = uint16(p)
+	return nil
+}
+
+// Validate checks the config version, the address of the slave, that it
+// serves at least one chain mask and that its masks do not overlap with each
+// other.
+func (s *SlaveConfig) Validate() error {
+	if err := checkConfigVersion(s.ConfigVersion); err != nil {
+		return fmt.Errorf("slave %s: %w", s.ID, err)
+	}
+	if err := s.validateAddr(); err != nil {
+		return fmt.Errorf("slave %s: %w", s.ID, err)
+	}
+	if len(s.ChainMaskList) == 0 {
+		return fmt.Errorf("slave %s has no chain mask", s.ID)
+	}
+	for i, mask := range s.ChainMaskList {
+		if mask == nil {
+			return fmt.Errorf("slave %s has an empty chain mask at index %d", s.ID, i)
+		}
+		for _, other := range s.ChainMaskList[:i] {
+			if other.HasOverlap(mask.GetMask()) {
+				return fmt.Errorf("slave %s has overlapping chain masks %d and %d", s.ID, other.GetMask(), mask.GetMask())
+			}
+		}
+	}
+	for _, id := range s.DisabledShards {
+		if !s.coversFullShard(id) {
+			return fmt.Errorf("slave %s disables full shard id %d which its chain masks do not cover", s.ID, id)
+		}
+	}
+	if s.LogLevel != "" {
+		if _, err := log.LvlFromString(s.LogLevel); err != nil {
+			return fmt.Errorf("slave %s: %w", s.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *SlaveConfig) coversFullShard(fullShardID uint32) bool {
+	for _, mask := range s.ChainMaskList {
+		if mask != nil && mask.ContainFullShardId(fullShardID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SlaveConfig) validateAddr() error {
+	if host := s.host(); net.ParseIP(host) == nil {
+		if host == "" {
+			return errInvalidSlaveHost
+		}
+		// the name is only resolved when dialed, the slave may not be up
+		// yet when the config is checked
+		if !validHostname(host) {
+			return fmt.Errorf("%w %s", errInvalidSlaveHost, s.IP)
+		}
+	}
+	if s.Port == 0 {
+		return errInvalidSlavePort
+	}
+	if s.WSPort == s.Port {
+		return fmt.Errorf("%w %d", errSlaveWSPortInUse, s.Port)
+	}
+	return nil
+}
+
+// ValidateSlaveList checks every slave, that no two slaves claim overlapping
+// chain masks and that each of the chainSize chains is served by a slave.
+func ValidateSlaveList(slaves []*SlaveConfig, chainSize uint32) error {
+	for _, slave := range slaves {
+		if err := slave.Validate(); err != nil {
+			return err
+		}
+	}
+	if errs := slaveMaskErrors(slaves, chainSize); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// slaveMaskErrors reports every pair of slaves with overlapping chain masks
+// and every chain not served by any slave. Empty slaves and masks are
+// skipped, SlaveConfig.Validate reports them.
+func slaveMaskErrors(slaves []*SlaveConfig, chainSize uint32) []error {
+	var errs []error
+	for i, slave := range slaves {
+		if slave == nil {
+			continue
+		}
+		for _, other := range slaves[:i] {
+			if other == nil {
+				continue
+			}
+			for _, mask := range slave.ChainMaskList {
+				for _, otherMask := range other.ChainMaskList {
+					if mask != nil && otherMask != nil && otherMask.HasOverlap(mask.GetMask()) {
+						errs = append(errs, fmt.Errorf("chain mask %d of slave %s overlaps with chain mask %d of slave %s",
+							mask.GetMask(), slave.ID, otherMask.GetMask(), other.ID))
+					}
+				}
+			}
+		}
+	}
+	for chainID := uint32(0); chainID < chainSize; chainID++ {
+		if !slavesContainChain(slaves, chainID) {
+			errs = append(errs, fmt.Errorf("chain %d is not served by any slave", chainID))
+		}
+	}
+	return errs
+}
+
+func slavesContainChain(slaves []*SlaveConfig, chainID uint32) bool {
+	for _, slave := range slaves {
+		if slave == nil {
+			continue
+		}
+		for _, mask := range slave.ChainMaskList {
+			if mask != nil && mask.ContainFullShardId(types.MakeFullShardId(chainID, 0)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// FindSlaveByFullShardID returns the slave serving fullShardID, whose chain
+// masks contain it and which did not disable it. It fails if no slave or
+// more than one slave does.
+func FindSlaveByFullShardID(slaves []*SlaveConfig, fullShardID uint32) (*SlaveConfig, error) {
+	var owner *SlaveConfig
+	for _, slave := range slaves {
+		if !slave.ServesFullShard(fullShardID) {
+			continue
+		}
+		if owner != nil {
+			return nil, fmt.Errorf("full shard id %d is served by both slave %s and slave %s", fullShardID, owner.ID, slave.ID)
+		}
+		owner = slave
+	}
+	if owner == nil {
+		return nil, fmt.Errorf("full shard id %d is not served by any slave", fullShardID)
+	}
+	return owner, nil
+}
+
+// BuildShardRouting maps each of fullShardIDs to the slave whose chain masks
+// contain it. Shards disabled by their slave are left out, requests for them
+// are not routed. It fails if a shard is contained by no slave or by more
+// than one.
+func BuildShardRouting(slaves []*SlaveConfig, fullShardIDs []uint32) (map[uint32]*SlaveConfig, error) {
+	routing := make(map[uint32]*SlaveConfig, len(fullShardIDs))
+	for _, fullShardID := range fullShardIDs {
+		var owner *SlaveConfig
+		for _, slave := range slaves {
+			if slave == nil || !slave.coversFullShard(fullShardID) {
+				continue
+			}
+			if owner != nil {
+				return nil, fmt.Errorf("full shard id %d is served by both slave %s and slave %s", fullShardID, owner.ID, slave.ID)
+			}
+			owner = slave
+		}
+		if owner == nil {
+			return nil, fmt.Errorf("full shard id %d is not served by any slave", fullShardID)
+		}
+		if !owner.ShardDisabled(fullShardID) {
+			routing[fullShardID] = owner
+		}
+	}
+	return routing, nil
+}
+
+// GenerateSlaveConfigs returns numSlaves default slave configs whose chain
+// masks partition the chains as evenly as possible: chain i of the chainSize
+// chains is served by slave i % numSlaves. The masks cover the whole chain id
+// space so that chains added later are served as well.
+func GenerateSlaveConfigs(chainSize uint32, numSlaves int) ([]*SlaveConfig, error) {
+	if chainSize == 0 || numSlaves <= 0 {
+		return nil, fmt.Errorf("invalid chain size %d or slave number %d", chainSize, numSlaves)
+	}
+	depth := bitsFor(uint32(numSlaves))
+	if d := bitsFor(chainSize); d > depth {
+		depth = d
+	}
+	masks := make([][]uint32, numSlaves)
+	for i := uint32(0); i < 1<<depth; i++ {
+		slave := int(i) % numSlaves
+		masks[slave] = append(masks[slave], 1<<depth|i)
+	}
+
+	slaves := make([]*SlaveConfig, numSlaves)
+	for i := range slaves {
+		slave := NewDefaultSlaveConfig()
+		slave.Port = slavePort + uint16(i)
+		slave.ID = fmt.Sprintf("S%d", i)
+		for _, mask := range mergeChainMasks(masks[i]) {
+			slave.ChainMaskList = append(slave.ChainMaskList, types.NewChainMask(mask))
+		}
+		slaves[i] = slave
+	}
+	return slaves, nil
+}
+
+// bitsFor returns the number of bits needed to tell n values apart.
+func bitsFor(n uint32) uint {
+	if n <= 1 {
+		return 0
+	}
+	return uint(bits.Len32(n - 1))
+}
+
+// mergeChainMasks replaces every two sibling masks, which only differ in
+// their highest matched bit, with their parent mask until none is left.
+func mergeChainMasks(masks []uint32) []uint32 {
+	set := make(map[uint32]bool, len(masks))
+	for _, mask := range masks {
+		set[mask] = true
+	}
+	for merged := true; merged; {
+		merged = false
+		for mask := range set {
+			top := uint(bits.Len32(mask)) - 1
+			if top == 0 {
+				continue
+			}
+			sibling := mask ^ 1<<(top-1)
+			if !set[sibling] {
+				continue
+			}
+			delete(set, mask)
+			delete(set, sibling)
+			set[1<<(top-1)|mask&(1<<(top-1)-1)] = true
+			merged = true
+			break
+		}
+	}
+	result := make([]uint32, 0, len(set))
+	for mask := range set {
+		result = append(result, mask)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
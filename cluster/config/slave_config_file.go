@@ -0,0 +1,134 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/naoina/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats of a slave config file, detected from its extension.
+const (
+	FormatJSON = "json"
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
+)
+
+// slaveConfigFile is the layout of a slave config in a TOML or YAML file. It
+// uses the same keys as the JSON encoding of SlaveConfig.
+type slaveConfigFile struct {
+	IP             string   `toml:"HOST" yaml:"HOST"`
+	Port           uint16   `toml:"PORT" yaml:"PORT"`
+	ID             string   `toml:"ID" yaml:"ID"`
+	WSPort         uint16   `toml:"WEBSOCKET_JSON_RPC_PORT" yaml:"WEBSOCKET_JSON_RPC_PORT"`
+	ChainMaskList  []uint32 `toml:"CHAIN_MASK_LIST" yaml:"CHAIN_MASK_LIST"`
+	ConfigVersion  uint32   `toml:"CONFIG_VERSION,omitempty" yaml:"CONFIG_VERSION,omitempty"`
+	DisabledShards []uint32 `toml:"DISABLED_FULL_SHARD_IDS,omitempty" yaml:"DISABLED_FULL_SHARD_IDS,omitempty"`
+}
+
+func newSlaveConfigFile(s *SlaveConfig) *slaveConfigFile {
+	f := &slaveConfigFile{
+		IP:             s.IP,
+		Port:           s.Port,
+		ID:             s.ID,
+		WSPort:         s.WSPort,
+		ConfigVersion:  s.ConfigVersion,
+		ChainMaskList:  make([]uint32, len(s.ChainMaskList)),
+		DisabledShards: s.DisabledShards,
+	}
+	for i, m := range s.ChainMaskList {
+		f.ChainMaskList[i] = m.GetMask()
+	}
+	return f
+}
+
+// slaveConfig converts f the same way SlaveConfig.UnmarshalJSON does.
+func (f *slaveConfigFile) slaveConfig() *SlaveConfig {
+	s := &SlaveConfig{
+		IP:             f.IP,
+		Port:           f.Port,
+		ID:             f.ID,
+		WSPort:         f.WSPort,
+		ConfigVersion:  f.ConfigVersion,
+		DisabledShards: f.DisabledShards,
+	}
+	if s.WSPort == 0 {
+		s.WSPort = DefaultWSPort
+	}
+	s.ChainMaskList = make([]*types.ChainMask, len(f.ChainMaskList))
+	for i, value := range f.ChainMaskList {
+		s.ChainMaskList[i] = types.NewChainMask(value)
+	}
+	return s
+}
+
+// SlaveConfigFormat returns the format of a slave config file from its
+// extension.
+func SlaveConfigFormat(file string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".json":
+		return FormatJSON, nil
+	case ".toml":
+		return FormatTOML, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	default:
+		return "", fmt.Errorf("unknown slave config format %q", ext)
+	}
+}
+
+// LoadSlaveConfig reads a slave config from a JSON, TOML or YAML file.
+func LoadSlaveConfig(file string) (*SlaveConfig, error) {
+	format, err := SlaveConfigFormat(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalSlaveConfig(data, format)
+}
+
+// UnmarshalSlaveConfig decodes a slave config encoded in format.
+func UnmarshalSlaveConfig(data []byte, format string) (*SlaveConfig, error) {
+	var f slaveConfigFile
+	switch format {
+	case FormatJSON:
+		s := new(SlaveConfig)
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown slave config format %q", format)
+	}
+	return f.slaveConfig(), nil
+}
+
+// MarshalSlaveConfig encodes s in format.
+func MarshalSlaveConfig(s *SlaveConfig, format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(s)
+	case FormatTOML:
+		return toml.Marshal(newSlaveConfigFile(s))
+	case FormatYAML:
+		return yaml.Marshal(newSlaveConfigFile(s))
+	default:
+		return nil, fmt.Errorf("unknown slave config format %q", format)
+	}
+}
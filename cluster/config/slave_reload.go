@@ -0,0 +1,135 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+)
+
+// ErrSlaveConfigNeedsRestart is returned when a reloaded slave config changes
+// fields which can only be applied by restarting the slave.
+var ErrSlaveConfigNeedsRestart = errors.New("slave config change needs a restart")
+
+// SlaveConfigSubscriber is notified after the config of the running slave is
+// reloaded. old and new are copies, subscribers are free to keep them.
+type SlaveConfigSubscriber interface {
+	SlaveConfigChanged(old, new *SlaveConfig)
+}
+
+// SlaveConfigSubscriberFunc adapts a function to SlaveConfigSubscriber.
+type SlaveConfigSubscriberFunc func(old, new *SlaveConfig)
+
+func (f SlaveConfigSubscriberFunc) SlaveConfigChanged(old, new *SlaveConfig) {
+	f(old, new)
+}
+
+// SlaveConfigStore holds the config of the running slave and swaps it on
+// reload. It is safe for concurrent use.
+type SlaveConfigStore struct {
+	mu   sync.RWMutex
+	cfg  *SlaveConfig
+	subs []SlaveConfigSubscriber
+}
+
+func NewSlaveConfigStore(cfg *SlaveConfig) *SlaveConfigStore {
+	return &SlaveConfigStore{cfg: copySlaveConfig(cfg)}
+}
+
+// Get returns a copy of the current config.
+func (s *SlaveConfigStore) Get() *SlaveConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copySlaveConfig(s.cfg)
+}
+
+// Subscribe registers sub to be notified of each applied reload.
+func (s *SlaveConfigStore) Subscribe(sub SlaveConfigSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, sub)
+}
+
+// Reload validates cfg and makes it the current config, then notifies the
+// subscribers. Changes to the ID, address, chain masks or disabled shards of
+// the slave are rejected with ErrSlaveConfigNeedsRestart and the current
+// config is kept.
+func (s *SlaveConfigStore) Reload(cfg *SlaveConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if fields := restartFields(s.cfg, cfg); len(fields) > 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s changed", ErrSlaveConfigNeedsRestart, strings.Join(fields, ", "))
+	}
+	old := s.cfg
+	s.cfg = copySlaveConfig(cfg)
+	subs := make([]SlaveConfigSubscriber, len(s.subs))
+	copy(subs, s.subs)
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.SlaveConfigChanged(copySlaveConfig(old), copySlaveConfig(cfg))
+	}
+	return nil
+}
+
+// restartFields returns the JSON names of the fields which differ between old
+// and new and cannot be changed while the slave is running.
+func restartFields(old, new *SlaveConfig) []string {
+	var fields []string
+	if old.ID != new.ID {
+		fields = append(fields, "ID")
+	}
+	if old.IP != new.IP {
+		fields = append(fields, "HOST")
+	}
+	if old.Port != new.Port {
+		fields = append(fields, "PORT")
+	}
+	if !sameChainMasks(old.ChainMaskList, new.ChainMaskList) {
+		fields = append(fields, "CHAIN_MASK_LIST")
+	}
+	if !sameShardIDs(old.DisabledShards, new.DisabledShards) {
+		fields = append(fields, "DISABLED_FULL_SHARD_IDS")
+	}
+	return fields
+}
+
+func sameChainMasks(a, b []*types.ChainMask) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].GetMask() != b[i].GetMask() {
+			return false
+		}
+	}
+	return true
+}
+
+func sameShardIDs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func copySlaveConfig(cfg *SlaveConfig) *SlaveConfig {
+	cpy := *cfg
+	cpy.ChainMaskList = make([]*types.ChainMask, len(cfg.ChainMaskList))
+	copy(cpy.ChainMaskList, cfg.ChainMaskList)
+	if cfg.DisabledShards != nil {
+		cpy.DisabledShards = make([]uint32, len(cfg.DisabledShards))
+		copy(cpy.DisabledShards, cfg.DisabledShards)
+	}
+	return &cpy
+}
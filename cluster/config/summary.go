@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+)
+
+// ValidateAndSummarize validates cfg like Validate, checks that the shards
+// of the network match its chain size and that each shard has exactly one
+// slave, and returns a report of the network and of the slave serving each
+// shard. It neither binds sockets nor dials peers, so operators can check a
+// config before deploying it. The report lists what could be resolved even
+// when the config is invalid, the problems are returned as ValidationErrors.
+func ValidateAndSummarize(cfg *ClusterConfig) (string, error) {
+	var errs ValidationErrors
+	if err := cfg.Validate(); err != nil {
+		if verrs, ok := err.(ValidationErrors); ok {
+			errs = append(errs, verrs...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	var b strings.Builder
+	if cfg.Quarkchain != nil {
+		q := cfg.Quarkchain
+		fmt.Fprintf(&b, "network %d: %d chains, %d slaves\n", q.NetworkID, q.ChainSize, len(cfg.SlaveList))
+
+		shards := q.GetGenesisShardIds()
+		sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+		chains := make(map[uint32]bool)
+		for _, fullShardID := range shards {
+			chainID, _ := types.SplitFullShardId(fullShardID)
+			chains[chainID] = true
+			if chainID >= q.ChainSize {
+				errs = append(errs, fmt.Errorf("shard %#x belongs to chain %d beyond chain size %d", fullShardID, chainID, q.ChainSize))
+			}
+			owner := "-"
+			if slave, err := FindSlaveByFullShardID(cfg.SlaveList, fullShardID); err != nil {
+				errs = append(errs, err)
+			} else {
+				owner = slave.ID
+			}
+			fmt.Fprintf(&b, "  chain %d shard %#x: %s\n", chainID, fullShardID, owner)
+		}
+		for chainID := uint32(0); chainID < q.ChainSize; chainID++ {
+			if !chains[chainID] {
+				errs = append(errs, fmt.Errorf("chain %d has no shard", chainID))
+			}
+		}
+	}
+	for _, slave := range cfg.SlaveList {
+		if slave == nil {
+			continue
+		}
+		masks := make([]string, 0, len(slave.ChainMaskList))
+		for _, mask := range slave.ChainMaskList {
+			if mask != nil {
+				masks = append(masks, fmt.Sprintf("%d", mask.GetMask()))
+			}
+		}
+		fmt.Fprintf(&b, "slave %s: %s:%d, websocket %d, chain masks [%s]\n",
+			slave.ID, slave.IP, slave.Port, slave.WSEndpointPort(), strings.Join(masks, " "))
+	}
+
+	if len(errs) > 0 {
+		return b.String(), errs
+	}
+	return b.String(), nil
+}
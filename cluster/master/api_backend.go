@@ -333,7 +333,7 @@ func (s *QKCMasterBackend) NetWorkInfo() map[string]interface{} {
 		"shardSizes":       shardSizeList,
 		"syncing":          s.IsSyncing(),
 		"mining":           s.IsMining(),
-		"shardServerCount": hexutil.Uint(len(s.clientPool)),
+		"shardServerCount": hexutil.Uint(s.ConnCount()),
 	}
 	return fileds
 }
@@ -394,6 +394,16 @@ func (s *QKCMasterBackend) GetTip() uint64 {
 	return s.rootBlockChain.CurrentBlock().NumberU64()
 }
 
+// GetSlaveReadiness returns the Readiness of the slave connections.
+func (s *QKCMasterBackend) GetSlaveReadiness() map[string]interface{} {
+	readiness := s.Readiness()
+	return map[string]interface{}{
+		"ready":     readiness.Ready,
+		"connected": readiness.Connected,
+		"pending":   readiness.Pending,
+	}
+}
+
 func (s *QKCMasterBackend) GetKadRoutingTable() ([]string, error) {
 	if s.srvr != nil {
 		return s.srvr.GetKadRoutingTable(), nil
@@ -278,6 +278,7 @@ func (s *QKCMasterBackend) Init(srvr *p2p.Server) error {
 	if srvr != nil {
 		s.srvr = srvr
 		s.maxPeers = srvr.MaxPeers
+		s.protocolManager.nodeKey = &srvr.PrivateKey.PublicKey
 	}
 	err := s.SlaveConnManager.InitConnManager(s.clusterConfig)
 	if err != nil {
@@ -288,6 +289,13 @@ func (s *QKCMasterBackend) Init(srvr *p2p.Server) error {
 	if err := s.initShards(); err != nil {
 		return err
 	}
+	if err := s.CheckSlavesHealth(); err != nil {
+		return err
+	}
+	ip, port := s.clusterConfig.Quarkchain.GRPCHost, s.clusterConfig.Quarkchain.GRPCPort
+	s.ConnectPendingSlaves(func(conn rpc.ISlaveConn) error {
+		return conn.MasterInfo(ip, port, s.rootBlockChain.CurrentBlock())
+	}, s.exitCh)
 
 	s.Heartbeat()
 	return nil
@@ -507,7 +515,14 @@ func (s *QKCMasterBackend) GetAccountData(address *account.Address, height *uint
 			branchToAccountBranchData[accountBranchData.Branch] = accountBranchData
 		}
 	}
-	if len(branchToAccountBranchData) != len(s.clusterConfig.Quarkchain.GetGenesisShardIds()) {
+	// disabled shards are not served by any slave
+	served := 0
+	for _, fullShardID := range s.clusterConfig.Quarkchain.GetGenesisShardIds() {
+		if s.GetOneSlaveConnById(fullShardID) != nil {
+			served++
+		}
+	}
+	if len(branchToAccountBranchData) != served {
 		return nil, errors.New("len is not match")
 	}
 	return branchToAccountBranchData, nil
@@ -1,12 +1,14 @@
 package master
 
 import (
+	"crypto/ecdsa"
 	"fmt"
-	"io/ioutil"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/QuarkChain/goquarkchain/account"
 	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/QuarkChain/goquarkchain/cluster/rpc"
 	qkcsync "github.com/QuarkChain/goquarkchain/cluster/sync"
@@ -14,11 +16,13 @@ import (
 	"github.com/QuarkChain/goquarkchain/core"
 	"github.com/QuarkChain/goquarkchain/core/types"
 	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
 	"github.com/QuarkChain/goquarkchain/serialize"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 )
@@ -26,13 +30,67 @@ import (
 // QKCProtocol details
 const (
 	QKCProtocolName     = "quarkchain"
-	QKCProtocolVersion  = 1
+	QKCProtocolVersion  = p2p.HelloExtVersion
 	QKCProtocolLength   = 16
 	chainHeadChanSize   = 10
 	forceSyncCycle      = 1000 * time.Second
 	minDesiredPeerCount = 0
+
+	// rootBlockHeadersLimit caps the headers returned for a
+	// GetRootBlockHeadersRequest.
+	rootBlockHeadersLimit = qkcsync.RootBlockHeaderListLimit
+	// minorBlockHeadersLimit caps the headers returned for a
+	// GetMinorBlockHeadersRequest.
+	minorBlockHeadersLimit = qkcsync.MinorBlockHeaderListLimit
+	// accountQueryLimit caps the GetAccountDataRequests of all peers
+	// querying the slaves at once.
+	accountQueryLimit = 4
+	// drainPollInterval is how often shutdown checks whether the requests
+	// pending their response are done.
+	drainPollInterval = 10 * time.Millisecond
 )
 
+// SnappyMinQKCVersion is the first qkc protocol version whose frames are
+// compressed once RLPx negotiated snappy. Both sides of a connection derive
+// the compression of its frames from it, so it is part of the protocol rather
+// than a setting, and version 1 compresses like the peers which predate it.
+const SnappyMinQKCVersion = 1
+
+// QKCProtocolVersions are the supported versions of the qkc protocol, the
+// highest one shared with a remote peer is run for it. Peers only running
+// version 1 keep the hello without extensions.
+var QKCProtocolVersions = []uint{1, QKCProtocolVersion}
+
+// QKCCapabilities are the optional features advertised to each peer after
+// the hello.
+var QKCCapabilities = []string{p2p.CapCrossShardTxList, p2p.CapTxAnnounce, p2p.CapRootTipUpdate, p2p.CapShardMasks}
+
+// builtinOps are the ops handled by the cases of handleMsg, or by the
+// handshake for the hellos, reported as builtin by p2p.OpTable.
+var builtinOps = []p2p.P2PCommandOp{
+	p2p.Hello, p2p.HelloAckMsg, p2p.DisconnectMsg, p2p.Ping, p2p.Pong, p2p.CapabilitiesMsg,
+	p2p.GetShardMasksRequestMsg, p2p.GetShardMasksResponseMsg, p2p.NewTipMsg, p2p.RootTipUpdateMsg,
+	p2p.NewTransactionListMsg, p2p.NewTransactionHashesMsg, p2p.GetTransactionsRequestMsg, p2p.GetTransactionsResponseMsg,
+	p2p.NewBlockMinorMsg, p2p.NewCrossShardTxListMsg, p2p.NewRootBlockMsg,
+	p2p.GetRootBlockHeaderListRequestMsg, p2p.GetRootBlockHeaderListResponseMsg,
+	p2p.GetRootBlockHeadersRequestMsg, p2p.GetRootBlockHeadersResponseMsg,
+	p2p.GetRootBlockRequestMsg, p2p.GetRootBlockResponseMsg,
+	p2p.GetRootBlockListRequestMsg, p2p.GetRootBlockListResponseMsg,
+	p2p.GetRootBlockHeaderListWithSkipRequestMsg, p2p.GetRootBlockHeaderListWithSkipResponseMsg,
+	p2p.GetMinorBlockHeaderListRequestMsg, p2p.GetMinorBlockHeaderListResponseMsg,
+	p2p.GetMinorBlockHeadersRequestMsg, p2p.GetMinorBlockHeadersResponseMsg,
+	p2p.GetMinorBlockRequestMsg, p2p.GetMinorBlockResponseMsg,
+	p2p.GetAccountDataRequestMsg, p2p.GetAccountDataResponseMsg,
+	p2p.GetMinorBlockListRequestMsg, p2p.GetMinorBlockListResponseMsg,
+	p2p.GetMinorBlockHeaderListWithSkipRequestMsg, p2p.GetMinorBlockHeaderListWithSkipResponseMsg,
+}
+
+func init() {
+	if err := p2p.RegisterBuiltinHandlers(builtinOps...); err != nil {
+		panic(err)
+	}
+}
+
 // ProtocolManager QKC manager
 type ProtocolManager struct {
 	networkID      uint32
@@ -50,51 +108,94 @@ type ProtocolManager struct {
 	// TODO can be removed ?
 	stats       *qkcsync.BlockSychronizerStats
 	maxPeers    int
-	peers       *peerSet // Set of active peers from which rootDownloader can proceed
+	peers       *PeerSet // Set of active peers from which rootDownloader can proceed
 	newPeerCh   chan *Peer
 	quitSync    chan struct{}
 	noMorePeers chan struct{}
+	txCache     *lru.Cache // Recent transactions, to answer GetTransactionsRequest
+	// accountQueries holds a token for each GetAccountDataRequest querying
+	// the slaves.
+	accountQueries chan struct{}
+	seen           *seenMsgs    // Recent announcements, nil if not deduplicated
+	helloNonces    *nonceWindow // Nonces of the recent hellos, to reject replays
+
+	nodeKey  *ecdsa.PublicKey // Key of the p2p server, nil until known
+	draining int32            // Set once shutdown drains the peers
+
+	droppedWarn  warnCooldown // Warns of the messages with a command but no handler
+	unknownWarn  warnCooldown // Warns of the ignored unknown messages
+	panickedWarn warnCooldown // Errors of the messages whose handler panicked
 
-	log string
-	wg  sync.WaitGroup
+	wg sync.WaitGroup
 }
 
 // NewQKCManager  new qkc manager
 func NewProtocolManager(env config.ClusterConfig, rootBlockChain *core.RootBlockChain, statsChan chan *rpc.ShardStatus, synchronizer qkcsync.Synchronizer, slaveConns rpc.ConnManager) (*ProtocolManager, error) {
+	txCache, _ := lru.New(txCacheSize)
 	manager := &ProtocolManager{
 		networkID:      env.Quarkchain.NetworkID,
 		rootBlockChain: rootBlockChain,
 		clusterConfig:  &env,
-		peers:          newPeerSet(),
+		peers:          NewPeerSet(),
 		newPeerCh:      make(chan *Peer),
 		quitSync:       make(chan struct{}),
 		noMorePeers:    make(chan struct{}),
+		txCache:        txCache,
+		accountQueries: make(chan struct{}, accountQueryLimit),
+		helloNonces:    newNonceWindow(helloNonceWindow),
+		seen:           newSeenMsgs(int(env.P2P.DedupCacheSize), time.Duration(env.P2P.DedupTTL)*time.Second),
 		statsChan:      statsChan,
 		synchronizer:   synchronizer,
 		slaveConns:     slaveConns,
 		stats:          &qkcsync.BlockSychronizerStats{},
 		started:        false,
 	}
-	protocol := p2p.Protocol{
-		Name:    QKCProtocolName,
-		Version: QKCProtocolVersion,
-		Length:  QKCProtocolLength,
-		Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
-			peer := newPeer(int(QKCProtocolVersion), p, rw)
-			select {
-			case manager.newPeerCh <- peer:
-				manager.wg.Add(1)
-				defer manager.wg.Done()
-				return manager.handle(peer)
-			case <-manager.quitSync:
-				return p2p.DiscQuitting
-			}
-		},
-	}
-	manager.subProtocols = []p2p.Protocol{protocol}
+	manager.subProtocols = manager.QKCProtocol()
 	return manager, nil
 }
 
+// peerID returns the peer id advertised in our hellos, which peers check
+// against the key we authenticate with. That is the key of the p2p server
+// once known, the configured one before.
+func (pm *ProtocolManager) peerID() common.Hash {
+	key := pm.nodeKey
+	if key == nil {
+		privateKey, _ := p2p.GetPrivateKeyFromConfig(pm.clusterConfig.P2P.PrivKey)
+		key = &privateKey.PublicKey
+	}
+	return common.BytesToHash(crypto.FromECDSAPub(key))
+}
+
+// QKCProtocol returns the qkc protocol in each of the supported versions. The
+// p2p server advertises all of them and runs the highest version the remote
+// peer supports as well.
+func (pm *ProtocolManager) QKCProtocol() []p2p.Protocol {
+	protocols := make([]p2p.Protocol, 0, len(QKCProtocolVersions))
+	for _, version := range QKCProtocolVersions {
+		version := version
+		protocols = append(protocols, p2p.Protocol{
+			Name:    QKCProtocolName,
+			Version: version,
+			Length:  QKCProtocolLength,
+			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+				if pm.isDraining() {
+					return p2p.DiscQuitting
+				}
+				peer := newPeer(int(version), p, rw)
+				select {
+				case pm.newPeerCh <- peer:
+					pm.wg.Add(1)
+					defer pm.wg.Done()
+					return pm.handle(peer)
+				case <-pm.quitSync:
+					return p2p.DiscQuitting
+				}
+			},
+		})
+	}
+	return protocols
+}
+
 func (pm *ProtocolManager) removePeer(id string) {
 	// Short circuit if the peer was already removed
 	peer := pm.peers.Peer(id)
@@ -131,6 +232,8 @@ func (pm *ProtocolManager) Stop() {
 
 	pm.chainHeadEventSub.Unsubscribe()
 
+	pm.drain(time.Duration(pm.clusterConfig.P2P.DrainTimeout) * time.Second)
+
 	// Quit the sync loop.
 	// After this send has completed, no new peers will be accepted.
 	pm.noMorePeers <- struct{}{}
@@ -149,18 +252,131 @@ func (pm *ProtocolManager) Stop() {
 	log.Info("cluster protocol stopped")
 }
 
-func (pm *ProtocolManager) handle(peer *Peer) error {
+// drain lets the peers finish before shutdown: new peers and new requests,
+// ours and theirs, are refused, the requests pending their response and the
+// handlers of the messages already received get up to timeout to complete,
+// then each peer is told we are quitting and disconnected. It reports whether
+// they completed in time.
+func (pm *ProtocolManager) drain(timeout time.Duration) bool {
+	atomic.StoreInt32(&pm.draining, 1)
+	peers := pm.peers.Peers()
+	for _, p := range peers {
+		p.drain()
+	}
+	handled := make(chan struct{})
+	go func() {
+		for _, p := range peers {
+			p.handlers.Wait()
+		}
+		close(handled)
+	}()
+
+	drained := true
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+wait:
+	for pending := pendingRPCs(peers); ; pending = pendingRPCs(peers) {
+		if pending == 0 {
+			select {
+			case <-handled:
+				break wait
+			default:
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.Warn("Drain timed out, dropping pending requests", "pending", pending)
+			drained = false
+			break wait
+		}
+	}
+	for _, p := range peers {
+		p.Disconnect(p2p.QKCDiscQuitting)
+	}
+	return drained
+}
+
+// isDraining reports whether shutdown started draining the peers.
+func (pm *ProtocolManager) isDraining() bool {
+	return atomic.LoadInt32(&pm.draining) == 1
+}
+
+// stopping reports whether shutdown started, by draining the peers or
+// quitting outright.
+func (pm *ProtocolManager) stopping() bool {
+	select {
+	case <-pm.quitSync:
+		return true
+	default:
+		return pm.isDraining()
+	}
+}
+
+// pendingRPCs returns the number of requests to peers pending their response.
+func pendingRPCs(peers []*Peer) int {
+	pending := 0
+	for _, p := range peers {
+		pending += p.pendingRPCs()
+	}
+	return pending
+}
+
+// qkcDiscReasonForError returns the reason announced to the remote peer when
+// err ends the message loop, ok is false if err is not worth announcing, e.g.
+// the connection is already broken or the remote peer disconnected first.
+func qkcDiscReasonForError(err error) (reason p2p.QKCDiscReason, ok bool) {
+	if _, ok := err.(*nodefilter.BlackErr); ok {
+		return p2p.QKCDiscProtocolMismatch, true
+	}
+	if _, ok := err.(*invalidHelloError); ok {
+		return p2p.QKCDiscInvalidHello, true
+	}
+	if _, ok := err.(*unsupportedVersionError); ok {
+		return p2p.QKCDiscVersionUnsupported, true
+	}
+	switch errors.Cause(err) {
+	case p2p.DiscTooManyPeers:
+		return p2p.QKCDiscTooManyPeers, true
+	case p2p.DiscQuitting:
+		return p2p.QKCDiscQuitting, true
+	case errUnknownOp:
+		return p2p.QKCDiscUnknownOp, true
+	case errRateLimited:
+		return p2p.QKCDiscRateLimited, true
+	}
+	return 0, false
+}
+
+func (pm *ProtocolManager) handle(peer *Peer) (err error) {
+	defer func() {
+		if errors.Cause(err) == errUnknownOp {
+			peer.Penalize(nodefilter.PenaltyUnknownOp)
+		}
+		if reason, ok := qkcDiscReasonForError(err); ok {
+			peer.Disconnect(reason)
+		}
+	}()
+
 	if pm.peers.Len() >= pm.maxPeers {
 		return p2p.DiscTooManyPeers
 	}
 
 	peer.Log().Info("peer connected", "name", peer.Name())
 
-	privateKey, _ := p2p.GetPrivateKeyFromConfig(pm.clusterConfig.P2P.PrivKey)
-	id := crypto.FromECDSAPub(&privateKey.PublicKey)
+	if timeout := pm.clusterConfig.P2P.HandshakeTimeout; timeout > 0 {
+		peer.SetHandshakeTimeout(time.Duration(timeout) * time.Second)
+	}
+	peer.SetMaxPendingRPCs(int(pm.clusterConfig.P2P.MaxPendingRPCs))
+	if timeout := pm.clusterConfig.P2P.RequestTimeout; timeout > 0 {
+		peer.SetRequestTimeout(time.Duration(timeout) * time.Second)
+	}
+	peer.helloNonces = pm.helloNonces
 	if err := peer.Handshake(pm.clusterConfig.Quarkchain.P2PProtocolVersion,
 		pm.networkID,
-		common.BytesToHash(id),
+		pm.peerID(),
 		uint16(pm.clusterConfig.P2PPort),
 		pm.rootBlockChain.CurrentBlock().Header(),
 		pm.rootBlockChain.Genesis().Hash(),
@@ -168,15 +384,41 @@ func (pm *ProtocolManager) handle(peer *Peer) error {
 		return err
 	}
 
+	// start the outbound queue before the peer is visible to broadcasters
+	writer := newMsgWriter(peer.rw, int(pm.clusterConfig.P2P.WriteQueueSize),
+		time.Duration(pm.clusterConfig.P2P.WriteTimeout)*time.Millisecond)
+	peer.setWriter(writer)
+	// the messages queued when the loop ends, such as a disconnect, are
+	// written before the connection is closed
+	defer writer.close(writerFlushTimeout)
+
+	// peers done with the handshake once shutdown started are not drained
+	if pm.isDraining() {
+		return p2p.DiscQuitting
+	}
 	// Register the peer locally
 	if err := pm.peers.Register(peer); err != nil {
 		peer.Log().Error("peer registration failed", "err", err)
 		return err
 	}
 	defer pm.removePeer(peer.id)
-	log.Info(pm.log, "peer add succ id ", peer.PeerID())
+	peer.Log().Info("peer registered", "peerID", peer.PeerID())
+
+	if err := peer.SendCapabilities(QKCCapabilities); err != nil {
+		return err
+	}
 
-	err := pm.synchronizer.AddTask(qkcsync.NewRootChainTask(peer, peer.RootHead(), pm.stats, pm.statsChan, pm.slaveConns))
+	peer.workers = newMsgWorkerPool(int(pm.clusterConfig.P2P.MsgWorkers), pm.clusterConfig.P2P.DropOnBusy)
+	defer peer.workers.stop()
+	peer.limiter = newMsgRateLimiter(float64(pm.clusterConfig.P2P.MsgRateLimit), float64(pm.clusterConfig.P2P.ByteRateLimit),
+		time.Duration(pm.clusterConfig.P2P.MaxThrottleTime)*time.Second)
+
+	if interval := pm.clusterConfig.P2P.PingInterval; interval > 0 {
+		go peer.keepalive(time.Duration(interval)*time.Second, time.Duration(pm.clusterConfig.P2P.PingTimeout)*time.Second)
+	}
+	go peer.advertiseTip(time.Duration(pm.clusterConfig.P2P.TipUpdateInterval)*time.Second, pm.rootTipUpdate)
+
+	err = pm.synchronizer.AddTask(qkcsync.NewRootChainTask(peer, peer.RootHead(), pm.stats, pm.statsChan, pm.slaveConns))
 	if err != nil {
 		return err
 	}
@@ -187,36 +429,161 @@ func (pm *ProtocolManager) handle(peer *Peer) error {
 	// we can add pm.syncTransactions(p) later
 
 	for {
-		if peer.handleMsgErr != nil {
-			return peer.handleMsgErr
+		if err := peer.workers.Err(); err != nil {
+			return err
+		}
+		if err := writer.Err(); err != nil {
+			return err
 		}
 		if err := pm.handleMsg(peer); err != nil {
-			peer.Log().Error("message handling failed", "err", err)
+			// the read fails once the connection is torn down on shutdown,
+			// report it as quitting rather than as a network failure
+			if pm.stopping() {
+				peer.Log().Debug("message handling stopped", "err", err)
+				return p2p.DiscQuitting
+			}
+			switch {
+			case err == p2p.ErrPeerClosed:
+				peer.Log().Debug("peer closed the connection")
+			case errors.Cause(err) == errUnknownOp:
+				// an unknown op is the remote's mistake rather than ours
+				peer.Log().Warn("message handling failed", "err", err)
+			default:
+				peer.Log().Error("message handling failed", "err", err)
+			}
 			return err
 		}
 
 	}
 }
 
-func (pm *ProtocolManager) handleMsg(peer *Peer) error {
+// throttle pauses reading from peer while it is over its rate limit, the
+// message of size bytes has been read already.
+func (pm *ProtocolManager) throttle(peer *Peer, size uint32) error {
+	if peer.limiter == nil {
+		return nil
+	}
+	wait, err := peer.limiter.reserve(size)
+	if err != nil || wait == 0 {
+		return err
+	}
+	peer.Log().Debug("peer over rate limit, pausing reads", "wait", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-pm.quitSync:
+		return p2p.DiscQuitting
+	}
+}
+
+func (pm *ProtocolManager) handleMsg(peer *Peer) (err error) {
 	msg, err := peer.rw.ReadMsg()
 	if err != nil {
 		return err
 	}
-	payload, err := ioutil.ReadAll(msg.Payload)
+	peer.markActive()
+	payload, err := p2p.ReadPayload(msg)
+	if err != nil {
+		return err
+	}
 	qkcMsg, err := p2p.DecodeQKCMsg(payload)
+	// the responses to our pending requests are paced by the requests, only
+	// the messages the peer sends unsolicited count against its rate limit
+	if err != nil || !peer.solicited(&qkcMsg) {
+		if err := pm.throttle(peer, msg.Size); err != nil {
+			return err
+		}
+	}
 	if err != nil {
+		// the frame passed its MAC so the stream is still in sync, the
+		// next message can be read
+		if pm.clusterConfig.P2P.SkipBadPayload {
+			peer.Log().Warn("Skipping undecodable msg", "size", msg.Size, "err", err)
+			peer.Penalize(nodefilter.PenaltyBadPayload)
+			return nil
+		}
 		return err
 	}
+	// the commands decoded below are decoded with the serializer of the peer,
+	// the data handed on as is, to the slaves or the registered handlers, is
+	// re-encoded with the default one they decode
+	if !decodedOps[qkcMsg.Op] {
+		if qkcMsg.Data, err = peer.decodeData(&qkcMsg); err != nil {
+			return err
+		}
+	}
 
-	log.Debug(pm.log, " receive QKC Msgop", qkcMsg.Op.String())
+	peer.Log().Trace("received qkc msg", "op", qkcMsg.Op, "rpcId", qkcMsg.RpcID, "branch", qkcMsg.MetaData.Branch)
+	peer.traceRead(qkcMsg.Op, qkcMsg.RpcID, msg.Size)
+	if pm.seen != nil && dedupOp(qkcMsg.Op) && pm.seen.seen(qkcMsg.Op, qkcMsg.MetaData.Branch, qkcMsg.Data) {
+		peer.Log().Trace("Dropping duplicate msg", "op", qkcMsg.Op)
+		markKnown(peer, qkcMsg.Op, qkcMsg.Data)
+		return nil
+	}
+	// a drained peer is only served the responses to our pending requests,
+	// its new messages and requests are not handled anymore
+	if peer.isDraining() && !responseOps[qkcMsg.Op] && qkcMsg.Op != p2p.DisconnectMsg && !peer.rpcPending(qkcMsg.RpcID) {
+		peer.Log().Trace("Dropping msg of draining peer", "op", qkcMsg.Op)
+		return nil
+	}
+	defer pm.recoverHandler(peer, qkcMsg.Op, &err)
 	switch {
 	case qkcMsg.Op == p2p.Hello:
 		return errors.New("Unexpected Hello msg")
 
+	case qkcMsg.Op == p2p.DisconnectMsg:
+		var disc p2p.DisconnectCommand
+		if err := peer.decode(&qkcMsg, &disc); err != nil {
+			return err
+		}
+		return disc.Reason
+
+	case qkcMsg.Op == p2p.Ping:
+		var ping p2p.PingPongCommand
+		if err := peer.decode(&qkcMsg, &ping); err != nil {
+			return err
+		}
+		return peer.SendPong(ping.Message)
+
+	case qkcMsg.Op == p2p.Pong:
+		var pong p2p.PingPongCommand
+		if err := peer.decode(&qkcMsg, &pong); err != nil {
+			return err
+		}
+		peer.deliverPong(pong.Message)
+
+	case qkcMsg.Op == p2p.CapabilitiesMsg:
+		var caps p2p.CapabilitiesCommand
+		if err := peer.decode(&qkcMsg, &caps); err != nil {
+			return err
+		}
+		if len(caps.Capabilities) > maxCapabilities {
+			return fmt.Errorf("too many capabilities: %d", len(caps.Capabilities))
+		}
+		peer.setCapabilities(caps.Capabilities)
+		if peer.HasCapability(p2p.CapShardMasks) {
+			go func() {
+				if _, err := peer.RequestShardMasks(); err != nil {
+					peer.Log().Debug("Failed to get shard masks", "err", err)
+				}
+			}()
+		}
+
+	case qkcMsg.Op == p2p.GetShardMasksRequestMsg:
+		return peer.SendResponse(p2p.GetShardMasksResponseMsg, p2p.Metadata{}, qkcMsg.RpcID, pm.HandleGetShardMasksRequest())
+
+	case qkcMsg.Op == p2p.GetShardMasksResponseMsg:
+		var masksResp p2p.GetShardMasksResponse
+		if err := peer.decode(&qkcMsg, &masksResp); err != nil {
+			return err
+		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &masksResp)
+
 	case qkcMsg.Op == p2p.NewTipMsg:
 		var tip p2p.Tip
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &tip); err != nil {
+		if err := peer.decode(&qkcMsg, &tip); err != nil {
 			return err
 		}
 		if tip.RootBlockHeader == nil {
@@ -229,25 +596,51 @@ func (pm *ProtocolManager) handleMsg(peer *Peer) error {
 		}
 		return pm.HandleNewMinorTip(qkcMsg.MetaData.Branch, &tip, peer)
 
+	case qkcMsg.Op == p2p.RootTipUpdateMsg:
+		var tip p2p.RootTipUpdate
+		if err := peer.decode(&qkcMsg, &tip); err != nil {
+			return err
+		}
+		return pm.HandleRootTipUpdate(&tip, peer)
+
 	case qkcMsg.Op == p2p.NewTransactionListMsg:
-		go func() {
-			err = pm.HandleNewTransactionListRequest(peer.id, qkcMsg.RpcID, qkcMsg.MetaData.Branch, qkcMsg.Data)
-			if err != nil {
-				peer.handleMsgErr = err
-			}
-		}()
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			return pm.HandleNewTransactionListRequest(peer.id, qkcMsg.RpcID, qkcMsg.MetaData.Branch, qkcMsg.Data)
+		})
+
+	case qkcMsg.Op == p2p.NewTransactionHashesMsg:
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			return pm.HandleNewTransactionHashes(peer, qkcMsg.MetaData.Branch, qkcMsg.Data)
+		})
+
+	case qkcMsg.Op == p2p.GetTransactionsRequestMsg:
+		var txsReq p2p.GetTransactionsRequest
+		if err := peer.decode(&qkcMsg, &txsReq); err != nil {
+			return err
+		}
+		resp := pm.HandleGetTransactionsRequest(qkcMsg.MetaData.Branch, &txsReq)
+		return peer.SendResponse(p2p.GetTransactionsResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+
+	case qkcMsg.Op == p2p.GetTransactionsResponseMsg:
+		var txsResp p2p.GetTransactionsResponse
+		if err := peer.decode(&qkcMsg, &txsResp); err != nil {
+			return err
+		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, txsResp.TransactionList)
 
 	case qkcMsg.Op == p2p.NewBlockMinorMsg:
-		go func() {
-			err = pm.HandleNewMinorBlock(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
-			if err != nil {
-				peer.handleMsgErr = err
-			}
-		}()
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			return pm.HandleNewMinorBlock(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
+		})
+
+	case qkcMsg.Op == p2p.NewCrossShardTxListMsg:
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			return pm.HandleNewCrossShardTxList(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
+		})
 
 	case qkcMsg.Op == p2p.GetRootBlockHeaderListRequestMsg:
 		var blockHeaderReq p2p.GetRootBlockHeaderListRequest
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &blockHeaderReq); err != nil {
+		if err := peer.decode(&qkcMsg, &blockHeaderReq); err != nil {
 			return err
 		}
 
@@ -260,18 +653,44 @@ func (pm *ProtocolManager) handleMsg(peer *Peer) error {
 
 	case qkcMsg.Op == p2p.GetRootBlockHeaderListResponseMsg:
 		var blockHeaderResp p2p.GetRootBlockHeaderListResponse
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &blockHeaderResp); err != nil {
+		if err := peer.decode(&qkcMsg, &blockHeaderResp); err != nil {
 			return err
 		}
-		if c := peer.getChan(qkcMsg.RpcID); c != nil {
-			c <- &blockHeaderResp
-		} else {
-			log.Warn(fmt.Sprintf("chan for rpc %d is missing", qkcMsg.RpcID))
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &blockHeaderResp)
+
+	case qkcMsg.Op == p2p.GetRootBlockHeadersRequestMsg:
+		var headersReq p2p.GetRootBlockHeadersRequest
+		if err := peer.decode(&qkcMsg, &headersReq); err != nil {
+			return err
+		}
+		resp := pm.HandleGetRootBlockHeadersRequest(&headersReq)
+		return peer.SendResponse(p2p.GetRootBlockHeadersResponseMsg, p2p.Metadata{Branch: 0}, qkcMsg.RpcID, resp)
+
+	case qkcMsg.Op == p2p.GetRootBlockHeadersResponseMsg:
+		var headersResp p2p.GetRootBlockHeadersResponse
+		if err := peer.decode(&qkcMsg, &headersResp); err != nil {
+			return err
+		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, headersResp.Headers)
+
+	case qkcMsg.Op == p2p.GetRootBlockRequestMsg:
+		var blockReq p2p.GetRootBlockRequest
+		if err := peer.decode(&qkcMsg, &blockReq); err != nil {
+			return err
 		}
+		resp := pm.HandleGetRootBlockRequest(&blockReq)
+		return peer.SendResponse(p2p.GetRootBlockResponseMsg, p2p.Metadata{Branch: 0}, qkcMsg.RpcID, resp)
+
+	case qkcMsg.Op == p2p.GetRootBlockResponseMsg:
+		var blockResp p2p.GetRootBlockResponse
+		if err := peer.decode(&qkcMsg, &blockResp); err != nil {
+			return err
+		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &blockResp)
 
 	case qkcMsg.Op == p2p.GetRootBlockListRequestMsg:
 		var rootBlockReq p2p.GetRootBlockListRequest
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &rootBlockReq); err != nil {
+		if err := peer.decode(&qkcMsg, &rootBlockReq); err != nil {
 			return err
 		}
 
@@ -284,18 +703,14 @@ func (pm *ProtocolManager) handleMsg(peer *Peer) error {
 
 	case qkcMsg.Op == p2p.GetRootBlockListResponseMsg:
 		var blockResp p2p.GetRootBlockListResponse
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &blockResp); err != nil {
+		if err := peer.decode(&qkcMsg, &blockResp); err != nil {
 			return err
 		}
-		if c := peer.getChan(qkcMsg.RpcID); c != nil {
-			c <- blockResp.RootBlockList
-		} else {
-			log.Warn(fmt.Sprintf("chan for rpc %d is missing", qkcMsg.RpcID))
-		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, blockResp.RootBlockList)
 
 	case qkcMsg.Op == p2p.GetRootBlockHeaderListWithSkipRequestMsg:
 		var rBHeadersSkip p2p.GetRootBlockHeaderListWithSkipRequest
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &rBHeadersSkip); err != nil {
+		if err := peer.decode(&qkcMsg, &rBHeadersSkip); err != nil {
 			return err
 		}
 		resp, err := pm.HandleGetRootBlockHeaderListWithSkipRequest(peer.id, qkcMsg.RpcID, &rBHeadersSkip)
@@ -306,82 +721,160 @@ func (pm *ProtocolManager) handleMsg(peer *Peer) error {
 
 	case qkcMsg.Op == p2p.GetRootBlockHeaderListWithSkipResponseMsg:
 		var minorBlockResp p2p.GetRootBlockHeaderListResponse
-		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &minorBlockResp); err != nil {
+		if err := peer.decode(&qkcMsg, &minorBlockResp); err != nil {
 			return err
 		}
-		if c := peer.getChan(qkcMsg.RpcID); c != nil {
-			c <- &minorBlockResp
-		} else {
-			log.Warn(fmt.Sprintf("chan for rpc %d is missing", qkcMsg.RpcID))
-		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &minorBlockResp)
 
 	case qkcMsg.Op == p2p.GetMinorBlockHeaderListRequestMsg:
-		go func() {
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
 			resp, err := pm.HandleGetMinorBlockHeaderListRequest(qkcMsg.MetaData.Branch, qkcMsg.Data)
 			if err != nil {
-				peer.handleMsgErr = err
+				return err
 			}
+			return peer.SendResponseWithData(p2p.GetMinorBlockHeaderListResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+		})
 
-			err = peer.SendResponseWithData(p2p.GetMinorBlockHeaderListResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+	case qkcMsg.Op == p2p.GetMinorBlockHeaderListResponseMsg:
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, qkcMsg.Data)
+
+	case qkcMsg.Op == p2p.GetMinorBlockHeadersRequestMsg:
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			var headersReq p2p.GetMinorBlockHeadersRequest
+			if err := peer.decode(&qkcMsg, &headersReq); err != nil {
+				return err
+			}
+			resp, err := pm.HandleGetMinorBlockHeadersRequest(qkcMsg.MetaData.Branch, &headersReq)
 			if err != nil {
-				peer.handleMsgErr = err
+				return err
 			}
-		}()
+			return peer.SendResponse(p2p.GetMinorBlockHeadersResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+		})
 
-	case qkcMsg.Op == p2p.GetMinorBlockHeaderListResponseMsg:
-		if c := peer.getChan(qkcMsg.RpcID); c != nil {
-			c <- qkcMsg.Data
-		} else {
-			log.Warn(fmt.Sprintf("chan for rpc %d is missing", qkcMsg.RpcID))
+	case qkcMsg.Op == p2p.GetMinorBlockHeadersResponseMsg:
+		var headersResp p2p.GetMinorBlockHeadersResponse
+		if err := peer.decode(&qkcMsg, &headersResp); err != nil {
+			return err
 		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &headersResp)
 
-	case qkcMsg.Op == p2p.GetMinorBlockListRequestMsg:
-		go func() {
-			resp, err := pm.HandleGetMinorBlockListRequest(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
+	case qkcMsg.Op == p2p.GetMinorBlockRequestMsg:
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			var blockReq p2p.GetMinorBlockRequest
+			if err := peer.decode(&qkcMsg, &blockReq); err != nil {
+				return err
+			}
+			resp := pm.HandleGetMinorBlockRequest(qkcMsg.MetaData.Branch, &blockReq)
+			return peer.SendResponse(p2p.GetMinorBlockResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+		})
+
+	case qkcMsg.Op == p2p.GetMinorBlockResponseMsg:
+		var blockResp p2p.GetMinorBlockResponse
+		if err := peer.decode(&qkcMsg, &blockResp); err != nil {
+			return err
+		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &blockResp)
+
+	case qkcMsg.Op == p2p.GetAccountDataRequestMsg:
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			var accountReq p2p.GetAccountDataRequest
+			if err := peer.decode(&qkcMsg, &accountReq); err != nil {
+				return err
+			}
+			resp, err := pm.HandleGetAccountDataRequest(qkcMsg.MetaData.Branch, &accountReq)
 			if err != nil {
-				peer.handleMsgErr = err
+				return err
 			}
-			err = peer.SendResponseWithData(p2p.GetMinorBlockListResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+			return peer.SendResponse(p2p.GetAccountDataResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+		})
+
+	case qkcMsg.Op == p2p.GetAccountDataResponseMsg:
+		var accountResp p2p.GetAccountDataResponse
+		if err := peer.decode(&qkcMsg, &accountResp); err != nil {
+			return err
+		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, &accountResp)
+
+	case qkcMsg.Op == p2p.GetMinorBlockListRequestMsg:
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
+			resp, err := pm.HandleGetMinorBlockListRequest(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
 			if err != nil {
-				peer.handleMsgErr = err
+				return err
 			}
-		}()
+			return peer.SendResponseWithData(p2p.GetMinorBlockListResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+		})
 
 	case qkcMsg.Op == p2p.GetMinorBlockListResponseMsg:
-		if c := peer.getChan(qkcMsg.RpcID); c != nil {
-			c <- qkcMsg.Data
-		} else {
-			log.Warn(fmt.Sprintf("chan for rpc %d is missing", qkcMsg.RpcID))
-		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, qkcMsg.Data)
 
 	case qkcMsg.Op == p2p.NewRootBlockMsg:
 		panic("not implemented")
 
 	case qkcMsg.Op == p2p.GetMinorBlockHeaderListWithSkipRequestMsg:
-		go func() {
+		return pm.dispatch(peer, qkcMsg.Op, func() error {
 			resp, err := pm.HandleGetMinorBlockHeaderListWithSkipRequest(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
 			if err != nil {
-				peer.handleMsgErr = err
-			}
-			err = peer.SendResponseWithData(p2p.GetMinorBlockHeaderListWithSkipResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
-			if err != nil {
-				peer.handleMsgErr = err
+				return err
 			}
-		}()
+			return peer.SendResponseWithData(p2p.GetMinorBlockHeaderListWithSkipResponseMsg, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+		})
 
 	case qkcMsg.Op == p2p.GetMinorBlockHeaderListWithSkipResponseMsg:
-		if c := peer.getChan(qkcMsg.RpcID); c != nil {
-			c <- qkcMsg.Data
-		} else {
-			log.Warn(fmt.Sprintf("chan for rpc %d is missing", qkcMsg.RpcID))
-		}
+		return peer.deliverResponse(qkcMsg.RpcID, qkcMsg.Op, qkcMsg.Data)
 
 	default:
-		return fmt.Errorf("unknown msg code %d", qkcMsg.Op)
+		if fn, ok := p2p.GetNonRPCHandler(qkcMsg.Op); ok {
+			return pm.dispatch(peer, qkcMsg.Op, func() error {
+				return fn(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
+			})
+		}
+		if handler, ok := p2p.GetRPCHandler(qkcMsg.Op); ok {
+			return pm.dispatch(peer, qkcMsg.Op, func() error {
+				resp, err := handler.Handle(peer.id, qkcMsg.MetaData.Branch, qkcMsg.Data)
+				if err != nil {
+					return err
+				}
+				return peer.SendResponseWithData(handler.ResponseOp, p2p.Metadata{Branch: qkcMsg.MetaData.Branch}, qkcMsg.RpcID, resp)
+			})
+		}
+		// the responses to the requests sent by SendRPC have no handler
+		if qkcMsg.RpcID != 0 && peer.deliverRPCMsg(&qkcMsg) {
+			return nil
+		}
+		if p2p.HasCommand(qkcMsg.Op) {
+			msgCounter(droppedMsgsPrefix, qkcMsg.Op).Inc(1)
+			if ok, suppressed := pm.droppedWarn.allow(); ok {
+				peer.Log().Warn("Dropping msg without handler", "op", qkcMsg.Op, "suppressed", suppressed)
+			}
+			return nil
+		}
+		if pm.clusterConfig.P2P.IgnoreUnknownMsg {
+			if ok, suppressed := pm.unknownWarn.allow(); ok {
+				peer.Log().Warn("Ignoring unknown msg", "op", qkcMsg.Op, "suppressed", suppressed)
+			}
+			return nil
+		}
+		return errors.Wrapf(errUnknownOp, "op %d", qkcMsg.Op)
 	}
 	return nil
 }
 
+// DroppedMsgs returns the number of messages dropped per op because the op is
+// known but has no handler. The counts are those of the process, as kept by the
+// registered metrics.
+func (pm *ProtocolManager) DroppedMsgs() map[p2p.P2PCommandOp]uint64 {
+	return msgCounts(droppedMsgsPrefix)
+}
+
+// DuplicateMsgs returns the number of announcements dropped per op because
+// they were already received from a peer.
+func (pm *ProtocolManager) DuplicateMsgs() map[p2p.P2PCommandOp]uint64 {
+	if pm.seen == nil {
+		return map[p2p.P2PCommandOp]uint64{}
+	}
+	return pm.seen.duplicates()
+}
+
 func (pm *ProtocolManager) HandleNewRootTip(tip *p2p.Tip, peer *Peer) error {
 	if len(tip.MinorBlockHeaderList) != 0 {
 		return errors.New("minor block header list must not be empty")
@@ -394,15 +887,35 @@ func (pm *ProtocolManager) HandleNewRootTip(tip *p2p.Tip, peer *Peer) error {
 		return fmt.Errorf("root block header changed with same height %d", tip.RootBlockHeader.NumberU64())
 	}
 	peer.SetRootHead(tip.RootBlockHeader)
+	peer.MarkBlock(tip.RootBlockHeader.Hash())
 	if tip.RootBlockHeader.NumberU64() > pm.rootBlockChain.CurrentBlock().NumberU64() {
 		err := pm.synchronizer.AddTask(qkcsync.NewRootChainTask(peer, tip.RootBlockHeader, pm.stats, pm.statsChan, pm.slaveConns))
 		if err != nil {
-			log.Error("Failed to add root chain task,", "hash", tip.RootBlockHeader.Hash(), "height", tip.RootBlockHeader.NumberU64())
+			peer.Log().Error("Failed to add root chain task", "hash", tip.RootBlockHeader.Hash(), "height", tip.RootBlockHeader.NumberU64(), "err", err)
 		}
 	}
 	return nil
 }
 
+// HandleRootTipUpdate records the root tip the peer advertises. Only its
+// summary is known, the header is fetched once sync picks the peer.
+func (pm *ProtocolManager) HandleRootTipUpdate(tip *p2p.RootTipUpdate, peer *Peer) error {
+	if tip.TotalDifficulty == nil {
+		return errors.New("root tip update without total difficulty")
+	}
+	if cur := peer.AdvertisedTip(); cur != nil && cur.TotalDifficulty != nil && tip.TotalDifficulty.Cmp(cur.TotalDifficulty) < 0 {
+		return fmt.Errorf("root tip total difficulty is decreasing %v < %v", tip.TotalDifficulty, cur.TotalDifficulty)
+	}
+	peer.setAdvertisedTip(tip)
+	peer.MarkBlock(tip.Hash)
+	return nil
+}
+
+// rootTipUpdate summarizes our root tip for the peers.
+func (pm *ProtocolManager) rootTipUpdate() *p2p.RootTipUpdate {
+	return newRootTipUpdate(pm.rootBlockChain.CurrentBlock().Header())
+}
+
 func (pm *ProtocolManager) HandleNewMinorBlock(peerId string, branch uint32, data []byte) error {
 	clients := pm.slaveConns.GetSlaveConnsById(branch)
 	if len(clients) == 0 {
@@ -426,6 +939,43 @@ func (pm *ProtocolManager) HandleNewMinorBlock(peerId string, branch uint32, dat
 	return g.Wait()
 }
 
+// HandleNewCrossShardTxList forwards the cross shard deposits received from a
+// peer to the local slaves owning the shard of branch.
+func (pm *ProtocolManager) HandleNewCrossShardTxList(peerId string, branch uint32, data []byte) error {
+	var list p2p.NewCrossShardTxList
+	if err := serialize.DeserializeFromBytes(data, &list); err != nil {
+		return err
+	}
+	if pm.clusterConfig.Quarkchain.GetShardConfigByFullShardID(branch) == nil {
+		return fmt.Errorf("unknown branch %d for cross shard txs from peer %s", branch, peerId)
+	}
+	var clients []rpc.ISlaveConn
+	for _, conn := range pm.slaveConns.GetSlaveConns() {
+		if conn.HasShard(branch) {
+			clients = append(clients, conn)
+		}
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("branch %d of cross shard txs from peer %s is not served locally", branch, peerId)
+	}
+
+	var (
+		g   errgroup.Group
+		req = rpc.AddXshardTxListRequest{
+			Branch:         branch,
+			MinorBlockHash: list.MinorBlockHash,
+			TxList:         list.TxList,
+		}
+	)
+	for _, client := range clients {
+		conn := client
+		g.Go(func() error {
+			return conn.AddXshardTxList(&req)
+		})
+	}
+	return g.Wait()
+}
+
 func (pm *ProtocolManager) HandleNewMinorTip(branch uint32, tip *p2p.Tip, peer *Peer) error {
 	// handle minor tip when branch != 0 and the minor block only contain 1 heard which is the tip block
 	if len(tip.MinorBlockHeaderList) != 1 {
@@ -578,7 +1128,62 @@ func (pm *ProtocolManager) HandleGetRootBlockHeaderListWithSkipRequest(peerId st
 	return &p2p.GetRootBlockHeaderListResponse{RootTip: rTip, BlockHeaderList: headerlist}, nil
 }
 
+// HandleGetRootBlockRequest returns the root block asked by request, the
+// response is marked NotFound if the block is unknown locally.
+func (pm *ProtocolManager) HandleGetRootBlockRequest(request *p2p.GetRootBlockRequest) *p2p.GetRootBlockResponse {
+	block := pm.rootBlockChain.GetBlock(request.Hash)
+	if qkcom.IsNil(block) {
+		return &p2p.GetRootBlockResponse{NotFound: true}
+	}
+	return &p2p.GetRootBlockResponse{Block: block.(*types.RootBlock)}
+}
+
+// HandleGetRootBlockHeadersRequest returns the canonical root block headers
+// asked by request, at most rootBlockHeadersLimit of them.
+func (pm *ProtocolManager) HandleGetRootBlockHeadersRequest(request *p2p.GetRootBlockHeadersRequest) *p2p.GetRootBlockHeadersResponse {
+	count := request.Count
+	if count > rootBlockHeadersLimit {
+		count = rootBlockHeadersLimit
+	}
+	resp := &p2p.GetRootBlockHeadersResponse{Headers: make([]*types.RootBlockHeader, 0, count)}
+
+	iHeader := pm.rootBlockChain.GetHeader(request.Start)
+	if qkcom.IsNil(iHeader) {
+		return resp
+	}
+	number := iHeader.NumberU64()
+	if canonical := pm.rootBlockChain.GetHeaderByNumber(number); qkcom.IsNil(canonical) || canonical.Hash() != request.Start {
+		return resp
+	}
+	for uint32(len(resp.Headers)) < count {
+		iHeader := pm.rootBlockChain.GetHeaderByNumber(number)
+		if qkcom.IsNil(iHeader) {
+			break
+		}
+		resp.Headers = append(resp.Headers, iHeader.(*types.RootBlockHeader))
+		if request.Reverse {
+			if number == 0 {
+				break
+			}
+			number--
+		} else {
+			number++
+		}
+	}
+	return resp
+}
+
 func (pm *ProtocolManager) HandleNewTransactionListRequest(peerId string, rpcId uint64, branch uint32, data []byte) error {
+	var list p2p.NewTransactionList
+	if err := serialize.DeserializeFromBytes(data, &list); err != nil {
+		return err
+	}
+	pm.cacheTransactions(branch, list.TransactionList)
+	if peer := pm.peers.Peer(peerId); peer != nil {
+		for _, tx := range list.TransactionList {
+			peer.MarkTransaction(tx.Hash())
+		}
+	}
 	req := &rpc.P2PRedirectRequest{
 		Branch: branch,
 		Data:   data,
@@ -620,6 +1225,127 @@ func (pm *ProtocolManager) HandleGetMinorBlockHeaderListRequest(branch uint32, d
 	return result, nil
 }
 
+// slaveConnForBranch returns the connection to the local slave whose chain
+// masks cover the shard of branch, nil if no slave runs it.
+func (pm *ProtocolManager) slaveConnForBranch(branch uint32) rpc.ISlaveConn {
+	if pm.clusterConfig.Quarkchain.GetShardConfigByFullShardID(branch) == nil {
+		return nil
+	}
+	for _, conn := range pm.slaveConns.GetSlaveConns() {
+		if conn.HasShard(branch) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// HandleGetMinorBlockRequest asks the slave running the shard of branch for
+// the block of request. The response is marked NotServed if no local slave
+// runs the shard, and NotFound if the slave does not have the block.
+func (pm *ProtocolManager) HandleGetMinorBlockRequest(branch uint32, request *p2p.GetMinorBlockRequest) *p2p.GetMinorBlockResponse {
+	conn := pm.slaveConnForBranch(branch)
+	if conn == nil {
+		return &p2p.GetMinorBlockResponse{NotServed: true}
+	}
+	block, _, err := conn.GetMinorBlockByHash(request.Hash, account.Branch{Value: branch}, false)
+	if err != nil || block == nil {
+		// the slave reports unknown blocks as errors
+		log.Debug("HandleGetMinorBlockRequest", "branch", branch, "hash", request.Hash, "err", err)
+		return &p2p.GetMinorBlockResponse{NotFound: true}
+	}
+	return &p2p.GetMinorBlockResponse{Block: block}
+}
+
+// HandleGetShardMasksRequest returns the chain masks of our slaves, which
+// cover the shards we serve.
+func (pm *ProtocolManager) HandleGetShardMasksRequest() *p2p.GetShardMasksResponse {
+	resp := new(p2p.GetShardMasksResponse)
+	for _, conn := range pm.slaveConns.GetSlaveConns() {
+		resp.ChainMaskList = append(resp.ChainMaskList, conn.GetShardMaskList()...)
+	}
+	return resp
+}
+
+// HandleGetAccountDataRequest asks the slave running the shard of branch for
+// the latest balance, nonce and code of the account of request. At most
+// accountQueryLimit requests query the slaves at once, the others wait for
+// their turn. The response is marked NotServed if no local slave runs the
+// shard.
+func (pm *ProtocolManager) HandleGetAccountDataRequest(branch uint32,
+	request *p2p.GetAccountDataRequest) (*p2p.GetAccountDataResponse, error) {
+	conn := pm.slaveConnForBranch(branch)
+	if conn == nil {
+		return &p2p.GetAccountDataResponse{NotServed: true}, nil
+	}
+	select {
+	case pm.accountQueries <- struct{}{}:
+		defer func() { <-pm.accountQueries }()
+	case <-pm.quitSync:
+		return nil, errors.New("protocol manager stopped")
+	}
+
+	// the full shard id as full shard key routes the address to branch
+	address := account.NewAddress(request.Recipient, branch)
+	data, err := conn.GetAccountData(&address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("branch %d GetAccountData failed with error: %v", branch, err)
+	}
+	resp := new(p2p.GetAccountDataResponse)
+	for _, branchData := range data.AccountBranchDataList {
+		if branchData.Branch == branch {
+			resp.Balance, resp.Nonce = branchData.Balance, branchData.TransactionCount
+		}
+	}
+	if resp.Balance == nil {
+		return &p2p.GetAccountDataResponse{NotServed: true}, nil
+	}
+	code, err := conn.GetCode(&address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("branch %d GetCode failed with error: %v", branch, err)
+	}
+	resp.CodeHash = crypto.Keccak256Hash(code)
+	return resp, nil
+}
+
+// HandleGetMinorBlockHeadersRequest asks the slave running the shard of
+// branch for the headers of request, at most minorBlockHeadersLimit of them.
+// The response is marked NotServed if no local slave runs the shard.
+func (pm *ProtocolManager) HandleGetMinorBlockHeadersRequest(branch uint32,
+	request *p2p.GetMinorBlockHeadersRequest) (*p2p.GetMinorBlockHeadersResponse, error) {
+	conn := pm.slaveConnForBranch(branch)
+	if conn == nil {
+		return &p2p.GetMinorBlockHeadersResponse{NotServed: true}, nil
+	}
+
+	count := request.Count
+	if count > minorBlockHeadersLimit {
+		count = minorBlockHeadersLimit
+	}
+	resp := &p2p.GetMinorBlockHeadersResponse{Headers: []*types.MinorBlockHeader{}}
+	if count == 0 {
+		return resp, nil
+	}
+	data, err := serialize.SerializeToBytes(&p2p.GetMinorBlockHeaderListRequest{
+		BlockHash: request.Start,
+		Branch:    account.Branch{Value: branch},
+		Limit:     count,
+		Direction: qkcom.DirectionToGenesis,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result, err := conn.GetMinorBlockHeaderList(&rpc.P2PRedirectRequest{Branch: branch, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("branch %d HandleGetMinorBlockHeadersRequest failed with error: %v", branch, err.Error())
+	}
+	var list p2p.GetMinorBlockHeaderListResponse
+	if err := serialize.DeserializeFromBytes(result, &list); err != nil {
+		return nil, err
+	}
+	resp.Headers = list.BlockHeaderList
+	return resp, nil
+}
+
 func (pm *ProtocolManager) HandleGetMinorBlockListRequest(peerId string, branch uint32, data []byte) ([]byte, error) {
 	conn := pm.slaveConns.GetOneSlaveConnById(branch)
 	if conn == nil {
@@ -634,13 +1360,8 @@ func (pm *ProtocolManager) HandleGetMinorBlockListRequest(peerId string, branch
 }
 
 func (pm *ProtocolManager) BroadcastTip(header *types.RootBlockHeader) {
-	for _, peer := range pm.peers.Peers() {
-		if peer.RootHead() != nil && header.Number <= peer.RootHead().Number {
-			continue
-		}
-		peer.AsyncSendNewTip(0, &p2p.Tip{RootBlockHeader: header, MinorBlockHeaderList: nil})
-	}
-	log.Trace("Announced block", "hash", header.Hash(), "recipients", pm.peers.Len())
+	recipients := pm.peers.BroadcastNewRootBlock(header)
+	log.Trace("Announced block", "hash", header.Hash(), "recipients", recipients)
 }
 
 func (pm *ProtocolManager) HandleGetMinorBlockHeaderListWithSkipRequest(peerId string, branch uint32,
@@ -658,6 +1379,9 @@ func (pm *ProtocolManager) tipBroadcastLoop() {
 		select {
 		case event := <-pm.chainHeadChan:
 			pm.BroadcastTip(event.Block.Header())
+			for _, peer := range pm.peers.Peers() {
+				peer.notifyTipChanged()
+			}
 
 		// Err() channel will be closed when unsubscribing.
 		case <-pm.chainHeadEventSub.Err():
@@ -666,9 +1390,22 @@ func (pm *ProtocolManager) tipBroadcastLoop() {
 	}
 }
 
+// BroadcastTransactions relays the transaction list of txs to the peers but
+// the source one. The peers supporting announcements are only sent the hashes
+// they do not know, and fetch the transactions they miss.
 func (pm *ProtocolManager) BroadcastTransactions(txs *rpc.P2PRedirectRequest, sourcePeerId string) {
+	var list p2p.NewTransactionList
+	announce := serialize.DeserializeFromBytes(txs.Data, &list) == nil
+	if announce {
+		pm.cacheTransactions(txs.Branch, list.TransactionList)
+	}
 	for _, peer := range pm.peers.Peers() {
-		if peer.id != sourcePeerId {
+		if peer.id == sourcePeerId {
+			continue
+		}
+		if announce && peer.HasCapability(p2p.CapTxAnnounce) {
+			pm.announceTransactions(peer, txs.Branch, list.TransactionList)
+		} else {
 			peer.AsyncSendTransactions(txs)
 		}
 	}
@@ -704,6 +1441,17 @@ func (pm *ProtocolManager) synchronise(peer *Peer) {
 	if peer == nil {
 		return
 	}
+	// the peer advertised a tip we only know the summary of
+	if tip := peer.AdvertisedTip(); tip != nil {
+		if head := peer.RootHead(); head == nil || head.Hash() != tip.Hash {
+			headers, err := peer.RequestRootBlockHeaders(tip.Hash, 1, false)
+			if err == nil && len(headers) == 1 && headers[0].Hash() == tip.Hash {
+				peer.SetRootHead(headers[0])
+			} else {
+				peer.Log().Debug("Failed to fetch advertised root tip", "hash", tip.Hash, "err", err)
+			}
+		}
+	}
 	if peer.RootHead() != nil {
 		err := pm.synchronizer.AddTask(qkcsync.NewRootChainTask(peer, peer.RootHead(), pm.stats, pm.statsChan, pm.slaveConns))
 		if err != nil {
@@ -2,11 +2,16 @@ package master
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/QuarkChain/goquarkchain/account"
+	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/QuarkChain/goquarkchain/cluster/rpc"
 	"github.com/QuarkChain/goquarkchain/cluster/sync"
 	"github.com/QuarkChain/goquarkchain/core"
@@ -15,8 +20,8 @@ import (
 	"github.com/QuarkChain/goquarkchain/p2p"
 	"github.com/QuarkChain/goquarkchain/serialize"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/golang/mock/gomock"
-	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,6 +44,367 @@ func TestProtocolCompatibility(t *testing.T) {
 	}
 }
 
+// Tests that a hello advertising a different network id is rejected.
+func TestHandshakeNetworkIDMismatch(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	header := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- peer.Handshake(qkcconfig.P2PProtocolVersion, qkcconfig.NetworkID, common.Hash{},
+			clusterconfig.P2PPort, header, header.Hash())
+	}()
+	if _, err := ExpectMsg(app, p2p.Hello, p2p.Metadata{}, nil); err != nil {
+		t.Fatalf("read hello failed: %v", err)
+	}
+	hello, err := p2p.MakeMsg(p2p.Hello, 0, p2p.Metadata{}, p2p.HelloCmd{
+		Version:              qkcconfig.P2PProtocolVersion,
+		NetWorkID:            qkcconfig.NetworkID + 1,
+		RootBlockHeader:      header,
+		GenesisRootBlockHash: header.Hash(),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, app.WriteMsg(hello))
+
+	err = waitChanTilErrorOrTimeout(errc, 3)
+	if err == nil || !strings.Contains(err.Error(), "networkid mismatch") {
+		t.Errorf("handshake should fail with networkid mismatch, got %v", err)
+	}
+}
+
+// Tests that a peer which never sends its hello is dropped.
+func TestHandshakeTimeout(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	peer.SetHandshakeTimeout(100 * time.Millisecond)
+	header := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- peer.Handshake(qkcconfig.P2PProtocolVersion, qkcconfig.NetworkID, common.Hash{},
+			clusterconfig.P2PPort, header, header.Hash())
+	}()
+	// the remote side reads our hello and stalls
+	if _, err := ExpectMsg(app, p2p.Hello, p2p.Metadata{}, nil); err != nil {
+		t.Fatalf("read hello failed: %v", err)
+	}
+	select {
+	case err := <-errc:
+		assert.Equal(t, p2p.DiscReadTimeout, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("handshake should time out")
+	}
+}
+
+// Tests that the hello sent to the remote side advertises the p2p port the
+// protocol manager listens on, as configured.
+func TestHandshakePeerPort(t *testing.T) {
+	defer func(port uint16) { clusterconfig.P2PPort = port }(clusterconfig.P2PPort)
+	for _, port := range []uint16{config.DefaultP2PPort + 1, config.DefaultP2PPort + 2} {
+		clusterconfig.P2PPort = port
+		pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+		peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, false)
+		assert.NoError(t, err)
+
+		msg, err := peer.app.ReadMsg()
+		assert.NoError(t, err)
+		payload, err := ioutil.ReadAll(msg.Payload)
+		assert.NoError(t, err)
+		qkcMsg, err := p2p.DecodeQKCMsg(payload)
+		assert.NoError(t, err)
+		assert.Equal(t, p2p.Hello, qkcMsg.Op)
+		cmd, err := p2p.DecodeQKCPayload(p2p.Hello, uint32(peer.version), qkcMsg.Data)
+		assert.NoError(t, err)
+		switch hello := cmd.(type) {
+		case *p2p.HelloCmd:
+			assert.Equal(t, port, hello.PeerPort)
+		case *p2p.HelloExtCmd:
+			assert.Equal(t, port, hello.PeerPort)
+		default:
+			t.Fatalf("port %d: unexpected hello %T", port, cmd)
+		}
+
+		peer.close()
+		pm.Stop()
+	}
+}
+
+// Tests that whether the peer dialed us is recorded in the handshake.
+func TestHandshakeDirection(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	for _, tt := range []struct {
+		newPeer func(string, int, *ProtocolManager, bool) (*testPeer, error)
+		inbound bool
+	}{{newTestPeer, false}, {newTestInboundPeer, true}} {
+		peer, err := tt.newPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.inbound, peer.Inbound())
+		assert.Equal(t, tt.inbound, peer.Info().Inbound)
+		peer.close()
+	}
+}
+
+// Tests that the hello received in the handshake is kept on the peer.
+func TestHandshakeHello(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(QKCProtocolVersion, net)
+	genesis := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+	tip := types.CopyRootBlockHeader(genesis)
+	tip.Number = 10
+	tip.Difficulty = new(big.Int).Mul(genesis.Difficulty, big.NewInt(2))
+
+	assert.Nil(t, peer.Hello())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- peer.Handshake(qkcconfig.P2PProtocolVersion, qkcconfig.NetworkID, common.Hash{},
+			clusterconfig.P2PPort, genesis, genesis.Hash())
+	}()
+	remote, err := expectHello(app, QKCProtocolVersion, p2p.HelloExtCmd{
+		HelloCmd: p2p.HelloCmd{
+			Version:              qkcconfig.P2PProtocolVersion,
+			NetWorkID:            qkcconfig.NetworkID,
+			PeerPort:             clusterconfig.P2PPort,
+			RootBlockHeader:      genesis,
+			GenesisRootBlockHash: genesis.Hash(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("read hello failed: %v", err)
+	}
+	nonce := common.Hash{1}
+	assert.NoError(t, sendHello(app, QKCProtocolVersion, p2p.HelloExtCmd{
+		HelloCmd: p2p.HelloCmd{
+			Version:              qkcconfig.P2PProtocolVersion,
+			NetWorkID:            qkcconfig.NetworkID,
+			PeerID:               nodePeerID(peer),
+			PeerPort:             clusterconfig.P2PPort + 1,
+			RootBlockHeader:      tip,
+			GenesisRootBlockHash: genesis.Hash(),
+		},
+		Nonce: nonce,
+	}))
+	assert.NoError(t, exchangeHelloAcks(app, remote, nonce))
+	assert.NoError(t, waitChanTilErrorOrTimeout(errc, 3))
+
+	got := peer.Hello()
+	if assert.NotNil(t, got) {
+		assert.Equal(t, clusterconfig.P2PPort+1, got.PeerPort)
+		assert.Equal(t, tip.Hash(), got.RootBlockHeader.Hash())
+		assert.Equal(t, uint64(10), got.RootBlockHeader.NumberU64())
+		assert.Equal(t, 0, tip.Difficulty.Cmp(got.RootBlockHeader.Difficulty))
+		assert.Equal(t, nonce, peer.helloExt.Nonce)
+	}
+}
+
+// Tests that a peer negotiated before p2p.HelloExtVersion is sent the hello
+// without extensions and handshakes without nonces nor acks.
+func TestHandshakeOldHello(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(1, net)
+	genesis := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- peer.Handshake(qkcconfig.P2PProtocolVersion, qkcconfig.NetworkID, common.Hash{},
+			clusterconfig.P2PPort, genesis, genesis.Hash())
+	}()
+	hello := p2p.HelloCmd{
+		Version:              qkcconfig.P2PProtocolVersion,
+		NetWorkID:            qkcconfig.NetworkID,
+		PeerPort:             clusterconfig.P2PPort,
+		RootBlockHeader:      genesis,
+		GenesisRootBlockHash: genesis.Hash(),
+	}
+	nonce, err := expectHello(app, 1, p2p.HelloExtCmd{HelloCmd: hello})
+	if err != nil {
+		t.Fatalf("read hello failed: %v", err)
+	}
+	assert.Equal(t, common.Hash{}, nonce)
+	msg, err := p2p.MakeMsg(p2p.Hello, 0, p2p.Metadata{}, hello)
+	assert.NoError(t, err)
+	assert.NoError(t, app.WriteMsg(msg))
+	assert.NoError(t, waitChanTilErrorOrTimeout(errc, 3))
+	assert.NotNil(t, peer.Hello())
+	assert.Nil(t, peer.helloExt)
+}
+
+// Tests that a hello whose nonce was seen in an earlier handshake is rejected,
+// and that a hello ack must echo the nonce of our hello.
+func TestHandshakeHelloNonce(t *testing.T) {
+	genesis := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+	nonces := newNonceWindow(16)
+	handshake := func(nonce common.Hash, echo func(ours common.Hash) common.Hash) error {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		peer := newTestClientPeer(QKCProtocolVersion, net)
+		peer.helloNonces = nonces
+		errc := make(chan error, 1)
+		go func() {
+			errc <- peer.Handshake(qkcconfig.P2PProtocolVersion, qkcconfig.NetworkID, common.Hash{},
+				clusterconfig.P2PPort, genesis, genesis.Hash())
+		}()
+		hello := p2p.HelloExtCmd{
+			HelloCmd: p2p.HelloCmd{
+				Version:              qkcconfig.P2PProtocolVersion,
+				NetWorkID:            qkcconfig.NetworkID,
+				PeerPort:             clusterconfig.P2PPort,
+				RootBlockHeader:      genesis,
+				GenesisRootBlockHash: genesis.Hash(),
+			},
+		}
+		ours, err := expectHello(app, QKCProtocolVersion, hello)
+		if err != nil {
+			return err
+		}
+		hello.PeerID, hello.Nonce = nodePeerID(peer), nonce
+		if err := sendHello(app, QKCProtocolVersion, hello); err != nil {
+			return err
+		}
+		// a rejected hello leaves the acks unread until the pipe is closed
+		go func() {
+			p2p.SendQKCMsg(app, p2p.HelloAckMsg, 0, p2p.Metadata{}, &p2p.HelloAckCommand{Nonce: echo(ours)})
+			ExpectMsg(app, p2p.HelloAckMsg, p2p.Metadata{}, nil)
+		}()
+		return waitChanTilErrorOrTimeout(errc, 3)
+	}
+	echo := func(ours common.Hash) common.Hash { return ours }
+
+	assert.NoError(t, handshake(common.Hash{1}, echo))
+	// the peer may just be out of step with us, so it is not blacklisted
+	err := handshake(common.Hash{1}, echo)
+	assert.True(t, errors.Is(err, errHelloReplayed), "got %v", err)
+	err = handshake(common.Hash{2}, func(common.Hash) common.Hash { return common.Hash{3} })
+	assert.True(t, errors.Is(err, errHelloAckMismatch), "got %v", err)
+	err = handshake(common.Hash{}, echo)
+	assert.True(t, errors.Is(err, errHelloNoNonce), "got %v", err)
+}
+
+// Tests that a peer with another hello version, newer or older, is
+// disconnected as unsupported without blacklisting.
+func TestHandshakeFutureVersion(t *testing.T) {
+	const ours = 3
+	genesis := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+	handshake := func(version uint32) error {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		peer := newTestClientPeer(QKCProtocolVersion, net)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- peer.Handshake(ours, qkcconfig.NetworkID, common.Hash{}, clusterconfig.P2PPort, genesis, genesis.Hash())
+		}()
+		hello := p2p.HelloExtCmd{
+			HelloCmd: p2p.HelloCmd{
+				Version:              ours,
+				NetWorkID:            qkcconfig.NetworkID,
+				PeerPort:             clusterconfig.P2PPort,
+				RootBlockHeader:      genesis,
+				GenesisRootBlockHash: genesis.Hash(),
+			},
+		}
+		remote, err := expectHello(app, QKCProtocolVersion, hello)
+		if err != nil {
+			return err
+		}
+		hello.Version, hello.Nonce = version, common.Hash{1}
+		hello.PeerID = nodePeerID(peer)
+		if err := sendHello(app, QKCProtocolVersion, hello); err != nil {
+			return err
+		}
+		go exchangeHelloAcks(app, remote, common.Hash{1})
+		return waitChanTilErrorOrTimeout(errc, 3)
+	}
+
+	assert.NoError(t, handshake(ours))
+	for _, version := range []uint32{ours + 1, ours - 1} {
+		err := handshake(version)
+		_, ok := err.(*unsupportedVersionError)
+		assert.True(t, ok, "version %d: got %v", version, err)
+		assert.True(t, isHelloMismatch(err))
+		reason, ok := qkcDiscReasonForError(err)
+		assert.True(t, ok)
+		assert.Equal(t, p2p.QKCDiscVersionUnsupported, reason)
+		assert.Equal(t, p2p.DiscIncompatibleVersion, reason.DiscReason())
+	}
+}
+
+// Tests that an extended hello must advertise the peer id of the key the peer
+// authenticated with, while older peers may advertise any.
+func TestHandshakePeerID(t *testing.T) {
+	genesis := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	handshake := func(version int, peerID common.Hash) error {
+		app, net := p2p.MsgPipe()
+		defer app.Close()
+		peer := newPeer(version, p2p.NewPeerWithKey(key, "client", nil), net)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- peer.Handshake(qkcconfig.P2PProtocolVersion, qkcconfig.NetworkID, common.Hash{},
+				clusterconfig.P2PPort, genesis, genesis.Hash())
+		}()
+		hello := p2p.HelloExtCmd{
+			HelloCmd: p2p.HelloCmd{
+				Version:              qkcconfig.P2PProtocolVersion,
+				NetWorkID:            qkcconfig.NetworkID,
+				PeerPort:             clusterconfig.P2PPort,
+				RootBlockHeader:      genesis,
+				GenesisRootBlockHash: genesis.Hash(),
+			},
+		}
+		remote, err := expectHello(app, version, hello)
+		if err != nil {
+			return err
+		}
+		hello.PeerID, hello.Nonce = peerID, common.Hash{1}
+		if err := sendHello(app, version, hello); err != nil {
+			return err
+		}
+		if version >= p2p.HelloExtVersion {
+			go exchangeHelloAcks(app, remote, common.Hash{1})
+		}
+		return waitChanTilErrorOrTimeout(errc, 3)
+	}
+
+	assert.NoError(t, handshake(QKCProtocolVersion, common.BytesToHash(crypto.FromECDSAPub(&key.PublicKey))))
+	// a mismatch is not blacklisted
+	err := handshake(QKCProtocolVersion, common.BytesToHash(crypto.FromECDSAPub(&other.PublicKey)))
+	assert.True(t, errors.Is(err, errPeerIDMismatch), "got %v", err)
+	assert.NoError(t, handshake(1, common.Hash{1}))
+}
+
+func TestCheckHelloHeader(t *testing.T) {
+	now := time.Now()
+	genesis := core.NewGenesis(qkcconfig).CreateRootBlock().Header()
+	tests := []struct {
+		modify func(h *types.RootBlockHeader)
+		valid  bool
+	}{
+		{modify: func(h *types.RootBlockHeader) {}, valid: true},
+		{modify: func(h *types.RootBlockHeader) { h.Time = uint64(now.Unix()) + 60 }, valid: true},
+		{modify: func(h *types.RootBlockHeader) { h.Version = 1 }},
+		{modify: func(h *types.RootBlockHeader) { h.Difficulty = new(big.Int) }},
+		{modify: func(h *types.RootBlockHeader) { h.Difficulty = big.NewInt(-1) }},
+		{modify: func(h *types.RootBlockHeader) { h.Time = uint64(now.Add(2 * maxHelloFutureTime).Unix()) }},
+	}
+	for i, test := range tests {
+		header := types.CopyRootBlockHeader(genesis)
+		test.modify(header)
+		err := checkHelloHeader(header, now)
+		if test.valid {
+			assert.NoError(t, err, "test %d", i)
+			continue
+		}
+		reason, ok := qkcDiscReasonForError(err)
+		assert.True(t, ok, "test %d", i)
+		assert.Equal(t, p2p.QKCDiscInvalidHello, reason, "test %d", i)
+	}
+}
+
 func TestGetRootBlockHeaders(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -118,6 +484,72 @@ func TestGetRootBlockHeaders(t *testing.T) {
 	}
 }
 
+func TestRequestRootBlockHeaders(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, int(rootBlockHeadersLimit)+15, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	clientPeer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), peer.app)
+
+	hashAt := func(number uint64) common.Hash {
+		return pm.rootBlockChain.GetHeaderByNumber(number).Hash()
+	}
+	tip := pm.rootBlockChain.CurrentBlock().NumberU64()
+	tests := []struct {
+		start   common.Hash
+		count   uint32
+		reverse bool
+		expect  []uint64 // numbers of the expected headers
+	}{
+		{hashAt(5), 3, false, []uint64{5, 6, 7}},
+		{hashAt(5), 3, true, []uint64{5, 4, 3}},
+		// ranges stop at genesis and at the tip
+		{hashAt(1), 3, true, []uint64{1, 0}},
+		{hashAt(tip - 1), 3, false, []uint64{tip - 1, tip}},
+		// unknown start
+		{common.Hash{1}, 3, false, nil},
+	}
+	for i, tt := range tests {
+		go handleMsg(clientPeer)
+		headers, err := clientPeer.RequestRootBlockHeaders(tt.start, tt.count, tt.reverse)
+		if err != nil {
+			t.Fatalf("test %d: request failed: %v", i, err)
+		}
+		if len(headers) != len(tt.expect) {
+			t.Fatalf("test %d: header count mismatch: got %d, want %d", i, len(headers), len(tt.expect))
+		}
+		for j, header := range headers {
+			if header.Hash() != hashAt(tt.expect[j]) {
+				t.Errorf("test %d: header %d mismatch: got %d, want %d", i, j, header.Number, tt.expect[j])
+			}
+		}
+	}
+
+	// the responder caps the count
+	resp := pm.HandleGetRootBlockHeadersRequest(&p2p.GetRootBlockHeadersRequest{Start: hashAt(0), Count: 2 * rootBlockHeadersLimit})
+	assert.Len(t, resp.Headers, rootBlockHeadersLimit)
+}
+
+func TestRequestRootBlock(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 5, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	clientPeer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), peer.app)
+
+	want := pm.rootBlockChain.GetBlockByNumber(3).(*types.RootBlock)
+	go handleMsg(clientPeer)
+	block, err := clientPeer.RequestRootBlock(want.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, want.Hash(), block.Hash())
+	assert.Equal(t, len(want.MinorBlockHeaders()), len(block.MinorBlockHeaders()))
+
+	// unknown blocks are reported as such rather than empty
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestRootBlock(common.Hash{1})
+	assert.True(t, errors.Is(err, errBlockNotFound))
+}
+
 func TestCloseConnWithErr(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -161,6 +593,710 @@ func TestCloseConnWithErr(t *testing.T) {
 	}
 }
 
+func TestHandleQuitOnShutdown(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	app, net := p2p.MsgPipe()
+	peer := &testPeer{app: app, net: net, Peer: newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pm.handle(peer.Peer)
+	}()
+	assert.NoError(t, peer.handshake(pm.rootBlockChain.CurrentBlock().Header(), pm.rootBlockChain.Genesis().Hash()))
+	for i := 0; pm.peers.Peer(peer.id) == nil; i++ {
+		if i == 100 {
+			t.Fatal("peer should be registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pm.Stop()
+	peer.close()
+	if err := waitChanTilErrorOrTimeout(errc, 3); err != p2p.DiscQuitting {
+		t.Errorf("handle should return %v on shutdown, got %v", p2p.DiscQuitting, err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	for _, respond := range []bool{true, false} {
+		pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+		peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+		assert.NoError(t, err)
+		var remote *Peer
+		for i := 0; remote == nil; i++ {
+			if i == 100 {
+				t.Fatal("peer should be registered")
+			}
+			time.Sleep(10 * time.Millisecond)
+			remote = pm.peers.Peer(peer.id)
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := remote.RequestShardMasks()
+			errc <- err
+		}()
+		req, err := ExpectMsg(peer.app, p2p.GetShardMasksRequestMsg, p2p.Metadata{}, p2p.GetShardMasksRequest{})
+		if err != nil {
+			t.Fatalf("shard masks request mismatch: %v", err)
+		}
+
+		drained := make(chan bool, 1)
+		start := time.Now()
+		go func() {
+			drained <- pm.drain(200 * time.Millisecond)
+		}()
+		for i := 0; !pm.isDraining(); i++ {
+			if i == 100 {
+				t.Fatal("drain should start")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		// new requests fail while the pending one may complete
+		if _, err := remote.RequestShardMasks(); err != errPeerDraining {
+			t.Errorf("respond %v: got %v, want %v", respond, err, errPeerDraining)
+		}
+		if respond {
+			msg, err := p2p.MakeMsg(p2p.GetShardMasksResponseMsg, req.RpcID, p2p.Metadata{}, p2p.GetShardMasksResponse{})
+			assert.NoError(t, err)
+			assert.NoError(t, peer.app.WriteMsg(msg))
+			assert.NoError(t, waitChanTilErrorOrTimeout(errc, 1))
+		}
+
+		disc := p2p.DisconnectCommand{Reason: p2p.QKCDiscQuitting}
+		if _, err := ExpectMsg(peer.app, p2p.DisconnectMsg, p2p.Metadata{}, disc); err != nil {
+			t.Errorf("respond %v: disconnect mismatch: %v", respond, err)
+		}
+		assert.Equal(t, respond, <-drained)
+		if elapsed := time.Since(start); respond == (elapsed >= 200*time.Millisecond) {
+			t.Errorf("respond %v: drained in %v", respond, elapsed)
+		}
+		peer.close()
+	}
+}
+
+func TestDrainWaitsForHandlers(t *testing.T) {
+	op := p2p.MaxOPNum + 7
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	assert.NoError(t, p2p.RegisterNonRPCHandler(op, p2p.OpParallel, func(peerID string, branch uint32, data []byte) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}))
+	defer p2p.UnregisterHandler(op)
+
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	msg, err := p2p.MakeMsg(op, 0, p2p.Metadata{}, p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("handler not started")
+	}
+
+	drained := make(chan bool, 1)
+	go func() {
+		drained <- pm.drain(time.Second)
+	}()
+	for i := 0; !pm.isDraining(); i++ {
+		if i == 100 {
+			t.Fatal("drain should start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the messages received while draining are not handled
+	msg, err = p2p.MakeMsg(op, 0, p2p.Metadata{}, p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	select {
+	case <-drained:
+		t.Fatal("drain should wait for the running handler")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	disc := p2p.DisconnectCommand{Reason: p2p.QKCDiscQuitting}
+	if _, err := ExpectMsg(peer.app, p2p.DisconnectMsg, p2p.Metadata{}, disc); err != nil {
+		t.Errorf("disconnect mismatch: %v", err)
+	}
+	assert.True(t, <-drained)
+	assert.Len(t, started, 0)
+}
+
+func TestDisconnectUnknownOp(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	msg, err := p2p.MakeMsgWithSerializedData(p2p.MaxOPNum, 0, p2p.Metadata{}, nil)
+	assert.NoError(t, err)
+	go peer.app.WriteMsg(msg)
+	disc := p2p.DisconnectCommand{Reason: p2p.QKCDiscUnknownOp}
+	if _, err := ExpectMsg(peer.app, p2p.DisconnectMsg, p2p.Metadata{}, disc); err != nil {
+		t.Errorf("disconnect mismatch: %v", err)
+	}
+}
+
+func TestSkipBadPayload(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	pm.clusterConfig.P2P.SkipBadPayload = true
+	defer func() { pm.clusterConfig.P2P.SkipBadPayload = false }()
+
+	// a payload too short for the qkc header, the peer stays connected
+	bad := []byte{1, 2, 3}
+	assert.NoError(t, peer.app.WriteMsg(p2p.Msg{Size: uint32(len(bad)), Payload: bytes.NewReader(bad)}))
+	ping, err := p2p.MakeMsg(p2p.Ping, 0, p2p.Metadata{}, p2p.PingPongCommand{Message: common.Hash{1}})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(ping))
+	if _, err := ExpectMsg(peer.app, p2p.Pong, p2p.Metadata{}, p2p.PingPongCommand{Message: common.Hash{1}}); err != nil {
+		t.Errorf("pong mismatch: %v", err)
+	}
+}
+
+// countsSince returns the counts per op which grew from before to after, the
+// message counters being those of the process.
+func countsSince(before, after map[p2p.P2PCommandOp]uint64) map[p2p.P2PCommandOp]uint64 {
+	counts := make(map[p2p.P2PCommandOp]uint64)
+	for op, n := range after {
+		if n > before[op] {
+			counts[op] = n - before[op]
+		}
+	}
+	return counts
+}
+
+func TestDropUnhandledOp(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	before := pm.DroppedMsgs()
+
+	// the op has a command but nothing handles it, the peer stays connected
+	for i := 0; i < 2; i++ {
+		msg, err := p2p.MakeMsg(p2p.GetPeerListRequestMsg, 0, p2p.Metadata{}, p2p.GetPeerListRequest{})
+		assert.NoError(t, err)
+		assert.NoError(t, peer.app.WriteMsg(msg))
+	}
+	// and so are the other builtin ops which handleMsg has no case for
+	builtin := make(map[p2p.P2PCommandOp]bool)
+	for _, op := range builtinOps {
+		builtin[op] = true
+	}
+	want := map[p2p.P2PCommandOp]uint64{p2p.GetPeerListRequestMsg: 2}
+	for op := p2p.Hello; op < p2p.MaxOPNum; op++ {
+		if builtin[op] || op == p2p.GetPeerListRequestMsg {
+			continue
+		}
+		msg, err := p2p.MakeMsg(op, 0, p2p.Metadata{}, p2p.OPSerializerMap[op])
+		assert.NoError(t, err)
+		assert.NoError(t, peer.app.WriteMsg(msg))
+		want[op] = 1
+	}
+	ping, err := p2p.MakeMsg(p2p.Ping, 0, p2p.Metadata{}, p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(ping))
+	if _, err := ExpectMsg(peer.app, p2p.Pong, p2p.Metadata{}, p2p.PingPongCommand{}); err != nil {
+		t.Fatalf("pong mismatch: %v", err)
+	}
+	assert.Equal(t, want, countsSince(before, pm.DroppedMsgs()))
+
+	// which OpTable tells apart from the ops handled
+	for _, info := range p2p.OpTable() {
+		if info.Op >= p2p.MaxOPNum {
+			continue
+		}
+		if builtin[info.Op] {
+			assert.Equal(t, p2p.OpHandlerBuiltin, info.Handler, "op %d", info.Op)
+		} else {
+			assert.Equal(t, p2p.OpHandlerNone, info.Handler, "op %d", info.Op)
+		}
+	}
+}
+
+func TestHandleRemoteDisconnect(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := &testPeer{app: app, net: net, Peer: newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pm.handle(peer.Peer)
+	}()
+	assert.NoError(t, peer.handshake(pm.rootBlockChain.CurrentBlock().Header(), pm.rootBlockChain.Genesis().Hash()))
+
+	msg, err := p2p.MakeMsg(p2p.DisconnectMsg, 0, p2p.Metadata{}, p2p.DisconnectCommand{Reason: p2p.QKCDiscQuitting})
+	assert.NoError(t, err)
+	assert.NoError(t, app.WriteMsg(msg))
+	if err := waitChanTilErrorOrTimeout(errc, 3); err != p2p.QKCDiscQuitting {
+		t.Errorf("handle should return %v, got %v", p2p.QKCDiscQuitting, err)
+	}
+}
+
+func TestPeerDisconnectTwice(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			peer.Disconnect(p2p.QKCDiscRateLimited)
+			done <- struct{}{}
+		}()
+	}
+	disc := p2p.DisconnectCommand{Reason: p2p.QKCDiscRateLimited}
+	if _, err := ExpectMsg(app, p2p.DisconnectMsg, p2p.Metadata{}, disc); err != nil {
+		t.Fatalf("disconnect mismatch: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	peer.Disconnect(p2p.QKCDiscQuitting)
+
+	// only the first call sends the reason
+	received := make(chan p2p.Msg, 1)
+	go func() {
+		if msg, err := app.ReadMsg(); err == nil {
+			received <- msg
+		}
+	}()
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message after disconnect: %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRegisteredHandlers(t *testing.T) {
+	reqOp, respOp, msgOp := p2p.MaxOPNum+1, p2p.MaxOPNum+2, p2p.MaxOPNum+3
+	echo := p2p.RPCHandler{
+		ResponseOp: respOp,
+		Handle: func(peerID string, branch uint32, data []byte) ([]byte, error) {
+			return data, nil
+		},
+	}
+	assert.NoError(t, p2p.RegisterRPCHandler(reqOp, echo))
+	defer p2p.UnregisterHandler(reqOp)
+	assert.Error(t, p2p.RegisterRPCHandler(reqOp, echo))
+	received := make(chan uint32, 1)
+	assert.NoError(t, p2p.RegisterNonRPCHandler(msgOp, p2p.OpParallel, func(peerID string, branch uint32, data []byte) error {
+		received <- branch
+		return nil
+	}))
+	defer p2p.UnregisterHandler(msgOp)
+
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	req := p2p.PingPongCommand{Message: common.Hash{1}}
+	msg, err := p2p.MakeMsg(reqOp, 7, p2p.Metadata{Branch: 3}, req)
+	assert.NoError(t, err)
+	go peer.app.WriteMsg(msg)
+	resp, err := ExpectMsg(peer.app, respOp, p2p.Metadata{Branch: 3}, req)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), resp.RpcID)
+
+	msg, err = p2p.MakeMsg(msgOp, 0, p2p.Metadata{Branch: 5}, req)
+	assert.NoError(t, err)
+	go peer.app.WriteMsg(msg)
+	select {
+	case branch := <-received:
+		assert.Equal(t, uint32(5), branch)
+	case <-time.After(time.Second):
+		t.Fatal("registered handler not called")
+	}
+}
+
+func TestSendRPC(t *testing.T) {
+	reqOp, respOp := p2p.MaxOPNum+8, p2p.MaxOPNum+9
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	var remote *Peer
+	for i := 0; remote == nil; i++ {
+		if i == 100 {
+			t.Fatal("peer should be registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+		remote = pm.peers.Peer(peer.id)
+	}
+
+	req := p2p.PingPongCommand{Message: common.Hash{1}}
+	data, err := serialize.SerializeToBytes(req)
+	assert.NoError(t, err)
+	rpcID := remote.NewRPCID()
+	resps, err := remote.SendRPC(reqOp, rpcID, data)
+	assert.NoError(t, err)
+	defer remote.CancelRPC(rpcID)
+	_, err = remote.SendRPC(reqOp, rpcID, data)
+	assert.Error(t, err)
+	if _, err := ExpectMsg(peer.app, reqOp, p2p.Metadata{}, req); err != nil {
+		t.Fatalf("request mismatch: %v", err)
+	}
+
+	// the response is routed by its rpc id
+	msg, err := p2p.MakeMsg(respOp, rpcID, p2p.Metadata{Branch: 2}, req)
+	assert.NoError(t, err)
+	go peer.app.WriteMsg(msg)
+	select {
+	case resp := <-resps:
+		assert.Equal(t, respOp, resp.Op)
+		assert.Equal(t, uint32(2), resp.MetaData.Branch)
+		assert.Equal(t, data, resp.Data)
+	case <-time.After(time.Second):
+		t.Fatal("response not delivered")
+	}
+	remote.CancelRPC(rpcID)
+	assert.Equal(t, 0, remote.pendingRPCs())
+}
+
+func TestDeliverResponse(t *testing.T) {
+	_, net := p2p.MsgPipe()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	rpcId, rpcchan, err := peer.getRpcIdWithChan()
+	assert.NoError(t, err)
+	defer peer.deleteChan(rpcId)
+
+	done := make(chan struct{})
+	go func() {
+		peer.deliverResponse(rpcId, p2p.GetRootBlockListResponseMsg, 1)
+		// duplicated and unknown responses must not block
+		peer.deliverResponse(rpcId, p2p.GetRootBlockListResponseMsg, 2)
+		peer.deliverResponse(rpcId+1, p2p.GetRootBlockListResponseMsg, 3)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliverResponse is blocked")
+	}
+	assert.Equal(t, 1, <-rpcchan)
+
+	// a request knowing its response op rejects the responses of other ops
+	rpcId, rpcchan, err = peer.getRpcIdWithResponseOp(p2p.GetRootBlockHeadersResponseMsg)
+	assert.NoError(t, err)
+	defer peer.deleteChan(rpcId)
+	err = peer.deliverResponse(rpcId, p2p.GetRootBlockResponseMsg, &p2p.GetRootBlockResponse{})
+	assert.True(t, errors.Is(err, errUnexpectedResponse))
+	assert.NoError(t, peer.deliverResponse(rpcId, p2p.GetRootBlockHeadersResponseMsg, []*types.RootBlockHeader{}))
+	assert.Equal(t, []*types.RootBlockHeader{}, <-rpcchan)
+}
+
+// answerBadResponse reads the request of op sent by a client peer on r,
+// answers it with resp, which is not the response of the request, bypassing
+// the op check of deliverResponse, and expects the client to disconnect.
+func answerBadResponse(r p2p.MsgReader, peer *Peer, op p2p.P2PCommandOp, resp interface{}) error {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return err
+	}
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	req, err := p2p.DecodeQKCMsg(payload)
+	if err != nil {
+		return err
+	}
+	if req.Op != op {
+		return fmt.Errorf("incorrect op code: got %d, want %d", req.Op, op)
+	}
+	peer.getChan(req.RpcID) <- resp
+	_, err = ExpectMsg(r, p2p.DisconnectMsg, p2p.Metadata{}, p2p.DisconnectCommand{Reason: p2p.QKCDiscProtocolMismatch})
+	return err
+}
+
+// Tests that a request answered with the response of another op fails and
+// drops the peer rather than crashing the node.
+func TestRequestBadResponse(t *testing.T) {
+	for _, tt := range []struct {
+		op      p2p.P2PCommandOp
+		request func(*Peer) error
+	}{
+		{p2p.GetRootBlockHeadersRequestMsg, func(p *Peer) error {
+			_, err := p.RequestRootBlockHeaders(common.Hash{}, 1, false)
+			return err
+		}},
+		{p2p.GetMinorBlockHeadersRequestMsg, func(p *Peer) error {
+			_, err := p.RequestMinorBlockHeaders(1, common.Hash{}, 1)
+			return err
+		}},
+		{p2p.GetRootBlockRequestMsg, func(p *Peer) error {
+			_, err := p.RequestRootBlock(common.Hash{})
+			return err
+		}},
+		{p2p.GetMinorBlockRequestMsg, func(p *Peer) error {
+			_, err := p.RequestMinorBlock(1, common.Hash{})
+			return err
+		}},
+		{p2p.GetAccountDataRequestMsg, func(p *Peer) error {
+			_, err := p.RequestAccountData(1, account.Recipient{})
+			return err
+		}},
+		{p2p.GetShardMasksRequestMsg, func(p *Peer) error {
+			_, err := p.RequestShardMasks()
+			return err
+		}},
+		{p2p.GetTransactionsRequestMsg, func(p *Peer) error {
+			_, err := p.RequestTransactions(1, []common.Hash{{1}})
+			return err
+		}},
+	} {
+		app, net := p2p.MsgPipe()
+		peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- answerBadResponse(app, peer, tt.op, &p2p.PingPongCommand{})
+		}()
+		if err := tt.request(peer); !errors.Is(err, errUnexpectedResponse) {
+			t.Errorf("op %d: request error mismatch: got %v, want %v", tt.op, err, errUnexpectedResponse)
+		}
+		assert.NoError(t, waitChanTilErrorOrTimeout(errc, 3))
+		app.Close()
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	peer.SetRequestTimeout(100 * time.Millisecond)
+
+	// read the request but never respond to it
+	go ExpectMsg(app, p2p.GetRootBlockListRequestMsg, p2p.Metadata{}, nil)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := peer.GetRootBlockList([]common.Hash{{}})
+		errc <- err
+	}()
+	if err := waitChanTilErrorOrTimeout(errc, 3); !errors.Is(err, errTimeout) {
+		t.Errorf("request should time out, got %v", err)
+	}
+	if c := peer.getChan(peer.rpcId); c != nil {
+		t.Errorf("pending chan for rpc %d should be released", peer.rpcId)
+	}
+
+	// the timeout of the peer can be overridden per call
+	peer.SetRequestTimeout(time.Hour)
+	go ExpectMsg(app, p2p.GetRootBlockListRequestMsg, p2p.Metadata{}, nil)
+	go func() {
+		_, err := peer.Request(p2p.GetRootBlockListRequestMsg, p2p.Metadata{}, p2p.GetRootBlockListRequest{}, 100*time.Millisecond)
+		errc <- err
+	}()
+	if err := waitChanTilErrorOrTimeout(errc, 3); !errors.Is(err, errTimeout) {
+		t.Errorf("request should time out, got %v", err)
+	}
+	if c := peer.getChan(peer.rpcId); c != nil {
+		t.Errorf("pending chan for rpc %d should be released", peer.rpcId)
+	}
+}
+
+func TestMaxPendingRPCs(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	peer.SetRequestTimeout(500 * time.Millisecond)
+	peer.SetMaxPendingRPCs(2)
+
+	// read the requests, answered by the test
+	requests := make(chan uint64, 4)
+	go func() {
+		for {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				return
+			}
+			payload, err := p2p.ReadPayload(msg)
+			if err != nil {
+				return
+			}
+			qkcMsg, err := p2p.DecodeQKCMsg(payload)
+			if err != nil {
+				return
+			}
+			requests <- qkcMsg.RpcID
+		}
+	}()
+	request := func() (uint64, chan error) {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := peer.GetRootBlockList([]common.Hash{{}})
+			errc <- err
+		}()
+		select {
+		case rpcId := <-requests:
+			return rpcId, errc
+		case <-time.After(time.Second):
+			t.Fatal("request not sent")
+			return 0, nil
+		}
+	}
+
+	answered, errc1 := request()
+	_, errc2 := request()
+	if _, err := peer.GetRootBlockList([]common.Hash{{}}); !errors.Is(err, errTooManyPendingRPCs) {
+		t.Fatalf("request over the limit should fail, got %v", err)
+	}
+
+	// a response frees its entry
+	assert.NoError(t, peer.deliverResponse(answered, p2p.GetRootBlockListResponseMsg, []*types.RootBlock{}))
+	assert.NoError(t, waitChanTilErrorOrTimeout(errc1, 3))
+	request()
+
+	// and so does a timeout
+	if err := waitChanTilErrorOrTimeout(errc2, 3); !errors.Is(err, errTimeout) {
+		t.Fatalf("request should time out, got %v", err)
+	}
+	request()
+}
+
+func TestPingPong(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	ping := p2p.PingPongCommand{Message: common.Hash{1}}
+	msg, err := p2p.MakeMsg(p2p.Ping, 0, p2p.Metadata{}, ping)
+	assert.NoError(t, err)
+	go peer.app.WriteMsg(msg)
+	if _, err := ExpectMsg(peer.app, p2p.Pong, p2p.Metadata{}, ping); err != nil {
+		t.Errorf("pong mismatch: %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	caps := p2p.CapabilitiesCommand{Capabilities: []string{"sync-v2", "fast-sync"}}
+	msg, err := p2p.MakeMsg(p2p.CapabilitiesMsg, 0, p2p.Metadata{}, caps)
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	var remote *Peer
+	for i := 0; remote == nil || !remote.HasCapability("fast-sync"); i++ {
+		if i == 100 {
+			t.Fatal("capabilities should be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+		remote = pm.peers.Peer(peer.id)
+	}
+	assert.False(t, remote.HasCapability("bloom-filter"))
+	assert.Equal(t, []string{"fast-sync", "sync-v2"}, remote.Capabilities())
+}
+
+func TestShardMasks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(2, ctrl)
+	for i, conn := range fakeConnMngr.GetSlaveConns() {
+		conn.(*mock_master.MockISlaveConn).EXPECT().GetShardMaskList().Return(
+			[]*types.ChainMask{types.NewChainMask(uint32(i + 2))}).AnyTimes()
+	}
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	// we report the masks of all our slaves
+	msg, err := p2p.MakeMsg(p2p.GetShardMasksRequestMsg, 5, p2p.Metadata{}, p2p.GetShardMasksRequest{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	ours := p2p.GetShardMasksResponse{ChainMaskList: []*types.ChainMask{types.NewChainMask(2), types.NewChainMask(3)}}
+	if _, err := ExpectMsg(peer.app, p2p.GetShardMasksResponseMsg, p2p.Metadata{}, ours); err != nil {
+		t.Fatalf("shard masks mismatch: %v", err)
+	}
+
+	// the masks of a peer advertising them are asked for once it does
+	var remote *Peer
+	for i := 0; remote == nil; i++ {
+		if i == 100 {
+			t.Fatal("peer not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+		remote = pm.peers.Peer(peer.id)
+	}
+	assert.Nil(t, remote.ShardMasks())
+	assert.True(t, remote.ServesShard(1<<16))
+	msg, err = p2p.MakeMsg(p2p.CapabilitiesMsg, 0, p2p.Metadata{}, p2p.CapabilitiesCommand{Capabilities: []string{p2p.CapShardMasks}})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	req, err := ExpectMsg(peer.app, p2p.GetShardMasksRequestMsg, p2p.Metadata{}, p2p.GetShardMasksRequest{})
+	if err != nil {
+		t.Fatalf("shard masks request mismatch: %v", err)
+	}
+	// even chains only
+	msg, err = p2p.MakeMsg(p2p.GetShardMasksResponseMsg, req.RpcID, p2p.Metadata{},
+		p2p.GetShardMasksResponse{ChainMaskList: []*types.ChainMask{types.NewChainMask(2)}})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	for i := 0; remote.ShardMasks() == nil; i++ {
+		if i == 100 {
+			t.Fatal("shard masks should be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, remote.ServesShard(0))
+	assert.True(t, remote.ServesShard(2<<16|1))
+	assert.False(t, remote.ServesShard(1<<16))
+
+	// requests for the other shards fail without being sent
+	if _, err := remote.RequestAccountData(1<<16, account.Recipient{}); !errors.Is(err, errShardNotServed) {
+		t.Errorf("got %v, want %v", err, errShardNotServed)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+
+	done := make(chan struct{})
+	go func() {
+		peer.keepalive(50*time.Millisecond, 100*time.Millisecond)
+		close(done)
+	}()
+	// an answered ping keeps the peer alive
+	msg, err := app.ReadMsg()
+	assert.NoError(t, err)
+	payload, err := ioutil.ReadAll(msg.Payload)
+	assert.NoError(t, err)
+	qkcMsg, err := p2p.DecodeQKCMsg(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, p2p.Ping, qkcMsg.Op)
+	var ping p2p.PingPongCommand
+	assert.NoError(t, serialize.DeserializeFromBytes(qkcMsg.Data, &ping))
+	peer.deliverPong(ping.Message)
+	_, ok := peer.Latency()
+	assert.True(t, ok)
+	// an unanswered one disconnects it
+	if _, err := ExpectMsg(app, p2p.Ping, p2p.Metadata{}, nil); err != nil {
+		t.Fatalf("ping mismatch: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("keepalive should stop after pong timeout")
+	}
+}
+
 func TestGetRootBlocks(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -481,6 +1617,180 @@ func TestBroadcastTransactions(t *testing.T) {
 	}
 }
 
+func TestHandleNewCrossShardTxList(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(1, ctrl)
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	list := p2p.NewCrossShardTxList{
+		MinorBlockHash: common.HexToHash("0x01"),
+		TxList:         []*types.CrossShardTransactionDeposit{},
+	}
+	data, err := serialize.SerializeToBytes(list)
+	assert.NoError(t, err)
+
+	conn := fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn)
+	conn.EXPECT().HasShard(branch).Return(true).Times(1)
+	conn.EXPECT().AddXshardTxList(gomock.Any()).DoAndReturn(func(req *rpc.AddXshardTxListRequest) error {
+		assert.Equal(t, branch, req.Branch)
+		assert.Equal(t, list.MinorBlockHash, req.MinorBlockHash)
+		return nil
+	}).Times(1)
+	assert.NoError(t, pm.HandleNewCrossShardTxList("peer", branch, data))
+
+	// the shard is not served by any local slave
+	conn.EXPECT().HasShard(branch).Return(false).Times(1)
+	assert.Error(t, pm.HandleNewCrossShardTxList("peer", branch, data))
+	// the shard does not exist
+	assert.Error(t, pm.HandleNewCrossShardTxList("peer", 12345, data))
+}
+
+func TestRequestMinorBlockHeaders(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(1, ctrl)
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	minorBlocks := generateMinorBlocks(minorBlockHeadersLimit + 5)
+	headers := make([]*types.MinorBlockHeader, len(minorBlocks))
+	for i, block := range minorBlocks {
+		headers[len(headers)-1-i] = block.Header()
+	}
+
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	clientPeer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), peer.app)
+
+	// the count is capped before the slave is asked
+	conn := fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn)
+	conn.EXPECT().HasShard(branch).Return(true).Times(1)
+	conn.EXPECT().GetMinorBlockHeaderList(gomock.Any()).DoAndReturn(func(req *rpc.P2PRedirectRequest) ([]byte, error) {
+		var listReq p2p.GetMinorBlockHeaderListRequest
+		assert.NoError(t, serialize.DeserializeFromBytes(req.Data, &listReq))
+		assert.Equal(t, branch, req.Branch)
+		assert.Equal(t, headers[0].Hash(), listReq.BlockHash)
+		assert.Equal(t, uint32(minorBlockHeadersLimit), listReq.Limit)
+		return serialize.SerializeToBytes(&p2p.GetMinorBlockHeaderListResponse{
+			RootTip:         pm.rootBlockChain.CurrentHeader().(*types.RootBlockHeader),
+			ShardTip:        headers[0],
+			BlockHeaderList: headers[:listReq.Limit],
+		})
+	}).Times(1)
+	go handleMsg(clientPeer)
+	res, err := clientPeer.RequestMinorBlockHeaders(branch, headers[0].Hash(), 2*minorBlockHeadersLimit)
+	assert.NoError(t, err)
+	assert.Len(t, res, minorBlockHeadersLimit)
+	assert.Equal(t, headers[minorBlockHeadersLimit-1].Hash(), res[minorBlockHeadersLimit-1].Hash())
+
+	// shards not run locally are reported as such rather than empty
+	conn.EXPECT().HasShard(branch).Return(false).Times(1)
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestMinorBlockHeaders(branch, headers[0].Hash(), 1)
+	assert.True(t, errors.Is(err, errShardNotServed))
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestMinorBlockHeaders(12345, headers[0].Hash(), 1)
+	assert.True(t, errors.Is(err, errShardNotServed))
+}
+
+func TestRequestMinorBlock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(2, ctrl)
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	block := generateMinorBlocks(1)[0]
+
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	clientPeer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), peer.app)
+
+	// the request goes to the slave running the shard
+	other := fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn)
+	owner := fakeConnMngr.GetSlaveConns()[1].(*mock_master.MockISlaveConn)
+	other.EXPECT().HasShard(branch).Return(false).Times(2)
+	owner.EXPECT().HasShard(branch).Return(true).Times(2)
+	owner.EXPECT().GetMinorBlockByHash(block.Hash(), account.Branch{Value: branch}, false).Return(block, nil, nil).Times(1)
+	go handleMsg(clientPeer)
+	res, err := clientPeer.RequestMinorBlock(branch, block.Hash())
+	assert.NoError(t, err)
+	assert.Equal(t, block.Hash(), res.Hash())
+
+	owner.EXPECT().GetMinorBlockByHash(common.Hash{1}, account.Branch{Value: branch}, false).Return(nil, nil, errors.New("minor block not found")).Times(1)
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestMinorBlock(branch, common.Hash{1})
+	assert.True(t, errors.Is(err, errBlockNotFound))
+
+	// shards not run locally are reported as such rather than not found
+	other.EXPECT().HasShard(branch).Return(false).Times(1)
+	owner.EXPECT().HasShard(branch).Return(false).Times(1)
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestMinorBlock(branch, block.Hash())
+	assert.True(t, errors.Is(err, errShardNotServed))
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestMinorBlock(12345, block.Hash())
+	assert.True(t, errors.Is(err, errShardNotServed))
+}
+
+func TestRequestAccountData(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(1, ctrl)
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	recipient := account.Recipient{1}
+	code := []byte{0x60, 0x80}
+
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	clientPeer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), peer.app)
+
+	// the account is read from the shard of the branch, among the ones the
+	// slave runs
+	conn := fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn)
+	conn.EXPECT().HasShard(branch).Return(true).Times(2)
+	conn.EXPECT().GetAccountData(gomock.Any(), gomock.Any()).DoAndReturn(func(address *account.Address, height *uint64) (*rpc.GetAccountDataResponse, error) {
+		assert.Equal(t, recipient, address.Recipient)
+		assert.Equal(t, branch, address.FullShardKey)
+		assert.Nil(t, height)
+		return &rpc.GetAccountDataResponse{AccountBranchDataList: []*rpc.AccountBranchData{
+			{Branch: branch + 1, TransactionCount: 7, Balance: types.NewEmptyTokenBalances()},
+			{Branch: branch, TransactionCount: 3, Balance: types.NewTokenBalancesWithMap(map[uint64]*big.Int{1: big.NewInt(100)})},
+		}}, nil
+	}).Times(1)
+	conn.EXPECT().GetCode(gomock.Any(), gomock.Any()).Return(code, nil).Times(1)
+	go handleMsg(clientPeer)
+	res, err := clientPeer.RequestAccountData(branch, recipient)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), res.Nonce)
+	assert.Equal(t, big.NewInt(100), res.Balance.GetTokenBalance(1))
+	assert.Equal(t, crypto.Keccak256Hash(code), res.CodeHash)
+
+	// an account which does not exist reads as empty
+	conn.EXPECT().GetAccountData(gomock.Any(), gomock.Any()).Return(&rpc.GetAccountDataResponse{AccountBranchDataList: []*rpc.AccountBranchData{
+		{Branch: branch, Balance: types.NewEmptyTokenBalances()},
+	}}, nil).Times(1)
+	conn.EXPECT().GetCode(gomock.Any(), gomock.Any()).Return(nil, nil).Times(1)
+	go handleMsg(clientPeer)
+	res, err = clientPeer.RequestAccountData(branch, account.Recipient{2})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), res.Nonce)
+	assert.True(t, res.Balance.IsEmpty())
+	assert.Equal(t, crypto.Keccak256Hash(nil), res.CodeHash)
+
+	// shards not run locally are reported as such rather than empty
+	conn.EXPECT().HasShard(branch).Return(false).Times(1)
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestAccountData(branch, recipient)
+	assert.True(t, errors.Is(err, errShardNotServed))
+	go handleMsg(clientPeer)
+	_, err = clientPeer.RequestAccountData(12345, recipient)
+	assert.True(t, errors.Is(err, errShardNotServed))
+}
+
 func TestBroadcastNewMinorBlockTip(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	errc := make(chan error, 1)
@@ -662,6 +1972,51 @@ func handleMsg(peer *Peer) error {
 			c <- &blockHeaderResp
 		}
 
+	case qkcMsg.Op == p2p.GetMinorBlockHeadersResponseMsg:
+		var headersResp p2p.GetMinorBlockHeadersResponse
+		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &headersResp); err != nil {
+			return err
+		}
+		if c := peer.getChan(qkcMsg.RpcID); c != nil {
+			c <- &headersResp
+		}
+
+	case qkcMsg.Op == p2p.GetMinorBlockResponseMsg:
+		var blockResp p2p.GetMinorBlockResponse
+		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &blockResp); err != nil {
+			return err
+		}
+		if c := peer.getChan(qkcMsg.RpcID); c != nil {
+			c <- &blockResp
+		}
+
+	case qkcMsg.Op == p2p.GetTransactionsResponseMsg:
+		var txsResp p2p.GetTransactionsResponse
+		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &txsResp); err != nil {
+			return err
+		}
+		if c := peer.getChan(qkcMsg.RpcID); c != nil {
+			c <- txsResp.TransactionList
+		}
+
+	case qkcMsg.Op == p2p.GetRootBlockResponseMsg:
+		var blockResp p2p.GetRootBlockResponse
+		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &blockResp); err != nil {
+			return err
+		}
+		if c := peer.getChan(qkcMsg.RpcID); c != nil {
+			c <- &blockResp
+		}
+
+	case qkcMsg.Op == p2p.GetRootBlockHeadersResponseMsg:
+		var headersResp p2p.GetRootBlockHeadersResponse
+		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &headersResp); err != nil {
+			return err
+		}
+		if c := peer.getChan(qkcMsg.RpcID); c != nil {
+			c <- headersResp.Headers
+		}
+
 	case qkcMsg.Op == p2p.GetRootBlockListResponseMsg:
 		var blockResp p2p.GetRootBlockListResponse
 		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &blockResp); err != nil {
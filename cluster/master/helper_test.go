@@ -20,8 +20,11 @@
 package master
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"github.com/QuarkChain/goquarkchain/account"
 	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/QuarkChain/goquarkchain/cluster/rpc"
@@ -36,8 +39,8 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
-	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/golang/mock/gomock"
+	"io/ioutil"
 	"math/big"
 	"sort"
 	"sync"
@@ -164,14 +167,22 @@ type testPeer struct {
 
 // newTestPeer creates a new peer registered at the given protocol manager.
 func newTestPeer(name string, version int, pm *ProtocolManager, shake bool) (*testPeer, error) {
+	return startTestPeer(p2p.NewPeerWithKey, name, version, pm, shake)
+}
+
+// newTestInboundPeer is newTestPeer for a peer which dialed us.
+func newTestInboundPeer(name string, version int, pm *ProtocolManager, shake bool) (*testPeer, error) {
+	return startTestPeer(p2p.NewInboundPeerWithKey, name, version, pm, shake)
+}
+
+func startTestPeer(newP2PPeer func(*ecdsa.PrivateKey, string, []p2p.Cap) *p2p.Peer, name string, version int,
+	pm *ProtocolManager, shake bool) (*testPeer, error) {
 	// Create a message pipe to communicate through
 	app, net := p2p.MsgPipe()
 
-	// Generate a random id and create the peer
-	var id enode.ID
-	rand.Read(id[:])
-
-	peer := newPeer(version, p2p.NewPeer(id, name, nil), net)
+	// Generate a random key and create the peer
+	key, _ := crypto.GenerateKey()
+	peer := newPeer(version, newP2PPeer(key, name, nil), net)
 
 	// Start the peer on a new thread
 	var err error
@@ -188,10 +199,14 @@ func newTestPeer(name string, version int, pm *ProtocolManager, shake bool) (*te
 }
 
 func newTestClientPeer(version int, msgrw p2p.MsgReadWriter) *Peer {
-	var id enode.ID
-	rand.Read(id[:])
+	key, _ := crypto.GenerateKey()
+	return newPeer(version, p2p.NewPeerWithKey(key, "client", nil), msgrw)
+}
 
-	return newPeer(version, p2p.NewPeer(id, "client", nil), msgrw)
+// nodePeerID returns the peer id p must advertise in its hello, derived from
+// the key it authenticated with.
+func nodePeerID(p *Peer) common.Hash {
+	return common.BytesToHash(crypto.FromECDSAPub(p.Node().Pubkey()))
 }
 
 // handshake simulates a trivial handshake that expects the same state from the
@@ -199,29 +214,103 @@ func newTestClientPeer(version int, msgrw p2p.MsgReadWriter) *Peer {
 func (p *testPeer) handshake(rootBlockHeader *types.RootBlockHeader, geneHash common.Hash) error {
 	privateKey, _ := p2p.GetPrivateKeyFromConfig(clusterconfig.P2P.PrivKey)
 	id := crypto.FromECDSAPub(&privateKey.PublicKey)
-	helloMsg := p2p.HelloCmd{
-		Version:              qkcconfig.P2PProtocolVersion,
-		NetWorkID:            qkcconfig.NetworkID,
-		PeerID:               common.BytesToHash(id),
-		PeerPort:             uint16(clusterconfig.P2PPort),
-		RootBlockHeader:      rootBlockHeader,
-		GenesisRootBlockHash: geneHash,
+	helloMsg := p2p.HelloExtCmd{
+		HelloCmd: p2p.HelloCmd{
+			Version:              qkcconfig.P2PProtocolVersion,
+			NetWorkID:            qkcconfig.NetworkID,
+			PeerID:               common.BytesToHash(id),
+			PeerPort:             uint16(clusterconfig.P2PPort),
+			RootBlockHeader:      rootBlockHeader,
+			GenesisRootBlockHash: geneHash,
+		},
 	}
-	msg, err := p2p.MakeMsg(p2p.Hello, p.getRpcId(), p2p.Metadata{}, helloMsg)
+	remote, err := expectHello(p.app, p.version, helloMsg)
 	if err != nil {
 		return err
 	}
 
-	if _, err := ExpectMsg(p.app, p2p.Hello, p2p.Metadata{}, helloMsg); err != nil {
+	// the remote side advertises the peer id of its own key
+	helloMsg.PeerID = nodePeerID(p.Peer)
+	rand.Read(helloMsg.Nonce[:])
+	if err := sendHello(p.app, p.version, helloMsg); err != nil {
 		return err
 	}
-
-	if err := p.app.WriteMsg(msg); err != nil {
+	if p.version >= p2p.HelloExtVersion {
+		if err := exchangeHelloAcks(p.app, remote, helloMsg.Nonce); err != nil {
+			return err
+		}
+	}
+	caps := p2p.CapabilitiesCommand{Capabilities: QKCCapabilities}
+	if _, err := ExpectMsg(p.app, p2p.CapabilitiesMsg, p2p.Metadata{}, caps); err != nil {
 		return err
 	}
 	return nil
 }
 
+// expectHello reads the hello of the remote side negotiated at version and
+// checks it against want, but for its nonce which is random and returned. The
+// hellos before p2p.HelloExtVersion are checked against want.HelloCmd alone.
+func expectHello(r p2p.MsgReader, version int, want p2p.HelloExtCmd) (common.Hash, error) {
+	msg, err := r.ReadMsg()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	qkcMsg, err := p2p.DecodeQKCMsg(payload)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if qkcMsg.Op != p2p.Hello {
+		return common.Hash{}, fmt.Errorf("incorrect op code: got %d, want %d", qkcMsg.Op, p2p.Hello)
+	}
+	cmd, err := p2p.DecodeQKCPayload(p2p.Hello, uint32(version), qkcMsg.Data)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var (
+		nonce   common.Hash
+		wantCmd interface{} = want.HelloCmd
+	)
+	if hello, ok := cmd.(*p2p.HelloExtCmd); ok {
+		if hello.Nonce == (common.Hash{}) {
+			return common.Hash{}, errors.New("hello without nonce")
+		}
+		nonce, want.Nonce = hello.Nonce, hello.Nonce
+		wantCmd = want
+	}
+	wantBytes, err := serialize.SerializeToBytes(wantCmd)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if !bytes.Equal(qkcMsg.Data, wantBytes) {
+		return common.Hash{}, fmt.Errorf("hello mismatch:\ngot:  %x\nwant: %x", qkcMsg.Data, wantBytes)
+	}
+	return nonce, nil
+}
+
+// sendHello sends hello from the remote side negotiated at version, without
+// its extensions before p2p.HelloExtVersion.
+func sendHello(w p2p.MsgWriter, version int, hello p2p.HelloExtCmd) error {
+	var cmd interface{} = hello.HelloCmd
+	if version >= p2p.HelloExtVersion {
+		cmd = hello
+	}
+	return p2p.SendQKCMsg(w, p2p.Hello, 0, p2p.Metadata{}, cmd)
+}
+
+// exchangeHelloAcks echoes the nonce of the remote hello and expects the
+// remote side to echo ours.
+func exchangeHelloAcks(rw p2p.MsgReadWriter, remote, ours common.Hash) error {
+	if err := p2p.SendQKCMsg(rw, p2p.HelloAckMsg, 0, p2p.Metadata{}, &p2p.HelloAckCommand{Nonce: remote}); err != nil {
+		return err
+	}
+	_, err := ExpectMsg(rw, p2p.HelloAckMsg, p2p.Metadata{}, p2p.HelloAckCommand{Nonce: ours})
+	return err
+}
+
 func toIBlocks(rootBlocks []*types.RootBlock) []types.IBlock {
 	blocks := make([]types.IBlock, len(rootBlocks))
 	for i, block := range rootBlocks {
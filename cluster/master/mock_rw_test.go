@@ -0,0 +1,220 @@
+package master
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRead is a message or an error returned by mockMsgReadWriter.ReadMsg.
+type mockRead struct {
+	msg p2p.Msg
+	err error
+}
+
+// mockMsgReadWriter is an in-memory p2p.MsgReadWriter. Tests inject the
+// messages it reads, including read errors and truncated payloads, and inspect
+// the qkc messages written to it. Connected with newMockMsgRWPair, the
+// messages written to one end are also read by the other.
+type mockMsgReadWriter struct {
+	reads   chan mockRead
+	written chan *p2p.QKCMsg
+	remote  *mockMsgReadWriter
+
+	lock   sync.Mutex
+	writes []*p2p.QKCMsg
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMockMsgReadWriter() *mockMsgReadWriter {
+	return &mockMsgReadWriter{
+		reads:   make(chan mockRead, 64),
+		written: make(chan *p2p.QKCMsg, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+// newMockMsgRWPair returns two connected mocks.
+func newMockMsgRWPair() (*mockMsgReadWriter, *mockMsgReadWriter) {
+	a, b := newMockMsgReadWriter(), newMockMsgReadWriter()
+	a.remote, b.remote = b, a
+	return a, b
+}
+
+func (rw *mockMsgReadWriter) ReadMsg() (p2p.Msg, error) {
+	select {
+	case read := <-rw.reads:
+		return read.msg, read.err
+	case <-rw.closed:
+		return p2p.Msg{}, p2p.ErrPipeClosed
+	}
+}
+
+func (rw *mockMsgReadWriter) WriteMsg(msg p2p.Msg) error {
+	select {
+	case <-rw.closed:
+		return p2p.ErrPipeClosed
+	default:
+	}
+	payload, err := ioutil.ReadAll(msg.Payload)
+	if err != nil {
+		return err
+	}
+	qkcMsg, err := p2p.DecodeQKCMsg(payload)
+	if err != nil {
+		return err
+	}
+	rw.lock.Lock()
+	rw.writes = append(rw.writes, &qkcMsg)
+	rw.lock.Unlock()
+	select {
+	case rw.written <- &qkcMsg:
+	default:
+	}
+	if rw.remote != nil {
+		msg.Payload = bytes.NewReader(payload)
+		rw.remote.reads <- mockRead{msg: msg}
+	}
+	return nil
+}
+
+// Inject queues the qkc message of op carrying cmd for reading.
+func (rw *mockMsgReadWriter) Inject(op p2p.P2PCommandOp, rpcID uint64, metadata p2p.Metadata, cmd interface{}) error {
+	msg, err := p2p.MakeMsg(op, rpcID, metadata, cmd)
+	if err != nil {
+		return err
+	}
+	rw.reads <- mockRead{msg: msg}
+	return nil
+}
+
+// InjectPartial queues the qkc message of op whose payload ends after n
+// bytes, while its size still announces the whole payload.
+func (rw *mockMsgReadWriter) InjectPartial(op p2p.P2PCommandOp, rpcID uint64, metadata p2p.Metadata, cmd interface{}, n int) error {
+	msg, err := p2p.MakeMsg(op, rpcID, metadata, cmd)
+	if err != nil {
+		return err
+	}
+	msg.Payload = &truncatedReader{r: io.LimitReader(msg.Payload, int64(n))}
+	rw.reads <- mockRead{msg: msg}
+	return nil
+}
+
+// InjectErr makes the next read fail with err.
+func (rw *mockMsgReadWriter) InjectErr(err error) {
+	rw.reads <- mockRead{err: err}
+}
+
+// Expect waits for the next message written and checks its op.
+func (rw *mockMsgReadWriter) Expect(op p2p.P2PCommandOp, timeout time.Duration) (*p2p.QKCMsg, error) {
+	select {
+	case msg := <-rw.written:
+		if msg.Op != op {
+			return msg, fmt.Errorf("op mismatch: got %v, want %v", msg.Op, op)
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no %v written within %v", op, timeout)
+	}
+}
+
+// Writes returns the messages written so far.
+func (rw *mockMsgReadWriter) Writes() []*p2p.QKCMsg {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+	return append([]*p2p.QKCMsg(nil), rw.writes...)
+}
+
+func (rw *mockMsgReadWriter) Close() {
+	rw.closeOnce.Do(func() { close(rw.closed) })
+}
+
+// truncatedReader fails with io.ErrUnexpectedEOF where its source ends.
+type truncatedReader struct {
+	r io.Reader
+}
+
+func (t *truncatedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestMockMsgReadWriterHandleMsg(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	rw := newMockMsgReadWriter()
+	defer rw.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), rw)
+	peer.workers = newMsgWorkerPool(1, false)
+	defer peer.workers.stop()
+
+	// a ping is answered through the mock
+	ping := p2p.PingPongCommand{Message: common.Hash{1}}
+	assert.NoError(t, rw.Inject(p2p.Ping, 0, p2p.Metadata{}, ping))
+	assert.NoError(t, pm.handleMsg(peer))
+	_, err := rw.Expect(p2p.Pong, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, rw.Writes(), 1)
+
+	// registered handlers are invoked with the injected message
+	op := p2p.MaxOPNum + 20
+	branches := make(chan uint32, 1)
+	assert.NoError(t, p2p.RegisterOp(op, p2p.PingPongCommand{}))
+	defer p2p.UnregisterOp(op)
+	assert.NoError(t, p2p.RegisterNonRPCHandler(op, p2p.OpParallel, func(peerID string, branch uint32, data []byte) error {
+		branches <- branch
+		return nil
+	}))
+	defer p2p.UnregisterHandler(op)
+	assert.NoError(t, rw.Inject(op, 0, p2p.Metadata{Branch: 7}, ping))
+	assert.NoError(t, pm.handleMsg(peer))
+	select {
+	case branch := <-branches:
+		assert.Equal(t, uint32(7), branch)
+	case <-time.After(time.Second):
+		t.Fatal("handler not invoked")
+	}
+
+	// read errors and truncated payloads stop the handling
+	errRead := errors.New("read failed")
+	rw.InjectErr(errRead)
+	assert.Equal(t, errRead, pm.handleMsg(peer))
+	assert.NoError(t, rw.InjectPartial(p2p.Ping, 0, p2p.Metadata{}, ping, 10))
+	assert.Equal(t, io.ErrUnexpectedEOF, pm.handleMsg(peer))
+
+	// the remote closing the connection is passed through as is
+	rw.InjectErr(p2p.ErrPeerClosed)
+	assert.Equal(t, p2p.ErrPeerClosed, pm.handleMsg(peer))
+}
+
+func TestMockMsgRWPair(t *testing.T) {
+	a, b := newMockMsgRWPair()
+	defer a.Close()
+	defer b.Close()
+
+	ping := p2p.PingPongCommand{Message: common.Hash{2}}
+	assert.NoError(t, p2p.SendQKCMsg(a, p2p.Ping, 3, p2p.Metadata{Branch: 1}, &ping))
+	if _, err := ExpectMsg(b, p2p.Ping, p2p.Metadata{Branch: 1}, ping); err != nil {
+		t.Fatalf("message mismatch: %v", err)
+	}
+	msg, err := a.Expect(p2p.Ping, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), msg.RpcID)
+
+	b.Close()
+	_, err = b.ReadMsg()
+	assert.Equal(t, p2p.ErrPipeClosed, err)
+}
@@ -0,0 +1,108 @@
+package master
+
+import (
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/serialize"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// dedupOp reports whether the messages of op are announcements whose content
+// is handled the same whichever peer relays it. Tips are not, they also tell
+// the head of the peer sending them.
+func dedupOp(op p2p.P2PCommandOp) bool {
+	switch op {
+	case p2p.NewTransactionListMsg, p2p.NewTransactionHashesMsg, p2p.NewBlockMinorMsg,
+		p2p.NewRootBlockMsg, p2p.NewCrossShardTxListMsg:
+		return true
+	}
+	return false
+}
+
+type seenKey struct {
+	op     p2p.P2PCommandOp
+	branch uint32
+	hash   common.Hash
+}
+
+// seenMsgs remembers the announcements received recently from any peer, so
+// that the copies relayed by the other peers of a mesh are dropped instead of
+// being handled again.
+type seenMsgs struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache *lru.Cache // seenKey -> time.Time first seen
+	dups  map[p2p.P2PCommandOp]uint64
+}
+
+// newSeenMsgs returns a cache of size entries remembering each for ttl, or
+// nil if either is 0, which disables deduplication.
+func newSeenMsgs(size int, ttl time.Duration) *seenMsgs {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	cache, _ := lru.New(size)
+	return &seenMsgs{
+		ttl:   ttl,
+		now:   time.Now,
+		cache: cache,
+		dups:  make(map[p2p.P2PCommandOp]uint64),
+	}
+}
+
+// seen records the message of op for branch carrying data and reports whether
+// the same one was already recorded within the ttl, counting it as a
+// duplicate then.
+func (s *seenMsgs) seen(op p2p.P2PCommandOp, branch uint32, data []byte) bool {
+	key := seenKey{op: op, branch: branch, hash: crypto.Keccak256Hash(data)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if at, ok := s.cache.Get(key); ok && now.Sub(at.(time.Time)) < s.ttl {
+		s.dups[op]++
+		return true
+	}
+	s.cache.Add(key, now)
+	return false
+}
+
+// duplicates returns the number of messages dropped per op.
+func (s *seenMsgs) duplicates() map[p2p.P2PCommandOp]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dups := make(map[p2p.P2PCommandOp]uint64, len(s.dups))
+	for op, n := range s.dups {
+		dups[op] = n
+	}
+	return dups
+}
+
+// markKnown marks the transactions of a duplicate announcement as known to
+// the peer relaying it, as handling it would have, so that they are not
+// propagated back to it.
+func markKnown(peer *Peer, op p2p.P2PCommandOp, data []byte) {
+	switch op {
+	case p2p.NewTransactionListMsg:
+		var list p2p.NewTransactionList
+		if err := serialize.DeserializeFromBytes(data, &list); err != nil {
+			return
+		}
+		for _, tx := range list.TransactionList {
+			peer.MarkTransaction(tx.Hash())
+		}
+	case p2p.NewTransactionHashesMsg:
+		var announce p2p.NewTransactionHashes
+		if err := serialize.DeserializeFromBytes(data, &announce); err != nil {
+			return
+		}
+		for _, hash := range announce.Hashes {
+			peer.MarkTransaction(hash)
+		}
+	}
+}
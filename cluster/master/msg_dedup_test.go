@@ -0,0 +1,94 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/cluster/rpc"
+	"github.com/QuarkChain/goquarkchain/mocks/mock_master"
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenMsgs(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	s := newSeenMsgs(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	assert.False(t, s.seen(p2p.NewBlockMinorMsg, 1, []byte{1}))
+	// the same announcement within the ttl is a duplicate, whoever sends it
+	assert.True(t, s.seen(p2p.NewBlockMinorMsg, 1, []byte{1}))
+	// the op is part of the key
+	assert.False(t, s.seen(p2p.NewRootBlockMsg, 1, []byte{1}))
+
+	now = now.Add(time.Minute)
+	assert.False(t, s.seen(p2p.NewBlockMinorMsg, 1, []byte{1}))
+	assert.True(t, s.seen(p2p.NewBlockMinorMsg, 1, []byte{1}))
+
+	// the least recently seen are evicted once the cache is full
+	assert.False(t, s.seen(p2p.NewBlockMinorMsg, 1, []byte{2}))
+	assert.False(t, s.seen(p2p.NewRootBlockMsg, 1, []byte{1}))
+	assert.Equal(t, map[p2p.P2PCommandOp]uint64{p2p.NewBlockMinorMsg: 2}, s.duplicates())
+
+	// and so is the branch, the same data sent to another shard is handled
+	assert.False(t, s.seen(p2p.NewRootBlockMsg, 2, []byte{1}))
+	assert.True(t, s.seen(p2p.NewRootBlockMsg, 2, []byte{1}))
+
+	assert.Nil(t, newSeenMsgs(0, time.Minute))
+	assert.Nil(t, newSeenMsgs(16, 0))
+}
+
+func TestDropDuplicateAnnouncement(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(1, ctrl)
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), fakeConnMngr)
+
+	added := make(chan struct{}, 2)
+	conn := fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn)
+	conn.EXPECT().AddTransactions(gomock.Any()).DoAndReturn(func(*rpc.P2PRedirectRequest) error {
+		added <- struct{}{}
+		return nil
+	}).Times(1)
+
+	list := p2p.NewTransactionList{TransactionList: newTestTransactions(2)}
+	var peers []*testPeer
+	for _, name := range []string{"peer1", "peer2"} {
+		peer, err := newTestPeer(name, int(qkcconfig.P2PProtocolVersion), pm, true)
+		assert.NoError(t, err)
+		defer peer.close()
+		peers = append(peers, peer)
+		msg, err := p2p.MakeMsg(p2p.NewTransactionListMsg, 0, p2p.Metadata{}, list)
+		assert.NoError(t, err)
+		assert.NoError(t, peer.app.WriteMsg(msg))
+	}
+
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("transactions not added")
+	}
+	// the transactions of the dropped copy are still known to its sender
+	known := func() bool {
+		for _, peer := range peers {
+			for _, tx := range list.TransactionList {
+				if !peer.KnownTransaction(tx.Hash()) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(time.Second)
+	for (pm.DuplicateMsgs()[p2p.NewTransactionListMsg] == 0 || !known()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[p2p.P2PCommandOp]uint64{p2p.NewTransactionListMsg: 1}, pm.DuplicateMsgs())
+	assert.True(t, known())
+	select {
+	case <-added:
+		t.Fatal("duplicate transactions added")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,144 @@
+package master
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+)
+
+var errRateLimited = errors.New("peer exceeded its message rate limit")
+
+// responseOps are the ops answering the requests sent to a peer.
+var responseOps = map[p2p.P2PCommandOp]bool{
+	p2p.GetShardMasksResponseMsg:                   true,
+	p2p.GetTransactionsResponseMsg:                 true,
+	p2p.GetRootBlockHeaderListResponseMsg:          true,
+	p2p.GetRootBlockHeadersResponseMsg:             true,
+	p2p.GetRootBlockResponseMsg:                    true,
+	p2p.GetRootBlockListResponseMsg:                true,
+	p2p.GetRootBlockHeaderListWithSkipResponseMsg:  true,
+	p2p.GetMinorBlockHeaderListResponseMsg:         true,
+	p2p.GetMinorBlockHeadersResponseMsg:            true,
+	p2p.GetMinorBlockResponseMsg:                   true,
+	p2p.GetAccountDataResponseMsg:                  true,
+	p2p.GetMinorBlockListResponseMsg:               true,
+	p2p.GetMinorBlockHeaderListWithSkipResponseMsg: true,
+}
+
+// solicited reports whether qkcMsg is the response to a request sent to the
+// peer which is still pending, the peer cannot send those at will.
+func (p *Peer) solicited(qkcMsg *p2p.QKCMsg) bool {
+	return responseOps[qkcMsg.Op] && p.getChan(qkcMsg.RpcID) != nil
+}
+
+// tokenBucket allows rate units per second, with bursts of up to one second
+// worth of units.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+}
+
+// take refills the bucket for the elapsed time and removes n tokens. It
+// returns how long the caller has to wait for the bucket to be back in credit.
+func (b *tokenBucket) take(n float64, elapsed time.Duration) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens = math.Min(b.rate, b.tokens+elapsed.Seconds()*b.rate)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimitStats are the counters of the inbound rate limit of a peer.
+type RateLimitStats struct {
+	Messages     uint64        // messages received
+	Bytes        uint64        // bytes received
+	Throttled    uint64        // messages which paused the reads
+	ThrottleTime time.Duration // total time the reads were paused
+}
+
+// msgRateLimiter limits the messages and bytes per second read from a peer.
+// A peer over its limit has its reads paused until it is back in credit, one
+// which stays over it for longer than maxThrottle is considered abusive.
+type msgRateLimiter struct {
+	mu             sync.Mutex
+	msgs, bytes    tokenBucket
+	maxThrottle    time.Duration
+	last           time.Time
+	throttledSince time.Time
+	stats          RateLimitStats
+	now            func() time.Time
+}
+
+// newMsgRateLimiter creates a limiter allowing msgRate messages and byteRate
+// bytes per second, a zero rate is not limited. A zero maxThrottle never
+// treats the peer as abusive.
+func newMsgRateLimiter(msgRate, byteRate float64, maxThrottle time.Duration) *msgRateLimiter {
+	l := &msgRateLimiter{
+		msgs:        tokenBucket{rate: msgRate},
+		bytes:       tokenBucket{rate: byteRate},
+		maxThrottle: maxThrottle,
+		now:         time.Now,
+	}
+	l.reset()
+	return l
+}
+
+// reserve accounts for a message of size bytes. It returns how long to pause
+// the reads before the next message, and errRateLimited if the peer has been
+// over its limit for too long.
+func (l *msgRateLimiter) reserve(size uint32) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	elapsed := now.Sub(l.last)
+	l.last = now
+	l.stats.Messages++
+	l.stats.Bytes += uint64(size)
+
+	wait := l.msgs.take(1, elapsed)
+	if w := l.bytes.take(float64(size), elapsed); w > wait {
+		wait = w
+	}
+	if wait == 0 {
+		l.throttledSince = time.Time{}
+		return 0, nil
+	}
+	if l.throttledSince.IsZero() {
+		l.throttledSince = now
+	} else if l.maxThrottle > 0 && now.Sub(l.throttledSince) > l.maxThrottle {
+		return wait, errRateLimited
+	}
+	l.stats.Throttled++
+	l.stats.ThrottleTime += wait
+	return wait, nil
+}
+
+// Stats returns the counters since the limiter was created or last reset.
+func (l *msgRateLimiter) Stats() RateLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// Reset refills the buckets and clears the counters.
+func (l *msgRateLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reset()
+}
+
+func (l *msgRateLimiter) reset() {
+	l.msgs.tokens = l.msgs.rate
+	l.bytes.tokens = l.bytes.rate
+	l.last = l.now()
+	l.throttledSince = time.Time{}
+	l.stats = RateLimitStats{}
+}
@@ -0,0 +1,93 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLimiter returns a limiter running on a fake clock advanced by the
+// returned function.
+func newTestLimiter(msgRate, byteRate float64, maxThrottle time.Duration) (*msgRateLimiter, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	l := newMsgRateLimiter(msgRate, byteRate, maxThrottle)
+	l.now = func() time.Time { return now }
+	l.reset()
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMsgRateLimiterBurst(t *testing.T) {
+	l, advance := newTestLimiter(10, 0, 5*time.Second)
+
+	// a burst of up to one second worth of messages goes through
+	for i := 0; i < 10; i++ {
+		wait, err := l.reserve(100)
+		assert.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+	// the next one pauses the reads for the time to earn a token
+	wait, err := l.reserve(100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	// a quiet peer is back in credit
+	advance(2 * time.Second)
+	wait, err = l.reserve(100)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+
+	stats := l.Stats()
+	assert.Equal(t, uint64(12), stats.Messages)
+	assert.Equal(t, uint64(1200), stats.Bytes)
+	assert.Equal(t, uint64(1), stats.Throttled)
+	assert.Equal(t, 100*time.Millisecond, stats.ThrottleTime)
+}
+
+func TestMsgRateLimiterBytes(t *testing.T) {
+	l, _ := newTestLimiter(0, 1000, 0)
+	wait, err := l.reserve(1000)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+	wait, err = l.reserve(500)
+	assert.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, wait)
+}
+
+func TestMsgRateLimiterSustained(t *testing.T) {
+	l, advance := newTestLimiter(10, 0, 5*time.Second)
+
+	// the peer sends as fast as the paused reads let it, twice its rate
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		var wait time.Duration
+		wait, err = l.reserve(1)
+		advance(wait + 50*time.Millisecond)
+	}
+	assert.Equal(t, errRateLimited, err)
+
+	// a reset limiter starts over
+	l.Reset()
+	assert.Equal(t, RateLimitStats{}, l.Stats())
+	wait, err := l.reserve(1)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestSolicitedResponse(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	rpcId, _, err := peer.getRpcIdWithChan()
+	assert.NoError(t, err)
+
+	// only the responses to our pending requests escape the rate limit
+	assert.True(t, peer.solicited(&p2p.QKCMsg{Op: p2p.GetRootBlockResponseMsg, RpcID: rpcId}))
+	assert.False(t, peer.solicited(&p2p.QKCMsg{Op: p2p.GetRootBlockResponseMsg, RpcID: rpcId + 1}))
+	assert.False(t, peer.solicited(&p2p.QKCMsg{Op: p2p.GetRootBlockRequestMsg, RpcID: rpcId}))
+	assert.False(t, peer.solicited(&p2p.QKCMsg{Op: p2p.NewBlockMinorMsg, RpcID: rpcId}))
+
+	peer.deleteChan(rpcId)
+	assert.False(t, peer.solicited(&p2p.QKCMsg{Op: p2p.GetRootBlockResponseMsg, RpcID: rpcId}))
+}
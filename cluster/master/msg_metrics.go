@@ -0,0 +1,57 @@
+package master
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	droppedMsgsPrefix  = "master/msgs/dropped/"
+	panickedMsgsPrefix = "master/msgs/panicked/"
+
+	// msgWarnCooldown is the least time between two warns of the same kind,
+	// a peer flooding unhandled ops must not flood the log as well.
+	msgWarnCooldown = 10 * time.Second
+)
+
+// msgCounter returns the counter of op under prefix. The counters are named
+// after the op number, the name of an op may change as handlers register. They
+// are forced so that the accessors count with metrics disabled too.
+func msgCounter(prefix string, op p2p.P2PCommandOp) metrics.Counter {
+	return metrics.GetOrRegisterCounterForced(prefix+strconv.Itoa(int(op)), nil)
+}
+
+// msgCounts returns the count of each op under prefix, since the process
+// started.
+func msgCounts(prefix string) map[p2p.P2PCommandOp]uint64 {
+	counts := make(map[p2p.P2PCommandOp]uint64)
+	for i := 0; i < 256; i++ {
+		counter, ok := metrics.DefaultRegistry.Get(prefix + strconv.Itoa(i)).(metrics.Counter)
+		if ok && counter.Count() > 0 {
+			counts[p2p.P2PCommandOp(i)] = uint64(counter.Count())
+		}
+	}
+	return counts
+}
+
+// warnCooldown lets through one warn per msgWarnCooldown.
+type warnCooldown struct {
+	last       int64 // unix nano of the last warn let through
+	suppressed uint64
+}
+
+// allow reports whether a warn may be logged now, and how many were
+// suppressed since the previous one.
+func (w *warnCooldown) allow() (bool, uint64) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&w.last)
+	if now-last < int64(msgWarnCooldown) || !atomic.CompareAndSwapInt64(&w.last, last, now) {
+		atomic.AddUint64(&w.suppressed, 1)
+		return false, 0
+	}
+	return true, atomic.SwapUint64(&w.suppressed, 0)
+}
@@ -0,0 +1,27 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarnCooldown(t *testing.T) {
+	var w warnCooldown
+	ok, suppressed := w.allow()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), suppressed)
+
+	// the warns within the cooldown are counted, not logged
+	for i := 0; i < 2; i++ {
+		ok, _ = w.allow()
+		assert.False(t, ok)
+	}
+
+	// and reported with the next warn let through
+	w.last = time.Now().Add(-msgWarnCooldown).UnixNano()
+	ok, suppressed = w.allow()
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), suppressed)
+}
@@ -0,0 +1,50 @@
+package master
+
+import (
+	"runtime/debug"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
+)
+
+// recoverHandler is deferred around the handling of an op message. A panic of
+// the handler is logged and counted, the peer penalized and err cleared, so
+// that the loop running the handler goes on with the next message rather than
+// taking the peer, or the node, down with a buggy handler.
+func (pm *ProtocolManager) recoverHandler(peer *Peer, op p2p.P2PCommandOp, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	msgCounter(panickedMsgsPrefix, op).Inc(1)
+	if ok, suppressed := pm.panickedWarn.allow(); ok {
+		peer.Log().Error("Message handler panicked", "op", op, "panic", r, "suppressed", suppressed, "stack", string(debug.Stack()))
+	}
+	peer.Penalize(nodefilter.PenaltyHandlerPanic)
+	*err = nil
+}
+
+// dispatch queues task on the workers of peer, guarded by recoverHandler.
+// Once the peer is drained the task is dropped, so that shutdown only waits
+// for the handlers already started.
+func (pm *ProtocolManager) dispatch(peer *Peer, op p2p.P2PCommandOp, task func() error) error {
+	if !peer.startHandler() {
+		peer.Log().Trace("Dropping msg of draining peer", "op", op)
+		return nil
+	}
+	err := peer.workers.dispatch(op, func() (err error) {
+		defer peer.handlers.Done()
+		defer pm.recoverHandler(peer, op, &err)
+		return task()
+	})
+	if err != nil {
+		peer.handlers.Done()
+	}
+	return err
+}
+
+// PanickedMsgs returns the number of messages per op whose handler panicked.
+// The counts are those of the process, as kept by the registered metrics.
+func (pm *ProtocolManager) PanickedMsgs() map[p2p.P2PCommandOp]uint64 {
+	return msgCounts(panickedMsgsPrefix)
+}
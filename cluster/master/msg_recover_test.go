@@ -0,0 +1,75 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/QuarkChain/goquarkchain/mocks/mock_master"
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectPong checks that the peer is still served after its previous
+// messages.
+func expectPong(t *testing.T, peer *testPeer, nonce byte) {
+	ping, err := p2p.MakeMsg(p2p.Ping, 0, p2p.Metadata{}, p2p.PingPongCommand{Message: common.Hash{nonce}})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(ping))
+	if _, err := ExpectMsg(peer.app, p2p.Pong, p2p.Metadata{}, p2p.PingPongCommand{Message: common.Hash{nonce}}); err != nil {
+		t.Fatalf("pong mismatch: %v", err)
+	}
+}
+
+func TestRecoverHandlerPanic(t *testing.T) {
+	msgOp, reqOp, respOp := p2p.MaxOPNum+4, p2p.MaxOPNum+5, p2p.MaxOPNum+6
+	assert.NoError(t, p2p.RegisterNonRPCHandler(msgOp, p2p.OpParallel, func(peerID string, branch uint32, data []byte) error {
+		panic("buggy message handler")
+	}))
+	defer p2p.UnregisterHandler(msgOp)
+	assert.NoError(t, p2p.RegisterRPCHandler(reqOp, p2p.RPCHandler{
+		ResponseOp: respOp,
+		Handle: func(peerID string, branch uint32, data []byte) ([]byte, error) {
+			panic("buggy request handler")
+		},
+	}))
+	defer p2p.UnregisterHandler(reqOp)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fakeConnMngr := newFakeConnManager(1, ctrl)
+	fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn).EXPECT().GetShardMaskList().DoAndReturn(func() []*types.ChainMask {
+		panic("buggy slave")
+	}).Times(1)
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	before := pm.PanickedMsgs()
+
+	// a handler run by the read loop
+	msg, err := p2p.MakeMsg(p2p.GetShardMasksRequestMsg, 1, p2p.Metadata{}, p2p.GetShardMasksRequest{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	expectPong(t, peer, 1)
+	assert.Equal(t, map[p2p.P2PCommandOp]uint64{p2p.GetShardMasksRequestMsg: 1}, countsSince(before, pm.PanickedMsgs()))
+
+	// and the registered handlers run by the workers
+	msg, err = p2p.MakeMsg(msgOp, 0, p2p.Metadata{}, p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	msg, err = p2p.MakeMsg(reqOp, 2, p2p.Metadata{}, p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(msg))
+	want := map[p2p.P2PCommandOp]uint64{p2p.GetShardMasksRequestMsg: 1, msgOp: 1, reqOp: 1}
+	for i := 0; !assert.ObjectsAreEqual(want, countsSince(before, pm.PanickedMsgs())); i++ {
+		if i == 100 {
+			t.Fatalf("panics not recovered: %v", countsSince(before, pm.PanickedMsgs()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, peer.workers.Err())
+	expectPong(t, peer, 2)
+}
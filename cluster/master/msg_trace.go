@@ -0,0 +1,88 @@
+package master
+
+import (
+	"sync/atomic"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+)
+
+// MsgTracer observes the qkc messages exchanged with peers, e.g. for a tool
+// dumping the timeline of a connection when debugging the protocol. Its
+// methods are called on the reading and writing goroutines of the peers, so
+// they must be safe for concurrent use and return quickly. The size is the
+// one of the encoded qkc message.
+type MsgTracer interface {
+	OnRead(peer *Peer, op p2p.P2PCommandOp, rpcID uint64, size uint32)
+	OnWrite(peer *Peer, op p2p.P2PCommandOp, rpcID uint64, size uint32)
+}
+
+// tracerBox lets an atomic.Value hold a nil tracer.
+type tracerBox struct {
+	MsgTracer
+}
+
+var globalTracer atomic.Value // tracerBox
+
+// SetMsgTracer sets the tracer of the peers which have none of their own,
+// nil disables it.
+func SetMsgTracer(t MsgTracer) {
+	globalTracer.Store(tracerBox{t})
+}
+
+// SetTracer sets the tracer of the messages of the peer, overriding the one
+// set by SetMsgTracer, nil falls back to the latter.
+func (p *Peer) SetTracer(t MsgTracer) {
+	p.tracer.Store(tracerBox{t})
+}
+
+// msgTracer returns the tracer of the peer, nil if tracing is disabled.
+func (p *Peer) msgTracer() MsgTracer {
+	if box, ok := p.tracer.Load().(tracerBox); ok && box.MsgTracer != nil {
+		return box.MsgTracer
+	}
+	if box, ok := globalTracer.Load().(tracerBox); ok {
+		return box.MsgTracer
+	}
+	return nil
+}
+
+// traceRead reports a message read from the peer to its tracer, if any.
+func (p *Peer) traceRead(op p2p.P2PCommandOp, rpcID uint64, size uint32) {
+	if t := p.msgTracer(); t != nil {
+		t.OnRead(p, op, rpcID, size)
+	}
+}
+
+// traced returns w reporting the messages written to the peer to its tracer,
+// or w itself if tracing is disabled.
+func (p *Peer) traced(w p2p.MsgWriter) p2p.MsgWriter {
+	if t := p.msgTracer(); t != nil {
+		return &tracingWriter{MsgWriter: w, peer: p, tracer: t}
+	}
+	return w
+}
+
+type tracingWriter struct {
+	p2p.MsgWriter
+	peer   *Peer
+	tracer MsgTracer
+}
+
+func (w *tracingWriter) WriteMsg(msg p2p.Msg) error {
+	w.trace(msg)
+	return w.MsgWriter.WriteMsg(msg)
+}
+
+// WriteMsgs keeps the batches of the underlying writer.
+func (w *tracingWriter) WriteMsgs(msgs []p2p.Msg) error {
+	for _, msg := range msgs {
+		w.trace(msg)
+	}
+	return p2p.WriteMsgs(w.MsgWriter, msgs)
+}
+
+func (w *tracingWriter) trace(msg p2p.Msg) {
+	if op, rpcID, ok := p2p.PeekHeader(msg); ok {
+		w.tracer.OnWrite(w.peer, op, rpcID, msg.Size)
+	}
+}
@@ -0,0 +1,87 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type tracedMsg struct {
+	write bool
+	op    p2p.P2PCommandOp
+	rpcID uint64
+}
+
+// chanTracer sends the traced messages to its channel, dropping them once it
+// is full rather than blocking the peer.
+type chanTracer chan tracedMsg
+
+func (c chanTracer) OnRead(peer *Peer, op p2p.P2PCommandOp, rpcID uint64, size uint32) {
+	c.send(tracedMsg{false, op, rpcID})
+}
+
+func (c chanTracer) OnWrite(peer *Peer, op p2p.P2PCommandOp, rpcID uint64, size uint32) {
+	c.send(tracedMsg{true, op, rpcID})
+}
+
+func (c chanTracer) send(msg tracedMsg) {
+	select {
+	case c <- msg:
+	default:
+	}
+}
+
+// waitTraced waits for want among the traced messages, skipping the others.
+func waitTraced(t *testing.T, tracer chanTracer, want tracedMsg) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case got := <-tracer:
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%+v not traced", want)
+		}
+	}
+}
+
+func TestMsgTracer(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+
+	global := make(chanTracer, 64)
+	SetMsgTracer(global)
+	defer SetMsgTracer(nil)
+	peer, err := newTestPeer("peer", QKCProtocolVersion, pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	waitTraced(t, global, tracedMsg{true, p2p.Hello, 0})
+	waitTraced(t, global, tracedMsg{false, p2p.Hello, 0})
+	waitTraced(t, global, tracedMsg{false, p2p.HelloAckMsg, 0})
+
+	// the tracer of the peer takes over from the global one
+	own := make(chanTracer, 64)
+	peer.SetTracer(own)
+	ping, err := p2p.MakeMsg(p2p.Ping, 7, p2p.Metadata{}, p2p.PingPongCommand{Message: common.Hash{1}})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(ping))
+	if _, err := ExpectMsg(peer.app, p2p.Pong, p2p.Metadata{}, p2p.PingPongCommand{Message: common.Hash{1}}); err != nil {
+		t.Fatalf("pong mismatch: %v", err)
+	}
+	waitTraced(t, own, tracedMsg{false, p2p.Ping, 7})
+	waitTraced(t, own, tracedMsg{true, p2p.Pong, 0})
+
+	// without tracers nothing is traced
+	SetMsgTracer(nil)
+	peer.SetTracer(nil)
+	assert.Nil(t, peer.msgTracer())
+	ping, err = p2p.MakeMsg(p2p.Ping, 8, p2p.Metadata{}, p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.app.WriteMsg(ping))
+	if _, err := ExpectMsg(peer.app, p2p.Pong, p2p.Metadata{}, nil); err != nil {
+		t.Fatalf("pong mismatch: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package master
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+)
+
+// msgQueueSize is the number of messages each lane queues up before the
+// read loop of the peer is blocked, or the peer dropped.
+const msgQueueSize = 64
+
+var (
+	errWorkersBusy   = errors.New("message workers are busy")
+	errWorkersClosed = errors.New("message workers are closed")
+)
+
+// msgWorkerPool handles the messages of a peer off its read loop, so that a
+// slow handler does not stall reading. Messages of ordered ops are handled one
+// at a time in the order they were received, the others are spread over the
+// workers and may be handled concurrently.
+type msgWorkerPool struct {
+	ordered    chan func() error
+	parallel   chan func() error
+	dropOnBusy bool
+
+	lock sync.Mutex
+	err  error
+
+	quit chan struct{}
+}
+
+func newMsgWorkerPool(workers int, dropOnBusy bool) *msgWorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	wp := &msgWorkerPool{
+		ordered:    make(chan func() error, msgQueueSize),
+		parallel:   make(chan func() error, msgQueueSize),
+		dropOnBusy: dropOnBusy,
+		quit:       make(chan struct{}),
+	}
+	go wp.loop(wp.ordered)
+	for i := 0; i < workers; i++ {
+		go wp.loop(wp.parallel)
+	}
+	return wp
+}
+
+func (wp *msgWorkerPool) loop(queue chan func() error) {
+	for {
+		select {
+		case task := <-queue:
+			if err := task(); err != nil {
+				wp.setErr(err)
+			}
+		case <-wp.quit:
+			return
+		}
+	}
+}
+
+// dispatch queues task on the lane of the category of op. When that lane is
+// saturated it either waits for room or fails with errWorkersBusy, depending
+// on the backpressure policy of the pool.
+func (wp *msgWorkerPool) dispatch(op p2p.P2PCommandOp, task func() error) error {
+	queue := wp.parallel
+	if p2p.GetOpCategory(op) == p2p.OpOrdered {
+		queue = wp.ordered
+	}
+	if wp.dropOnBusy {
+		select {
+		case queue <- task:
+			return nil
+		case <-wp.quit:
+			return errWorkersClosed
+		default:
+			return errWorkersBusy
+		}
+	}
+	select {
+	case queue <- task:
+		return nil
+	case <-wp.quit:
+		return errWorkersClosed
+	}
+}
+
+func (wp *msgWorkerPool) setErr(err error) {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	if wp.err == nil {
+		wp.err = err
+	}
+}
+
+// Err returns the first error returned by a handler.
+func (wp *msgWorkerPool) Err() error {
+	wp.lock.Lock()
+	defer wp.lock.Unlock()
+	return wp.err
+}
+
+// stop terminates the workers once their running handlers return, queued
+// messages are discarded.
+func (wp *msgWorkerPool) stop() {
+	close(wp.quit)
+}
@@ -0,0 +1,126 @@
+package master
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgWorkerPoolOrder(t *testing.T) {
+	wp := newMsgWorkerPool(4, false)
+	defer wp.stop()
+
+	results := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		i := i
+		assert.NoError(t, wp.dispatch(p2p.NewBlockMinorMsg, func() error {
+			results <- i
+			return nil
+		}))
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case got := <-results:
+			assert.Equal(t, i, got)
+		case <-time.After(time.Second):
+			t.Fatal("message handler not called")
+		}
+	}
+}
+
+func TestMsgWorkerPoolOrderUnderLoad(t *testing.T) {
+	wp := newMsgWorkerPool(4, false)
+	defer wp.stop()
+
+	// blocks and cross shard lists share the ordered lane while transactions
+	// keep the other workers busy
+	ordered := []p2p.P2PCommandOp{p2p.NewBlockMinorMsg, p2p.NewCrossShardTxListMsg, p2p.NewTipMsg}
+	results := make(chan int, 300)
+	for i := 0; i < 300; i++ {
+		i := i
+		assert.NoError(t, wp.dispatch(p2p.NewTransactionListMsg, func() error {
+			time.Sleep(time.Duration(i%3) * time.Millisecond)
+			return nil
+		}))
+		assert.NoError(t, wp.dispatch(ordered[i%len(ordered)], func() error {
+			time.Sleep(time.Duration(i%2) * time.Millisecond)
+			results <- i
+			return nil
+		}))
+	}
+	for i := 0; i < 300; i++ {
+		select {
+		case got := <-results:
+			assert.Equal(t, i, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message handler not called")
+		}
+	}
+}
+
+func TestMsgWorkerPoolParallel(t *testing.T) {
+	wp := newMsgWorkerPool(2, false)
+	defer wp.stop()
+
+	// both handlers only return once the other one started
+	var started sync.WaitGroup
+	started.Add(2)
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, wp.dispatch(p2p.NewTransactionHashesMsg, func() error {
+			started.Done()
+			started.Wait()
+			done <- struct{}{}
+			return nil
+		}))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("transaction messages should be handled concurrently")
+		}
+	}
+}
+
+func TestMsgWorkerPoolDropOnBusy(t *testing.T) {
+	wp := newMsgWorkerPool(1, true)
+	defer wp.stop()
+
+	release, started := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	block := func() error {
+		<-release
+		return nil
+	}
+	// one task keeps the worker busy, the others fill up its queue
+	assert.NoError(t, wp.dispatch(p2p.NewBlockMinorMsg, func() error {
+		close(started)
+		return block()
+	}))
+	<-started
+	for i := 0; i < msgQueueSize; i++ {
+		assert.NoError(t, wp.dispatch(p2p.NewBlockMinorMsg, block))
+	}
+	err := wp.dispatch(p2p.NewBlockMinorMsg, block)
+	assert.Equal(t, errWorkersBusy, err)
+}
+
+func TestMsgWorkerPoolErr(t *testing.T) {
+	wp := newMsgWorkerPool(1, false)
+	defer wp.stop()
+
+	errHandle := errors.New("handle failed")
+	assert.NoError(t, wp.dispatch(p2p.NewTransactionListMsg, func() error { return errHandle }))
+	for i := 0; wp.Err() == nil; i++ {
+		if i == 100 {
+			t.Fatal("handler error should be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, errHandle, wp.Err())
+}
@@ -0,0 +1,290 @@
+package master
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+)
+
+var (
+	errWriteCongested = errors.New("peer write congested")
+	errWriterClosed   = errors.New("peer writer is closed")
+)
+
+// msgLane is the priority of a message in the outbound queue, lower lanes
+// are written first.
+type msgLane int
+
+const (
+	// laneControl carries the small messages keeping the connection alive,
+	// which must not wait behind a block transfer.
+	laneControl msgLane = iota
+	// laneSync carries requests and their responses.
+	laneSync
+	// laneGossip carries broadcast transactions, blocks and tips.
+	laneGossip
+	numLanes
+)
+
+// maxLaneSkips is the number of messages written from higher lanes while a
+// lower lane waits before the lower lane is served once anyway.
+const maxLaneSkips = 8
+
+// maxWriteBatch is the largest number of queued messages written to the peer
+// as one batch.
+const maxWriteBatch = 16
+
+// writerFlushTimeout bounds how long the message loop of a peer waits, once
+// it ends, for the messages queued to the peer to be written.
+const writerFlushTimeout = 2 * time.Second
+
+func (l msgLane) String() string {
+	switch l {
+	case laneControl:
+		return "control"
+	case laneSync:
+		return "sync"
+	case laneGossip:
+		return "gossip"
+	}
+	return "unknown"
+}
+
+// laneOf returns the lane of msg from its op, messages whose op cannot be
+// read go with the requests.
+func laneOf(msg p2p.Msg) msgLane {
+	op, ok := p2p.PeekOp(msg)
+	if !ok {
+		return laneSync
+	}
+	switch op {
+	case p2p.Hello, p2p.Ping, p2p.Pong, p2p.DisconnectMsg, p2p.CapabilitiesMsg:
+		return laneControl
+	case p2p.NewTipMsg, p2p.NewTransactionListMsg, p2p.NewBlockMinorMsg, p2p.NewRootBlockMsg,
+		p2p.NewCrossShardTxListMsg, p2p.NewTransactionHashesMsg, p2p.RootTipUpdateMsg:
+		return laneGossip
+	}
+	return laneSync
+}
+
+// msgWriter queues the messages sent to a peer and writes them from a single
+// goroutine, so that senders are not serialized on a slow connection. Each
+// lane has its own queue, and the writer drains them in priority order.
+type msgWriter struct {
+	w     p2p.MsgWriter
+	lanes [numLanes]chan p2p.Msg
+	// skips counts the messages written past each waiting lane, only used
+	// by the writer goroutine.
+	skips [numLanes]int
+	// timeout is how long a send waits for room in a full queue, it fails
+	// with errWriteCongested at once if zero.
+	timeout time.Duration
+
+	lock sync.Mutex
+	err  error
+
+	quit chan struct{}
+	// flushing is closed by close, the writer then stops once its queues
+	// are empty. done is closed once the writer stopped.
+	flushing chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newMsgWriter starts a writer to w queuing up to size messages per lane.
+func newMsgWriter(w p2p.MsgWriter, size int, timeout time.Duration) *msgWriter {
+	if size < 1 {
+		size = 1
+	}
+	mw := &msgWriter{
+		w:        w,
+		timeout:  timeout,
+		quit:     make(chan struct{}),
+		flushing: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for lane := range mw.lanes {
+		mw.lanes[lane] = make(chan p2p.Msg, size)
+	}
+	go mw.loop()
+	return mw
+}
+
+// loop writes the queued messages. If w writes batches, the messages already
+// waiting behind the next one are written along with it.
+func (mw *msgWriter) loop() {
+	defer close(mw.done)
+	_, batching := mw.w.(p2p.MsgBatchWriter)
+	batch := make([]p2p.Msg, 0, maxWriteBatch)
+	for {
+		msg, ok := mw.next()
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], msg)
+		for batching && len(batch) < maxWriteBatch {
+			msg, ok := mw.poll()
+			if !ok {
+				break
+			}
+			batch = append(batch, msg)
+		}
+		if err := p2p.WriteMsgs(mw.w, batch); err != nil {
+			mw.setErr(err)
+			return
+		}
+	}
+}
+
+// next waits for the next message to write, it returns false once the writer
+// is stopped, or closed with nothing left to write.
+func (mw *msgWriter) next() (p2p.Msg, bool) {
+	select {
+	case <-mw.quit:
+		return p2p.Msg{}, false
+	default:
+	}
+	if msg, ok := mw.poll(); ok {
+		return msg, true
+	}
+	var (
+		msg  p2p.Msg
+		lane msgLane
+	)
+	select {
+	case msg = <-mw.lanes[laneControl]:
+		lane = laneControl
+	case msg = <-mw.lanes[laneSync]:
+		lane = laneSync
+	case msg = <-mw.lanes[laneGossip]:
+		lane = laneGossip
+	case <-mw.quit:
+		return p2p.Msg{}, false
+	case <-mw.flushing:
+		// a message may have been queued along with the close
+		return mw.poll()
+	}
+	mw.served(lane)
+	return msg, true
+}
+
+// poll returns the next message to write if one is queued. A lane passed
+// over maxLaneSkips times goes first, then the highest priority lane holding
+// a message.
+func (mw *msgWriter) poll() (p2p.Msg, bool) {
+	for lane := laneControl; lane < numLanes; lane++ {
+		if mw.skips[lane] >= maxLaneSkips {
+			if msg, ok := mw.take(lane); ok {
+				return msg, true
+			}
+		}
+	}
+	for lane := laneControl; lane < numLanes; lane++ {
+		if msg, ok := mw.take(lane); ok {
+			return msg, true
+		}
+	}
+	return p2p.Msg{}, false
+}
+
+// take returns the next message of lane if it holds one.
+func (mw *msgWriter) take(lane msgLane) (p2p.Msg, bool) {
+	select {
+	case msg := <-mw.lanes[lane]:
+		mw.served(lane)
+		return msg, true
+	default:
+		return p2p.Msg{}, false
+	}
+}
+
+// served records a message taken from lane, skipping the lower lanes which
+// hold messages.
+func (mw *msgWriter) served(lane msgLane) {
+	mw.skips[lane] = 0
+	for lower := lane + 1; lower < numLanes; lower++ {
+		if len(mw.lanes[lower]) > 0 {
+			mw.skips[lower]++
+		}
+	}
+}
+
+// WriteMsg queues msg to be written to the peer, it only reports the error
+// of an earlier write.
+func (mw *msgWriter) WriteMsg(msg p2p.Msg) error {
+	if err := mw.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-mw.flushing:
+		return errWriterClosed
+	default:
+	}
+	queue := mw.lanes[laneOf(msg)]
+	select {
+	case queue <- msg:
+		return nil
+	case <-mw.quit:
+		return errWriterClosed
+	default:
+	}
+	if mw.timeout == 0 {
+		return errWriteCongested
+	}
+	timer := time.NewTimer(mw.timeout)
+	defer timer.Stop()
+	select {
+	case queue <- msg:
+		return nil
+	case <-mw.quit:
+		return errWriterClosed
+	case <-timer.C:
+		return errWriteCongested
+	}
+}
+
+func (mw *msgWriter) setErr(err error) {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	if mw.err == nil {
+		mw.err = err
+	}
+}
+
+// Depths returns the number of messages waiting in each lane.
+func (mw *msgWriter) Depths() map[string]int {
+	depths := make(map[string]int, numLanes)
+	for lane := laneControl; lane < numLanes; lane++ {
+		depths[lane.String()] = len(mw.lanes[lane])
+	}
+	return depths
+}
+
+// Err returns the error which stopped the writer.
+func (mw *msgWriter) Err() error {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	return mw.err
+}
+
+// stop terminates the writer once its running write returns, queued
+// messages are discarded.
+func (mw *msgWriter) stop() {
+	mw.stopOnce.Do(func() { close(mw.quit) })
+}
+
+// close refuses new messages and stops the writer once the messages queued
+// so far are written, or after timeout, when the ones left are discarded. It
+// returns once the writer stopped or timed out.
+func (mw *msgWriter) close(timeout time.Duration) {
+	close(mw.flushing)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-mw.done:
+	case <-timer.C:
+	}
+	mw.stop()
+}
@@ -0,0 +1,237 @@
+package master
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowWriter blocks every write until it is released.
+type slowWriter struct {
+	release chan struct{}
+	written chan p2p.Msg
+}
+
+func (w *slowWriter) WriteMsg(msg p2p.Msg) error {
+	<-w.release
+	w.written <- msg
+	return nil
+}
+
+// batchWriter blocks every batch until it is released and records its size.
+type batchWriter struct {
+	release chan struct{}
+	batches chan int
+}
+
+func (w *batchWriter) WriteMsg(msg p2p.Msg) error {
+	return w.WriteMsgs([]p2p.Msg{msg})
+}
+
+func (w *batchWriter) WriteMsgs(msgs []p2p.Msg) error {
+	<-w.release
+	w.batches <- len(msgs)
+	return nil
+}
+
+func newTestMsg(t *testing.T, rpcID uint64) p2p.Msg {
+	msg, err := p2p.MakeMsg(p2p.Ping, rpcID, p2p.Metadata{}, &p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	return msg
+}
+
+// waitWriterBusy waits until the writer took the only queued message.
+func waitWriterBusy(t *testing.T, mw *msgWriter) {
+	for i := 0; ; i++ {
+		if depths := mw.Depths(); depths["control"]+depths["sync"]+depths["gossip"] == 0 {
+			return
+		}
+		if i == 100 {
+			t.Fatal("writer should take the first message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMsgWriterCongested(t *testing.T) {
+	w := &slowWriter{release: make(chan struct{}), written: make(chan p2p.Msg, 10)}
+	mw := newMsgWriter(w, 2, 0)
+	defer mw.stop()
+
+	// the first message is taken by the writer, the others fill the queue
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 0)))
+	waitWriterBusy(t, mw)
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 1)))
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 2)))
+	assert.Equal(t, errWriteCongested, mw.WriteMsg(newTestMsg(t, 3)))
+
+	close(w.release)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-w.written:
+		case <-time.After(time.Second):
+			t.Fatal("queued message not written")
+		}
+	}
+}
+
+func TestMsgWriterTimeout(t *testing.T) {
+	w := &slowWriter{release: make(chan struct{}), written: make(chan p2p.Msg, 10)}
+	mw := newMsgWriter(w, 1, 50*time.Millisecond)
+	defer mw.stop()
+
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 0)))
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 1)))
+	start := time.Now()
+	// the writer is stuck on the first message, so the queue stays full
+	assert.Equal(t, errWriteCongested, mw.WriteMsg(newTestMsg(t, 2)))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// room frees up within the timeout once the writer moves on
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		w.release <- struct{}{}
+	}()
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 3)))
+}
+
+func TestMsgWriterPongOvertakesBody(t *testing.T) {
+	w := &slowWriter{release: make(chan struct{}), written: make(chan p2p.Msg, 10)}
+	mw := newMsgWriter(w, 4, 0)
+	defer mw.stop()
+
+	// the writer is stuck on a first message while a large body and then a
+	// pong are queued
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 0)))
+	waitWriterBusy(t, mw)
+	body, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockListResponseMsg, 1, p2p.Metadata{}, make([]byte, 1024*1024))
+	assert.NoError(t, err)
+	assert.NoError(t, mw.WriteMsg(body))
+	pong, err := p2p.MakeMsg(p2p.Pong, 2, p2p.Metadata{}, &p2p.PingPongCommand{})
+	assert.NoError(t, err)
+	assert.NoError(t, mw.WriteMsg(pong))
+	assert.Equal(t, map[string]int{"control": 1, "sync": 1, "gossip": 0}, mw.Depths())
+
+	close(w.release)
+	var ops []p2p.P2PCommandOp
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-w.written:
+			op, _ := p2p.PeekOp(msg)
+			ops = append(ops, op)
+		case <-time.After(time.Second):
+			t.Fatal("queued message not written")
+		}
+	}
+	assert.Equal(t, []p2p.P2PCommandOp{p2p.Ping, p2p.Pong, p2p.GetMinorBlockListResponseMsg}, ops)
+}
+
+func TestMsgWriterStarvation(t *testing.T) {
+	w := &slowWriter{release: make(chan struct{}), written: make(chan p2p.Msg, 2*maxLaneSkips)}
+	mw := newMsgWriter(w, 2*maxLaneSkips, 0)
+	defer mw.stop()
+
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 0)))
+	waitWriterBusy(t, mw)
+	tip, err := p2p.MakeMsgWithSerializedData(p2p.NewTipMsg, 0, p2p.Metadata{}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, mw.WriteMsg(tip))
+	for i := 1; i < 2*maxLaneSkips; i++ {
+		assert.NoError(t, mw.WriteMsg(newTestMsg(t, uint64(i))))
+	}
+
+	// the gossip lane goes once maxLaneSkips control messages passed it
+	close(w.release)
+	for i := 0; i <= maxLaneSkips+1; i++ {
+		select {
+		case msg := <-w.written:
+			op, _ := p2p.PeekOp(msg)
+			assert.Equal(t, i == maxLaneSkips+1, op == p2p.NewTipMsg, "message %d is %v", i, op)
+		case <-time.After(time.Second):
+			t.Fatal("queued message not written")
+		}
+	}
+}
+
+func TestMsgWriterBatches(t *testing.T) {
+	w := &batchWriter{release: make(chan struct{}), batches: make(chan int, 10)}
+	mw := newMsgWriter(w, 2*maxWriteBatch, 0)
+	defer mw.stop()
+
+	// the messages queued while the writer is stuck go out together, up to
+	// maxWriteBatch at a time
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 0)))
+	waitWriterBusy(t, mw)
+	for i := 1; i <= maxWriteBatch+2; i++ {
+		assert.NoError(t, mw.WriteMsg(newTestMsg(t, uint64(i))))
+	}
+	close(w.release)
+	var batches []int
+	for total := 0; total < maxWriteBatch+3; {
+		select {
+		case n := <-w.batches:
+			assert.True(t, n <= maxWriteBatch, "batch of %d messages", n)
+			batches = append(batches, n)
+			total += n
+		case <-time.After(time.Second):
+			t.Fatal("queued messages not written")
+		}
+	}
+	// the first message may have been taken with the next one or alone
+	assert.True(t, len(batches) == 2 || len(batches) == 3, "batches %v", batches)
+}
+
+func TestMsgWriterClose(t *testing.T) {
+	w := &slowWriter{release: make(chan struct{}), written: make(chan p2p.Msg, 10)}
+	mw := newMsgWriter(w, 4, 0)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, mw.WriteMsg(newTestMsg(t, uint64(i))))
+	}
+
+	// the queued messages are flushed before the writer stops
+	closed := make(chan struct{})
+	go func() {
+		mw.close(time.Second)
+		close(closed)
+	}()
+	<-mw.flushing
+	assert.Equal(t, errWriterClosed, mw.WriteMsg(newTestMsg(t, 3)))
+	close(w.release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close should return once the queue is flushed")
+	}
+	assert.Len(t, w.written, 3)
+
+	// a stuck write is given up on after the timeout
+	w = &slowWriter{release: make(chan struct{}), written: make(chan p2p.Msg, 10)}
+	mw = newMsgWriter(w, 4, 0)
+	assert.NoError(t, mw.WriteMsg(newTestMsg(t, 0)))
+	start := time.Now()
+	mw.close(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("close returned after %v", elapsed)
+	}
+	close(w.release)
+}
+
+func TestMsgLane(t *testing.T) {
+	for op, lane := range map[p2p.P2PCommandOp]msgLane{
+		p2p.Ping:                         laneControl,
+		p2p.DisconnectMsg:                laneControl,
+		p2p.GetRootBlockListRequestMsg:   laneSync,
+		p2p.GetMinorBlockListResponseMsg: laneSync,
+		p2p.NewTransactionListMsg:        laneGossip,
+		p2p.NewTipMsg:                    laneGossip,
+	} {
+		msg, err := p2p.MakeMsgWithSerializedData(op, 0, p2p.Metadata{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, lane, laneOf(msg), "op %v", op)
+	}
+	// the op of a streamed payload is unknown
+	assert.Equal(t, laneSync, laneOf(p2p.Msg{Size: 64, Payload: strings.NewReader(strings.Repeat("x", 64))}))
+}
@@ -8,18 +8,18 @@ import (
 )
 
 type PrivateP2PAPI struct {
-	peers *peerSet
+	peers *PeerSet
 }
 
 // NewPrivateP2PAPI creates a new peer shard p2p protocol API.
-func NewPrivateP2PAPI(peers *peerSet) *PrivateP2PAPI {
+func NewPrivateP2PAPI(peers *PeerSet) *PrivateP2PAPI {
 	return &PrivateP2PAPI{peers}
 }
 
 //BroadcastMinorBlock will be called when a minor block first time added to a chain
 func (api *PrivateP2PAPI) BroadcastMinorBlock(res *rpc.P2PRedirectRequest) error {
 	for _, peer := range api.peers.Peers() {
-		if peer.id != res.PeerID {
+		if peer.id != res.PeerID && peer.ServesShard(res.Branch) {
 			peer.AsyncSendNewMinorBlock(res)
 		}
 	}
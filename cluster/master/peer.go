@@ -3,13 +3,18 @@
 package master
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/QuarkChain/goquarkchain/account"
 	"github.com/QuarkChain/goquarkchain/cluster/rpc"
 	qkcom "github.com/QuarkChain/goquarkchain/common"
 	"github.com/QuarkChain/goquarkchain/core/types"
@@ -17,6 +22,8 @@ import (
 	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
 	"github.com/QuarkChain/goquarkchain/serialize"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 var (
@@ -24,14 +31,86 @@ var (
 	errAlreadyRegistered = errors.New("peer is already registered")
 	errNotRegistered     = errors.New("peer is not registered")
 	errTimeout           = errors.New("request timeout")
+	errUnknownOp         = errors.New("unknown msg code")
+	errShardNotServed    = errors.New("shard not served")
+	errBlockNotFound     = errors.New("block not found")
+	// errHelloNoNonce is returned for an extended hello without a nonce.
+	errHelloNoNonce = errors.New("hello without nonce")
+	// errHelloReplayed is returned for a hello whose nonce was already seen.
+	errHelloReplayed = errors.New("hello nonce already seen")
+	// errNoHelloAck is returned when the remote sends another message where
+	// its hello ack is expected.
+	errNoHelloAck = errors.New("no hello ack")
+	// errHelloAckMismatch is returned when the hello ack of the remote does
+	// not echo the nonce of our hello.
+	errHelloAckMismatch = errors.New("hello ack does not echo our nonce")
+	// errTooManyPendingRPCs is returned for a request to a peer which has
+	// too many requests pending their response already.
+	errTooManyPendingRPCs = errors.New("too many pending RPCs")
+	// errPeerIDMismatch is returned for a hello whose peer id is not the one
+	// of the key the peer authenticated with.
+	errPeerIDMismatch = errors.New("hello peer id does not match the node id")
+	// errPeerDraining is returned for a request to a peer which is being
+	// drained before shutdown.
+	errPeerDraining = errors.New("peer is draining")
+	// errUnexpectedResponse is returned when a peer answers a request with
+	// the response of another op.
+	errUnexpectedResponse = errors.New("unexpected response")
 )
 
+// invalidHelloError is returned by the handshake when the peer advertises a
+// root block header which can not be right.
+type invalidHelloError struct {
+	s string
+}
+
+func (e *invalidHelloError) Error() string {
+	return "invalid root block header in hello: " + e.s
+}
+
+// unsupportedVersionError is returned by the handshake when the peer runs
+// another protocol version than ours.
+type unsupportedVersionError struct {
+	ours, theirs uint32
+}
+
+func (e *unsupportedVersionError) Error() string {
+	return fmt.Sprintf("protocol version unsupported, get: %d, want: %d", e.theirs, e.ours)
+}
+
+// isHelloMismatch reports whether err of the handshake may come from a peer
+// which is out of step with us rather than misbehaving, e.g. a bad header
+// from a skewed clock, other versions, nonces lost to a reconnect or a peer
+// id derived another way. Such peers are disconnected without being
+// blacklisted.
+func isHelloMismatch(err error) bool {
+	switch err.(type) {
+	case *invalidHelloError, *unsupportedVersionError:
+		return true
+	}
+	mismatches := []error{errHelloNoNonce, errHelloReplayed, errNoHelloAck, errHelloAckMismatch, errPeerIDMismatch}
+	for _, mismatch := range mismatches {
+		if errors.Is(err, mismatch) {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	// maxQueuedTxs is the maximum number of transaction lists to queue up before
 	// dropping broadcasts. This is a sensitive number as a transaction list might
 	// contain a single transaction, or thousands.
 	maxQueuedTxs = 128
 
+	// maxKnownTxs is the maximum transaction hashes to keep in the known list
+	// of a peer, the least recently seen are evicted first.
+	maxKnownTxs = 32768
+
+	// maxKnownBlocks is the maximum root block hashes to keep in the known
+	// list of a peer, the least recently seen are evicted first.
+	maxKnownBlocks = 1024
+
 	// maxQueuedMinorBlocks is the maximum number of block propagations to queue up before
 	// dropping broadcasts.
 	maxQueuedMinorBlocks = 512
@@ -40,9 +119,36 @@ const (
 	// dropping broadcasts.
 	maxQueuedTips = 512
 
-	handshakeTimeout = 5 * time.Second
+	// defaultHandshakeTimeout is how long the hello exchange may take unless
+	// the peer is configured otherwise.
+	defaultHandshakeTimeout = 10 * time.Second
+
+	// maxHelloFutureTime is how far ahead of our clock the root block a peer
+	// advertises in its hello may be.
+	maxHelloFutureTime = time.Hour
 
-	requestTimeout = 30 * time.Second
+	// maxCapabilities is the most capabilities a peer may advertise.
+	maxCapabilities = 64
+
+	// defaultRequestTimeout is how long a request waits for its response
+	// unless the peer or the call is configured otherwise.
+	defaultRequestTimeout = 10 * time.Second
+
+	// defaultMaxPendingRPCs is how many requests to a peer may be pending
+	// their response at once unless the peer is configured otherwise.
+	defaultMaxPendingRPCs = 256
+
+	// maxPendingPings is the most pings awaiting their pong, the oldest is
+	// forgotten beyond it.
+	maxPendingPings = 4
+
+	// latencyWeight is the weight of a new round trip in the average
+	// latency of a peer.
+	latencyWeight = 0.2
+
+	// helloNonceWindow is the number of recent hello nonces remembered to
+	// reject replayed hellos.
+	helloNonceWindow = 4096
 )
 
 type newMinorBlock struct {
@@ -58,6 +164,9 @@ type newTip struct {
 type peerHead struct {
 	rootTip   *types.RootBlockHeader
 	minorTips map[uint32]*p2p.Tip
+	// advertised is the best root block the peer announced, it may be
+	// ahead of rootTip when only its summary is known.
+	advertised *p2p.RootTipUpdate
 }
 
 type Peer struct {
@@ -70,7 +179,23 @@ type Peer struct {
 	version  int         // Protocol version negotiated
 	forkDrop *time.Timer // Timed connection dropper if forks aren't validated in time
 
-	head *peerHead
+	head  *peerHead
+	hello *p2p.HelloCmd       // Hello received in the handshake
+	nonce common.Hash         // Nonce of our hello, echoed by the peer in the handshake
+	caps  map[string]struct{} // Capabilities advertised by the peer
+	// helloExt is the extended hello received in the handshake, nil for the
+	// peers negotiated before p2p.HelloExtVersion.
+	helloExt *p2p.HelloExtCmd
+
+	helloNonces *nonceWindow // Nonces of the hellos received from any peer
+	inbound     bool         // Whether the peer dialed us, recorded in the handshake
+
+	tracer atomic.Value // tracerBox observing the messages of the peer
+
+	shardMasks []*types.ChainMask // Chain masks of the shards the peer serves, nil until reported
+
+	serializerName string         // Name of the serializer negotiated in the handshake
+	serializer     p2p.Serializer // Serializer negotiated in the handshake, nil for the default one
 
 	lock             sync.RWMutex
 	chanLock         sync.RWMutex
@@ -79,22 +204,55 @@ type Peer struct {
 	queuedTip        chan newTip                  // Queue of Tips to announce to the peer
 	term             chan struct{}                // Termination channel to stop the broadcaster
 	chans            map[uint64]chan interface{}
-	handleMsgErr     error
+	respOps          map[uint64]p2p.P2PCommandOp // Response op awaited by the requests of chans, if known
+	rpcMsgs          map[uint64]chan p2p.QKCMsg  // Requests sent by SendRPC pending their response
+	requestTimeout   time.Duration
+	handshakeTimeout time.Duration
+	maxPendingRPCs   int             // Requests pending their response at once, 0 is unbounded
+	lastActive       int64           // unix nano time of the last received message
+	pong             chan struct{}   // Signals the pong of an outstanding ping
+	tipChanged       chan struct{}   // Signals a change of our root tip to advertise
+	workers          *msgWorkerPool  // Handles messages off the read loop
+	writer           atomic.Value    // *msgWriter queuing the messages written to the peer
+	knownTxs         *lru.Cache      // Hashes of the transactions known to the peer
+	knownBlocks      *lru.Cache      // Hashes of the root blocks known to the peer
+	limiter          *msgRateLimiter // Limits the messages read from the peer
+	disconnected     int32           // Set once Disconnect has been called
+	draining         int32           // Set once the peer is drained before shutdown
+	handlerLock      sync.Mutex      // Orders the start of handlers against draining
+	handlers         sync.WaitGroup  // Inbound message handlers run by the workers
+
+	pingNonce uint64 // Number of pings sent
+	pingLock  sync.Mutex
+	pings     map[common.Hash]time.Time // Sending time of the pings awaiting their pong
+	latency   time.Duration             // Average ping round trip, 0 until measured
 }
 
 func newPeer(version int, p *p2p.Peer, rw p2p.MsgReadWriter) *Peer {
+	knownTxs, _ := lru.New(maxKnownTxs)
+	knownBlocks, _ := lru.New(maxKnownBlocks)
 	return &Peer{
 		Peer:             p,
 		rw:               rw,
 		version:          version,
 		id:               fmt.Sprintf("%x", p.ID().Bytes()[:8]),
-		head:             &peerHead{nil, make(map[uint32]*p2p.Tip)},
+		head:             &peerHead{minorTips: make(map[uint32]*p2p.Tip)},
 		queuedTxs:        make(chan *rpc.P2PRedirectRequest, maxQueuedTxs),
 		queuedMinorBlock: make(chan *rpc.P2PRedirectRequest, maxQueuedMinorBlocks),
 		queuedTip:        make(chan newTip, maxQueuedTips),
 		term:             make(chan struct{}),
 		chans:            make(map[uint64]chan interface{}),
-		handleMsgErr:     nil,
+		respOps:          make(map[uint64]p2p.P2PCommandOp),
+		rpcMsgs:          make(map[uint64]chan p2p.QKCMsg),
+		requestTimeout:   defaultRequestTimeout,
+		handshakeTimeout: defaultHandshakeTimeout,
+		maxPendingRPCs:   defaultMaxPendingRPCs,
+		lastActive:       time.Now().UnixNano(),
+		pong:             make(chan struct{}, 1),
+		pings:            make(map[common.Hash]time.Time),
+		tipChanged:       make(chan struct{}, 1),
+		knownTxs:         knownTxs,
+		knownBlocks:      knownBlocks,
 	}
 }
 
@@ -138,6 +296,11 @@ func (p *Peer) close() {
 	close(p.term)
 }
 
+// NewRPCID returns an rpc id no other request to the peer uses, for SendRPC.
+func (p *Peer) NewRPCID() uint64 {
+	return p.getRpcId()
+}
+
 func (p *Peer) getRpcId() uint64 {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -145,13 +308,137 @@ func (p *Peer) getRpcId() uint64 {
 	return p.rpcId
 }
 
-func (p *Peer) getRpcIdWithChan() (uint64, chan interface{}) {
+// getRpcIdWithChan registers a request pending its response. It fails with
+// errTooManyPendingRPCs once maxPendingRPCs requests are pending, until their
+// responses arrive or they time out, and with errPeerDraining once the peer
+// is drained.
+func (p *Peer) getRpcIdWithChan() (uint64, chan interface{}, error) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
+	p.chanLock.Lock()
+	defer p.chanLock.Unlock()
+	if p.isDraining() {
+		return 0, nil, errPeerDraining
+	}
+	if p.maxPendingRPCs > 0 && len(p.chans)+len(p.rpcMsgs) >= p.maxPendingRPCs {
+		return 0, nil, errTooManyPendingRPCs
+	}
 	p.rpcId = p.rpcId + 1
 	rpcchan := make(chan interface{}, 1)
-	p.addChan(p.rpcId, rpcchan)
-	return p.rpcId, rpcchan
+	p.chans[p.rpcId] = rpcchan
+	return p.rpcId, rpcchan, nil
+}
+
+// getRpcIdWithResponseOp is getRpcIdWithChan for a request answered with
+// respOp, deliverResponse rejects the responses of any other op.
+func (p *Peer) getRpcIdWithResponseOp(respOp p2p.P2PCommandOp) (uint64, chan interface{}, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
+	if err != nil {
+		return 0, nil, err
+	}
+	p.chanLock.Lock()
+	p.respOps[rpcId] = respOp
+	p.chanLock.Unlock()
+	return rpcId, rpcchan, nil
+}
+
+// drain makes the new requests to the peer fail, the pending ones still get
+// their response. The new messages of the peer are no longer handled, the
+// handlers already started are waited for by waitHandlers.
+func (p *Peer) drain() {
+	p.handlerLock.Lock()
+	defer p.handlerLock.Unlock()
+	atomic.StoreInt32(&p.draining, 1)
+}
+
+// isDraining reports whether the peer is drained before shutdown.
+func (p *Peer) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// startHandler registers an inbound message handler about to be run by the
+// workers, it fails once the peer is drained. The handler must call
+// p.handlers.Done when it returns.
+func (p *Peer) startHandler() bool {
+	p.handlerLock.Lock()
+	defer p.handlerLock.Unlock()
+	if p.isDraining() {
+		return false
+	}
+	p.handlers.Add(1)
+	return true
+}
+
+// pendingRPCs returns the number of requests pending their response.
+func (p *Peer) pendingRPCs() int {
+	p.chanLock.RLock()
+	defer p.chanLock.RUnlock()
+	return len(p.chans) + len(p.rpcMsgs)
+}
+
+// SendRPC sends data, the serialized command of op, as the request rpcID,
+// taken from NewRPCID, and returns the channel receiving the response with
+// the same rpc id as it is read. It serves the ops registered with
+// p2p.RegisterRPCHandler, whose responses have no handler of their own. The
+// request stays pending until it is released with CancelRPC, once its
+// response is received or given up on.
+func (p *Peer) SendRPC(op p2p.P2PCommandOp, rpcID uint64, data []byte) (<-chan p2p.QKCMsg, error) {
+	p.lock.RLock()
+	maxPending := p.maxPendingRPCs
+	p.lock.RUnlock()
+	p.chanLock.Lock()
+	switch {
+	case p.isDraining():
+		p.chanLock.Unlock()
+		return nil, errPeerDraining
+	case maxPending > 0 && len(p.chans)+len(p.rpcMsgs) >= maxPending:
+		p.chanLock.Unlock()
+		return nil, errTooManyPendingRPCs
+	case p.chans[rpcID] != nil || p.rpcMsgs[rpcID] != nil:
+		p.chanLock.Unlock()
+		return nil, fmt.Errorf("rpc %d is already pending", rpcID)
+	}
+	c := make(chan p2p.QKCMsg, 1)
+	p.rpcMsgs[rpcID] = c
+	p.chanLock.Unlock()
+
+	if err := p.SendResponseWithData(op, p2p.Metadata{}, rpcID, data); err != nil {
+		p.CancelRPC(rpcID)
+		return nil, err
+	}
+	return c, nil
+}
+
+// CancelRPC releases the request rpcID sent by SendRPC, its response is
+// dropped if it still arrives.
+func (p *Peer) CancelRPC(rpcID uint64) {
+	p.chanLock.Lock()
+	defer p.chanLock.Unlock()
+	delete(p.rpcMsgs, rpcID)
+}
+
+// rpcPending reports whether a request sent by SendRPC waits on rpcID.
+func (p *Peer) rpcPending(rpcID uint64) bool {
+	p.chanLock.RLock()
+	defer p.chanLock.RUnlock()
+	return p.rpcMsgs[rpcID] != nil
+}
+
+// deliverRPCMsg hands qkcMsg to the request sent by SendRPC with its rpc id,
+// it reports whether there is one. Duplicated responses are dropped.
+func (p *Peer) deliverRPCMsg(qkcMsg *p2p.QKCMsg) bool {
+	p.chanLock.RLock()
+	c := p.rpcMsgs[qkcMsg.RpcID]
+	p.chanLock.RUnlock()
+	if c == nil {
+		return false
+	}
+	select {
+	case c <- *qkcMsg:
+	default:
+		p.Log().Warn("Dropping duplicated response", "rpcId", qkcMsg.RpcID)
+	}
+	return true
 }
 
 // RootHead retrieves a copy of the current root head of the
@@ -169,6 +456,143 @@ func (p *Peer) SetRootHead(rootTip *types.RootBlockHeader) {
 	defer p.lock.Unlock()
 
 	p.head.rootTip = rootTip
+	if rootTip != nil {
+		p.head.advertised = newRootTipUpdate(rootTip)
+	}
+}
+
+// AdvertisedTip returns the summary of the best root block the peer
+// announced, in its hello, a new tip or a tip update.
+func (p *Peer) AdvertisedTip() *p2p.RootTipUpdate {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.head.advertised
+}
+
+// setAdvertisedTip records a tip update of the peer.
+func (p *Peer) setAdvertisedTip(tip *p2p.RootTipUpdate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.head.advertised = tip
+}
+
+// TotalDifficulty returns the total difficulty of the best root block the
+// peer advertised, nil if it is unknown.
+func (p *Peer) TotalDifficulty() *big.Int {
+	if tip := p.AdvertisedTip(); tip != nil {
+		return tip.TotalDifficulty
+	}
+	return nil
+}
+
+// newRootTipUpdate summarizes header for a tip update.
+func newRootTipUpdate(header *types.RootBlockHeader) *p2p.RootTipUpdate {
+	return &p2p.RootTipUpdate{Number: header.Number, Hash: header.Hash(), TotalDifficulty: headerTotalDifficulty(header)}
+}
+
+// headerTotalDifficulty returns the total difficulty carried by header, nil
+// if it is missing or only repeats the difficulty of the block itself, which
+// peers filling in no total difficulty send past the genesis.
+func headerTotalDifficulty(header *types.RootBlockHeader) *big.Int {
+	td := header.ToTalDifficulty
+	if td == nil || td.Sign() <= 0 {
+		return nil
+	}
+	if header.Number > 0 && header.Difficulty != nil && td.Cmp(header.Difficulty) <= 0 {
+		return nil
+	}
+	return td
+}
+
+// Hello returns the hello the peer sent in the handshake, with the root
+// block it claimed as its tip back then, nil before the handshake is done.
+func (p *Peer) Hello() *p2p.HelloCmd {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.hello
+}
+
+// Inbound reports whether the peer dialed us rather than being dialed, as
+// recorded in the handshake.
+func (p *Peer) Inbound() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.inbound
+}
+
+// setCapabilities records the capabilities the peer advertised.
+func (p *Peer) setCapabilities(caps []string) {
+	set := make(map[string]struct{}, len(caps))
+	for _, c := range caps {
+		set[c] = struct{}{}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.caps = set
+}
+
+// HasCapability reports whether the peer advertised the capability name.
+func (p *Peer) HasCapability(name string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, ok := p.caps[name]
+	return ok
+}
+
+// ServesShard reports whether the peer serves the shard fullShardID as far as
+// we know. Peers which did not report their chain masks are taken to serve
+// every shard, their requests fail with errShardNotServed otherwise.
+func (p *Peer) ServesShard(fullShardID uint32) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.shardMasks == nil {
+		return true
+	}
+	for _, mask := range p.shardMasks {
+		if mask != nil && mask.ContainFullShardId(fullShardID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShardMasks returns the chain masks the peer reported, nil if it did not.
+func (p *Peer) ShardMasks() []*types.ChainMask {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.shardMasks
+}
+
+// setShardMasks records the chain masks the peer reported, an empty list
+// meaning that it serves no shard.
+func (p *Peer) setShardMasks(masks []*types.ChainMask) {
+	if masks == nil {
+		masks = []*types.ChainMask{}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.shardMasks = masks
+}
+
+// Capabilities returns the sorted capabilities the peer advertised.
+func (p *Peer) Capabilities() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	caps := make([]string, 0, len(p.caps))
+	for c := range p.caps {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return caps
 }
 
 // RootHead retrieves a copy of the current root head of the
@@ -192,6 +616,28 @@ func (p *Peer) PeerID() string {
 	return p.id
 }
 
+// MarkTransaction marks a transaction as known to the peer, so that it is not
+// propagated back to it.
+func (p *Peer) MarkTransaction(hash common.Hash) {
+	p.knownTxs.Add(hash, struct{}{})
+}
+
+// KnownTransaction reports whether the transaction is known to the peer.
+func (p *Peer) KnownTransaction(hash common.Hash) bool {
+	return p.knownTxs.Contains(hash)
+}
+
+// MarkBlock marks a root block as known to the peer, so that it is not
+// announced to it again.
+func (p *Peer) MarkBlock(hash common.Hash) {
+	p.knownBlocks.Add(hash, struct{}{})
+}
+
+// KnownBlock reports whether the root block is known to the peer.
+func (p *Peer) KnownBlock(hash common.Hash) bool {
+	return p.knownBlocks.Contains(hash)
+}
+
 // SendTransactions sends transactions to the peer and includes the hashes
 // in its transaction hash set for future reference.
 func (p *Peer) SendTransactions(p2pTxs *rpc.P2PRedirectRequest) error {
@@ -199,7 +645,7 @@ func (p *Peer) SendTransactions(p2pTxs *rpc.P2PRedirectRequest) error {
 	if err != nil {
 		return err
 	}
-	return p.rw.WriteMsg(msg)
+	return p.out().WriteMsg(msg)
 }
 
 // AsyncSendTransactions queues list of transactions propagation to a remote
@@ -215,11 +661,7 @@ func (p *Peer) AsyncSendTransactions(txs *rpc.P2PRedirectRequest) {
 
 // SendNewTip announces the head of each shard or root.
 func (p *Peer) SendNewTip(branch uint32, tip *p2p.Tip) error {
-	msg, err := p2p.MakeMsg(p2p.NewTipMsg, 0, p2p.Metadata{Branch: branch}, tip) //NewTipMsg should rpc=0
-	if err != nil {
-		return err
-	}
-	return p.rw.WriteMsg(msg)
+	return p.sendCmd(p.queue(), p2p.NewTipMsg, 0, p2p.Metadata{Branch: branch}, tip) //NewTipMsg should rpc=0
 }
 
 // AsyncSendNewTip queues the head block for propagation to a remote peer.
@@ -227,9 +669,9 @@ func (p *Peer) SendNewTip(branch uint32, tip *p2p.Tip) error {
 func (p *Peer) AsyncSendNewTip(branch uint32, tip *p2p.Tip) {
 	select {
 	case p.queuedTip <- newTip{branch: branch, tip: tip}:
-		p.Log().Debug("Add new tip to broadcast queue", "", tip.RootBlockHeader.NumberU64(), "branch", branch)
+		p.Log().Debug("Add new tip to broadcast queue", "number", tip.RootBlockHeader.NumberU64(), "branch", branch)
 	default:
-		p.Log().Debug("Dropping new tip", "", tip.RootBlockHeader.NumberU64(), "branch", branch)
+		p.Log().Debug("Dropping new tip", "number", tip.RootBlockHeader.NumberU64(), "branch", branch)
 	}
 }
 
@@ -239,7 +681,7 @@ func (p *Peer) SendNewMinorBlock(branch uint32, data []byte) error {
 	if err != nil {
 		return err
 	}
-	return p.rw.WriteMsg(msg)
+	return p.out().WriteMsg(msg)
 }
 
 // AsyncSendNewMinorBlock queues an entire minor block for propagation to a remote peer. If
@@ -259,220 +701,808 @@ func (p *Peer) getChan(rpcId uint64) chan interface{} {
 	return p.chans[rpcId]
 }
 
-func (p *Peer) addChan(rpcId uint64, rpcchan chan interface{}) {
-	p.chanLock.Lock()
-	defer p.chanLock.Unlock()
-	p.chans[rpcId] = rpcchan
-}
-
 func (p *Peer) deleteChan(rpcId uint64) {
 	p.chanLock.Lock()
 	defer p.chanLock.Unlock()
 	delete(p.chans, rpcId)
+	delete(p.respOps, rpcId)
 }
 
-// requestRootBlockHeaderList fetches a batch of root blocks' headers corresponding to the
-// specified header hashList, based on the hash of an origin block.
-func (p *Peer) requestRootBlockHeaderList(rpcId uint64, request *p2p.GetRootBlockHeaderListRequest) error {
-	if request.Direction != qkcom.DirectionToGenesis {
-		return errors.New("bad direction")
-	}
-	msg, err := p2p.MakeMsg(p2p.GetRootBlockHeaderListRequestMsg, rpcId, p2p.Metadata{}, request)
-	if err != nil {
-		return err
-	}
-	return p.rw.WriteMsg(msg)
+// SetRequestTimeout sets how long requests to the peer wait for a response.
+func (p *Peer) SetRequestTimeout(timeout time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requestTimeout = timeout
 }
 
-func (p *Peer) requestRootBlockHeaderListWithSkip(rpcId uint64, request *p2p.GetRootBlockHeaderListWithSkipRequest) error {
-	msg, err := p2p.MakeMsg(p2p.GetRootBlockHeaderListWithSkipRequestMsg, rpcId, p2p.Metadata{}, request)
+// Request sends payload as a request of op and waits for its response for up
+// to timeout, 0 meaning the request timeout of the peer. The response is
+// returned as the handler of its op delivers it, e.g. []*types.RootBlock for
+// GetRootBlockListRequestMsg. A request timing out fails with errTimeout and
+// releases its pending entry.
+func (p *Peer) Request(op p2p.P2PCommandOp, metadata p2p.Metadata, payload interface{}, timeout time.Duration) (interface{}, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return p.rw.WriteMsg(msg)
-}
-
-func (p *Peer) GetRootBlockHeaderList(req *p2p.GetRootBlockHeaderListWithSkipRequest) (res *p2p.GetRootBlockHeaderListResponse, err error) {
-
-	rpcId, rpcchan := p.getRpcIdWithChan()
 	defer p.deleteChan(rpcId)
 
-	err = p.requestRootBlockHeaderListWithSkip(rpcId, req)
-
-	if err != nil {
+	if err := p.sendCmd(p.queue(), op, rpcId, metadata, payload); err != nil {
 		return nil, err
 	}
-	timeout := time.NewTimer(requestTimeout)
-	select {
-	case obj := <-rpcchan:
-		if ret, ok := obj.(*p2p.GetRootBlockHeaderListResponse); !ok {
-			panic("invalid return result in GetRootBlockHeaderList")
-		} else {
-			return ret, nil
-		}
-	case <-timeout.C:
-		return nil, fmt.Errorf("peer %v return GetRootBlockHeaderList disc Read Time out for rpcid %d", p.id, rpcId)
-	}
+	return p.waitResponseFor(rpcId, rpcchan, timeout)
 }
 
-func (p *Peer) requestMinorBlockHeaderList(rpcId uint64, branch uint32, data []byte) error {
-	msg, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockHeaderListRequestMsg, rpcId, p2p.Metadata{Branch: branch}, data)
-	if err != nil {
-		return err
-	}
-	return p.rw.WriteMsg(msg)
+// SetMaxPendingRPCs sets how many requests to the peer may be pending their
+// response at once, 0 does not bound them.
+func (p *Peer) SetMaxPendingRPCs(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.maxPendingRPCs = n
 }
 
-func (p *Peer) requestMinorBlockHeaderListWithSkip(rpcId uint64, branch uint32, data []byte) error {
-	msg, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockHeaderListWithSkipRequestMsg, rpcId, p2p.Metadata{Branch: branch}, data)
-	if err != nil {
-		return err
-	}
-	return p.rw.WriteMsg(msg)
+// SetHandshakeTimeout sets how long the hello exchange with the peer may take
+// before the peer is dropped.
+func (p *Peer) SetHandshakeTimeout(timeout time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.handshakeTimeout = timeout
 }
 
-func (p *Peer) GetMinorBlockHeaderListWithSkip(req *rpc.P2PRedirectRequest) (res []byte, err error) {
-
-	rpcId, rpcchan := p.getRpcIdWithChan()
-	defer p.deleteChan(rpcId)
+// waitResponse waits for the response of rpcId for the request timeout of the
+// peer. The caller is expected to release the pending channel with deleteChan
+// once it returns.
+func (p *Peer) waitResponse(rpcId uint64, rpcchan chan interface{}) (interface{}, error) {
+	return p.waitResponseFor(rpcId, rpcchan, 0)
+}
 
-	if err = p.requestMinorBlockHeaderListWithSkip(rpcId, req.Branch, req.Data); err != nil {
-		return nil, err
+// waitResponseFor is waitResponse for up to d, 0 meaning the request timeout
+// of the peer.
+func (p *Peer) waitResponseFor(rpcId uint64, rpcchan chan interface{}, d time.Duration) (interface{}, error) {
+	if d <= 0 {
+		p.lock.RLock()
+		d = p.requestTimeout
+		p.lock.RUnlock()
 	}
-	timeout := time.NewTimer(requestTimeout)
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
 	select {
 	case obj := <-rpcchan:
-		if ret, ok := obj.([]byte); !ok {
-			panic("invalid return result in GetMinorBlockHeaderList")
-		} else {
-			return ret, nil
-		}
+		p.Reward(nodefilter.RewardRPCResponse)
+		return obj, nil
 	case <-timeout.C:
-		return nil, fmt.Errorf("peer %v return GetMinorBlockHeaderList disc Read Time out for rpcid %d", p.id, rpcId)
+		p.Penalize(nodefilter.PenaltyRPCTimeout)
+		return nil, fmt.Errorf("peer %v rpcid %d: %w", p.id, rpcId, errTimeout)
 	}
 }
 
-func (p *Peer) GetMinorBlockHeaderList(req *rpc.P2PRedirectRequest) (res []byte, err error) {
-
-	rpcId, rpcchan := p.getRpcIdWithChan()
-	defer p.deleteChan(rpcId)
-
-	if err = p.requestMinorBlockHeaderList(rpcId, req.Branch, req.Data); err != nil {
-		return nil, err
+// deliverResponse hands resp, the response of op, to the request waiting on
+// rpcId. Responses for unknown rpc ids, or duplicated ones, are dropped so that
+// they can not block the message loop. It fails with errUnexpectedResponse if
+// the request awaits the response of another op.
+func (p *Peer) deliverResponse(rpcId uint64, op p2p.P2PCommandOp, resp interface{}) error {
+	p.chanLock.RLock()
+	c := p.chans[rpcId]
+	respOp, checked := p.respOps[rpcId]
+	p.chanLock.RUnlock()
+	if c == nil {
+		p.Log().Warn("Dropping response for unknown rpc", "rpcId", rpcId)
+		return nil
+	}
+	if checked && op != respOp {
+		return fmt.Errorf("%w: op %d for rpc %d, want op %d", errUnexpectedResponse, op, rpcId, respOp)
 	}
-
-	timeout := time.NewTimer(requestTimeout)
 	select {
-	case obj := <-rpcchan:
-		if ret, ok := obj.([]byte); !ok {
-			panic("invalid return result in GetMinorBlockHeaderList")
-		} else {
-			return ret, nil
-		}
-	case <-timeout.C:
-		return nil, fmt.Errorf("peer %v return GetMinorBlockHeaderList disc Read Time out for rpcid %d", p.id, rpcId)
+	case c <- resp:
+	default:
+		p.Log().Warn("Dropping duplicated response", "rpcId", rpcId)
 	}
+	return nil
 }
 
-// requestRootBlockList fetches a batch of root blocks' corresponding to the hashes
-// specified.
-func (p *Peer) requestRootBlockList(rpcId uint64, hashList []common.Hash) error {
-	data := p2p.GetRootBlockListRequest{RootBlockHashList: hashList}
-	msg, err := p2p.MakeMsg(p2p.GetRootBlockListRequestMsg, rpcId, p2p.Metadata{}, data)
-	if err != nil {
-		return err
-	}
-	return p.rw.WriteMsg(msg)
+// badResponse disconnects the peer for answering the request of rpcId with
+// resp, which is not the response of the request, and returns the error.
+func (p *Peer) badResponse(rpcId uint64, resp interface{}) error {
+	p.Disconnect(p2p.QKCDiscProtocolMismatch)
+	return fmt.Errorf("peer %v rpcid %d: %w %T", p.id, rpcId, errUnexpectedResponse, resp)
 }
 
-func (p *Peer) GetRootBlockList(hashes []common.Hash) ([]*types.RootBlock, error) {
-	rpcId, rpcchan := p.getRpcIdWithChan()
-	defer p.deleteChan(rpcId)
-
-	err := p.requestRootBlockList(rpcId, hashes)
-	if err != nil {
-		return nil, err
+// RateLimitStats returns the counters of the inbound rate limit of the peer.
+func (p *Peer) RateLimitStats() RateLimitStats {
+	if p.limiter == nil {
+		return RateLimitStats{}
 	}
+	return p.limiter.Stats()
+}
 
-	timeout := time.NewTimer(requestTimeout)
-	select {
-	case obj := <-rpcchan:
-		if ret, ok := obj.([]*types.RootBlock); !ok {
-			panic("invalid return result in GetRootBlockList")
-		} else {
-			return ret, nil
-		}
-	case <-timeout.C:
-		return nil, fmt.Errorf("peer %v return GetRootBlockList disc Read Time out for rpcid %d", p.id, rpcId)
+// ResetRateLimit clears the inbound rate limit state of the peer, it is back
+// in full credit.
+func (p *Peer) ResetRateLimit() {
+	if p.limiter != nil {
+		p.limiter.Reset()
 	}
 }
 
-// TODO does nothing at the moment
-func (p *Peer) GetNewBlockMinor() (*types.MinorBlock, error) {
-	panic("does nothing at the moment")
+// markActive records that a message has just been received from the peer.
+func (p *Peer) markActive() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
 }
 
-func (p *Peer) requestMinorBlockList(rpcId uint64, req *rpc.P2PRedirectRequest) error {
-	msg, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockListRequestMsg, rpcId, p2p.Metadata{Branch: req.Branch}, req.Data)
-	if err != nil {
-		return err
-	}
-	return p.rw.WriteMsg(msg)
+// idle returns how long the peer has not sent anything.
+func (p *Peer) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActive)))
 }
 
-func (p *Peer) GetMinorBlockList(req *rpc.P2PRedirectRequest) ([]byte, error) {
-	rpcId, rpcchan := p.getRpcIdWithChan()
-	defer p.deleteChan(rpcId)
+// Version returns the qkc protocol version negotiated with the peer, encoding
+// of messages whose format changed between versions depends on it.
+func (p *Peer) Version() int {
+	return p.version
+}
 
-	err := p.requestMinorBlockList(rpcId, req)
-	if err != nil {
-		return nil, err
-	}
+// setWriter starts queuing the messages sent to the peer on w, it is set once
+// the handshake is done while the peer may already be written to.
+func (p *Peer) setWriter(w *msgWriter) {
+	p.writer.Store(w)
+}
 
-	timeout := time.NewTimer(requestTimeout)
-	select {
-	case obj := <-rpcchan:
-		if ret, ok := obj.([]byte); !ok {
-			panic("invalid return result in GetMinorBlockList")
-		} else {
-			return ret, nil
-		}
-	case <-timeout.C:
-		return nil, fmt.Errorf("peer %v return GetMinorBlockList disc Read Time out for rpcid %d", p.id, rpcId)
-	}
+// outQueue returns the outbound queue of the peer, nil until it is started.
+func (p *Peer) outQueue() *msgWriter {
+	w, _ := p.writer.Load().(*msgWriter)
+	return w
 }
 
-func (p *Peer) SendResponseWithData(op p2p.P2PCommandOp, metadata p2p.Metadata, rpcId uint64, data []byte) error {
-	msg, err := p2p.MakeMsgWithSerializedData(op, rpcId, metadata, data)
-	if err != nil {
-		return err
+// out returns where the messages sent to the peer are written, which is the
+// outbound queue once it is started. The messages are built with the default
+// serializer and re-encoded with the one run with the peer.
+func (p *Peer) out() p2p.MsgWriter {
+	if w := p.outQueue(); w != nil {
+		return p.traced(p.serialized(w))
 	}
-	return p.rw.WriteMsg(msg)
+	return p.traced(p.serialized(p.rw))
 }
 
-func (p *Peer) SendResponse(op p2p.P2PCommandOp, metadata p2p.Metadata, rpcId uint64, response interface{}) error {
-	msg, err := p2p.MakeMsg(op, rpcId, metadata, response)
-	if err != nil {
-		return err
+// queue is out for the messages encoded with the serializer run with the
+// peer already.
+func (p *Peer) queue() p2p.MsgWriter {
+	if w := p.outQueue(); w != nil {
+		return p.traced(w)
 	}
-	return p.rw.WriteMsg(msg)
+	return p.traced(p.rw)
 }
 
-// Handshake executes the eth protocol handshake, negotiating version number,
-// network IDs, difficulties, head and genesis blocks.
-func (p *Peer) Handshake(protoVersion, networkId uint32, peerId common.Hash, peerPort uint16, rootBlockHeader *types.RootBlockHeader,
-	genesisRootBlockHash common.Hash) error {
-	// Send out own handshake in a new thread
+// WriteMsgs sends msgs to the peer in order. Written directly they go out
+// as one batch, through the outbound queue they are queued one by one and
+// batched with the other queued messages.
+func (p *Peer) WriteMsgs(msgs []p2p.Msg) error {
+	return p2p.WriteMsgs(p.out(), msgs)
+}
+
+// SendQKCMsg sends payload as the command of op to the peer, it fails if op
+// has no registered command.
+func (p *Peer) SendQKCMsg(op p2p.P2PCommandOp, rpcID uint64, payload interface{}) error {
+	return p.sendCmd(p.queue(), op, rpcID, p2p.Metadata{}, payload)
+}
+
+// SendVersionedMsg sends payload as the command of op for the protocol
+// version negotiated with the peer.
+func (p *Peer) SendVersionedMsg(op p2p.P2PCommandOp, rpcID uint64, metadata p2p.Metadata, payload interface{}) error {
+	return p2p.SendVersionedQKCMsg(p.out(), op, uint32(p.version), rpcID, metadata, payload)
+}
+
+// DecodePayload deserializes the data of an op message from the peer with the
+// command of op for the negotiated protocol version.
+func (p *Peer) DecodePayload(op p2p.P2PCommandOp, data []byte) (interface{}, error) {
+	return p2p.DecodeQKCPayload(op, uint32(p.version), data)
+}
+
+// SendPing sends a keepalive ping to the peer. Its message carries a nonce
+// and the sending time, which the pong echoes to measure the round trip.
+func (p *Peer) SendPing() error {
+	now := time.Now()
+	var message common.Hash
+	binary.BigEndian.PutUint64(message[:8], atomic.AddUint64(&p.pingNonce, 1))
+	binary.BigEndian.PutUint64(message[8:16], uint64(now.UnixNano()))
+
+	p.pingLock.Lock()
+	if len(p.pings) >= maxPendingPings {
+		var (
+			oldest     common.Hash
+			oldestSent time.Time
+		)
+		for m, sent := range p.pings {
+			if oldestSent.IsZero() || sent.Before(oldestSent) {
+				oldest, oldestSent = m, sent
+			}
+		}
+		delete(p.pings, oldest)
+	}
+	p.pings[message] = now
+	p.pingLock.Unlock()
+	return p.SendQKCMsg(p2p.Ping, 0, &p2p.PingPongCommand{Message: message})
+}
+
+// SendPong answers a ping, echoing its message.
+func (p *Peer) SendPong(message common.Hash) error {
+	return p.SendQKCMsg(p2p.Pong, 0, &p2p.PingPongCommand{Message: message})
+}
+
+// SendCapabilities advertises the optional features we support.
+func (p *Peer) SendCapabilities(caps []string) error {
+	return p.SendQKCMsg(p2p.CapabilitiesMsg, 0, &p2p.CapabilitiesCommand{Capabilities: caps})
+}
+
+// SendDisconnect tells the peer why it is about to be disconnected.
+func (p *Peer) SendDisconnect(reason p2p.QKCDiscReason) error {
+	// written directly, it is sent while the outbound queue shuts down
+	return p.sendCmd(p.traced(p.rw), p2p.DisconnectMsg, 0, p2p.Metadata{}, &p2p.DisconnectCommand{Reason: reason})
+}
+
+// SendRootTipUpdate advertises the summary of our root tip.
+func (p *Peer) SendRootTipUpdate(tip *p2p.RootTipUpdate) error {
+	return p.SendQKCMsg(p2p.RootTipUpdateMsg, 0, tip)
+}
+
+// notifyTipChanged wakes up advertiseTip, the signal is dropped if one is
+// already pending.
+func (p *Peer) notifyTipChanged() {
+	select {
+	case p.tipChanged <- struct{}{}:
+	default:
+	}
+}
+
+// advertiseTip sends the peer the summary returned by tip whenever our root
+// tip changes, and every interval if it is not zero. Peers which did not
+// advertise CapRootTipUpdate are skipped.
+func (p *Peer) advertiseTip(interval time.Duration, tip func() *p2p.RootTipUpdate) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-p.tipChanged:
+		case <-p.term:
+			return
+		}
+		if !p.HasCapability(p2p.CapRootTipUpdate) {
+			continue
+		}
+		if err := p.SendRootTipUpdate(tip()); err != nil {
+			p.Log().Debug("Root tip update failed", "err", err)
+			return
+		}
+	}
+}
+
+// Disconnect tells the peer why it is dropped and closes the connection.
+// Only the first call has an effect, later and concurrent calls return at
+// once. Transport failures, where the message cannot be delivered, should
+// use the Disconnect of the embedded p2p.Peer instead.
+func (p *Peer) Disconnect(reason p2p.QKCDiscReason) {
+	if !atomic.CompareAndSwapInt32(&p.disconnected, 0, 1) {
+		return
+	}
+	if err := p.SendDisconnect(reason); err != nil {
+		p.Log().Debug("send disconnect failed", "reason", reason, "err", err)
+	}
+	p.Peer.Disconnect(reason.DiscReason())
+}
+
+// deliverPong measures the round trip of the ping answered by the pong of
+// message and wakes up the keepalive loop waiting for it. Pongs matching no
+// pending ping, duplicates included, are dropped.
+func (p *Peer) deliverPong(message common.Hash) {
+	if !p.recordPong(message, time.Now()) {
+		p.Log().Trace("Dropping unexpected pong", "message", message)
+		return
+	}
+	select {
+	case p.pong <- struct{}{}:
+	default:
+	}
+}
+
+// recordPong folds the round trip of the ping of message, answered at now,
+// into the average latency. It reports false if no such ping is pending.
+func (p *Peer) recordPong(message common.Hash, now time.Time) bool {
+	p.pingLock.Lock()
+	defer p.pingLock.Unlock()
+	sent, ok := p.pings[message]
+	if !ok {
+		return false
+	}
+	delete(p.pings, message)
+	rtt := now.Sub(sent)
+	if p.latency == 0 {
+		p.latency = rtt
+	} else {
+		p.latency += time.Duration(latencyWeight * float64(rtt-p.latency))
+	}
+	return true
+}
+
+// Latency returns the average round trip of the pings answered by the peer,
+// it is unknown until a pong arrives.
+func (p *Peer) Latency() (time.Duration, bool) {
+	p.pingLock.Lock()
+	defer p.pingLock.Unlock()
+	return p.latency, p.latency != 0
+}
+
+// keepalive pings the peer whenever it stays idle for interval, and
+// disconnects it if the pong does not arrive within timeout.
+func (p *Peer) keepalive(interval, timeout time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-p.term:
+			return
+		}
+		if idle := p.idle(); idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+		if err := p.SendPing(); err != nil {
+			p.Log().Warn("Keepalive ping failed", "err", err)
+			p.Peer.Disconnect(p2p.DiscNetworkError)
+			return
+		}
+		timer.Reset(timeout)
+		select {
+		case <-p.pong:
+		case <-timer.C:
+			p.Log().Warn("Keepalive pong timeout", "timeout", timeout)
+			p.Peer.Disconnect(p2p.DiscReadTimeout)
+			return
+		case <-p.term:
+			return
+		}
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(interval)
+	}
+}
+
+// requestRootBlockHeaderList fetches a batch of root blocks' headers corresponding to the
+// specified header hashList, based on the hash of an origin block.
+func (p *Peer) requestRootBlockHeaderList(rpcId uint64, request *p2p.GetRootBlockHeaderListRequest) error {
+	if request.Direction != qkcom.DirectionToGenesis {
+		return errors.New("bad direction")
+	}
+	return p.SendQKCMsg(p2p.GetRootBlockHeaderListRequestMsg, rpcId, request)
+}
+
+func (p *Peer) requestRootBlockHeaderListWithSkip(rpcId uint64, request *p2p.GetRootBlockHeaderListWithSkipRequest) error {
+	return p.SendQKCMsg(p2p.GetRootBlockHeaderListWithSkipRequestMsg, rpcId, request)
+}
+
+func (p *Peer) GetRootBlockHeaderList(req *p2p.GetRootBlockHeaderListWithSkipRequest) (res *p2p.GetRootBlockHeaderListResponse, err error) {
+
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	err = p.requestRootBlockHeaderListWithSkip(rpcId, req)
+
+	if err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := obj.(*p2p.GetRootBlockHeaderListResponse)
+	if !ok {
+		panic("invalid return result in GetRootBlockHeaderList")
+	}
+	return ret, nil
+}
+
+// RequestRootBlockHeaders fetches up to count headers of the canonical root
+// chain of the peer starting at the block start, towards genesis if reverse
+// is set. The peer returns fewer headers past its tip or genesis, and none if
+// it does not know start.
+func (p *Peer) RequestRootBlockHeaders(start common.Hash, count uint32, reverse bool) ([]*types.RootBlockHeader, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetRootBlockHeadersResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	req := &p2p.GetRootBlockHeadersRequest{Start: start, Count: count, Reverse: reverse}
+	if err := p.SendQKCMsg(p2p.GetRootBlockHeadersRequestMsg, rpcId, req); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	headers, ok := obj.([]*types.RootBlockHeader)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	if uint32(len(headers)) > count {
+		return nil, fmt.Errorf("peer returned %d root block headers, %d asked", len(headers), count)
+	}
+	return headers, nil
+}
+
+// RequestRootBlock fetches the full root block of hash. It fails with
+// errBlockNotFound if the peer does not have the block.
+func (p *Peer) RequestRootBlock(hash common.Hash) (*types.RootBlock, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetRootBlockResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	req := &p2p.GetRootBlockRequest{Hash: hash}
+	if err := p.SendQKCMsg(p2p.GetRootBlockRequestMsg, rpcId, req); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := obj.(*p2p.GetRootBlockResponse)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	if resp.NotFound || resp.Block == nil {
+		return nil, fmt.Errorf("%w: root block %x", errBlockNotFound, hash)
+	}
+	if resp.Block.Hash() != hash {
+		return nil, fmt.Errorf("peer returned root block %x, %x asked", resp.Block.Hash(), hash)
+	}
+	return resp.Block, nil
+}
+
+// RequestMinorBlockHeaders fetches up to count headers of the shard of branch
+// from the block start towards genesis. It fails with errShardNotServed if the
+// peer does not run the shard.
+func (p *Peer) RequestMinorBlockHeaders(branch uint32, start common.Hash, count uint32) ([]*types.MinorBlockHeader, error) {
+	if !p.ServesShard(branch) {
+		return nil, fmt.Errorf("%w: branch %d", errShardNotServed, branch)
+	}
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetMinorBlockHeadersResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	req := &p2p.GetMinorBlockHeadersRequest{Start: start, Count: count}
+	if err := p.sendCmd(p.queue(), p2p.GetMinorBlockHeadersRequestMsg, rpcId, p2p.Metadata{Branch: branch}, req); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := obj.(*p2p.GetMinorBlockHeadersResponse)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	if resp.NotServed {
+		return nil, fmt.Errorf("%w: branch %d", errShardNotServed, branch)
+	}
+	if uint32(len(resp.Headers)) > count {
+		return nil, fmt.Errorf("peer returned %d minor block headers, %d asked", len(resp.Headers), count)
+	}
+	return resp.Headers, nil
+}
+
+// RequestMinorBlock fetches the full minor block of hash in the shard of
+// branch. It fails with errShardNotServed if the peer does not run the shard
+// and with errBlockNotFound if the shard lacks the block.
+func (p *Peer) RequestMinorBlock(branch uint32, hash common.Hash) (*types.MinorBlock, error) {
+	if !p.ServesShard(branch) {
+		return nil, fmt.Errorf("%w: branch %d", errShardNotServed, branch)
+	}
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetMinorBlockResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	req := &p2p.GetMinorBlockRequest{Hash: hash}
+	if err := p.sendCmd(p.queue(), p2p.GetMinorBlockRequestMsg, rpcId, p2p.Metadata{Branch: branch}, req); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := obj.(*p2p.GetMinorBlockResponse)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	if resp.NotServed {
+		return nil, fmt.Errorf("%w: branch %d", errShardNotServed, branch)
+	}
+	if resp.NotFound || resp.Block == nil {
+		return nil, fmt.Errorf("%w: minor block %x", errBlockNotFound, hash)
+	}
+	if resp.Block.Hash() != hash {
+		return nil, fmt.Errorf("peer returned minor block %x, %x asked", resp.Block.Hash(), hash)
+	}
+	return resp.Block, nil
+}
+
+// RequestAccountData fetches the latest state of the account of recipient in
+// the shard of branch. It fails with errShardNotServed if the peer does not
+// run the shard.
+func (p *Peer) RequestAccountData(branch uint32, recipient account.Recipient) (*p2p.GetAccountDataResponse, error) {
+	if !p.ServesShard(branch) {
+		return nil, fmt.Errorf("%w: branch %d", errShardNotServed, branch)
+	}
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetAccountDataResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	req := &p2p.GetAccountDataRequest{Recipient: recipient}
+	if err := p.sendCmd(p.queue(), p2p.GetAccountDataRequestMsg, rpcId, p2p.Metadata{Branch: branch}, req); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := obj.(*p2p.GetAccountDataResponse)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	if resp.NotServed || resp.Balance == nil {
+		return nil, fmt.Errorf("%w: branch %d", errShardNotServed, branch)
+	}
+	return resp, nil
+}
+
+// RequestShardMasks asks the peer for the chain masks of the shards it serves
+// and records them, requests for other shards fail at once from then on.
+func (p *Peer) RequestShardMasks() ([]*types.ChainMask, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetShardMasksResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	if err := p.SendQKCMsg(p2p.GetShardMasksRequestMsg, rpcId, &p2p.GetShardMasksRequest{}); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := obj.(*p2p.GetShardMasksResponse)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	p.setShardMasks(resp.ChainMaskList)
+	return resp.ChainMaskList, nil
+}
+
+// SendTransactionHashes announces transactions of the shard of branch to the
+// peer, which fetches the ones it misses with RequestTransactions.
+func (p *Peer) SendTransactionHashes(branch uint32, hashes []common.Hash) error {
+	return p.sendCmd(p.queue(), p2p.NewTransactionHashesMsg, 0, p2p.Metadata{Branch: branch}, &p2p.NewTransactionHashes{Hashes: hashes})
+}
+
+// RequestTransactions fetches the announced transactions of hashes from the
+// peer, the ones it no longer has are left out of the result.
+func (p *Peer) RequestTransactions(branch uint32, hashes []common.Hash) ([]*types.Transaction, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithResponseOp(p2p.GetTransactionsResponseMsg)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	req := &p2p.GetTransactionsRequest{Hashes: hashes}
+	if err := p.sendCmd(p.queue(), p2p.GetTransactionsRequestMsg, rpcId, p2p.Metadata{Branch: branch}, req); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	txs, ok := obj.([]*types.Transaction)
+	if !ok {
+		return nil, p.badResponse(rpcId, obj)
+	}
+	if len(txs) > len(hashes) {
+		return nil, fmt.Errorf("peer returned %d transactions, %d asked", len(txs), len(hashes))
+	}
+	return txs, nil
+}
+
+func (p *Peer) requestMinorBlockHeaderList(rpcId uint64, branch uint32, data []byte) error {
+	msg, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockHeaderListRequestMsg, rpcId, p2p.Metadata{Branch: branch}, data)
+	if err != nil {
+		return err
+	}
+	return p.out().WriteMsg(msg)
+}
+
+func (p *Peer) requestMinorBlockHeaderListWithSkip(rpcId uint64, branch uint32, data []byte) error {
+	msg, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockHeaderListWithSkipRequestMsg, rpcId, p2p.Metadata{Branch: branch}, data)
+	if err != nil {
+		return err
+	}
+	return p.out().WriteMsg(msg)
+}
+
+func (p *Peer) GetMinorBlockHeaderListWithSkip(req *rpc.P2PRedirectRequest) (res []byte, err error) {
+
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	if err = p.requestMinorBlockHeaderListWithSkip(rpcId, req.Branch, req.Data); err != nil {
+		return nil, err
+	}
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := obj.([]byte)
+	if !ok {
+		panic("invalid return result in GetMinorBlockHeaderList")
+	}
+	return ret, nil
+}
+
+func (p *Peer) GetMinorBlockHeaderList(req *rpc.P2PRedirectRequest) (res []byte, err error) {
+
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	if err = p.requestMinorBlockHeaderList(rpcId, req.Branch, req.Data); err != nil {
+		return nil, err
+	}
+
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := obj.([]byte)
+	if !ok {
+		panic("invalid return result in GetMinorBlockHeaderList")
+	}
+	return ret, nil
+}
+
+// requestRootBlockList fetches a batch of root blocks' corresponding to the hashes
+// specified.
+func (p *Peer) requestRootBlockList(rpcId uint64, hashList []common.Hash) error {
+	data := p2p.GetRootBlockListRequest{RootBlockHashList: hashList}
+	return p.SendQKCMsg(p2p.GetRootBlockListRequestMsg, rpcId, data)
+}
+
+func (p *Peer) GetRootBlockList(hashes []common.Hash) ([]*types.RootBlock, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	err = p.requestRootBlockList(rpcId, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := obj.([]*types.RootBlock)
+	if !ok {
+		panic("invalid return result in GetRootBlockList")
+	}
+	return ret, nil
+}
+
+// TODO does nothing at the moment
+func (p *Peer) GetNewBlockMinor() (*types.MinorBlock, error) {
+	panic("does nothing at the moment")
+}
+
+func (p *Peer) requestMinorBlockList(rpcId uint64, req *rpc.P2PRedirectRequest) error {
+	msg, err := p2p.MakeMsgWithSerializedData(p2p.GetMinorBlockListRequestMsg, rpcId, p2p.Metadata{Branch: req.Branch}, req.Data)
+	if err != nil {
+		return err
+	}
+	return p.out().WriteMsg(msg)
+}
+
+func (p *Peer) GetMinorBlockList(req *rpc.P2PRedirectRequest) ([]byte, error) {
+	rpcId, rpcchan, err := p.getRpcIdWithChan()
+	if err != nil {
+		return nil, err
+	}
+	defer p.deleteChan(rpcId)
+
+	err = p.requestMinorBlockList(rpcId, req)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := p.waitResponse(rpcId, rpcchan)
+	if err != nil {
+		return nil, err
+	}
+	ret, ok := obj.([]byte)
+	if !ok {
+		panic("invalid return result in GetMinorBlockList")
+	}
+	return ret, nil
+}
+
+func (p *Peer) SendResponseWithData(op p2p.P2PCommandOp, metadata p2p.Metadata, rpcId uint64, data []byte) error {
+	msg, err := p2p.MakeMsgWithSerializedData(op, rpcId, metadata, data)
+	if err != nil {
+		return err
+	}
+	return p.out().WriteMsg(msg)
+}
+
+func (p *Peer) SendResponse(op p2p.P2PCommandOp, metadata p2p.Metadata, rpcId uint64, response interface{}) error {
+	return p.sendCmd(p.queue(), op, rpcId, metadata, response)
+}
+
+// Handshake executes the eth protocol handshake, negotiating version number,
+// network IDs, difficulties, head and genesis blocks. From p2p.HelloExtVersion
+// on, the hellos are followed by hello acks echoing the nonce of the hello
+// received, so that each side knows the other answers this session rather
+// than replaying a recorded hello.
+func (p *Peer) Handshake(protoVersion, networkId uint32, peerId common.Hash, peerPort uint16, rootBlockHeader *types.RootBlockHeader,
+	genesisRootBlockHash common.Hash) error {
+	p.lock.Lock()
+	p.inbound = p.Peer.Inbound()
+	p.lock.Unlock()
+
+	extended := p.version >= p2p.HelloExtVersion
+	var nonce common.Hash
+	if extended {
+		if _, err := crand.Read(nonce[:]); err != nil {
+			return err
+		}
+	}
+	// Send out own handshake in a new thread
 	errc := make(chan error, 2)
 
-	hello, err := p2p.MakeMsg(p2p.Hello, 0, p2p.Metadata{}, p2p.HelloCmd{
-		Version:              protoVersion,
-		NetWorkID:            networkId,
-		PeerID:               peerId,
-		PeerPort:             peerPort,
-		RootBlockHeader:      rootBlockHeader,
-		GenesisRootBlockHash: genesisRootBlockHash,
-	})
+	helloCmd := &p2p.HelloExtCmd{
+		HelloCmd: p2p.HelloCmd{
+			Version:              protoVersion,
+			NetWorkID:            networkId,
+			PeerID:               peerId,
+			PeerPort:             peerPort,
+			RootBlockHeader:      rootBlockHeader,
+			GenesisRootBlockHash: genesisRootBlockHash,
+		},
+		Nonce:       nonce,
+		Serializers: p2p.SerializerNames(),
+	}
+	var cmd interface{} = &helloCmd.HelloCmd
+	if extended {
+		cmd = helloCmd
+	}
+	hello, err := p2p.MakeMsg(p2p.Hello, 0, p2p.Metadata{}, cmd)
 	if err != nil {
 		return err
 	}
@@ -481,63 +1511,216 @@ func (p *Peer) Handshake(protoVersion, networkId uint32, peerId common.Hash, pee
 		errc <- p.readStatus(protoVersion, networkId, genesisRootBlockHash)
 	}()
 	go func() {
-		errc <- p.rw.WriteMsg(hello)
+		errc <- p.traced(p.rw).WriteMsg(hello)
 	}()
 
+	p.lock.RLock()
+	handshakeTimeout := p.handshakeTimeout
+	p.lock.RUnlock()
 	timeout := time.NewTimer(handshakeTimeout)
 	defer timeout.Stop()
-	for i := 0; i < 2; i++ {
-		select {
-		case err := <-errc:
-			if err != nil {
-				return nodefilter.NewHandleBlackListErr(err.Error())
+	wait := func() error {
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errc:
+				// a peer disconnecting us with a reason is not misbehaving
+				if reason, ok := err.(p2p.QKCDiscReason); ok {
+					return reason
+				}
+				if isHelloMismatch(err) {
+					return err
+				}
+				if err != nil {
+					return nodefilter.NewHandleBlackListErr(err.Error())
+				}
+			case <-timeout.C:
+				p.Log().Warn("Handshake timeout", "timeout", handshakeTimeout)
+				return p2p.DiscReadTimeout
 			}
-		case <-timeout.C:
-			fmt.Println("return Handshake disc Read Time out")
-			return p2p.DiscReadTimeout
 		}
+		return nil
+	}
+	if err := wait(); err != nil {
+		return err
+	}
+
+	if extended {
+		p.lock.RLock()
+		ack := &p2p.HelloAckCommand{Nonce: p.helloExt.Nonce}
+		serializers := p.helloExt.Serializers
+		p.lock.RUnlock()
+		go func() {
+			errc <- p.readHelloAck(nonce)
+		}()
+		go func() {
+			errc <- p2p.SendQKCMsg(p.traced(p.rw), p2p.HelloAckMsg, 0, p2p.Metadata{}, ack)
+		}()
+		if err := wait(); err != nil {
+			return err
+		}
+		// older peers only run the default serializer
+		p.setSerializer(p2p.NegotiateSerializer(serializers))
 	}
 	return nil
 }
 
-func (p *Peer) readStatus(protoVersion, networkId uint32, genesisRootBlockHash common.Hash) (err error) {
+// readHandshakeMsg reads the next message of the handshake, failing with the
+// reason of the remote if it disconnects.
+func (p *Peer) readHandshakeMsg() (*p2p.QKCMsg, error) {
 	msg, err := p.rw.ReadMsg()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	qkcBody, err := ioutil.ReadAll(msg.Payload)
+	qkcBody, err := p2p.ReadPayload(msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	qkcMsg, err := p2p.DecodeQKCMsg(qkcBody)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	p.traceRead(qkcMsg.Op, qkcMsg.RpcID, msg.Size)
+	if qkcMsg.Op == p2p.DisconnectMsg {
+		var disc p2p.DisconnectCommand
+		if err := serialize.DeserializeFromBytes(qkcMsg.Data, &disc); err != nil {
+			return nil, err
+		}
+		return nil, disc.Reason
 	}
+	return &qkcMsg, nil
+}
 
-	var helloCmd = p2p.HelloCmd{}
-	err = serialize.DeserializeFromBytes(qkcMsg.Data, &helloCmd)
+func (p *Peer) readStatus(protoVersion, networkId uint32, genesisRootBlockHash common.Hash) (err error) {
+	qkcMsg, err := p.readHandshakeMsg()
 	if err != nil {
 		return err
 	}
-
-	if msg.Code != uint64(p2p.Hello) {
+	if qkcMsg.Op != p2p.Hello {
 		return errors.New("msgCode is err")
 	}
+
+	// peers negotiated at p2p.HelloExtVersion or later send the extended hello
+	cmd, err := p2p.DecodeQKCPayload(p2p.Hello, uint32(p.version), qkcMsg.Data)
+	if err != nil {
+		return err
+	}
+	var ext *p2p.HelloExtCmd
+	helloCmd, ok := cmd.(*p2p.HelloCmd)
+	if !ok {
+		ext = cmd.(*p2p.HelloExtCmd)
+		helloCmd = &ext.HelloCmd
+	}
+
 	if helloCmd.NetWorkID != networkId {
 		return fmt.Errorf("networkid mismatch, get: %d, want: %d", helloCmd.NetWorkID, networkId)
 	}
 	if helloCmd.Version != protoVersion {
-		return fmt.Errorf("protoco version mismatch, get: %d, want: %d", helloCmd.Version, protoVersion)
+		return &unsupportedVersionError{ours: protoVersion, theirs: helloCmd.Version}
 	}
 	if helloCmd.RootBlockHeader == nil {
 		return errors.New("root block header in hello cmd is nil")
 	}
+	if err := checkHelloHeader(helloCmd.RootBlockHeader, time.Now()); err != nil {
+		return err
+	}
 	if helloCmd.GenesisRootBlockHash != genesisRootBlockHash {
 		return errors.New("genesis block mismatch")
 	}
+	// older peers may advertise any peer id
+	if ext != nil {
+		if err := p.checkPeerID(helloCmd.PeerID); err != nil {
+			return err
+		}
+		if ext.Nonce == (common.Hash{}) {
+			return errHelloNoNonce
+		}
+		if err := p.helloNonces.add(ext.Nonce); err != nil {
+			return err
+		}
+	}
 
+	p.lock.Lock()
+	p.hello = helloCmd
+	p.helloExt = ext
+	p.lock.Unlock()
 	p.SetRootHead(helloCmd.RootBlockHeader)
+	p.MarkBlock(helloCmd.RootBlockHeader.Hash())
+	return nil
+}
+
+// checkPeerID verifies that id, the peer id of the hello, is derived from the
+// key the peer authenticated with in the RLPx handshake, the way we derive
+// ours.
+func (p *Peer) checkPeerID(id common.Hash) error {
+	pub := p.Node().Pubkey()
+	if pub == nil {
+		return fmt.Errorf("%w: no node key", errPeerIDMismatch)
+	}
+	if want := common.BytesToHash(crypto.FromECDSAPub(pub)); id != want {
+		return fmt.Errorf("%w: got %x, want %x", errPeerIDMismatch, id, want)
+	}
+	return nil
+}
+
+// readHelloAck reads the hello ack of the peer, which must echo nonce, the
+// nonce of our hello. The nonce is kept for the session once it matches.
+func (p *Peer) readHelloAck(nonce common.Hash) error {
+	qkcMsg, err := p.readHandshakeMsg()
+	if err != nil {
+		return err
+	}
+	if qkcMsg.Op != p2p.HelloAckMsg {
+		return fmt.Errorf("%w: got %v", errNoHelloAck, qkcMsg.Op)
+	}
+	var ack p2p.HelloAckCommand
+	if err := serialize.DeserializeFromBytes(qkcMsg.Data, &ack); err != nil {
+		return err
+	}
+	if ack.Nonce != nonce {
+		return errHelloAckMismatch
+	}
+	p.lock.Lock()
+	p.nonce = nonce
+	p.lock.Unlock()
+	return nil
+}
+
+// nonceWindow remembers the nonces of the recent hellos received from any
+// peer, a nil window remembers none.
+type nonceWindow struct {
+	cache *lru.Cache
+}
+
+func newNonceWindow(size int) *nonceWindow {
+	cache, _ := lru.New(size)
+	return &nonceWindow{cache: cache}
+}
+
+// add records nonce, failing with errHelloReplayed if it is remembered
+// already.
+func (w *nonceWindow) add(nonce common.Hash) error {
+	if w == nil {
+		return nil
+	}
+	if seen, _ := w.cache.ContainsOrAdd(nonce, struct{}{}); seen {
+		return errHelloReplayed
+	}
+	return nil
+}
+
+// checkHelloHeader sanity checks the root block header a peer advertises as
+// its tip, the header itself is only verified once it is synced.
+func checkHelloHeader(header *types.RootBlockHeader, now time.Time) error {
+	// same as the consensus check, no other version is defined yet
+	if header.Version != 0 {
+		return &invalidHelloError{fmt.Sprintf("unsupported version %d", header.Version)}
+	}
+	if header.Difficulty == nil || header.Difficulty.Sign() <= 0 {
+		return &invalidHelloError{fmt.Sprintf("difficulty %v is not positive", header.Difficulty)}
+	}
+	if limit := uint64(now.Add(maxHelloFutureTime).Unix()); header.Time > limit {
+		return &invalidHelloError{fmt.Sprintf("timestamp %d is too far in the future", header.Time)}
+	}
 	return nil
 }
 
@@ -548,17 +1731,70 @@ func (p *Peer) String() string {
 	)
 }
 
-// peerSet represents the collection of active peers currently participating in
+// PeerInfo is what is known about a connected peer, for admin APIs.
+type PeerInfo struct {
+	ID                  string         `json:"ID"`
+	Enode               string         `json:"ENODE"`
+	RemoteAddr          string         `json:"REMOTE_ADDR"`
+	Version             uint32         `json:"VERSION"`
+	Inbound             bool           `json:"INBOUND"`
+	NetworkID           uint32         `json:"NETWORK_ID"`
+	RootNumber          uint64         `json:"ROOT_NUMBER"`
+	RootTotalDifficulty *big.Int       `json:"ROOT_TOTAL_DIFFICULTY"`
+	Snappy              bool           `json:"SNAPPY"`
+	AdaptiveSnappy      bool           `json:"ADAPTIVE_SNAPPY"`
+	Capabilities        []string       `json:"CAPABILITIES"`
+	WriteQueue          map[string]int `json:"WRITE_QUEUE,omitempty"`
+	ClockSkewMs         *int64         `json:"CLOCK_SKEW_MS,omitempty"`
+	LatencyMs           *int64         `json:"LATENCY_MS,omitempty"`
+}
+
+// Info returns the protocol version, network and root tip the peer advertised
+// in its hello, along with the direction and state of the connection, of its
+// outbound queue, the skew of its clock measured in the handshake and its
+// latency.
+func (p *Peer) Info() *PeerInfo {
+	info := &PeerInfo{
+		ID:           p.id,
+		Enode:        p.Node().String(),
+		RemoteAddr:   p.RemoteAddr().String(),
+		Inbound:      p.Inbound(),
+		Capabilities: p.Capabilities(),
+	}
+	info.Snappy, info.AdaptiveSnappy = p.Peer.Snappy()
+	if w := p.outQueue(); w != nil {
+		info.WriteQueue = w.Depths()
+	}
+	if skew, ok := p.Peer.ClockSkew(); ok {
+		ms := int64(skew / time.Millisecond)
+		info.ClockSkewMs = &ms
+	}
+	if latency, ok := p.Latency(); ok {
+		ms := int64(latency / time.Millisecond)
+		info.LatencyMs = &ms
+	}
+	if hello := p.Hello(); hello != nil {
+		info.Version = hello.Version
+		info.NetworkID = hello.NetWorkID
+		if hello.RootBlockHeader != nil {
+			info.RootNumber = hello.RootBlockHeader.NumberU64()
+			info.RootTotalDifficulty = hello.RootBlockHeader.ToTalDifficulty
+		}
+	}
+	return info
+}
+
+// PeerSet represents the collection of active peers currently participating in
 // the sub-protocol.
-type peerSet struct {
+type PeerSet struct {
 	peers  map[string]*Peer
 	lock   sync.RWMutex
 	closed bool
 }
 
-// newPeerSet creates a new peer set to track the active participants.
-func newPeerSet() *peerSet {
-	return &peerSet{
+// NewPeerSet creates a new peer set to track the active participants.
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
 		peers: make(map[string]*Peer),
 	}
 }
@@ -566,7 +1802,7 @@ func newPeerSet() *peerSet {
 // Register injects a new peer into the working set, or returns an error if the
 // peer is already known. If a new peer it registered, its broadcast loop is also
 // started.
-func (ps *peerSet) Register(p *Peer) error {
+func (ps *PeerSet) Register(p *Peer) error {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
 
@@ -584,7 +1820,7 @@ func (ps *peerSet) Register(p *Peer) error {
 
 // Unregister removes a remote peer from the active set, disabling any further
 // actions to/from that particular entity.
-func (ps *peerSet) Unregister(id string) error {
+func (ps *PeerSet) Unregister(id string) error {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
 
@@ -599,7 +1835,7 @@ func (ps *peerSet) Unregister(id string) error {
 }
 
 // Peer retrieves the registered peer with the given id.
-func (ps *peerSet) Peer(id string) *Peer {
+func (ps *PeerSet) Peer(id string) *Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
@@ -607,7 +1843,7 @@ func (ps *peerSet) Peer(id string) *Peer {
 }
 
 // Peers retrieves all registered peers as a slice
-func (ps *peerSet) Peers() []*Peer {
+func (ps *PeerSet) Peers() []*Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
@@ -619,7 +1855,7 @@ func (ps *peerSet) Peers() []*Peer {
 }
 
 // Len returns if the current number of peers in the set.
-func (ps *peerSet) Len() int {
+func (ps *PeerSet) Len() int {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
@@ -627,31 +1863,128 @@ func (ps *peerSet) Len() int {
 }
 
 // BestPeer retrieves the known peer with the currently highest total difficulty.
-func (ps *peerSet) BestPeer() *Peer {
+// The peers of unknown total difficulty are only picked when no other peer is
+// left, the one with the highest root block first.
+func (ps *PeerSet) BestPeer() *Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
 	var (
 		bestPeer      *Peer
 		bestTotalDiff *big.Int
+		fallback      *Peer
+		fallbackTip   *p2p.RootTipUpdate
 	)
 
 	for _, p := range ps.peers {
-		if head := p.RootHead(); head != nil && (bestPeer == nil || head.GetTotalDifficulty().Cmp(bestTotalDiff) > 0) {
-			bestPeer, bestTotalDiff = p, head.GetTotalDifficulty()
+		tip := p.AdvertisedTip()
+		if tip == nil {
+			continue
+		}
+		if tip.TotalDifficulty == nil {
+			if fallback == nil || tip.Number > fallbackTip.Number {
+				fallback, fallbackTip = p, tip
+			}
+			continue
+		}
+		if bestPeer == nil || tip.TotalDifficulty.Cmp(bestTotalDiff) > 0 {
+			bestPeer, bestTotalDiff = p, tip.TotalDifficulty
 		}
 	}
+	if bestPeer == nil {
+		return fallback
+	}
 	return bestPeer
 }
 
+// PeersWithoutTx retrieves the peers which do not know the transaction hash.
+func (ps *PeerSet) PeersWithoutTx(hash common.Hash) []*Peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	peers := make([]*Peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		if !p.KnownTransaction(hash) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// RandomPeers retrieves up to n peers picked at random.
+func (ps *PeerSet) RandomPeers(n int) []*Peer {
+	peers := ps.Peers()
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if n < len(peers) {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// FastestPeers retrieves up to n peers by increasing latency, for requests
+// which must be answered quickly. Peers whose latency is not measured yet
+// come last.
+func (ps *PeerSet) FastestPeers(n int) []*Peer {
+	peers := ps.Peers()
+	latencies := make(map[*Peer]time.Duration, len(peers))
+	for _, p := range peers {
+		if latency, ok := p.Latency(); ok {
+			latencies[p] = latency
+		}
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		li, iok := latencies[peers[i]]
+		lj, jok := latencies[peers[j]]
+		if iok != jok {
+			return iok
+		}
+		return li < lj
+	})
+	if n < len(peers) {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// BroadcastNewRootBlock announces the root block to the peers which neither
+// know it nor have a higher tip, and returns how many peers it was sent to.
+func (ps *PeerSet) BroadcastNewRootBlock(header *types.RootBlockHeader) int {
+	hash, sent := header.Hash(), 0
+	for _, p := range ps.Peers() {
+		if p.KnownBlock(hash) {
+			continue
+		}
+		if head := p.RootHead(); head != nil && header.Number <= head.Number {
+			continue
+		}
+		p.MarkBlock(hash)
+		p.AsyncSendNewTip(0, &p2p.Tip{RootBlockHeader: header})
+		sent++
+	}
+	return sent
+}
+
+// AllInfo returns the info of every peer, ordered by peer ID.
+func (ps *PeerSet) AllInfo() []*PeerInfo {
+	peers := ps.Peers()
+	infos := make([]*PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		infos = append(infos, p.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
 // Close disconnects all peers.
 // No new peers can be registered after Close has returned.
-func (ps *peerSet) Close() {
+func (ps *PeerSet) Close() {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
 
 	for _, p := range ps.peers {
-		p.Disconnect(p2p.DiscQuitting)
+		p.Peer.Disconnect(p2p.DiscQuitting)
 	}
 	ps.closed = true
 }
@@ -0,0 +1,150 @@
+package master
+
+import (
+	"fmt"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+)
+
+// decodedOps are the ops whose commands handleMsg decodes itself, with the
+// serializer of the peer. The data of the other ops is handed on as is, to
+// the slaves or the registered handlers, which decode it with the default
+// serializer.
+var decodedOps = map[p2p.P2PCommandOp]bool{
+	p2p.DisconnectMsg:                             true,
+	p2p.Ping:                                      true,
+	p2p.Pong:                                      true,
+	p2p.CapabilitiesMsg:                           true,
+	p2p.GetShardMasksResponseMsg:                  true,
+	p2p.NewTipMsg:                                 true,
+	p2p.RootTipUpdateMsg:                          true,
+	p2p.GetTransactionsRequestMsg:                 true,
+	p2p.GetTransactionsResponseMsg:                true,
+	p2p.GetRootBlockHeaderListRequestMsg:          true,
+	p2p.GetRootBlockHeaderListResponseMsg:         true,
+	p2p.GetRootBlockHeadersRequestMsg:             true,
+	p2p.GetRootBlockHeadersResponseMsg:            true,
+	p2p.GetRootBlockRequestMsg:                    true,
+	p2p.GetRootBlockResponseMsg:                   true,
+	p2p.GetRootBlockListRequestMsg:                true,
+	p2p.GetRootBlockListResponseMsg:               true,
+	p2p.GetRootBlockHeaderListWithSkipRequestMsg:  true,
+	p2p.GetRootBlockHeaderListWithSkipResponseMsg: true,
+	p2p.GetMinorBlockHeadersRequestMsg:            true,
+	p2p.GetMinorBlockHeadersResponseMsg:           true,
+	p2p.GetMinorBlockRequestMsg:                   true,
+	p2p.GetMinorBlockResponseMsg:                  true,
+	p2p.GetAccountDataRequestMsg:                  true,
+	p2p.GetAccountDataResponseMsg:                 true,
+}
+
+// setSerializer records the serializer negotiated with the peer in the
+// handshake, the messages exchanged from then on are encoded with it.
+func (p *Peer) setSerializer(name string, s p2p.Serializer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if name == p2p.DefaultSerializerName {
+		p.serializerName, p.serializer = "", nil
+		return
+	}
+	p.serializerName, p.serializer = name, s
+}
+
+// Serializer returns the name of the serializer run with the peer.
+func (p *Peer) Serializer() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.serializer == nil {
+		return p2p.DefaultSerializerName
+	}
+	return p.serializerName
+}
+
+// customSerializer returns the serializer run with the peer, nil if it is
+// the default one, which needs no transcoding.
+func (p *Peer) customSerializer() p2p.Serializer {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.serializer
+}
+
+// codec returns the serializer run with the peer.
+func (p *Peer) codec() p2p.Serializer {
+	if s := p.customSerializer(); s != nil {
+		return s
+	}
+	return p2p.DefaultSerializer
+}
+
+// decode decodes the data of a message read from the peer into v, with the
+// serializer run with the peer.
+func (p *Peer) decode(qkcMsg *p2p.QKCMsg, v interface{}) error {
+	return p.codec().Decode(qkcMsg.Op, qkcMsg.Data, v)
+}
+
+// sendCmd writes payload as the command of op to w, encoded with the
+// serializer run with the peer. It fails if op has no registered command.
+func (p *Peer) sendCmd(w p2p.MsgWriter, op p2p.P2PCommandOp, rpcID uint64, metadata p2p.Metadata, payload interface{}) error {
+	if !p2p.HasCommand(op) {
+		return fmt.Errorf("op %d has no registered command", op)
+	}
+	data, err := p.codec().Encode(op, payload)
+	if err != nil {
+		return err
+	}
+	msg, err := p2p.MakeMsgWithSerializedData(op, rpcID, metadata, data)
+	if err != nil {
+		return err
+	}
+	return w.WriteMsg(msg)
+}
+
+// decodeData returns the data of a message read from the peer encoded with
+// the default serializer, for the data handed on as is to the slaves and the
+// registered handlers.
+func (p *Peer) decodeData(qkcMsg *p2p.QKCMsg) ([]byte, error) {
+	s := p.customSerializer()
+	if s == nil {
+		return qkcMsg.Data, nil
+	}
+	return p2p.Transcode(qkcMsg.Op, uint32(p.version), qkcMsg.Data, s, p2p.DefaultSerializer)
+}
+
+// serialized returns w re-encoding the messages written to the peer, built
+// with the default serializer, with its serializer, or w itself if that is
+// the default one. The data of the messages relayed from the slaves is only
+// encoded with the default serializer.
+func (p *Peer) serialized(w p2p.MsgWriter) p2p.MsgWriter {
+	if s := p.customSerializer(); s != nil {
+		return &serializingWriter{MsgWriter: w, version: uint32(p.version), serializer: s}
+	}
+	return w
+}
+
+// serializingWriter transcodes the messages, built with the default
+// serializer, to the serializer of the peer.
+type serializingWriter struct {
+	p2p.MsgWriter
+	version    uint32
+	serializer p2p.Serializer
+}
+
+func (w *serializingWriter) WriteMsg(msg p2p.Msg) error {
+	msg, err := p2p.TranscodeMsg(msg, w.version, p2p.DefaultSerializer, w.serializer)
+	if err != nil {
+		return err
+	}
+	return w.MsgWriter.WriteMsg(msg)
+}
+
+// WriteMsgs keeps the batches of the underlying writer.
+func (w *serializingWriter) WriteMsgs(msgs []p2p.Msg) error {
+	encoded := make([]p2p.Msg, len(msgs))
+	for i, msg := range msgs {
+		var err error
+		if encoded[i], err = p2p.TranscodeMsg(msg, w.version, p2p.DefaultSerializer, w.serializer); err != nil {
+			return err
+		}
+	}
+	return p2p.WriteMsgs(w.MsgWriter, encoded)
+}
@@ -0,0 +1,67 @@
+package master
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/serialize"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// jsonSerializer encodes the commands as JSON.
+type jsonSerializer struct{}
+
+func (jsonSerializer) Encode(op p2p.P2PCommandOp, v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Decode(op p2p.P2PCommandOp, data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestPeerSerializer(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	assert.Equal(t, p2p.DefaultSerializerName, peer.Serializer())
+
+	// the messages written are encoded with the serializer of the peer
+	peer.setSerializer("json", jsonSerializer{})
+	assert.Equal(t, "json", peer.Serializer())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- peer.SendPong(common.Hash{1})
+	}()
+	msg, err := app.ReadMsg()
+	assert.NoError(t, err)
+	payload, err := ioutil.ReadAll(msg.Payload)
+	assert.NoError(t, err)
+	assert.NoError(t, <-errc)
+	qkcMsg, err := p2p.DecodeQKCMsg(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, p2p.Pong, qkcMsg.Op)
+	var pong p2p.PingPongCommand
+	assert.NoError(t, json.Unmarshal(qkcMsg.Data, &pong))
+	assert.Equal(t, common.Hash{1}, pong.Message)
+
+	// the commands read are decoded with it by the handlers
+	data, err := json.Marshal(p2p.PingPongCommand{Message: common.Hash{2}})
+	assert.NoError(t, err)
+	var ping p2p.PingPongCommand
+	assert.NoError(t, peer.decode(&p2p.QKCMsg{Op: p2p.Ping, Data: data}, &ping))
+	assert.Equal(t, common.Hash{2}, ping.Message)
+
+	// and the data handed on as is re-encoded with the default serializer
+	data, err = peer.decodeData(&p2p.QKCMsg{Op: p2p.Ping, Data: data})
+	assert.NoError(t, err)
+	ping = p2p.PingPongCommand{}
+	assert.NoError(t, serialize.DeserializeFromBytes(data, &ping))
+	assert.Equal(t, common.Hash{2}, ping.Message)
+
+	peer.setSerializer(p2p.DefaultSerializerName, p2p.DefaultSerializer)
+	assert.Equal(t, p2p.DefaultSerializerName, peer.Serializer())
+	assert.Nil(t, peer.customSerializer())
+}
@@ -0,0 +1,322 @@
+package master
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSetPeer(td int64) *Peer {
+	_, net := p2p.MsgPipe()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	peer.SetRootHead(&types.RootBlockHeader{ToTalDifficulty: big.NewInt(td)})
+	return peer
+}
+
+// unregisterAll stops the broadcast loops of the peers, Close would wait on
+// their unstarted connections.
+func unregisterAll(ps *PeerSet) {
+	for _, p := range ps.Peers() {
+		ps.Unregister(p.id)
+	}
+}
+
+func TestPeerSetSelection(t *testing.T) {
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+	assert.Nil(t, ps.BestPeer())
+
+	peers := []*Peer{newTestSetPeer(10), newTestSetPeer(30), newTestSetPeer(20)}
+	for _, p := range peers {
+		assert.NoError(t, ps.Register(p))
+	}
+	assert.Equal(t, errAlreadyRegistered, ps.Register(peers[0]))
+	assert.Equal(t, peers[1], ps.BestPeer())
+
+	tx := common.Hash{1}
+	peers[0].MarkTransaction(tx)
+	without := ps.PeersWithoutTx(tx)
+	assert.Len(t, without, 2)
+	assert.NotContains(t, without, peers[0])
+
+	assert.Len(t, ps.RandomPeers(2), 2)
+	assert.ElementsMatch(t, peers, ps.RandomPeers(10))
+
+	assert.NoError(t, ps.Unregister(peers[1].id))
+	assert.Equal(t, peers[2], ps.BestPeer())
+	assert.Equal(t, errNotRegistered, ps.Unregister(peers[1].id))
+}
+
+func TestPeerSetConcurrentAccess(t *testing.T) {
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+		tx   = common.Hash{1}
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ps.BestPeer()
+				ps.RandomPeers(3)
+				for _, p := range ps.PeersWithoutTx(tx) {
+					p.MarkTransaction(tx)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		p := newTestSetPeer(int64(i))
+		assert.NoError(t, ps.Register(p))
+		if i%2 == 0 {
+			assert.NoError(t, ps.Unregister(p.id))
+		}
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, 50, ps.Len())
+	assert.Equal(t, int64(99), ps.BestPeer().RootHead().GetTotalDifficulty().Int64())
+}
+
+func TestBroadcastNewRootBlock(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 5, nil, NewFakeSynchronizer(1), nil)
+	header := pm.rootBlockChain.CurrentBlock().Header()
+
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+	_, netA := p2p.MsgPipe()
+	appB, netB := p2p.MsgPipe()
+	defer appB.Close()
+	announcer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), netA)
+	other := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), netB)
+	assert.NoError(t, ps.Register(announcer))
+	assert.NoError(t, ps.Register(other))
+
+	// the block came from announcer, only the other peer needs it
+	assert.NoError(t, pm.HandleNewRootTip(&p2p.Tip{RootBlockHeader: header}, announcer))
+	assert.Equal(t, 1, ps.BroadcastNewRootBlock(header))
+	if _, err := ExpectMsg(appB, p2p.NewTipMsg, p2p.Metadata{}, &p2p.Tip{RootBlockHeader: header}); err != nil {
+		t.Fatalf("tip mismatch: %v", err)
+	}
+	// nobody is sent the block twice
+	assert.Equal(t, 0, ps.BroadcastNewRootBlock(header))
+	assert.True(t, other.KnownBlock(header.Hash()))
+}
+
+func TestPeerSetAllInfo(t *testing.T) {
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+	peers := []*Peer{newTestSetPeer(10), newTestSetPeer(20)}
+	for _, p := range peers {
+		assert.NoError(t, ps.Register(p))
+	}
+	header := &types.RootBlockHeader{Number: 12, ToTalDifficulty: big.NewInt(30)}
+	peers[0].hello = &p2p.HelloCmd{Version: 1, NetWorkID: 3, RootBlockHeader: header}
+	peers[0].setCapabilities([]string{p2p.CapTxAnnounce, p2p.CapCrossShardTxList})
+
+	info := peers[0].Info()
+	assert.Equal(t, peers[0].id, info.ID)
+	assert.Equal(t, peers[0].Node().String(), info.Enode)
+	assert.Equal(t, uint32(1), info.Version)
+	assert.Equal(t, uint32(3), info.NetworkID)
+	assert.Equal(t, uint64(12), info.RootNumber)
+	assert.Equal(t, big.NewInt(30), info.RootTotalDifficulty)
+	assert.False(t, info.Snappy)
+	assert.Equal(t, []string{p2p.CapTxAnnounce, p2p.CapCrossShardTxList}, info.Capabilities)
+
+	// peers which have not said hello yet are listed as well
+	infos := ps.AllInfo()
+	assert.Len(t, infos, 2)
+	assert.True(t, infos[0].ID < infos[1].ID)
+	for _, i := range infos {
+		if i.ID == peers[1].id {
+			assert.Zero(t, i.Version)
+			assert.Nil(t, i.RootTotalDifficulty)
+		}
+	}
+}
+
+func TestRootTipUpdateBestPeer(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+
+	peers := []*Peer{newTestSetPeer(10), newTestSetPeer(20)}
+	for _, p := range peers {
+		assert.NoError(t, ps.Register(p))
+	}
+	assert.Equal(t, peers[1], ps.BestPeer())
+
+	// a reorg of the first peer to a heavier chain makes it the best peer
+	tip := &p2p.RootTipUpdate{Number: 3, Hash: common.Hash{1}, TotalDifficulty: big.NewInt(30)}
+	assert.NoError(t, pm.HandleRootTipUpdate(tip, peers[0]))
+	assert.Equal(t, tip, peers[0].AdvertisedTip())
+	assert.True(t, peers[0].KnownBlock(tip.Hash))
+	assert.Equal(t, peers[0], ps.BestPeer())
+
+	assert.NoError(t, pm.HandleRootTipUpdate(&p2p.RootTipUpdate{Number: 4, Hash: common.Hash{2}, TotalDifficulty: big.NewInt(40)}, peers[1]))
+	assert.Equal(t, peers[1], ps.BestPeer())
+
+	assert.Error(t, pm.HandleRootTipUpdate(&p2p.RootTipUpdate{Number: 2, Hash: common.Hash{3}, TotalDifficulty: big.NewInt(25)}, peers[0]))
+	assert.Error(t, pm.HandleRootTipUpdate(&p2p.RootTipUpdate{Number: 5, Hash: common.Hash{4}}, peers[0]))
+	assert.Equal(t, tip, peers[0].AdvertisedTip())
+}
+
+func TestBestPeerUnknownTotalDifficulty(t *testing.T) {
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+
+	// the first peer only sends the difficulty of its blocks
+	_, net := p2p.MsgPipe()
+	perBlock := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	perBlock.SetRootHead(&types.RootBlockHeader{Number: 9, Difficulty: big.NewInt(100), ToTalDifficulty: big.NewInt(100)})
+	assert.Nil(t, perBlock.TotalDifficulty())
+	_, net = p2p.MsgPipe()
+	missing := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	missing.SetRootHead(&types.RootBlockHeader{Number: 5})
+	assert.Nil(t, missing.TotalDifficulty())
+
+	// peers of unknown total difficulty are picked when there is no other
+	assert.NoError(t, ps.Register(perBlock))
+	assert.NoError(t, ps.Register(missing))
+	assert.Equal(t, perBlock, ps.BestPeer())
+
+	known := newTestSetPeer(10)
+	assert.Equal(t, big.NewInt(10), known.TotalDifficulty())
+	assert.NoError(t, ps.Register(known))
+	assert.Equal(t, known, ps.BestPeer())
+
+	// until they advertise one in a tip update
+	pm, _ := newTestProtocolManagerMust(t, 0, nil, NewFakeSynchronizer(1), nil)
+	assert.NoError(t, pm.HandleRootTipUpdate(&p2p.RootTipUpdate{Number: 10, Hash: common.Hash{1}, TotalDifficulty: big.NewInt(1000)}, perBlock))
+	assert.Equal(t, big.NewInt(1000), perBlock.TotalDifficulty())
+	assert.Equal(t, perBlock, ps.BestPeer())
+
+	// a genesis tip carries its difficulty as its total difficulty
+	_, net = p2p.MsgPipe()
+	genesis := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	genesis.SetRootHead(&types.RootBlockHeader{Difficulty: big.NewInt(5), ToTalDifficulty: big.NewInt(5)})
+	assert.Equal(t, big.NewInt(5), genesis.TotalDifficulty())
+}
+
+func TestAdvertiseTip(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	defer peer.close()
+
+	tip := &p2p.RootTipUpdate{Number: 7, Hash: common.Hash{7}, TotalDifficulty: big.NewInt(70)}
+	go peer.advertiseTip(20*time.Millisecond, func() *p2p.RootTipUpdate { return tip })
+
+	// nothing is sent until the peer advertises the capability
+	peer.notifyTipChanged()
+	received := make(chan p2p.Msg, 1)
+	go func() {
+		if msg, err := app.ReadMsg(); err == nil {
+			received <- msg
+		}
+	}()
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message before the capability: %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the pending read above gets the next update, on tip change or interval
+	peer.setCapabilities([]string{p2p.CapRootTipUpdate})
+	peer.notifyTipChanged()
+	select {
+	case msg := <-received:
+		body, err := p2p.ReadPayload(msg)
+		assert.NoError(t, err)
+		qkcMsg, err := p2p.DecodeQKCMsg(body)
+		assert.NoError(t, err)
+		assert.Equal(t, p2p.RootTipUpdateMsg, qkcMsg.Op)
+	case <-time.After(time.Second):
+		t.Fatal("root tip update not sent")
+	}
+	// and the interval keeps sending it
+	if _, err := ExpectMsg(app, p2p.RootTipUpdateMsg, p2p.Metadata{}, tip); err != nil {
+		t.Errorf("periodic update mismatch: %v", err)
+	}
+}
+
+func TestPeerLatency(t *testing.T) {
+	peer := newTestSetPeer(0)
+	_, ok := peer.Latency()
+	assert.False(t, ok)
+
+	start := time.Unix(1560000000, 0)
+	pings := []common.Hash{{1}, {2}, {3}}
+	for i, m := range pings {
+		peer.pings[m] = start.Add(time.Duration(i) * time.Second)
+	}
+	// the first round trip seeds the average
+	assert.True(t, peer.recordPong(pings[0], start.Add(100*time.Millisecond)))
+	latency, ok := peer.Latency()
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, latency)
+
+	// pongs arriving out of order are matched with their own ping
+	assert.True(t, peer.recordPong(pings[2], start.Add(2*time.Second+600*time.Millisecond)))
+	latency, _ = peer.Latency()
+	assert.Equal(t, 200*time.Millisecond, latency)
+	assert.True(t, peer.recordPong(pings[1], start.Add(time.Second+200*time.Millisecond)))
+	latency, _ = peer.Latency()
+	assert.Equal(t, 200*time.Millisecond, latency)
+
+	// duplicated and unsolicited pongs leave the average alone
+	assert.False(t, peer.recordPong(pings[1], start.Add(10*time.Second)))
+	assert.False(t, peer.recordPong(common.Hash{4}, start.Add(10*time.Second)))
+	latency, _ = peer.Latency()
+	assert.Equal(t, 200*time.Millisecond, latency)
+	assert.Equal(t, int64(200), *peer.Info().LatencyMs)
+}
+
+func TestPendingPingsBounded(t *testing.T) {
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	peer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), net)
+	go func() {
+		for i := 0; i < maxPendingPings+2; i++ {
+			peer.SendPing()
+		}
+	}()
+	for i := 0; i < maxPendingPings+2; i++ {
+		if _, err := ExpectMsg(app, p2p.Ping, p2p.Metadata{}, nil); err != nil {
+			t.Fatalf("ping mismatch: %v", err)
+		}
+	}
+	peer.pingLock.Lock()
+	defer peer.pingLock.Unlock()
+	assert.Len(t, peer.pings, maxPendingPings)
+}
+
+func TestFastestPeers(t *testing.T) {
+	ps := NewPeerSet()
+	defer unregisterAll(ps)
+
+	peers := []*Peer{newTestSetPeer(0), newTestSetPeer(0), newTestSetPeer(0)}
+	for _, p := range peers {
+		assert.NoError(t, ps.Register(p))
+	}
+	peers[0].latency = 300 * time.Millisecond
+	peers[2].latency = 100 * time.Millisecond
+	assert.Equal(t, []*Peer{peers[2], peers[0], peers[1]}, ps.FastestPeers(3))
+	assert.Equal(t, []*Peer{peers[2]}, ps.FastestPeers(1))
+}
@@ -23,39 +23,167 @@ type SlaveConnManager struct {
 	clientPool         []rpc.ISlaveConn
 	branchToSlaveConns map[uint32][]rpc.ISlaveConn
 	logInfo            string
+
+	// pending are the optional slaves not connected yet, ready is set once
+	// the critical ones are connected and healthy.
+	pending      []rpc.ISlaveConn
+	ready        bool
+	dialer       *slaveDialer
+	fullShardIds []uint32
+	mu           sync.RWMutex
+}
+
+// SlaveReadiness tells whether the master may serve traffic, which needs
+// every critical slave, and which slaves it is connected to.
+type SlaveReadiness struct {
+	Ready     bool     `json:"ready"`
+	Connected []string `json:"connected"`
+	Pending   []string `json:"pending"` // optional slaves not connected yet
 }
 
 func (s *SlaveConnManager) InitConnManager(cfg *config.ClusterConfig) error {
-	s.clientPool = make([]rpc.ISlaveConn, 0, len(cfg.SlaveList))
+	conns := make([]rpc.ISlaveConn, 0, len(cfg.SlaveList))
+	critical := make(map[string]bool)
+	for _, cfg := range cfg.SlaveList {
+		client := NewSlaveConn(cfg.Address(), cfg.ChainMaskList, cfg.ID)
+		client.disabledShards = cfg.DisabledShards
+		conns = append(conns, client)
+		critical[cfg.ID] = cfg.Critical
+	}
+	return s.connectSlaves(newSlaveDialer(cfg.Master), cfg.Quarkchain.GetGenesisShardIds(), conns, critical)
+}
+
+// connectSlaves connects the critical slaves, failing if any of them stays
+// unreachable, the optional ones are left to ConnectPendingSlaves. Without
+// any slave marked critical, all of them are. The master is ready once
+// CheckSlavesHealth succeeds.
+func (s *SlaveConnManager) connectSlaves(dialer *slaveDialer, fullShardIds []uint32, conns []rpc.ISlaveConn, critical map[string]bool) error {
+	s.clientPool = make([]rpc.ISlaveConn, 0, len(conns))
 	s.branchToSlaveConns = make(map[uint32][]rpc.ISlaveConn)
 	s.logInfo = "slave connection manager"
+	s.dialer, s.fullShardIds = dialer, fullShardIds
 
-	fullShardIds := cfg.Quarkchain.GetGenesisShardIds()
-	for _, cfg := range cfg.SlaveList {
-		target := fmt.Sprintf("%s:%d", cfg.IP, cfg.Port)
-		client := NewSlaveConn(target, cfg.ChainMaskList, cfg.ID)
-		s.clientPool = append(s.clientPool, client)
-
-		id, chainMaskList, err := client.SendPing()
-		if err != nil {
-			return err
+	anyCritical := false
+	for _, c := range critical {
+		anyCritical = anyCritical || c
+	}
+	for _, conn := range conns {
+		if anyCritical && !critical[conn.GetSlaveID()] {
+			s.pending = append(s.pending, conn)
+			continue
 		}
-		if err := checkPing(client, id, chainMaskList); err != nil {
+		if err := s.pingSlave(conn); err != nil {
 			return err
 		}
-		for _, fullShardID := range fullShardIds {
-			if client.HasShard(fullShardID) {
-				s.branchToSlaveConns[fullShardID] = append(s.branchToSlaveConns[fullShardID], client)
-				log.Info(s.logInfo, "branch:", fullShardID, "is run by slave", client.GetSlaveID())
-			}
+		s.addSlave(conn)
+	}
+	return nil
+}
+
+// CheckSlavesHealth asks the connected slaves, the critical ones at startup,
+// for their health, and marks the master ready if all of them are healthy.
+func (s *SlaveConnManager) CheckSlavesHealth() error {
+	for _, conn := range s.GetSlaveConns() {
+		if err := conn.CheckHealth(); err != nil {
+			return fmt.Errorf("slave %s unhealthy: %w", conn.GetSlaveID(), err)
+		}
+	}
+	s.mu.Lock()
+	s.ready = true
+	s.mu.Unlock()
+	return nil
+}
+
+// pingSlave waits for conn to answer a ping with its id and chain masks.
+func (s *SlaveConnManager) pingSlave(conn rpc.ISlaveConn) error {
+	id, chainMaskList, err := s.dialer.ping(conn)
+	if err != nil {
+		return err
+	}
+	return checkPing(conn, id, chainMaskList)
+}
+
+// addSlave routes the shards of conn to it.
+func (s *SlaveConnManager) addSlave(conn rpc.ISlaveConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientPool = append(s.clientPool, conn)
+	for _, fullShardID := range s.fullShardIds {
+		if conn.HasShard(fullShardID) {
+			s.branchToSlaveConns[fullShardID] = append(s.branchToSlaveConns[fullShardID], conn)
+			log.Info(s.logInfo, "branch:", fullShardID, "is run by slave", conn.GetSlaveID())
 		}
 	}
 	s.count = len(s.clientPool)
+	for i, pending := range s.pending {
+		if pending == conn {
+			s.pending = append(s.pending[:i:i], s.pending[i+1:]...)
+			break
+		}
+	}
+}
 
-	return nil
+// ConnectPendingSlaves connects the optional slaves in the background, each
+// once it answers its ping, ready, which prepares it to serve traffic,
+// succeeds and it reports healthy. Slaves failing any of them are retried
+// until quit is closed.
+func (s *SlaveConnManager) ConnectPendingSlaves(ready func(rpc.ISlaveConn) error, quit <-chan struct{}) {
+	s.mu.RLock()
+	pending := append([]rpc.ISlaveConn(nil), s.pending...)
+	s.mu.RUnlock()
+	for _, conn := range pending {
+		go s.connectPendingSlave(conn, ready, quit)
+	}
+}
+
+// connectPendingSlave retries connecting the optional slave conn, waiting
+// longer after each failure, until it succeeds or quit is closed.
+func (s *SlaveConnManager) connectPendingSlave(conn rpc.ISlaveConn, ready func(rpc.ISlaveConn) error, quit <-chan struct{}) {
+	for n := 1; ; n++ {
+		err := s.pingSlave(conn)
+		if err == nil {
+			err = ready(conn)
+		}
+		if err == nil {
+			err = conn.CheckHealth()
+		}
+		if err == nil {
+			s.addSlave(conn)
+			log.Info("Optional slave connected", "slave", conn.GetSlaveID())
+			return
+		}
+		delay := s.dialer.delay(n)
+		log.Warn("Optional slave not connected, retrying", "slave", conn.GetSlaveID(), "attempt", n, "delay", delay, "err", err)
+		s.dialer.sleep(delay)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+	}
+}
+
+// Readiness returns the aggregate state of the slave connections.
+func (s *SlaveConnManager) Readiness() SlaveReadiness {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	readiness := SlaveReadiness{
+		Ready:     s.ready,
+		Connected: make([]string, 0, len(s.clientPool)),
+		Pending:   make([]string, 0, len(s.pending)),
+	}
+	for _, conn := range s.clientPool {
+		readiness.Connected = append(readiness.Connected, conn.GetSlaveID())
+	}
+	for _, conn := range s.pending {
+		readiness.Pending = append(readiness.Pending, conn.GetSlaveID())
+	}
+	return readiness
 }
 
 func (c *SlaveConnManager) GetOneSlaveConnById(fullShardId uint32) rpc.ISlaveConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if conns, ok := c.branchToSlaveConns[fullShardId]; ok {
 		return conns[0]
 	}
@@ -63,6 +191,8 @@ func (c *SlaveConnManager) GetOneSlaveConnById(fullShardId uint32) rpc.ISlaveCon
 }
 
 func (c *SlaveConnManager) GetSlaveConnsById(fullShardId uint32) []rpc.ISlaveConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if conns, ok := c.branchToSlaveConns[fullShardId]; ok {
 		return conns
 	}
@@ -70,10 +200,14 @@ func (c *SlaveConnManager) GetSlaveConnsById(fullShardId uint32) []rpc.ISlaveCon
 }
 
 func (c *SlaveConnManager) GetSlaveConns() []rpc.ISlaveConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.clientPool
 }
 
 func (c *SlaveConnManager) ConnCount() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.count
 }
 
@@ -84,6 +218,10 @@ type SlaveConnection struct {
 	slaveID       string
 	logInfo       string
 	mu            sync.Mutex
+
+	// disabledShards are covered by shardMaskList but not served by the
+	// slave for now, requests for them are routed elsewhere or fail.
+	disabledShards []uint32
 }
 
 // create slave connection manager
@@ -131,6 +269,13 @@ func (s *SlaveConnection) HeartBeat() bool {
 	return false
 }
 
+// CheckHealth asks the slave for its health once, which fails until it has
+// created its shards.
+func (s *SlaveConnection) CheckHealth() error {
+	_, err := s.client.Call(s.target, &rpc.Request{Op: rpc.OpHeartBeat})
+	return err
+}
+
 func (s *SlaveConnection) MasterInfo(ip string, port uint16, rootTip *types.RootBlock) error {
 	if rootTip == nil {
 		return errors.New("send MasterInfo failed :rootTip is nil")
@@ -196,7 +341,14 @@ func (s *SlaveConnection) SendConnectToSlaves(slaveInfoLst []*rpc.SlaveInfo) err
 	return nil
 }
 
+// HasShard reports whether the slave serves fullShardID, which its chain masks
+// cover unless it is disabled.
 func (s *SlaveConnection) HasShard(fullShardID uint32) bool {
+	for _, id := range s.disabledShards {
+		if id == fullShardID {
+			return false
+		}
+	}
 	for _, chainMask := range s.shardMaskList {
 		if chainMask.ContainFullShardId(fullShardID) {
 			return true
@@ -591,6 +743,15 @@ func (s *SlaveConnection) AddTransactions(request *rpc.P2PRedirectRequest) error
 	return nil
 }
 
+func (s *SlaveConnection) AddXshardTxList(request *rpc.AddXshardTxListRequest) error {
+	bytes, err := serialize.SerializeToBytes(request)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Call(s.target, &rpc.Request{Op: rpc.OpAddXshardTxList, Data: bytes})
+	return err
+}
+
 func (s *SlaveConnection) GetMinorBlocks(request *rpc.P2PRedirectRequest) ([]byte, error) {
 	bytes, err := serialize.SerializeToBytes(request)
 	if err != nil {
@@ -0,0 +1,72 @@
+package master
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/cluster/config"
+	"github.com/QuarkChain/goquarkchain/cluster/rpc"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// slaveDialer pings a slave until it answers, waiting longer after each
+// failure, so that the master can start before its slaves.
+type slaveDialer struct {
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	attempts  int // 0 retries forever
+
+	sleep  func(time.Duration)
+	jitter func() float64 // in [0, 1)
+}
+
+func newSlaveDialer(cfg *config.MasterConfig) *slaveDialer {
+	if cfg == nil {
+		cfg = config.NewMasterConfig()
+	}
+	return &slaveDialer{
+		baseDelay: time.Duration(cfg.MasterToSlaveConnectRetryDelay * float32(time.Second)),
+		maxDelay:  time.Duration(cfg.MasterToSlaveConnectMaxDelay * float32(time.Second)),
+		attempts:  int(cfg.MasterToSlaveConnectAttempts),
+		sleep:     time.Sleep,
+		jitter:    rand.Float64,
+	}
+}
+
+// delay returns the wait after the failed attempt n, counted from 1. It
+// doubles from baseDelay up to maxDelay, and its second half is random so
+// that slaves started together are not hit in lockstep.
+func (d *slaveDialer) delay(n int) time.Duration {
+	delay := d.baseDelay
+	for i := 1; i < n && delay < d.maxDelay; i++ {
+		delay *= 2
+	}
+	if d.maxDelay > 0 && delay > d.maxDelay {
+		delay = d.maxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(d.jitter()*float64(delay-half))
+}
+
+// ping pings conn until it answers, and fails with the error of the last
+// attempt once the attempts are exhausted.
+func (d *slaveDialer) ping(conn rpc.ISlaveConn) ([]byte, []*types.ChainMask, error) {
+	for n := 1; ; n++ {
+		id, chainMaskList, err := conn.SendPing()
+		if err == nil {
+			if n > 1 {
+				log.Info("Slave reachable", "slave", conn.GetSlaveID(), "attempt", n)
+			}
+			return id, chainMaskList, nil
+		}
+		if d.attempts > 0 && n >= d.attempts {
+			log.Error("Giving up on slave", "slave", conn.GetSlaveID(), "attempt", n, "err", err)
+			return nil, nil, fmt.Errorf("slave %s unreachable after %d attempts: %w", conn.GetSlaveID(), n, err)
+		}
+		delay := d.delay(n)
+		log.Warn("Slave unreachable, retrying", "slave", conn.GetSlaveID(), "attempt", n, "delay", delay, "err", err)
+		d.sleep(delay)
+	}
+}
@@ -0,0 +1,176 @@
+package master
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/cluster/rpc"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/QuarkChain/goquarkchain/mocks/mock_master"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock records the sleeps of a slaveDialer instead of waiting.
+type fakeClock struct {
+	now    time.Duration
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.now += d
+	c.sleeps = append(c.sleeps, d)
+}
+
+func newTestSlaveDialer(clock *fakeClock, attempts int, jitter float64) *slaveDialer {
+	return &slaveDialer{
+		baseDelay: 100 * time.Millisecond,
+		maxDelay:  time.Second,
+		attempts:  attempts,
+		sleep:     clock.sleep,
+		jitter:    func() float64 { return jitter },
+	}
+}
+
+func TestSlaveDialerBackoff(t *testing.T) {
+	clock := new(fakeClock)
+	d := newTestSlaveDialer(clock, 0, 0)
+	// without jitter the delay is half of the doubling one, capped at 1s
+	want := []time.Duration{50, 100, 200, 400, 500, 500}
+	for i, w := range want {
+		assert.Equal(t, w*time.Millisecond, d.delay(i+1), "delay after attempt %d", i+1)
+	}
+	// the jitter spreads the delay over its second half
+	d.jitter = func() float64 { return 0.5 }
+	assert.Equal(t, 600*time.Millisecond, d.delay(4))
+	d.jitter = func() float64 { return 0.99 }
+	assert.True(t, d.delay(10) < time.Second)
+}
+
+func TestSlaveDialerRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	conn := mock_master.NewMockISlaveConn(ctrl)
+	conn.EXPECT().GetSlaveID().Return("S0").AnyTimes()
+
+	errDown := errors.New("connection refused")
+	masks := []*types.ChainMask{types.NewChainMask(2)}
+	gomock.InOrder(
+		conn.EXPECT().SendPing().Return(nil, nil, errDown).Times(3),
+		conn.EXPECT().SendPing().Return([]byte("S0"), masks, nil),
+	)
+	clock := new(fakeClock)
+	id, chainMaskList, err := newTestSlaveDialer(clock, 5, 0).ping(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("S0"), id)
+	assert.Equal(t, masks, chainMaskList)
+	assert.Equal(t, []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}, clock.sleeps)
+	assert.Equal(t, 350*time.Millisecond, clock.now)
+
+	// the last error is returned once the attempts are exhausted
+	conn.EXPECT().SendPing().Return(nil, nil, errDown).Times(3)
+	clock = new(fakeClock)
+	_, _, err = newTestSlaveDialer(clock, 3, 0).ping(conn)
+	assert.True(t, errors.Is(err, errDown), "got %v", err)
+	assert.Len(t, clock.sleeps, 2)
+}
+
+func newTestSlaveConn(ctrl *gomock.Controller, id string, mask uint32) *mock_master.MockISlaveConn {
+	masks := []*types.ChainMask{types.NewChainMask(mask)}
+	conn := mock_master.NewMockISlaveConn(ctrl)
+	conn.EXPECT().GetSlaveID().Return(id).AnyTimes()
+	conn.EXPECT().GetShardMaskList().Return(masks).AnyTimes()
+	conn.EXPECT().HasShard(gomock.Any()).DoAndReturn(func(fullShardID uint32) bool {
+		return masks[0].ContainFullShardId(fullShardID)
+	}).AnyTimes()
+	return conn
+}
+
+func TestConnectCriticalSlaves(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	fullShardIds := []uint32{0, 1 << 16}
+	errDown := errors.New("connection refused")
+
+	// the optional slave coming up late does not hold the critical one back
+	s0, s1 := newTestSlaveConn(ctrl, "S0", 2), newTestSlaveConn(ctrl, "S1", 3)
+	s0.EXPECT().SendPing().Return([]byte("S0"), s0.GetShardMaskList(), nil)
+	up := make(chan struct{})
+	s1.EXPECT().SendPing().DoAndReturn(func() ([]byte, []*types.ChainMask, error) {
+		<-up
+		return []byte("S1"), s1.GetShardMaskList(), nil
+	}).Times(3)
+	m := new(SlaveConnManager)
+	err := m.connectSlaves(newTestSlaveDialer(new(fakeClock), 3, 0), fullShardIds,
+		[]rpc.ISlaveConn{s0, s1}, map[string]bool{"S0": true})
+	assert.NoError(t, err)
+	assert.Equal(t, SlaveReadiness{Ready: false, Connected: []string{"S0"}, Pending: []string{"S1"}}, m.Readiness())
+	assert.Equal(t, s0, m.GetOneSlaveConnById(0))
+	assert.Nil(t, m.GetOneSlaveConnById(1<<16))
+
+	// the master is ready once the critical slave reports healthy shards
+	gomock.InOrder(
+		s0.EXPECT().CheckHealth().Return(errors.New("shards uninitialized")),
+		s0.EXPECT().CheckHealth().Return(nil),
+	)
+	assert.Error(t, m.CheckSlavesHealth())
+	assert.False(t, m.Readiness().Ready)
+	assert.NoError(t, m.CheckSlavesHealth())
+	assert.True(t, m.Readiness().Ready)
+
+	// the optional slave is retried until it is prepared and healthy
+	gomock.InOrder(
+		s1.EXPECT().CheckHealth().Return(errors.New("shards uninitialized")),
+		s1.EXPECT().CheckHealth().Return(nil),
+	)
+	ready := make(chan rpc.ISlaveConn, 3)
+	attempts := 0
+	quit := make(chan struct{})
+	defer close(quit)
+	m.ConnectPendingSlaves(func(conn rpc.ISlaveConn) error {
+		if attempts++; attempts == 1 {
+			return errDown
+		}
+		ready <- conn
+		return nil
+	}, quit)
+	close(up)
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-ready:
+			assert.Equal(t, s1, conn)
+		case <-time.After(time.Second):
+			t.Fatal("optional slave not connected")
+		}
+	}
+	for i := 0; m.GetOneSlaveConnById(1<<16) == nil; i++ {
+		if i == 100 {
+			t.Fatal("optional slave not routed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, SlaveReadiness{Ready: true, Connected: []string{"S0", "S1"}, Pending: []string{}}, m.Readiness())
+
+	// a critical slave staying unreachable fails the startup
+	s2, s3 := newTestSlaveConn(ctrl, "S2", 2), newTestSlaveConn(ctrl, "S3", 3)
+	s2.EXPECT().SendPing().Return(nil, nil, errDown).Times(3)
+	m = new(SlaveConnManager)
+	err = m.connectSlaves(newTestSlaveDialer(new(fakeClock), 3, 0), fullShardIds,
+		[]rpc.ISlaveConn{s2, s3}, map[string]bool{"S2": true})
+	assert.True(t, errors.Is(err, errDown), "got %v", err)
+	assert.False(t, m.Readiness().Ready)
+
+	// without any slave marked critical, all of them are
+	s4, s5 := newTestSlaveConn(ctrl, "S4", 2), newTestSlaveConn(ctrl, "S5", 3)
+	s4.EXPECT().SendPing().Return([]byte("S4"), s4.GetShardMaskList(), nil)
+	s5.EXPECT().SendPing().Return([]byte("S5"), s5.GetShardMaskList(), nil)
+	m = new(SlaveConnManager)
+	err = m.connectSlaves(newTestSlaveDialer(new(fakeClock), 3, 0), fullShardIds,
+		[]rpc.ISlaveConn{s4, s5}, map[string]bool{})
+	assert.NoError(t, err)
+	s4.EXPECT().CheckHealth().Return(nil)
+	s5.EXPECT().CheckHealth().Return(nil)
+	assert.NoError(t, m.CheckSlavesHealth())
+	assert.Equal(t, SlaveReadiness{Ready: true, Connected: []string{"S4", "S5"}, Pending: []string{}}, m.Readiness())
+}
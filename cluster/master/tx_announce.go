@@ -0,0 +1,120 @@
+package master
+
+import (
+	"fmt"
+
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/serialize"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// maxTxFetch is the maximum number of hashes in a transaction
+	// announcement or fetch request.
+	maxTxFetch = 256
+	// txCacheSize is the number of recent transactions kept to answer the
+	// fetches of peers they were announced to.
+	txCacheSize = 4096
+)
+
+// txCacheKey keys the cached transactions by the branch they were received
+// or broadcast with, a fetch is only answered with the transactions of its
+// shard.
+type txCacheKey struct {
+	branch uint32
+	hash   common.Hash
+}
+
+func (pm *ProtocolManager) cacheTransactions(branch uint32, txs []*types.Transaction) {
+	for _, tx := range txs {
+		pm.txCache.Add(txCacheKey{branch: branch, hash: tx.Hash()}, tx)
+	}
+}
+
+// announceTransactions sends the hashes of txs of the shard of branch which
+// the peer does not know yet to it, if it serves the shard. The transactions
+// are to be cached to answer its fetches.
+func (pm *ProtocolManager) announceTransactions(peer *Peer, branch uint32, txs []*types.Transaction) {
+	if !peer.ServesShard(branch) {
+		return
+	}
+	hashes := make([]common.Hash, 0, len(txs))
+	for _, tx := range txs {
+		if hash := tx.Hash(); !peer.KnownTransaction(hash) {
+			peer.MarkTransaction(hash)
+			hashes = append(hashes, hash)
+		}
+	}
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxTxFetch {
+			n = maxTxFetch
+		}
+		if err := peer.SendTransactionHashes(branch, hashes[:n]); err != nil {
+			log.Warn("Failed to announce transactions", "peer", peer.id, "err", err)
+			return
+		}
+		hashes = hashes[n:]
+	}
+}
+
+// HandleNewTransactionHashes fetches the announced transactions which are not
+// known locally from the announcing peer and hands them to the slaves.
+func (pm *ProtocolManager) HandleNewTransactionHashes(peer *Peer, branch uint32, data []byte) error {
+	var announce p2p.NewTransactionHashes
+	if err := serialize.DeserializeFromBytes(data, &announce); err != nil {
+		return err
+	}
+	if len(announce.Hashes) > maxTxFetch {
+		return fmt.Errorf("too many transaction hashes announced: %d", len(announce.Hashes))
+	}
+	requested := make(map[common.Hash]struct{}, len(announce.Hashes))
+	unknown := make([]common.Hash, 0, len(announce.Hashes))
+	for _, hash := range announce.Hashes {
+		peer.MarkTransaction(hash)
+		if _, ok := requested[hash]; ok || pm.txCache.Contains(txCacheKey{branch: branch, hash: hash}) {
+			continue
+		}
+		requested[hash] = struct{}{}
+		unknown = append(unknown, hash)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	txs, err := peer.RequestTransactions(branch, unknown)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if _, ok := requested[tx.Hash()]; !ok {
+			return fmt.Errorf("peer returned unrequested transaction %x", tx.Hash())
+		}
+	}
+	if len(txs) == 0 {
+		return nil
+	}
+	list, err := serialize.SerializeToBytes(&p2p.NewTransactionList{TransactionList: txs})
+	if err != nil {
+		return err
+	}
+	return pm.HandleNewTransactionListRequest(peer.id, 0, branch, list)
+}
+
+// HandleGetTransactionsRequest returns the cached transactions of the shard of
+// branch among the first maxTxFetch requested hashes.
+func (pm *ProtocolManager) HandleGetTransactionsRequest(branch uint32, req *p2p.GetTransactionsRequest) *p2p.GetTransactionsResponse {
+	hashes := req.Hashes
+	if len(hashes) > maxTxFetch {
+		hashes = hashes[:maxTxFetch]
+	}
+	resp := &p2p.GetTransactionsResponse{TransactionList: make([]*types.Transaction, 0, len(hashes))}
+	for _, hash := range hashes {
+		if tx, ok := pm.txCache.Get(txCacheKey{branch: branch, hash: hash}); ok {
+			resp.TransactionList = append(resp.TransactionList, tx.(*types.Transaction))
+		}
+	}
+	return resp
+}
@@ -0,0 +1,135 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/cluster/rpc"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/QuarkChain/goquarkchain/mocks/mock_master"
+	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/serialize"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTransactions(count int) []*types.Transaction {
+	key, _ := crypto.HexToECDSA("45a915e4d060149eb4365960e6a7a45f334393093061116b197e3240065ff2d8")
+	txs := make([]*types.Transaction, count)
+	for i := range txs {
+		txs[i] = newTestTransaction(key, uint64(i), 0)
+	}
+	return txs
+}
+
+func TestNewTransactionHashesDedup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	errc := make(chan error, 1)
+	fakeConnMngr := newFakeConnManager(1, ctrl)
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), fakeConnMngr)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	txs := newTestTransactions(3)
+	pm.cacheTransactions(branch, txs[:1])
+
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+
+	conn := fakeConnMngr.GetSlaveConns()[0].(*mock_master.MockISlaveConn)
+	conn.EXPECT().AddTransactions(gomock.Any()).DoAndReturn(func(req *rpc.P2PRedirectRequest) error {
+		var list p2p.NewTransactionList
+		assert.NoError(t, serialize.DeserializeFromBytes(req.Data, &list))
+		assert.Len(t, list.TransactionList, 2)
+		errc <- nil
+		return nil
+	}).Times(1)
+
+	// the cached and repeated hashes are not fetched
+	announce := &p2p.NewTransactionHashes{Hashes: []common.Hash{txs[0].Hash(), txs[1].Hash(), txs[2].Hash(), txs[1].Hash()}}
+	assert.NoError(t, p2p.SendQKCMsg(peer.app, p2p.NewTransactionHashesMsg, 0, p2p.Metadata{Branch: branch}, announce))
+	req := &p2p.GetTransactionsRequest{Hashes: []common.Hash{txs[1].Hash(), txs[2].Hash()}}
+	msg, err := ExpectMsg(peer.app, p2p.GetTransactionsRequestMsg, p2p.Metadata{Branch: branch}, req)
+	if err != nil {
+		t.Fatalf("fetch mismatch: %v", err)
+	}
+	resp := &p2p.GetTransactionsResponse{TransactionList: txs[1:]}
+	assert.NoError(t, p2p.SendQKCMsg(peer.app, p2p.GetTransactionsResponseMsg, msg.RpcID, p2p.Metadata{Branch: branch}, resp))
+	if err := waitChanTilErrorOrTimeout(errc, 2); err != nil {
+		t.Fatalf("transactions not added: %v", err)
+	}
+	for _, tx := range txs {
+		assert.True(t, peer.KnownTransaction(tx.Hash()))
+	}
+
+	// all of them are known now, announcing them again fetches nothing
+	data, err := serialize.SerializeToBytes(announce)
+	assert.NoError(t, err)
+	assert.NoError(t, pm.HandleNewTransactionHashes(peer.Peer, branch, data))
+}
+
+func TestGetTransactionsCap(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), nil)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	txs := newTestTransactions(maxTxFetch + 10)
+	pm.cacheTransactions(branch, txs)
+	hashes := make([]common.Hash, len(txs))
+	for i, tx := range txs {
+		hashes[i] = tx.Hash()
+	}
+
+	peer, err := newTestPeer("peer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer peer.close()
+	clientPeer := newTestClientPeer(int(qkcconfig.P2PProtocolVersion), peer.app)
+
+	go handleMsg(clientPeer)
+	res, err := clientPeer.RequestTransactions(branch, hashes)
+	assert.NoError(t, err)
+	assert.Len(t, res, maxTxFetch)
+	assert.Equal(t, hashes[maxTxFetch-1], res[maxTxFetch-1].Hash())
+
+	// unknown hashes are left out
+	go handleMsg(clientPeer)
+	res, err = clientPeer.RequestTransactions(branch, []common.Hash{{1}, hashes[0]})
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+
+	// oversized announcements are rejected without fetching
+	data, err := serialize.SerializeToBytes(&p2p.NewTransactionHashes{Hashes: hashes})
+	assert.NoError(t, err)
+	assert.Error(t, pm.HandleNewTransactionHashes(peer.Peer, branch, data))
+}
+
+func TestBroadcastTransactionsAnnounce(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, 15, nil, NewFakeSynchronizer(1), nil)
+	branch := pm.clusterConfig.Quarkchain.GetGenesisShardIds()[0]
+	txs := newTestTransactions(2)
+	list := &p2p.NewTransactionList{TransactionList: txs}
+	data, err := serialize.SerializeToBytes(list)
+	assert.NoError(t, err)
+
+	announcer, err := newTestPeer("announcer", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer announcer.close()
+	announcer.setCapabilities([]string{p2p.CapTxAnnounce})
+	legacy, err := newTestPeer("legacy", int(qkcconfig.P2PProtocolVersion), pm, true)
+	assert.NoError(t, err)
+	defer legacy.close()
+
+	// the peers supporting announcements get the hashes, the others the list
+	pm.BroadcastTransactions(&rpc.P2PRedirectRequest{Branch: branch, Data: data}, "")
+	announce := &p2p.NewTransactionHashes{Hashes: []common.Hash{txs[0].Hash(), txs[1].Hash()}}
+	if _, err := ExpectMsg(announcer.app, p2p.NewTransactionHashesMsg, p2p.Metadata{Branch: branch}, announce); err != nil {
+		t.Fatalf("announcement mismatch: %v", err)
+	}
+	if _, err := ExpectMsg(legacy.app, p2p.NewTransactionListMsg, p2p.Metadata{Branch: branch}, list); err != nil {
+		t.Fatalf("transaction list mismatch: %v", err)
+	}
+
+	// and the transactions are cached for the fetches of their shard only
+	req := &p2p.GetTransactionsRequest{Hashes: announce.Hashes}
+	assert.Len(t, pm.HandleGetTransactionsRequest(branch, req).TransactionList, 2)
+	assert.Empty(t, pm.HandleGetTransactionsRequest(branch+1, req).TransactionList)
+}
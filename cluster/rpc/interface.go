@@ -36,6 +36,7 @@ type ISlaveConn interface {
 	GetMinorBlockHeaderListWithSkip(req *P2PRedirectRequest) ([]byte, error)
 	HandleNewTip(request *HandleNewTipRequest) (bool, error)
 	HandleNewMinorBlock(request *P2PRedirectRequest) error
+	AddXshardTxList(request *AddXshardTxListRequest) error
 	AddBlockListForSync(request *AddBlockListForSyncRequest) (*ShardStatus, error)
 	GetSlaveID() string
 	GetShardMaskList() []*types.ChainMask
@@ -43,6 +44,7 @@ type ISlaveConn interface {
 	HasShard(fullShardID uint32) bool
 	SendPing() ([]byte, []*types.ChainMask, error)
 	HeartBeat() bool
+	CheckHealth() error
 	GetUnconfirmedHeaders() (*GetUnconfirmedHeadersResponse, error)
 	GetAccountData(address *account.Address, height *uint64) (*GetAccountDataResponse, error)
 	AddRootBlock(rootBlock *types.RootBlock, expectSwitch bool) error
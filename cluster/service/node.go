@@ -367,6 +367,29 @@ func (n *Node) stopWS() {
 	}
 }
 
+// RestartWS rebinds the websocket RPC endpoint to endpoint without touching
+// the other endpoints or the peers. If the new endpoint cannot be opened the
+// previous one is restored.
+func (n *Node) RestartWS(endpoint string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.server == nil {
+		return ErrNodeStopped
+	}
+	prev := n.config.WSEndpoint
+	n.stopWS()
+	n.config.WSEndpoint = endpoint
+	if err := n.startWS(n.rpcAPIs, n.config.WSModules, n.config.WSOrigins); err != nil {
+		n.config.WSEndpoint = prev
+		if rerr := n.startWS(n.rpcAPIs, n.config.WSModules, n.config.WSOrigins); rerr != nil {
+			n.log.Error("Failed to restore websocket endpoint", "url", prev, "err", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
 // startHTTP initializes and starts the HTTP RPC endpoint.
 func (n *Node) startHTTP(apis []rpc.API, modules []string, timeouts rpc.HTTPTimeouts) error {
 	// Short circuit if the HTTP endpoint isn't being exposed
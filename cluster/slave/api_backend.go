@@ -206,6 +206,9 @@ func (s *SlaveBackend) GetAccountData(address *account.Address, height *uint64)
 		err     error
 	)
 	for branch, shard := range s.shards {
+		if s.config.ShardDisabled(branch) {
+			continue
+		}
 		data := rpc.AccountBranchData{
 			Branch: branch,
 		}
@@ -236,6 +239,9 @@ func (s *SlaveBackend) GetAccountData(address *account.Address, height *uint64)
 }
 
 func (s *SlaveBackend) GetMinorBlock(hash common.Hash, height *uint64, branch uint32) (*types.MinorBlock, error) {
+	if s.config.ShardDisabled(branch) {
+		return nil, ErrShardDisabled(branch)
+	}
 	if shard, ok := s.shards[branch]; ok {
 		return shard.GetMinorBlock(hash, height)
 	}
@@ -8,3 +8,9 @@ import (
 func ErrMsg(str string) error {
 	return errors.New(fmt.Sprintf("incorrect branch when call %s", str))
 }
+
+// ErrShardDisabled is returned for the requests to a shard the slave config
+// disables.
+func ErrShardDisabled(branch uint32) error {
+	return fmt.Errorf("full shard %d is disabled on this slave", branch)
+}
@@ -8,17 +8,33 @@ import (
 	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/QuarkChain/goquarkchain/cluster/service"
 	"github.com/QuarkChain/goquarkchain/cmd/utils"
+	"github.com/QuarkChain/goquarkchain/internal/debug"
 	"github.com/QuarkChain/goquarkchain/params"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/naoina/toml"
 	"gopkg.in/urfave/cli.v1"
 	"io/ioutil"
+	"os"
+	"os/signal"
 	"reflect"
-	"strconv"
+	"syscall"
 	"unicode"
 )
 
 var (
 	ClusterConfigFlag = cli.StringFlag{Name: "cluster_config", Usage: "", Value: ""}
+
+	checkConfigCommand = cli.Command{
+		Action:    checkConfig,
+		Name:      "checkconfig",
+		Usage:     "Validate the cluster config and print the shard assignment",
+		ArgsUsage: "",
+		Category:  "MISCELLANEOUS COMMANDS",
+		Description: `
+The checkconfig command loads the cluster config like the cluster would,
+validates it and prints which slave serves each shard, without starting
+any service.`,
+	}
 )
 
 // These settings ensure that TOML keys use the same names as Go struct fields.
@@ -52,7 +68,28 @@ func loadConfig(file string, cfg *config.ClusterConfig) error {
 	if content, err = ioutil.ReadFile(file); err != nil {
 		return errors.New(file + ", " + err.Error())
 	}
-	return json.Unmarshal(content, cfg)
+	if err = json.Unmarshal(content, cfg); err != nil {
+		return err
+	}
+	return cfg.Validate()
+}
+
+// checkConfig is the action of checkConfigCommand.
+func checkConfig(ctx *cli.Context) error {
+	cfg := config.NewClusterConfig()
+	if file := ctx.GlobalString(ClusterConfigFlag.Name); file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.New(file + ", " + err.Error())
+		}
+		if err := json.Unmarshal(content, cfg); err != nil {
+			return err
+		}
+	}
+	utils.SetClusterConfig(ctx, cfg)
+	report, err := config.ValidateAndSummarize(cfg)
+	fmt.Print(report)
+	return err
 }
 
 func defaultNodeConfig() service.Config {
@@ -79,26 +116,24 @@ func makeConfigNode(ctx *cli.Context) (*service.Node, qkcConfig) {
 
 	ServiceName := ctx.GlobalString(utils.ServiceFlag.Name)
 	if ServiceName != clientIdentifier {
-		slv, err := cfg.Cluster.GetSlaveConfig(ServiceName)
+		slv, err := cfg.Cluster.GetSlaveConfig(config.SlaveIDFromEnv(ServiceName))
 		if err != nil {
 			utils.Fatalf("service type error: %v", err)
 		}
+		if err := slv.ApplyEnv(); err != nil {
+			utils.Fatalf("slave config error: %v", err)
+		}
+		if err := slv.Validate(); err != nil {
+			utils.Fatalf("slave config error: %v", err)
+		}
 		// set slave name and grpc endpoint
-		cfg.Service.Name = ServiceName
+		cfg.Service.Name = slv.ID
 		cfg.Cluster.Quarkchain.GRPCHost = slv.IP
 		cfg.Cluster.Quarkchain.GRPCPort = slv.Port
 
 		// set websocket endpoint
 		if ctx.GlobalBool(utils.WSEnableFlag.Name) {
-			sufPort, _ := strconv.Atoi(slv.ID[1:])
-			ip, port := slv.IP, slv.WSPort+uint16(sufPort)
-			if ctx.GlobalIsSet(utils.WSRPCHostFlag.Name) {
-				ip = ctx.GlobalString(utils.WSRPCHostFlag.Name)
-			}
-			if ctx.GlobalIsSet(utils.WSRPCPortFlag.Name) {
-				port = uint16(ctx.GlobalInt(utils.WSRPCPortFlag.Name))
-			}
-			cfg.Service.WSEndpoint = fmt.Sprintf("%s:%d", ip, port)
+			cfg.Service.WSEndpoint = wsEndpoint(ctx, slv)
 		}
 
 		// load genesis accounts
@@ -117,6 +152,127 @@ func makeConfigNode(ctx *cli.Context) (*service.Node, qkcConfig) {
 	return stack, cfg
 }
 
+// wsEndpoint returns the websocket endpoint of slv, the flags take precedence
+// over the config.
+func wsEndpoint(ctx *cli.Context, slv *config.SlaveConfig) string {
+	ip, port := slv.IP, slv.WSEndpointPort()
+	if ctx.GlobalIsSet(utils.WSRPCHostFlag.Name) {
+		ip = ctx.GlobalString(utils.WSRPCHostFlag.Name)
+	}
+	if ctx.GlobalIsSet(utils.WSRPCPortFlag.Name) {
+		port = uint16(ctx.GlobalInt(utils.WSRPCPortFlag.Name))
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// watchSlaveConfig re-reads the config of the slave from the cluster config
+// file on SIGHUP. Changes which can be applied while running, such as the
+// websocket port and the log level, are applied, the others are rejected and
+// logged.
+func watchSlaveConfig(ctx *cli.Context, stack *service.Node, slv *config.SlaveConfig) {
+	store := config.NewSlaveConfigStore(slv)
+	setLogLevel(slv.LogLevel)
+	store.Subscribe(config.SlaveConfigSubscriberFunc(func(old, new *config.SlaveConfig) {
+		if new.LogLevel != old.LogLevel {
+			setLogLevel(new.LogLevel)
+		}
+	}))
+	if ctx.GlobalBool(utils.WSEnableFlag.Name) {
+		store.Subscribe(config.SlaveConfigSubscriberFunc(func(old, new *config.SlaveConfig) {
+			endpoint := wsEndpoint(ctx, new)
+			if endpoint == wsEndpoint(ctx, old) {
+				return
+			}
+			if err := stack.RestartWS(endpoint); err != nil {
+				log.Error("Failed to rebind websocket endpoint", "endpoint", endpoint, "err", err)
+			}
+		}))
+	}
+	file := ctx.GlobalString(ClusterConfigFlag.Name)
+	if file == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadSlaveConfig(file, store); err != nil {
+				log.Error("Failed to reload slave config", "file", file, "err", err)
+				continue
+			}
+			log.Info("Reloaded slave config", "file", file)
+		}
+	}()
+}
+
+// setLogLevel applies the log level of the slave config, an empty level
+// keeps the current verbosity.
+func setLogLevel(level string) {
+	if level == "" {
+		return
+	}
+	lvl, err := log.LvlFromString(level)
+	if err != nil {
+		log.Error("Invalid slave log level", "level", level, "err", err)
+		return
+	}
+	debug.Handler.Verbosity(int(lvl))
+	log.Info("Set slave log level", "level", lvl)
+}
+
+func reloadSlaveConfig(file string, store *config.SlaveConfigStore) error {
+	cfg := config.NewClusterConfig()
+	if err := loadConfig(file, cfg); err != nil {
+		return err
+	}
+	slv, err := cfg.GetSlaveConfig(store.Get().ID)
+	if err != nil {
+		return err
+	}
+	if err := slv.ApplyEnv(); err != nil {
+		return err
+	}
+	return store.Reload(slv)
+}
+
+// watchPeerLists re-reads the peer allowlist and denylist of the master from
+// the cluster config file on SIGHUP and applies them to the p2p server, the
+// connected peers are kept.
+func watchPeerLists(ctx *cli.Context, stack *service.Node) {
+	file := ctx.GlobalString(ClusterConfigFlag.Name)
+	if file == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadPeerLists(file, stack); err != nil {
+				log.Error("Failed to reload peer lists", "file", file, "err", err)
+				continue
+			}
+			log.Info("Reloaded peer lists", "file", file)
+		}
+	}()
+}
+
+func reloadPeerLists(file string, stack *service.Node) error {
+	cfg := config.NewClusterConfig()
+	if err := loadConfig(file, cfg); err != nil {
+		return err
+	}
+	allowed, denied, err := utils.ParsePeerLists(cfg.P2P)
+	if err != nil {
+		return err
+	}
+	srv := stack.Server()
+	if srv == nil {
+		return service.ErrNodeStopped
+	}
+	srv.SetNodeLists(allowed, denied)
+	return nil
+}
+
 func makeFullNode(ctx *cli.Context) *service.Node {
 	stack, cfg := makeConfigNode(ctx)
 
@@ -124,11 +280,13 @@ func makeFullNode(ctx *cli.Context) *service.Node {
 		for _, slv := range cfg.Cluster.SlaveList {
 			if cfg.Service.Name == slv.ID {
 				utils.RegisterSlaveService(stack, &cfg.Cluster, slv)
+				watchSlaveConfig(ctx, stack, slv)
 				break
 			}
 		}
 	} else {
 		utils.RegisterMasterService(stack, &cfg.Cluster)
+		watchPeerLists(ctx, stack)
 	}
 
 	return stack
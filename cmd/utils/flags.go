@@ -7,11 +7,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/QuarkChain/goquarkchain/cluster/master"
 	"github.com/QuarkChain/goquarkchain/cluster/service"
 	"github.com/QuarkChain/goquarkchain/p2p"
+	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
 	"github.com/QuarkChain/goquarkchain/params"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -351,8 +353,24 @@ func SetP2PConfig(ctx *cli.Context, cfg *p2p.Config, clstrCfg *config.ClusterCon
 
 	cfg.NetWorkId = clstrCfg.Quarkchain.NetworkID
 
+	allowed, denied, err := ParsePeerLists(clstrCfg.P2P)
+	if err != nil {
+		Fatalf("Invalid peer lists: %v", err)
+	}
+	cfg.AllowedNodes, cfg.DeniedNodes = allowed, denied
+
 	cfg.MaxPeers = int(clstrCfg.P2P.MaxPeers)
 	log.Info("Maximum peer count", "QKC", cfg.MaxPeers, "total", cfg.MaxPeers)
+	cfg.PeerEviction = clstrCfg.P2P.PeerEviction
+	cfg.MinEvictIdle = time.Duration(clstrCfg.P2P.MinEvictIdle) * time.Second
+	cfg.ReadTimeout = time.Duration(clstrCfg.P2P.ReadTimeout) * time.Second
+	cfg.WriteTimeout = time.Duration(clstrCfg.P2P.FrameWriteTimeout) * time.Second
+	cfg.CompressionDict = clstrCfg.P2P.CompressionDict
+	cfg.DecodeBufferSize = clstrCfg.P2P.DecodeBufferSize
+	cfg.MaxMessageSize = clstrCfg.Quarkchain.P2PCommandSizeLimit
+	cfg.SnappyMinProtocol = p2p.Cap{Name: master.QKCProtocolName, Version: master.SnappyMinQKCVersion}
+	cfg.ClockSkewWarn = time.Duration(clstrCfg.P2P.ClockSkewWarn) * time.Second
+	cfg.MaxClockSkew = time.Duration(clstrCfg.P2P.MaxClockSkew) * time.Second
 
 	if ctx.GlobalIsSet(MaxPendingPeersFlag.Name) {
 		cfg.MaxPendingPeers = ctx.GlobalInt(MaxPendingPeersFlag.Name)
@@ -369,6 +387,17 @@ func SetP2PConfig(ctx *cli.Context, cfg *p2p.Config, clstrCfg *config.ClusterCon
 	}
 }
 
+// ParsePeerLists parses the allowlist and denylist of the p2p config.
+func ParsePeerLists(p2pCfg *config.P2PConfig) (allowed, denied []enode.ID, err error) {
+	if allowed, err = nodefilter.ParseNodeIDs(p2pCfg.AllowedPeers); err != nil {
+		return nil, nil, fmt.Errorf("ALLOWED_PEERS: %v", err)
+	}
+	if denied, err = nodefilter.ParseNodeIDs(p2pCfg.DeniedPeers); err != nil {
+		return nil, nil, fmt.Errorf("DENIED_PEERS: %v", err)
+	}
+	return allowed, denied, nil
+}
+
 func SetClusterConfig(ctx *cli.Context, cfg *config.ClusterConfig) {
 	// quarkchain.network_id
 	if ctx.GlobalIsSet(NetworkIdFlag.Name) {
@@ -1,10 +1,30 @@
 package types
 
 import (
+	"encoding/json"
+	"errors"
+
 	"github.com/QuarkChain/goquarkchain/account"
 	"github.com/QuarkChain/goquarkchain/common"
 )
 
+// fullShardIdShardBits is the number of low bits of a full shard id holding
+// the shard, the chain id takes the bits above them.
+const fullShardIdShardBits = 16
+
+// SplitFullShardId splits a full shard id into the chain id matched by
+// ChainMask and the shard id, which keeps the shard size bit above the index
+// of the shard like the low half of a Branch.
+func SplitFullShardId(fullShardId uint32) (chainId, shardId uint32) {
+	return fullShardId >> fullShardIdShardBits, fullShardId & (1<<fullShardIdShardBits - 1)
+}
+
+// MakeFullShardId is the inverse of SplitFullShardId, shardId is cut to the
+// bits of the shard.
+func MakeFullShardId(chainId, shardId uint32) uint32 {
+	return chainId<<fullShardIdShardBits | shardId&(1<<fullShardIdShardBits-1)
+}
+
 type ChainMask struct {
 	Value uint32
 }
@@ -30,7 +50,7 @@ func (c *ChainMask) GetMask() uint32 {
 }
 
 func (c *ChainMask) ContainFullShardId(fullShardId uint32) bool {
-	chainId := fullShardId >> 16
+	chainId, _ := SplitFullShardId(fullShardId)
 	bitMask := uint32((1 << (common.IntLeftMostBit(c.Value) - 1)) - 1)
 	return (bitMask & chainId) == (c.Value & bitMask)
 }
@@ -42,3 +62,21 @@ func (c *ChainMask) ContainBranch(branch account.Branch) bool {
 func (c *ChainMask) HasOverlap(value uint32) bool {
 	return common.MasksHaveOverlap(c.Value, value)
 }
+
+// MarshalJSON encodes the mask as its numeric value.
+func (c ChainMask) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Value)
+}
+
+// UnmarshalJSON decodes a mask from its numeric value, 0 is not a valid mask.
+func (c *ChainMask) UnmarshalJSON(input []byte) error {
+	var value uint32
+	if err := json.Unmarshal(input, &value); err != nil {
+		return err
+	}
+	if value == 0 {
+		return errors.New("chain mask must not be 0")
+	}
+	c.Value = value
+	return nil
+}
@@ -1,6 +1,9 @@
 package types
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestShardMask(t *testing.T) {
 	var (
@@ -35,3 +38,76 @@ func TestShardMask(t *testing.T) {
 		}
 	}
 }
+
+func TestChainMaskJSON(t *testing.T) {
+	enc, err := json.Marshal(NewChainMask(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(enc) != "5" {
+		t.Errorf("mask encoding mismatch: got %s, want 5", enc)
+	}
+	var mask ChainMask
+	if err := json.Unmarshal(enc, &mask); err != nil {
+		t.Fatal(err)
+	}
+	if mask.GetMask() != 5 {
+		t.Errorf("mask mismatch: got %d, want 5", mask.GetMask())
+	}
+
+	masks := []*ChainMask{NewChainMask(1), NewChainMask(6)}
+	enc, err = json.Marshal(masks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(enc) != "[1,6]" {
+		t.Errorf("mask list encoding mismatch: got %s, want [1,6]", enc)
+	}
+	var decoded []*ChainMask
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].GetMask() != 1 || decoded[1].GetMask() != 6 {
+		t.Errorf("mask list mismatch: got %v", decoded)
+	}
+
+	if err := json.Unmarshal([]byte("[0]"), &decoded); err == nil {
+		t.Error("mask 0 should be rejected")
+	}
+}
+
+func TestSplitFullShardId(t *testing.T) {
+	// the chain id takes the high 16 bits, the shard size bit and the shard
+	// index the low ones
+	fixtures := []struct {
+		fullShardId      uint32
+		chainId, shardId uint32
+	}{
+		{0x00000001, 0, 1},
+		{0x00010001, 1, 1},
+		{0x00020005, 2, 5},
+		{0x0003000c, 3, 12},
+		{0xffff8000, 0xffff, 0x8000},
+	}
+	for _, f := range fixtures {
+		chainId, shardId := SplitFullShardId(f.fullShardId)
+		if chainId != f.chainId || shardId != f.shardId {
+			t.Errorf("split %#x: got (%d, %#x), want (%d, %#x)", f.fullShardId, chainId, shardId, f.chainId, f.shardId)
+		}
+		if got := MakeFullShardId(f.chainId, f.shardId); got != f.fullShardId {
+			t.Errorf("make (%d, %#x): got %#x, want %#x", f.chainId, f.shardId, got, f.fullShardId)
+		}
+	}
+	// shard bits beyond the low half do not leak into the chain id
+	if got := MakeFullShardId(1, 0x10001); got != 0x00010001 {
+		t.Errorf("make with oversized shard id: got %#x, want 0x10001", got)
+	}
+
+	// the masks match on the chain id alone
+	mask := NewChainMask(0x05)
+	for chainId, ok := range map[uint32]bool{1: true, 5: true, 9: true, 2: false, 3: false} {
+		if got := mask.ContainFullShardId(MakeFullShardId(chainId, 0x11)); got != ok {
+			t.Errorf("mask 0x05 on chain %d: got %v, want %v", chainId, got, ok)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/QuarkChain/goquarkchain/common/hexutil"
 	"github.com/QuarkChain/goquarkchain/core/types"
 	"github.com/QuarkChain/goquarkchain/internal/encoder"
+	"github.com/QuarkChain/goquarkchain/p2p"
 	"github.com/QuarkChain/goquarkchain/rpc"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
@@ -742,6 +743,25 @@ func (p *PrivateBlockChainAPI) GetKadRoutingTable() ([]string, error) {
 	return p.b.GetKadRoutingTable()
 }
 
+// GetSlaveReadiness returns whether the master is ready to serve traffic,
+// with every critical slave connected and healthy, and the ids of the
+// connected and pending slaves.
+func (p *PrivateBlockChainAPI) GetSlaveReadiness() map[string]interface{} {
+	return p.b.GetSlaveReadiness()
+}
+
+// DebugAPI exposes the internals of the node for troubleshooting.
+type DebugAPI struct{}
+
+func NewDebugAPI() *DebugAPI {
+	return &DebugAPI{}
+}
+
+// OpTable returns the p2p ops with their command and handler registration.
+func (d *DebugAPI) OpTable() []p2p.OpInfo {
+	return p2p.OpTable()
+}
+
 type EthBlockChainAPI struct {
 	CommonAPI
 	b Backend
@@ -44,6 +44,9 @@ type Backend interface {
 	GetSlavePoolLen() int
 	GetLastMinorBlockByFullShardID(fullShardId uint32) (uint64, error)
 	GetRootHashConfirmingMinorBlock(mBlockID []byte) common.Hash
+	// GetSlaveReadiness tells whether the critical slaves are up and which
+	// slaves are connected or still pending.
+	GetSlaveReadiness() map[string]interface{}
 	// p2p discovery healty nodes
 	GetKadRoutingTable() ([]string, error)
 }
@@ -71,5 +74,11 @@ func GetAPIs(apiBackend Backend) []rpc.API {
 			Service:   NewEthAPI(apiBackend),
 			Public:    true,
 		},
+		{
+			Namespace: "debug",
+			Version:   "1.0",
+			Service:   NewDebugAPI(),
+			Public:    false,
+		},
 	}
 }
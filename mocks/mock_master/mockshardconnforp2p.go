@@ -238,6 +238,20 @@ func (mr *MockISlaveConnMockRecorder) HandleNewMinorBlock(request interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandleNewMinorBlock", reflect.TypeOf((*MockISlaveConn)(nil).HandleNewMinorBlock), request)
 }
 
+// AddXshardTxList mocks base method
+func (m *MockISlaveConn) AddXshardTxList(request *rpc.AddXshardTxListRequest) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddXshardTxList", request)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddXshardTxList indicates an expected call of AddXshardTxList
+func (mr *MockISlaveConnMockRecorder) AddXshardTxList(request interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddXshardTxList", reflect.TypeOf((*MockISlaveConn)(nil).AddXshardTxList), request)
+}
+
 // AddBlockListForSync mocks base method
 func (m *MockISlaveConn) AddBlockListForSync(request *rpc.AddBlockListForSyncRequest) (*rpc.ShardStatus, error) {
 	m.ctrl.T.Helper()
@@ -339,6 +353,20 @@ func (mr *MockISlaveConnMockRecorder) HeartBeat() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HeartBeat", reflect.TypeOf((*MockISlaveConn)(nil).HeartBeat))
 }
 
+// CheckHealth mocks base method
+func (m *MockISlaveConn) CheckHealth() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckHealth")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CheckHealth indicates an expected call of CheckHealth
+func (mr *MockISlaveConnMockRecorder) CheckHealth() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckHealth", reflect.TypeOf((*MockISlaveConn)(nil).CheckHealth))
+}
+
 // GetUnconfirmedHeaders mocks base method
 func (m *MockISlaveConn) GetUnconfirmedHeaders() (*rpc.GetUnconfirmedHeadersResponse, error) {
 	m.ctrl.T.Helper()
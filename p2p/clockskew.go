@@ -0,0 +1,63 @@
+package p2p
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// handshakeTimeIndex is the position of the sender's clock among the trailing
+// fields of the protocol handshake, after the dictionary offer.
+const handshakeTimeIndex = 1
+
+var errClockSkew = errors.New("clock skew too large")
+
+// withHandshakeTime returns a copy of hs stamped with now in milliseconds
+// since the epoch. Older peers ignore the trailing fields, an empty
+// dictionary offer is filled in if hs has none.
+func withHandshakeTime(hs *protoHandshake, now time.Time) *protoHandshake {
+	stamped := *hs
+	n := handshakeTimeIndex + 1
+	if len(hs.Rest) > n {
+		n = len(hs.Rest)
+	}
+	stamped.Rest = make([]rlp.RawValue, n)
+	copy(stamped.Rest, hs.Rest)
+	if stamped.Rest[0] == nil {
+		stamped.Rest[0], _ = rlp.EncodeToBytes([]uint64{})
+	}
+	stamped.Rest[handshakeTimeIndex], _ = rlp.EncodeToBytes(uint64(now.UnixNano() / int64(time.Millisecond)))
+	return &stamped
+}
+
+// handshakeTime returns the clock of the sender of hs, if it sent one.
+func handshakeTime(hs *protoHandshake) (time.Time, bool) {
+	var ms uint64
+	if len(hs.Rest) <= handshakeTimeIndex || rlp.DecodeBytes(hs.Rest[handshakeTimeIndex], &ms) != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)), true
+}
+
+// clockSkew returns how far the clock of the sender of their is ahead of
+// ours, taking the exchange to happen halfway between sent and received.
+func clockSkew(their *protoHandshake, sent, received time.Time) (time.Duration, bool) {
+	remote, ok := handshakeTime(their)
+	if !ok {
+		return 0, false
+	}
+	return remote.Sub(sent.Add(received.Sub(sent) / 2)), true
+}
+
+// checkClockSkew warns about a peer whose clock is off by more than
+// ClockSkewWarn and rejects it beyond MaxClockSkew, either is disabled if 0.
+func (srv *Server) checkClockSkew(skew time.Duration) (warn bool, err error) {
+	if skew < 0 {
+		skew = -skew
+	}
+	if srv.MaxClockSkew > 0 && skew > srv.MaxClockSkew {
+		return true, errClockSkew
+	}
+	return srv.ClockSkewWarn > 0 && skew > srv.ClockSkewWarn, nil
+}
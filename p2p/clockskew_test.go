@@ -0,0 +1,28 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestClockSkew(t *testing.T) {
+	sent := time.Unix(1560000000, 0)
+	received := sent.Add(200 * time.Millisecond)
+	// the dictionary offer is kept in front of the clock
+	offer := &protoHandshake{Rest: []rlp.RawValue{dictHandshake()}}
+	their := withHandshakeTime(offer, sent.Add(5*time.Second))
+	if len(offer.Rest) != 1 || !bytes.Equal(their.Rest[0], offer.Rest[0]) {
+		t.Fatalf("dictionary offer not kept: %x", their.Rest)
+	}
+	// the remote stamped its handshake halfway through the exchange
+	skew, ok := clockSkew(their, sent, received)
+	if want := 5*time.Second - 100*time.Millisecond; !ok || skew != want {
+		t.Errorf("skew mismatch: got %v, want %v", skew, want)
+	}
+	if _, ok := clockSkew(&protoHandshake{}, sent, received); ok {
+		t.Error("skew of a handshake without clock should be unknown")
+	}
+}
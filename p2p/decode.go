@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"github.com/QuarkChain/goquarkchain/serialize"
+	"io"
 	"unsafe"
 )
 
@@ -55,6 +56,28 @@ func DecodeQKCMsg(body []byte) (QKCMsg, error) {
 	return msg, nil
 }
 
+// PeekOp returns the op of an encoded qkc message without consuming its
+// payload. It fails for payloads without io.ReaderAt, those built by MakeMsg
+// have it.
+func PeekOp(msg Msg) (P2PCommandOp, bool) {
+	op, _, ok := PeekHeader(msg)
+	return op, ok
+}
+
+// PeekHeader returns the op and rpc id of an encoded qkc message without
+// consuming its payload, like PeekOp.
+func PeekHeader(msg Msg) (P2PCommandOp, uint64, bool) {
+	r, ok := msg.Payload.(io.ReaderAt)
+	if !ok || msg.Size < PreP2PLength {
+		return 0, 0, false
+	}
+	var header [OPLength + RPCIDLength]byte
+	if _, err := r.ReadAt(header[:], MetadataLength); err != nil {
+		return 0, 0, false
+	}
+	return P2PCommandOp(header[0]), binary.BigEndian.Uint64(header[OPLength:]), true
+}
+
 // Encrypt encrypt Data to byte array
 func Encrypt(metadata Metadata, op P2PCommandOp, ipcID uint64, data []byte) ([]byte, error) {
 	encryptBytes := make([]byte, PreP2PLength+len(data))
@@ -1,11 +1,13 @@
 package p2p
 
 import (
+	"bytes"
 	"github.com/QuarkChain/goquarkchain/serialize"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"reflect"
 	"testing"
+	"testing/quick"
 )
 
 type codeC struct {
@@ -139,6 +141,106 @@ func verifySerializeData(t *testing.T, decodeMsg QKCMsg, v codeC) error {
 		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
 			t.Fatal("deserialize from Bytes err", err)
 		}
+	case DisconnectMsg:
+		cmd := new(DisconnectCommand)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case NewCrossShardTxListMsg:
+		cmd := new(NewCrossShardTxList)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case CapabilitiesMsg:
+		cmd := new(CapabilitiesCommand)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetRootBlockHeadersRequestMsg:
+		cmd := new(GetRootBlockHeadersRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetRootBlockHeadersResponseMsg:
+		cmd := new(GetRootBlockHeadersResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetMinorBlockHeadersRequestMsg:
+		cmd := new(GetMinorBlockHeadersRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetMinorBlockHeadersResponseMsg:
+		cmd := new(GetMinorBlockHeadersResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case NewTransactionHashesMsg:
+		cmd := new(NewTransactionHashes)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetTransactionsRequestMsg:
+		cmd := new(GetTransactionsRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetTransactionsResponseMsg:
+		cmd := new(GetTransactionsResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetRootBlockRequestMsg:
+		cmd := new(GetRootBlockRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetRootBlockResponseMsg:
+		cmd := new(GetRootBlockResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetMinorBlockRequestMsg:
+		cmd := new(GetMinorBlockRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetMinorBlockResponseMsg:
+		cmd := new(GetMinorBlockResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case RootTipUpdateMsg:
+		cmd := new(RootTipUpdate)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetAccountDataRequestMsg:
+		cmd := new(GetAccountDataRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetAccountDataResponseMsg:
+		cmd := new(GetAccountDataResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case HelloAckMsg:
+		cmd := new(HelloAckCommand)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetShardMasksRequestMsg:
+		cmd := new(GetShardMasksRequest)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
+	case GetShardMasksResponseMsg:
+		cmd := new(GetShardMasksResponse)
+		if err := serialize.DeserializeFromBytes(decodeMsg.Data, &cmd); err != nil {
+			t.Fatal("deserialize from Bytes err", err)
+		}
 	default:
 		t.Fatal("unexcepted decodeMsg op")
 	}
@@ -170,3 +272,59 @@ func TestEncryptAndDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestUnknownOpString(t *testing.T) {
+	assert.Equal(t, "HelloCmd", Hello.String())
+	assert.Equal(t, "255", P2PCommandOp(255).String())
+}
+
+func TestDecodeQKCMsgRoundtrip(t *testing.T) {
+	for op := range OPSerializerMap {
+		op := op
+		roundtrip := func(branch uint32, rpcID uint64, data []byte) bool {
+			body, err := Encrypt(Metadata{Branch: branch}, op, rpcID, data)
+			if err != nil {
+				return false
+			}
+			msg, err := DecodeQKCMsg(body)
+			if err != nil {
+				return false
+			}
+			return msg.Op == op && msg.RpcID == rpcID && msg.MetaData.Branch == branch &&
+				bytes.Equal(msg.Data, data)
+		}
+		if err := quick.Check(roundtrip, nil); err != nil {
+			t.Errorf("op %s: %v", op, err)
+		}
+	}
+}
+
+func FuzzDecodeQKCMsg(f *testing.F) {
+	for _, v := range getTestCodeCTest() {
+		cmdBytes, err := serialize.SerializeToBytes(v.data)
+		if err != nil {
+			f.Fatal(err)
+		}
+		body, err := Encrypt(v.metaData, v.op, v.rpcID, cmdBytes)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, PreP2PLength-1))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		msg, err := DecodeQKCMsg(body)
+		if err != nil {
+			return
+		}
+		encoded, err := Encrypt(msg.MetaData, msg.Op, msg.RpcID, msg.Data)
+		if err != nil {
+			t.Fatal("encrypt decoded msg err", err)
+		}
+		if !bytes.Equal(encoded, body) {
+			t.Fatalf("roundtrip mismatch: have %x, want %x", encoded, body)
+		}
+	})
+}
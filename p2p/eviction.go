@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Policies choosing the peer to drop when a new one connects while the peer
+// set is full.
+const (
+	EvictNone       = "none"
+	EvictIdle       = "idle"
+	EvictReputation = "reputation"
+)
+
+// evictionCandidate returns the peer to drop to admit c, which the peer limits
+// reject, under the configured policy, nil if c is not worth it. An inbound c
+// past the inbound limit only takes the slot of another inbound peer. Trusted
+// and static peers are never dropped.
+func (srv *Server) evictionCandidate(peers map[enode.ID]*Peer, inboundCount int, c *conn) *Peer {
+	var (
+		victim      *Peer
+		score       int
+		inboundOnly = c.is(inboundConn) && inboundCount >= srv.maxInboundConns()
+	)
+	if srv.reputation != nil {
+		score = srv.reputation.Score(c.node.IP().String())
+	}
+	eligible := func(p *Peer) bool {
+		return !p.rw.is(trustedConn|staticDialedConn) && (!inboundOnly || p.Inbound())
+	}
+	switch srv.PeerEviction {
+	case EvictIdle:
+		var maxIdle time.Duration
+		for _, p := range peers {
+			if idle := p.Idle(); eligible(p) && idle >= srv.MinEvictIdle && p.Score() <= score && preferVictim(p, victim, idle > maxIdle) {
+				victim, maxIdle = p, idle
+			}
+		}
+	case EvictReputation:
+		var min int
+		for _, p := range peers {
+			if s := p.Score(); eligible(p) && s < score && preferVictim(p, victim, s < min) {
+				victim, min = p, s
+			}
+		}
+	}
+	return victim
+}
+
+// preferVictim reports whether p is to be dropped rather than victim. The
+// outbound peers are ours to choose, so they are kept over inbound ones
+// whatever the policy, which decides between peers of the same direction
+// through worse.
+func preferVictim(p, victim *Peer, worse bool) bool {
+	if victim == nil {
+		return true
+	}
+	if p.Inbound() != victim.Inbound() {
+		return p.Inbound()
+	}
+	return worse
+}
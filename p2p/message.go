@@ -63,10 +63,77 @@ func (msg Msg) String() string {
 
 // Discard reads any remaining payload data into a black hole.
 func (msg Msg) Discard() error {
-	_, err := io.Copy(ioutil.Discard, msg.Payload)
+	_, err := io.Copy(ioutil.Discard, newLimitedPayload(msg, config.DefaultP2PCmddSizeLimit))
 	return err
 }
 
+// errPayloadTooLarge is returned when a message payload yields more bytes
+// than the message size claims.
+var errPayloadTooLarge = errors.New("message payload exceeds message size")
+
+// limitedPayload wraps a message payload like io.LimitReader, but fails with
+// errPayloadTooLarge when the payload has bytes past the limit instead of
+// silently cutting them off.
+type limitedPayload struct {
+	r     io.Reader
+	limit int64 // bytes left
+}
+
+// newLimitedPayload guards the payload of msg to msg.Size bytes, and never to
+// more than maxSize whatever the size claims. The transports pass the message
+// size they are configured with, the helpers which do not know the transport
+// of a message fall back to the default command size limit.
+func newLimitedPayload(msg Msg, maxSize uint32) io.Reader {
+	limit := msg.Size
+	if limit > maxSize {
+		limit = maxSize
+	}
+	return &limitedPayload{r: msg.Payload, limit: int64(limit)}
+}
+
+func (l *limitedPayload) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if l.limit <= 0 {
+		// reading one byte more tells the end of the payload from an excess
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, errPayloadTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.limit {
+		p = p[:l.limit]
+	}
+	n, err := l.r.Read(p)
+	l.limit -= int64(n)
+	return n, err
+}
+
+// payloadReader is a message payload held in memory, ReadPayload hands out
+// its bytes without copying them.
+type payloadReader struct {
+	*bytes.Reader
+	buf []byte
+}
+
+func newPayloadReader(buf []byte) *payloadReader {
+	return &payloadReader{Reader: bytes.NewReader(buf), buf: buf}
+}
+
+// ReadPayload reads the whole payload of msg. The payload of a message read by
+// the qkc transport is returned as is rather than copied, so that a large
+// block body is not held twice.
+func ReadPayload(msg Msg) ([]byte, error) {
+	if r, ok := msg.Payload.(*payloadReader); ok && r.Len() == len(r.buf) {
+		r.Reset(nil)
+		return r.buf, nil
+	}
+	return ioutil.ReadAll(newLimitedPayload(msg, config.DefaultP2PCmddSizeLimit))
+}
+
 type MsgReader interface {
 	ReadMsg() (Msg, error)
 }
@@ -88,6 +155,28 @@ type MsgReadWriter interface {
 	MsgWriter
 }
 
+// MsgBatchWriter is implemented by the writers which can send several
+// messages at once more cheaply than one at a time.
+type MsgBatchWriter interface {
+	// WriteMsgs sends msgs in order. The messages before the one failing
+	// may have been sent.
+	WriteMsgs(msgs []Msg) error
+}
+
+// WriteMsgs sends msgs to w in order, as a single batch if w is a
+// MsgBatchWriter and one at a time otherwise.
+func WriteMsgs(w MsgWriter, msgs []Msg) error {
+	if bw, ok := w.(MsgBatchWriter); ok {
+		return bw.WriteMsgs(msgs)
+	}
+	for _, msg := range msgs {
+		if err := w.WriteMsg(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Send writes an RLP-encoded message with the given code.
 // data should encode as an RLP list.
 func Send(w MsgWriter, msgcode uint64, data interface{}) error {
@@ -309,6 +398,24 @@ func (ev *msgEventer) WriteMsg(msg Msg) error {
 	return nil
 }
 
+// WriteMsgs writes msgs to the underlying MsgReadWriter as one batch and
+// emits a "message sent" event for each of them
+func (ev *msgEventer) WriteMsgs(msgs []Msg) error {
+	if err := WriteMsgs(ev.MsgReadWriter, msgs); err != nil {
+		return err
+	}
+	for i := range msgs {
+		ev.feed.Send(&PeerEvent{
+			Type:     PeerEventTypeMsgSend,
+			Peer:     ev.peerID,
+			Protocol: ev.Protocol,
+			MsgCode:  &msgs[i].Code,
+			MsgSize:  &msgs[i].Size,
+		})
+	}
+	return nil
+}
+
 // Close closes the underlying MsgReadWriter if it implements the io.Closer
 // interface
 func (ev *msgEventer) Close() error {
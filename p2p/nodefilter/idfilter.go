@@ -0,0 +1,90 @@
+package nodefilter
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+var (
+	// ErrNodeDenied is returned for a node on the denylist.
+	ErrNodeDenied = errors.New("node is denylisted")
+	// ErrNodeNotAllowed is returned for a node missing from a non-empty
+	// allowlist.
+	ErrNodeNotAllowed = errors.New("node is not allowlisted")
+)
+
+// IDFilter decides from node IDs which peers may connect. Denylisted nodes
+// are always rejected, and once an allowlist is set only the nodes on it are
+// accepted. The lists can be replaced while connections are being checked.
+type IDFilter struct {
+	mu    sync.RWMutex
+	allow map[enode.ID]bool
+	deny  map[enode.ID]bool
+}
+
+func NewIDFilter(allow, deny []enode.ID) *IDFilter {
+	f := new(IDFilter)
+	f.Update(allow, deny)
+	return f
+}
+
+// Update replaces both lists.
+func (f *IDFilter) Update(allow, deny []enode.ID) {
+	allowSet := make(map[enode.ID]bool, len(allow))
+	for _, id := range allow {
+		allowSet[id] = true
+	}
+	denySet := make(map[enode.ID]bool, len(deny))
+	for _, id := range deny {
+		denySet[id] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow, f.deny = allowSet, denySet
+}
+
+// Check returns ErrNodeDenied or ErrNodeNotAllowed if id may not connect.
+func (f *IDFilter) Check(id enode.ID) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.deny[id] {
+		return ErrNodeDenied
+	}
+	if len(f.allow) > 0 && !f.allow[id] {
+		return ErrNodeNotAllowed
+	}
+	return nil
+}
+
+// ParseNodeIDs parses a comma separated list of nodes given by enode URL,
+// public key or node ID, all in hex.
+func ParseNodeIDs(list string) ([]enode.ID, error) {
+	var ids []enode.ID
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if len(s) == 2*len(enode.ID{}) {
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid node ID %q: %v", s, err)
+			}
+			var id enode.ID
+			copy(id[:], b)
+			ids = append(ids, id)
+			continue
+		}
+		node, err := enode.ParseV4(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node %q: %v", s, err)
+		}
+		ids = append(ids, node.ID())
+	}
+	return ids, nil
+}
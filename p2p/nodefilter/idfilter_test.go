@@ -0,0 +1,73 @@
+package nodefilter
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+func TestIDFilter(t *testing.T) {
+	a, b, c := enode.ID{1}, enode.ID{2}, enode.ID{3}
+
+	// denylist only
+	f := NewIDFilter(nil, []enode.ID{a})
+	if err := f.Check(a); err != ErrNodeDenied {
+		t.Fatalf("denied node: got %v, want %v", err, ErrNodeDenied)
+	}
+	if err := f.Check(b); err != nil {
+		t.Fatalf("unlisted node should connect, got %v", err)
+	}
+
+	// allowlist, the denylist still wins
+	f.Update([]enode.ID{a, b}, []enode.ID{a})
+	if err := f.Check(a); err != ErrNodeDenied {
+		t.Fatalf("denied allowed node: got %v, want %v", err, ErrNodeDenied)
+	}
+	if err := f.Check(b); err != nil {
+		t.Fatalf("allowed node should connect, got %v", err)
+	}
+	if err := f.Check(c); err != ErrNodeNotAllowed {
+		t.Fatalf("unlisted node: got %v, want %v", err, ErrNodeNotAllowed)
+	}
+
+	// clearing the lists lets everyone in
+	f.Update(nil, nil)
+	for _, id := range []enode.ID{a, b, c} {
+		if err := f.Check(id); err != nil {
+			t.Fatalf("node %v should connect, got %v", id, err)
+		}
+	}
+}
+
+func TestParseNodeIDs(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	node := enode.NewV4(&key.PublicKey, nil, 0, 0)
+	pubkey := hex.EncodeToString(crypto.FromECDSAPub(&key.PublicKey)[1:])
+	id := node.ID()
+
+	list := "enode://" + pubkey + "@127.0.0.1:38291, " + pubkey + ",," + hex.EncodeToString(id[:])
+	ids, err := ParseNodeIDs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("parsed %d nodes, want 3", len(ids))
+	}
+	for i, got := range ids {
+		if got != id {
+			t.Errorf("node %d: got %v, want %v", i, got, id)
+		}
+	}
+
+	if ids, err := ParseNodeIDs(""); err != nil || len(ids) != 0 {
+		t.Fatalf("empty list: got %v, %v", ids, err)
+	}
+	if _, err := ParseNodeIDs("zz" + pubkey[2:64]); err == nil {
+		t.Fatal("invalid node ID should fail")
+	}
+	if _, err := ParseNodeIDs("enode://1234@127.0.0.1:1"); err == nil {
+		t.Fatal("invalid enode URL should fail")
+	}
+}
@@ -0,0 +1,125 @@
+package nodefilter
+
+import (
+	"sync"
+	"time"
+)
+
+// Penalties subtracted from the score of a peer for protocol violations.
+const (
+	PenaltyBadMAC       = 50
+	PenaltyBadFrameSize = 50
+	PenaltyUnknownOp    = 20
+	PenaltyBadPayload   = 20
+	PenaltyRPCTimeout   = 10
+	// PenaltyCompressionBomb is for a compressed frame decoding past the
+	// frame size limit, two of them get the peer banned.
+	PenaltyCompressionBomb = 50
+	// PenaltyHandlerPanic is for a message whose handler panicked.
+	PenaltyHandlerPanic = 20
+
+	// RewardRPCResponse is added to the score of a peer for each request it
+	// answers in time.
+	RewardRPCResponse = 1
+)
+
+const (
+	// a peer is banned once its score drops to banScore
+	banScore = -100
+	maxScore = 100
+	// the ban period doubles on each ban of the same peer, up to maxBan
+	baseBan = time.Minute
+	maxBan  = 24 * time.Hour
+)
+
+type peerScore struct {
+	score       int
+	bans        uint
+	bannedUntil time.Time
+}
+
+// Reputation keeps a score per peer IP, lowered on protocol violations and
+// raised on good behavior. A peer whose score drops too low is banned for a
+// period growing with each ban.
+type Reputation struct {
+	mu     sync.Mutex
+	scores map[string]*peerScore
+	now    func() time.Time
+}
+
+func NewReputation() *Reputation {
+	return &Reputation{
+		scores: make(map[string]*peerScore),
+		now:    time.Now,
+	}
+}
+
+func (r *Reputation) get(ip string) *peerScore {
+	ps, ok := r.scores[ip]
+	if !ok {
+		ps = new(peerScore)
+		r.scores[ip] = ps
+	}
+	return ps
+}
+
+// Penalize lowers the score of ip, and bans it if the score drops below the
+// threshold. It returns whether ip got banned.
+func (r *Reputation) Penalize(ip string, penalty int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ps := r.get(ip)
+	ps.score -= penalty
+	if ps.score > banScore {
+		return false
+	}
+	ban := baseBan << ps.bans
+	if ban > maxBan || ban <= 0 {
+		ban = maxBan
+	}
+	ps.bans++
+	ps.bannedUntil = r.now().Add(ban)
+	// the peer starts over once the ban is served
+	ps.score = 0
+	return true
+}
+
+// Reward raises the score of ip.
+func (r *Reputation) Reward(ip string, reward int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ps := r.get(ip)
+	ps.score += reward
+	if ps.score > maxScore {
+		ps.score = maxScore
+	}
+}
+
+// Score returns the current score of ip, 0 for an unknown peer.
+func (r *Reputation) Score(ip string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ps, ok := r.scores[ip]; ok {
+		return ps.score
+	}
+	return 0
+}
+
+// Banned reports whether ip is serving a ban.
+func (r *Reputation) Banned(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ps, ok := r.scores[ip]
+	return ok && r.now().Before(ps.bannedUntil)
+}
+
+// Scores returns the current score of each known peer IP.
+func (r *Reputation) Scores() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	scores := make(map[string]int, len(r.scores))
+	for ip, ps := range r.scores {
+		scores[ip] = ps.score
+	}
+	return scores
+}
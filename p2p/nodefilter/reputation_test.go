@@ -0,0 +1,45 @@
+package nodefilter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReputationBan(t *testing.T) {
+	now := time.Now()
+	r := NewReputation()
+	r.now = func() time.Time { return now }
+	ip := "10.0.0.1"
+
+	r.Reward(ip, maxScore+10)
+	if score := r.Scores()[ip]; score != maxScore {
+		t.Fatalf("score %d, want %d", score, maxScore)
+	}
+	for i := 0; r.Penalize(ip, PenaltyBadMAC) == false; i++ {
+		if i == 10 {
+			t.Fatal("peer should be banned")
+		}
+	}
+	if !r.Banned(ip) || r.Banned("10.0.0.2") {
+		t.Fatal("only the penalized peer should be banned")
+	}
+	if score := r.Scores()[ip]; score != 0 {
+		t.Fatalf("score %d after ban, want 0", score)
+	}
+
+	// the second ban lasts twice as long
+	now = now.Add(baseBan)
+	if r.Banned(ip) {
+		t.Fatal("first ban should be over")
+	}
+	for !r.Penalize(ip, PenaltyBadMAC) {
+	}
+	now = now.Add(baseBan)
+	if !r.Banned(ip) {
+		t.Fatal("second ban should last longer")
+	}
+	now = now.Add(baseBan)
+	if r.Banned(ip) {
+		t.Fatal("second ban should be over")
+	}
+}
@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// builtinOpRange is the name owning the ops of the builtin protocol.
+	builtinOpRange = "builtin"
+	// maxOps is the size of the op space.
+	maxOps = 1 << 8
+)
+
+// OpRange is a contiguous block of ops owned by a subsystem, such as sync,
+// mining or the mempool, which numbers its own ops within it.
+type OpRange struct {
+	Name  string
+	First P2PCommandOp
+	Count int
+}
+
+// Last returns the last op of the range.
+func (r OpRange) Last() P2PCommandOp {
+	return r.First + P2PCommandOp(r.Count-1)
+}
+
+// Op returns the i-th op of the range.
+func (r OpRange) Op(i int) P2PCommandOp {
+	if i < 0 || i >= r.Count {
+		panic(fmt.Sprintf("op %d out of range %s of %d ops", i, r.Name, r.Count))
+	}
+	return r.First + P2PCommandOp(i)
+}
+
+// Contains reports whether op belongs to the range.
+func (r OpRange) Contains(op P2PCommandOp) bool {
+	return op >= r.First && int(op) < int(r.First)+r.Count
+}
+
+// RegisterOp installs the command struct of the i-th op of the range, which
+// must still be reserved.
+func (r OpRange) RegisterOp(i int, cmd interface{}) error {
+	if i < 0 || i >= r.Count {
+		return fmt.Errorf("op %d out of range %s of %d ops", i, r.Name, r.Count)
+	}
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+	for _, o := range opRanges {
+		if o == r {
+			return registerOp(r.Op(i), cmd)
+		}
+	}
+	return fmt.Errorf("op range %v is not reserved", r)
+}
+
+func (r OpRange) overlaps(o OpRange) bool {
+	return int(r.First) < int(o.First)+o.Count && int(o.First) < int(r.First)+r.Count
+}
+
+func (r OpRange) String() string {
+	return fmt.Sprintf("%s [%d, %d]", r.Name, r.First, r.Last())
+}
+
+// opRangeLock is taken before opLock when both are needed.
+var (
+	opRangeLock sync.Mutex
+	opRanges    = []OpRange{{Name: builtinOpRange, First: 0, Count: int(MaxOPNum)}}
+)
+
+// ReserveOpRange assigns the count ops starting at first to the subsystem
+// name. It fails if the name is taken or the ops overlap another range.
+func ReserveOpRange(name string, first P2PCommandOp, count int) (OpRange, error) {
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+	return reserveOpRange(OpRange{Name: name, First: first, Count: count})
+}
+
+// AllocOpRange assigns the lowest free count ops to the subsystem name.
+func AllocOpRange(name string, count int) (OpRange, error) {
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+
+	// opRanges is kept sorted, try the gap before each range and the end
+	first := 0
+	for _, r := range opRanges {
+		if int(r.First)-first >= count {
+			break
+		}
+		if end := int(r.First) + r.Count; end > first {
+			first = end
+		}
+	}
+	if first+count > maxOps {
+		return OpRange{}, fmt.Errorf("no room left for %d ops of %s", count, name)
+	}
+	return reserveOpRange(OpRange{Name: name, First: P2PCommandOp(first), Count: count})
+}
+
+// reserveOpRange must be called with opRangeLock held.
+func reserveOpRange(r OpRange) (OpRange, error) {
+	if r.Count <= 0 {
+		return OpRange{}, fmt.Errorf("op range %s must have at least one op", r.Name)
+	}
+	if int(r.First)+r.Count > maxOps {
+		return OpRange{}, fmt.Errorf("op range %s of %d ops from %d exceeds the %d ops available", r.Name, r.Count, r.First, maxOps)
+	}
+	for _, o := range opRanges {
+		if o.Name == r.Name {
+			return OpRange{}, fmt.Errorf("op range %s is already reserved as %v", r.Name, o)
+		}
+		if o.overlaps(r) {
+			return OpRange{}, fmt.Errorf("op range %v overlaps %v", r, o)
+		}
+	}
+	opLock.RLock()
+	defer opLock.RUnlock()
+	for i := 0; i < r.Count; i++ {
+		if _, ok := OPSerializerMap[r.Op(i)]; ok {
+			return OpRange{}, fmt.Errorf("op range %v contains the registered op %d", r, r.Op(i))
+		}
+	}
+	opRanges = append(opRanges, r)
+	sort.Slice(opRanges, func(i, j int) bool { return opRanges[i].First < opRanges[j].First })
+	return r, nil
+}
+
+// ReleaseOpRange frees the ops of the subsystem name, along with the commands
+// registered in them, so that they can be reserved again.
+func ReleaseOpRange(name string) error {
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+	if name == builtinOpRange {
+		return fmt.Errorf("op range %s cannot be released", name)
+	}
+	for i, r := range opRanges {
+		if r.Name != name {
+			continue
+		}
+		opLock.Lock()
+		for j := 0; j < r.Count; j++ {
+			unregisterOp(r.Op(j))
+		}
+		opLock.Unlock()
+		opRanges = append(opRanges[:i], opRanges[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("op range %s is not reserved", name)
+}
+
+// OpRanges returns the reserved ranges ordered by their first op.
+func OpRanges() []OpRange {
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+	return append([]OpRange(nil), opRanges...)
+}
+
+// OpRangeOf returns the range op belongs to.
+func OpRangeOf(op P2PCommandOp) (OpRange, bool) {
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+	return opRangeOf(op)
+}
+
+// opRangeOf must be called with opRangeLock held.
+func opRangeOf(op P2PCommandOp) (OpRange, bool) {
+	for _, r := range opRanges {
+		if r.Contains(op) {
+			return r, true
+		}
+	}
+	return OpRange{}, false
+}
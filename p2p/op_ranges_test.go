@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpRanges(t *testing.T) {
+	sync, err := ReserveOpRange("sync", MaxOPNum+150, 4)
+	assert.NoError(t, err)
+	defer ReleaseOpRange("sync")
+	assert.Equal(t, MaxOPNum+153, sync.Last())
+	assert.Equal(t, MaxOPNum+151, sync.Op(1))
+	assert.Panics(t, func() { sync.Op(4) })
+
+	// overlaps are reported with both ranges
+	_, err = ReserveOpRange("mining", MaxOPNum+152, 4)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "overlaps sync"), err.Error())
+	}
+	_, err = ReserveOpRange("mining", Ping, 1)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "overlaps builtin"), err.Error())
+	}
+	_, err = ReserveOpRange("sync", MaxOPNum+160, 1)
+	assert.Error(t, err)
+	_, err = ReserveOpRange("mining", 250, 10)
+	assert.Error(t, err)
+	_, err = ReserveOpRange("mining", MaxOPNum+160, 0)
+	assert.Error(t, err)
+
+	// allocation fills the first gap large enough
+	mempool, err := AllocOpRange("mempool", 8)
+	assert.NoError(t, err)
+	defer ReleaseOpRange("mempool")
+	assert.Equal(t, MaxOPNum, mempool.First)
+	_, err = AllocOpRange("huge", maxOps)
+	assert.Error(t, err)
+
+	r, ok := OpRangeOf(MaxOPNum + 151)
+	assert.True(t, ok)
+	assert.Equal(t, sync, r)
+	r, ok = OpRangeOf(Hello)
+	assert.True(t, ok)
+	assert.Equal(t, builtinOpRange, r.Name)
+	ranges := OpRanges()
+	for i := 1; i < len(ranges); i++ {
+		assert.True(t, ranges[i-1].Last() < ranges[i].First)
+	}
+
+	// the ops of a range are registered through it
+	assert.Error(t, RegisterOp(sync.Op(1), PingPongCommand{}))
+	assert.NoError(t, sync.RegisterOp(1, PingPongCommand{}))
+	assert.True(t, HasCommand(sync.Op(1)))
+	assert.Error(t, sync.RegisterOp(1, PingPongCommand{}))
+	assert.Error(t, sync.RegisterOp(4, PingPongCommand{}))
+	assert.Error(t, ReleaseOpRange(builtinOpRange))
+
+	// released ranges can be reserved again, but not registered in
+	assert.NoError(t, ReleaseOpRange("sync"))
+	assert.False(t, HasCommand(sync.Op(1)))
+	assert.Error(t, ReleaseOpRange("sync"))
+	assert.Error(t, sync.RegisterOp(1, PingPongCommand{}))
+	_, err = ReserveOpRange("sync", sync.First, sync.Count)
+	assert.NoError(t, err)
+
+	// nor can a range claim an op registered outside of it
+	op := MaxOPNum + 170
+	assert.NoError(t, RegisterOp(op, PingPongCommand{}))
+	defer UnregisterOp(op)
+	_, err = ReserveOpRange("mining", op, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,268 @@
+package p2p
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// NonRPCHandler handles a message which expects no response.
+type NonRPCHandler func(peerID string, branch uint32, data []byte) error
+
+// RPCHandler handles a request, the serialized response it returns is sent
+// back to the peer with ResponseOp.
+type RPCHandler struct {
+	ResponseOp P2PCommandOp
+	Category   OpCategory
+	Handle     func(peerID string, branch uint32, data []byte) ([]byte, error)
+}
+
+// OpCategory tells how the messages of an op are scheduled against the other
+// messages of the same peer.
+type OpCategory uint8
+
+const (
+	// OpParallel messages may be handled concurrently, like transaction
+	// gossip.
+	OpParallel OpCategory = iota
+	// OpOrdered messages are handled one at a time, in the order they were
+	// received among the ordered messages of the peer, like blocks and
+	// headers.
+	OpOrdered
+)
+
+var (
+	opLock         sync.RWMutex
+	nonRPCHandlers = make(map[P2PCommandOp]NonRPCHandler)
+	rpcHandlers    = make(map[P2PCommandOp]RPCHandler)
+	opCategories   = map[P2PCommandOp]OpCategory{
+		NewTipMsg:                                  OpOrdered,
+		NewBlockMinorMsg:                           OpOrdered,
+		NewRootBlockMsg:                            OpOrdered,
+		NewCrossShardTxListMsg:                     OpOrdered,
+		GetRootBlockHeaderListResponseMsg:          OpOrdered,
+		GetRootBlockListResponseMsg:                OpOrdered,
+		GetMinorBlockListResponseMsg:               OpOrdered,
+		GetMinorBlockHeaderListResponseMsg:         OpOrdered,
+		GetRootBlockHeaderListWithSkipResponseMsg:  OpOrdered,
+		GetMinorBlockHeaderListWithSkipResponseMsg: OpOrdered,
+		GetRootBlockHeadersResponseMsg:             OpOrdered,
+		GetMinorBlockHeadersResponseMsg:            OpOrdered,
+		RootTipUpdateMsg:                           OpOrdered,
+	}
+	// builtinOps are the ops the protocol handler handles itself
+	builtinOps = make(map[P2PCommandOp]bool)
+)
+
+// RegisterOp installs the command struct of an op which is not part of the
+// builtin protocol, so that subsystems can define their own messages. The ops
+// of a reserved range are registered through OpRange.RegisterOp instead.
+func RegisterOp(op P2PCommandOp, cmd interface{}) error {
+	opRangeLock.Lock()
+	defer opRangeLock.Unlock()
+	if r, ok := opRangeOf(op); ok && r.Name != builtinOpRange {
+		return fmt.Errorf("op %d belongs to op range %v", op, r)
+	}
+	return registerOp(op, cmd)
+}
+
+// registerOp must be called with opRangeLock held.
+func registerOp(op P2PCommandOp, cmd interface{}) error {
+	opLock.Lock()
+	defer opLock.Unlock()
+	if op < MaxOPNum {
+		return fmt.Errorf("op %d is reserved", op)
+	}
+	if _, ok := OPSerializerMap[op]; ok {
+		return fmt.Errorf("op %d is already registered", op)
+	}
+	OPSerializerMap[op] = cmd
+	return nil
+}
+
+// UnregisterOp removes the command registered for op, along with its later
+// versions, builtin ops are kept.
+func UnregisterOp(op P2PCommandOp) {
+	opLock.Lock()
+	defer opLock.Unlock()
+	unregisterOp(op)
+}
+
+// unregisterOp must be called with opLock held.
+func unregisterOp(op P2PCommandOp) {
+	if op < MaxOPNum {
+		return
+	}
+	delete(OPSerializerMap, op)
+	delete(opVersions, op)
+}
+
+// HasCommand reports whether op has a builtin or registered command.
+func HasCommand(op P2PCommandOp) bool {
+	opLock.RLock()
+	defer opLock.RUnlock()
+	_, ok := OPSerializerMap[op]
+	return ok
+}
+
+// RegisterNonRPCHandler installs the handler of a message op, its messages are
+// scheduled according to category.
+func RegisterNonRPCHandler(op P2PCommandOp, category OpCategory, fn NonRPCHandler) error {
+	opLock.Lock()
+	defer opLock.Unlock()
+	if err := checkHandlerOp(op); err != nil {
+		return err
+	}
+	nonRPCHandlers[op] = fn
+	opCategories[op] = category
+	return nil
+}
+
+// RegisterRPCHandler installs the handler of a request op, its requests are
+// scheduled according to the category of the handler.
+func RegisterRPCHandler(op P2PCommandOp, handler RPCHandler) error {
+	opLock.Lock()
+	defer opLock.Unlock()
+	if err := checkHandlerOp(op); err != nil {
+		return err
+	}
+	rpcHandlers[op] = handler
+	opCategories[op] = handler.Category
+	return nil
+}
+
+// UnregisterHandler removes the handler registered for op, so that another
+// one can be registered.
+func UnregisterHandler(op P2PCommandOp) {
+	opLock.Lock()
+	defer opLock.Unlock()
+	if op < MaxOPNum {
+		return
+	}
+	delete(nonRPCHandlers, op)
+	delete(rpcHandlers, op)
+	delete(opCategories, op)
+}
+
+// RegisterBuiltinHandlers records the ops of the builtin protocol which the
+// protocol handler handles itself, OpTable reports the others as unhandled.
+func RegisterBuiltinHandlers(ops ...P2PCommandOp) error {
+	opLock.Lock()
+	defer opLock.Unlock()
+	for _, op := range ops {
+		if op >= MaxOPNum {
+			return fmt.Errorf("op %d is not builtin", op)
+		}
+	}
+	for _, op := range ops {
+		builtinOps[op] = true
+	}
+	return nil
+}
+
+// GetOpCategory returns how the messages of op are scheduled, ops which are
+// not classified are parallel.
+func GetOpCategory(op P2PCommandOp) OpCategory {
+	opLock.RLock()
+	defer opLock.RUnlock()
+	return opCategories[op]
+}
+
+// checkHandlerOp must be called with opLock held.
+func checkHandlerOp(op P2PCommandOp) error {
+	if op < MaxOPNum {
+		return fmt.Errorf("op %d is reserved", op)
+	}
+	_, nonRPC := nonRPCHandlers[op]
+	_, rpc := rpcHandlers[op]
+	if nonRPC || rpc {
+		return fmt.Errorf("handler of op %d is already registered", op)
+	}
+	return nil
+}
+
+// GetNonRPCHandler returns the registered handler of a message op.
+func GetNonRPCHandler(op P2PCommandOp) (NonRPCHandler, bool) {
+	opLock.RLock()
+	defer opLock.RUnlock()
+	fn, ok := nonRPCHandlers[op]
+	return fn, ok
+}
+
+// GetRPCHandler returns the registered handler of a request op.
+func GetRPCHandler(op P2PCommandOp) (RPCHandler, bool) {
+	opLock.RLock()
+	defer opLock.RUnlock()
+	handler, ok := rpcHandlers[op]
+	return handler, ok
+}
+
+// Handler categories of an op in OpTable.
+const (
+	OpHandlerBuiltin = "builtin" // handled by the protocol itself
+	OpHandlerNonRPC  = "non-rpc"
+	OpHandlerRPC     = "rpc"
+	OpHandlerNone    = "none"
+)
+
+// OpInfo describes how an op is registered.
+type OpInfo struct {
+	Op         P2PCommandOp `json:"op"`
+	Serializer string       `json:"serializer"` // command type, empty if none
+	Handler    string       `json:"handler"`
+	ResponseOp P2PCommandOp `json:"responseOp,omitempty"` // set for rpc handlers
+}
+
+// OpTable returns a snapshot of the registered ops ordered by op. The ops
+// passed to RegisterBuiltinHandlers are builtin, the others are reported with
+// the handler registered for them, if any, so that an op with a command but
+// no handler stands out.
+func OpTable() []OpInfo {
+	opLock.RLock()
+	defer opLock.RUnlock()
+
+	infos := make(map[P2PCommandOp]*OpInfo)
+	info := func(op P2PCommandOp) *OpInfo {
+		if infos[op] == nil {
+			infos[op] = &OpInfo{Op: op, Handler: OpHandlerNone}
+			if builtinOps[op] {
+				infos[op].Handler = OpHandlerBuiltin
+			}
+		}
+		return infos[op]
+	}
+	for op, cmd := range OPSerializerMap {
+		info(op).Serializer = reflect.TypeOf(cmd).Name()
+	}
+	for op := range nonRPCHandlers {
+		info(op).Handler = OpHandlerNonRPC
+	}
+	for op, handler := range rpcHandlers {
+		info(op).Handler = OpHandlerRPC
+		info(op).ResponseOp = handler.ResponseOp
+	}
+
+	table := make([]OpInfo, 0, len(infos))
+	for _, info := range infos {
+		table = append(table, *info)
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].Op < table[j].Op })
+	return table
+}
+
+// SendQKCMsg serializes payload as the command of op and writes it to w. It
+// fails if op has no registered command.
+func SendQKCMsg(w MsgWriter, op P2PCommandOp, rpcID uint64, metadata Metadata, payload interface{}) error {
+	opLock.RLock()
+	_, ok := OPSerializerMap[op]
+	opLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("op %d has no registered command", op)
+	}
+	msg, err := MakeMsg(op, rpcID, metadata, payload)
+	if err != nil {
+		return err
+	}
+	return w.WriteMsg(msg)
+}
@@ -0,0 +1,143 @@
+package p2p
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterOp(t *testing.T) {
+	op := MaxOPNum + 100
+	assert.Error(t, RegisterOp(Ping, PingPongCommand{}))
+	assert.NoError(t, RegisterOp(op, PingPongCommand{}))
+	defer UnregisterOp(op)
+	assert.Error(t, RegisterOp(op, PingPongCommand{}))
+	assert.Equal(t, "PingPongCommand", op.String())
+
+	fn := func(peerID string, branch uint32, data []byte) error { return nil }
+	assert.Error(t, RegisterNonRPCHandler(Ping, OpParallel, fn))
+	assert.NoError(t, RegisterNonRPCHandler(op, OpOrdered, fn))
+	defer UnregisterHandler(op)
+	assert.Error(t, RegisterNonRPCHandler(op, OpParallel, fn))
+	assert.Error(t, RegisterRPCHandler(op, RPCHandler{ResponseOp: op + 1}))
+	assert.Equal(t, OpOrdered, GetOpCategory(op))
+	assert.Equal(t, OpOrdered, GetOpCategory(NewBlockMinorMsg))
+	assert.Equal(t, OpParallel, GetOpCategory(NewTransactionListMsg))
+
+	_, ok := GetNonRPCHandler(op)
+	assert.True(t, ok)
+	_, ok = GetRPCHandler(op)
+	assert.False(t, ok)
+
+	// unregistered ops can be registered again
+	UnregisterHandler(op)
+	_, ok = GetNonRPCHandler(op)
+	assert.False(t, ok)
+	assert.Equal(t, OpParallel, GetOpCategory(op))
+	UnregisterOp(op)
+	assert.False(t, HasCommand(op))
+	assert.NoError(t, RegisterOp(op, PingPongCommand{}))
+	UnregisterOp(Ping)
+	assert.True(t, HasCommand(Ping))
+}
+
+func TestOpTable(t *testing.T) {
+	cmdOp, msgOp, reqOp := MaxOPNum+110, MaxOPNum+111, MaxOPNum+112
+	assert.NoError(t, RegisterOp(cmdOp, PingPongCommand{}))
+	defer UnregisterOp(cmdOp)
+	assert.NoError(t, RegisterOp(msgOp, PingPongCommand{}))
+	defer UnregisterOp(msgOp)
+	assert.NoError(t, RegisterNonRPCHandler(msgOp, OpParallel, func(string, uint32, []byte) error { return nil }))
+	defer UnregisterHandler(msgOp)
+	assert.NoError(t, RegisterRPCHandler(reqOp, RPCHandler{ResponseOp: msgOp}))
+	defer UnregisterHandler(reqOp)
+	assert.NoError(t, RegisterBuiltinHandlers(Hello))
+	assert.Error(t, RegisterBuiltinHandlers(cmdOp))
+
+	infos := make(map[P2PCommandOp]OpInfo)
+	table := OpTable()
+	for i, info := range table {
+		if i > 0 {
+			assert.True(t, table[i-1].Op < info.Op)
+		}
+		infos[info.Op] = info
+	}
+	assert.Equal(t, OpInfo{Op: Hello, Serializer: "HelloCmd", Handler: OpHandlerBuiltin}, infos[Hello])
+	// the builtin ops without a handler are not labelled builtin
+	assert.Equal(t, OpInfo{Op: GetPeerListRequestMsg, Serializer: "GetPeerListRequest", Handler: OpHandlerNone}, infos[GetPeerListRequestMsg])
+	assert.Equal(t, OpInfo{Op: cmdOp, Serializer: "PingPongCommand", Handler: OpHandlerNone}, infos[cmdOp])
+	assert.Equal(t, OpInfo{Op: msgOp, Serializer: "PingPongCommand", Handler: OpHandlerNonRPC}, infos[msgOp])
+	assert.Equal(t, OpInfo{Op: reqOp, Handler: OpHandlerRPC, ResponseOp: msgOp}, infos[reqOp])
+}
+
+func TestSendQKCMsg(t *testing.T) {
+	r, w := MsgPipe()
+	defer r.Close()
+	defer w.Close()
+
+	assert.Error(t, SendQKCMsg(w, MaxOPNum+101, 0, Metadata{}, &PingPongCommand{}))
+
+	errc := make(chan error, 1)
+	go func() { errc <- SendQKCMsg(w, Ping, 7, Metadata{Branch: 2}, &PingPongCommand{}) }()
+	msg, err := r.ReadMsg()
+	assert.NoError(t, err)
+	payload, err := ioutil.ReadAll(msg.Payload)
+	assert.NoError(t, err)
+	qkcMsg, err := DecodeQKCMsg(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, Ping, qkcMsg.Op)
+	assert.Equal(t, uint64(7), qkcMsg.RpcID)
+	assert.Equal(t, uint32(2), qkcMsg.MetaData.Branch)
+	assert.NoError(t, <-errc)
+}
+
+type pingPongCommandV2 struct {
+	Message common.Hash
+	Nonce   uint64
+}
+
+func TestOpVersions(t *testing.T) {
+	op := MaxOPNum + 120
+	assert.Error(t, RegisterOpVersion(op, 2, pingPongCommandV2{}))
+	assert.NoError(t, RegisterOp(op, PingPongCommand{}))
+	defer UnregisterOp(op)
+	assert.Error(t, RegisterOpVersion(op, 0, pingPongCommandV2{}))
+	assert.NoError(t, RegisterOpVersion(op, 2, pingPongCommandV2{}))
+	assert.Error(t, RegisterOpVersion(op, 2, pingPongCommandV2{}))
+
+	for version, want := range map[uint32]interface{}{
+		0: PingPongCommand{}, 1: PingPongCommand{}, 2: pingPongCommandV2{}, 5: pingPongCommandV2{},
+	} {
+		cmd, ok := GetSerializer(op, version)
+		assert.True(t, ok)
+		assert.IsType(t, want, cmd, "version %d", version)
+	}
+
+	r, w := MsgPipe()
+	defer r.Close()
+	defer w.Close()
+	roundTrip := func(version uint32, payload interface{}) interface{} {
+		errc := make(chan error, 1)
+		go func() { errc <- SendVersionedQKCMsg(w, op, version, 0, Metadata{}, payload) }()
+		msg, err := r.ReadMsg()
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(msg.Payload)
+		assert.NoError(t, err)
+		qkcMsg, err := DecodeQKCMsg(body)
+		assert.NoError(t, err)
+		assert.NoError(t, <-errc)
+		cmd, err := DecodeQKCPayload(qkcMsg.Op, version, qkcMsg.Data)
+		assert.NoError(t, err)
+		return cmd
+	}
+	// older peers keep the layout of the registered command
+	assert.Equal(t, &PingPongCommand{Message: common.Hash{1}}, roundTrip(0, &PingPongCommand{Message: common.Hash{1}}))
+	assert.Equal(t, &pingPongCommandV2{Message: common.Hash{2}, Nonce: 3}, roundTrip(2, &pingPongCommandV2{Message: common.Hash{2}, Nonce: 3}))
+
+	assert.Error(t, SendVersionedQKCMsg(w, op, 2, 0, Metadata{}, &PingPongCommand{}))
+	assert.Error(t, SendVersionedQKCMsg(w, op, 0, 0, Metadata{}, pingPongCommandV2{}))
+	_, err := DecodeQKCPayload(op, 2, []byte{1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/QuarkChain/goquarkchain/serialize"
+)
+
+// opVersion is the command of an op from protocol version since on.
+type opVersion struct {
+	since uint32
+	cmd   interface{}
+}
+
+// opVersions holds the later commands of the ops whose payload changed,
+// sorted by version. The command in OPSerializerMap is used from version 0
+// until the first of them, so peers negotiated at an old version keep the
+// old layout.
+var opVersions = map[P2PCommandOp][]opVersion{
+	Hello: {{since: HelloExtVersion, cmd: HelloExtCmd{}}},
+}
+
+// RegisterOpVersion installs cmd as the command of op for the peers
+// negotiated at version or later, up to the next version registered for op.
+func RegisterOpVersion(op P2PCommandOp, version uint32, cmd interface{}) error {
+	opLock.Lock()
+	defer opLock.Unlock()
+	if _, ok := OPSerializerMap[op]; !ok {
+		return fmt.Errorf("op %d has no registered command", op)
+	}
+	if version == 0 {
+		return fmt.Errorf("version 0 of op %d is its registered command", op)
+	}
+	versions := opVersions[op]
+	for _, v := range versions {
+		if v.since == version {
+			return fmt.Errorf("version %d of op %d is already registered", version, op)
+		}
+	}
+	versions = append(versions, opVersion{since: version, cmd: cmd})
+	sort.Slice(versions, func(i, j int) bool { return versions[i].since < versions[j].since })
+	opVersions[op] = versions
+	return nil
+}
+
+// GetSerializer returns the command of op for a peer negotiated at version.
+func GetSerializer(op P2PCommandOp, version uint32) (interface{}, bool) {
+	opLock.RLock()
+	defer opLock.RUnlock()
+	versions := opVersions[op]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].since <= version {
+			return versions[i].cmd, true
+		}
+	}
+	cmd, ok := OPSerializerMap[op]
+	return cmd, ok
+}
+
+// DecodeQKCPayload deserializes the data of an op message received from a
+// peer negotiated at version. It returns a pointer to a new value of the
+// command of op for that version.
+func DecodeQKCPayload(op P2PCommandOp, version uint32, data []byte) (interface{}, error) {
+	cmd, ok := GetSerializer(op, version)
+	if !ok {
+		return nil, fmt.Errorf("op %d has no registered command", op)
+	}
+	val := reflect.New(reflect.TypeOf(cmd))
+	if err := serialize.DeserializeFromBytes(data, val.Interface()); err != nil {
+		return nil, err
+	}
+	return val.Interface(), nil
+}
+
+// SendVersionedQKCMsg is SendQKCMsg for a peer negotiated at version, it fails
+// if payload is not the command of op for that version.
+func SendVersionedQKCMsg(w MsgWriter, op P2PCommandOp, version uint32, rpcID uint64, metadata Metadata, payload interface{}) error {
+	cmd, ok := GetSerializer(op, version)
+	if !ok {
+		return fmt.Errorf("op %d has no registered command", op)
+	}
+	typ := reflect.TypeOf(payload)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if want := reflect.TypeOf(cmd); typ != want {
+		return fmt.Errorf("op %d at version %d takes %v, got %v", op, version, want, typ)
+	}
+	msg, err := MakeMsg(op, rpcID, metadata, payload)
+	if err != nil {
+		return err
+	}
+	return w.WriteMsg(msg)
+}
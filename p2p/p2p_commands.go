@@ -37,6 +37,26 @@ const (
 	NewRootBlockMsg
 	GetMinorBlockHeaderListWithSkipRequestMsg
 	GetMinorBlockHeaderListWithSkipResponseMsg
+	DisconnectMsg
+	NewCrossShardTxListMsg
+	CapabilitiesMsg
+	GetRootBlockHeadersRequestMsg
+	GetRootBlockHeadersResponseMsg
+	GetMinorBlockHeadersRequestMsg
+	GetMinorBlockHeadersResponseMsg
+	NewTransactionHashesMsg
+	GetTransactionsRequestMsg
+	GetTransactionsResponseMsg
+	GetRootBlockRequestMsg
+	GetRootBlockResponseMsg
+	GetMinorBlockRequestMsg
+	GetMinorBlockResponseMsg
+	RootTipUpdateMsg
+	GetAccountDataRequestMsg
+	GetAccountDataResponseMsg
+	HelloAckMsg
+	GetShardMasksRequestMsg
+	GetShardMasksResponseMsg
 	MaxOPNum
 )
 
@@ -63,11 +83,33 @@ var OPSerializerMap = map[P2PCommandOp]interface{}{
 	NewRootBlockMsg:                            NewRootBlockCommand{},
 	GetMinorBlockHeaderListWithSkipRequestMsg:  GetMinorBlockHeaderListWithSkipRequest{},
 	GetMinorBlockHeaderListWithSkipResponseMsg: GetMinorBlockHeaderListResponse{},
+	DisconnectMsg:                              DisconnectCommand{},
+	NewCrossShardTxListMsg:                     NewCrossShardTxList{},
+	CapabilitiesMsg:                            CapabilitiesCommand{},
+	GetRootBlockHeadersRequestMsg:              GetRootBlockHeadersRequest{},
+	GetRootBlockHeadersResponseMsg:             GetRootBlockHeadersResponse{},
+	GetMinorBlockHeadersRequestMsg:             GetMinorBlockHeadersRequest{},
+	GetMinorBlockHeadersResponseMsg:            GetMinorBlockHeadersResponse{},
+	NewTransactionHashesMsg:                    NewTransactionHashes{},
+	GetTransactionsRequestMsg:                  GetTransactionsRequest{},
+	GetTransactionsResponseMsg:                 GetTransactionsResponse{},
+	GetRootBlockRequestMsg:                     GetRootBlockRequest{},
+	GetRootBlockResponseMsg:                    GetRootBlockResponse{},
+	GetMinorBlockRequestMsg:                    GetMinorBlockRequest{},
+	GetMinorBlockResponseMsg:                   GetMinorBlockResponse{},
+	RootTipUpdateMsg:                           RootTipUpdate{},
+	GetAccountDataRequestMsg:                   GetAccountDataRequest{},
+	GetAccountDataResponseMsg:                  GetAccountDataResponse{},
+	HelloAckMsg:                                HelloAckCommand{},
+	GetShardMasksRequestMsg:                    GetShardMasksRequest{},
+	GetShardMasksResponseMsg:                   GetShardMasksResponse{},
 }
 
 func (p P2PCommandOp) String() string {
+	opLock.RLock()
+	defer opLock.RUnlock()
 	if _, ok := OPSerializerMap[p]; !ok {
-		strconv.Itoa(int(p))
+		return strconv.Itoa(int(p))
 	}
 	return reflect.TypeOf(OPSerializerMap[p]).Name()
 }
@@ -101,6 +143,29 @@ type HelloCmd struct {
 	GenesisRootBlockHash common.Hash
 }
 
+// HelloExtVersion is the first qkc protocol version whose peers send a
+// HelloExtCmd and ack the hello of the remote, peers negotiated at an older
+// version send the HelloCmd alone.
+const HelloExtVersion = 2
+
+// HelloExtCmd is the hello of the peers negotiated at HelloExtVersion or
+// later, the fields of HelloCmd followed by the extensions.
+type HelloExtCmd struct {
+	HelloCmd
+	// Nonce is drawn at random for each handshake, the remote proves its
+	// hello is not replayed by echoing it in a HelloAckCommand.
+	Nonce common.Hash
+	// Serializers are the names of the serializers the sender runs besides
+	// the default one, see NegotiateSerializer.
+	Serializers []string `bytesizeofslicelen:"4"`
+}
+
+// HelloAckCommand follows the hello exchange, echoing the Nonce of the hello
+// received from the remote.
+type HelloAckCommand struct {
+	Nonce common.Hash
+}
+
 // Tip new minor block header list
 type Tip struct {
 	RootBlockHeader      *types.RootBlockHeader
@@ -180,6 +245,143 @@ type PingPongCommand struct {
 	Message common.Hash
 }
 
+// DisconnectCommand tells the remote peer why it is being disconnected
+type DisconnectCommand struct {
+	Reason QKCDiscReason
+}
+
+// NewCrossShardTxList carries the cross shard deposits a minor block makes to
+// the shard in the branch of the message metadata.
+type NewCrossShardTxList struct {
+	MinorBlockHash common.Hash
+	TxList         []*types.CrossShardTransactionDeposit `bytesizeofslicelen:"4"`
+}
+
+// Optional features a peer may advertise in CapabilitiesCommand.
+const (
+	// CapCrossShardTxList is advertised by peers handling NewCrossShardTxListMsg.
+	CapCrossShardTxList = "xshard-tx-list"
+	// CapTxAnnounce is advertised by peers handling NewTransactionHashesMsg
+	// and GetTransactionsRequestMsg.
+	CapTxAnnounce = "tx-announce"
+	// CapRootTipUpdate is advertised by peers handling RootTipUpdateMsg.
+	CapRootTipUpdate = "root-tip-update"
+	// CapShardMasks is advertised by peers answering GetShardMasksRequestMsg.
+	CapShardMasks = "shard-masks"
+)
+
+// CapabilitiesCommand lists the optional features its sender supports, it is
+// sent once right after the hello.
+type CapabilitiesCommand struct {
+	Capabilities []string `bytesizeofslicelen:"4"`
+}
+
+// GetRootBlockHeadersRequest asks for up to Count headers of the canonical
+// root chain starting at the block Start, towards genesis if Reverse is set.
+type GetRootBlockHeadersRequest struct {
+	Start   common.Hash
+	Count   uint32
+	Reverse bool
+}
+
+// GetRootBlockHeadersResponse answers GetRootBlockHeadersRequest, it is empty
+// if the start block is unknown or not canonical.
+type GetRootBlockHeadersResponse struct {
+	Headers []*types.RootBlockHeader `bytesizeofslicelen:"4"`
+}
+
+// GetMinorBlockHeadersRequest asks for up to Count headers of the shard in the
+// branch of the message metadata, from the block Start towards genesis.
+type GetMinorBlockHeadersRequest struct {
+	Start common.Hash
+	Count uint32
+}
+
+// GetMinorBlockHeadersResponse answers GetMinorBlockHeadersRequest, NotServed
+// is set if the responder does not run the shard.
+type GetMinorBlockHeadersResponse struct {
+	NotServed bool
+	Headers   []*types.MinorBlockHeader `bytesizeofslicelen:"4"`
+}
+
+// NewTransactionHashes announces transactions of the shard in the branch of
+// the message metadata, peers fetch the ones they miss with
+// GetTransactionsRequest.
+type NewTransactionHashes struct {
+	Hashes []common.Hash `bytesizeofslicelen:"4"`
+}
+
+// GetTransactionsRequest asks for the bodies of announced transactions of the
+// shard in the branch of the message metadata.
+type GetTransactionsRequest struct {
+	Hashes []common.Hash `bytesizeofslicelen:"4"`
+}
+
+// GetTransactionsResponse answers GetTransactionsRequest with the requested
+// transactions the responder still has.
+type GetTransactionsResponse struct {
+	TransactionList []*types.Transaction `bytesizeofslicelen:"4"`
+}
+
+// GetRootBlockRequest asks for the full root block of Hash.
+type GetRootBlockRequest struct {
+	Hash common.Hash
+}
+
+// GetRootBlockResponse answers GetRootBlockRequest, NotFound is set and Block
+// left nil if the responder does not have the block.
+type GetRootBlockResponse struct {
+	NotFound bool
+	Block    *types.RootBlock `ser:"nil"`
+}
+
+// GetMinorBlockRequest asks for the full minor block of Hash in the shard of
+// the branch of the message metadata.
+type GetMinorBlockRequest struct {
+	Hash common.Hash
+}
+
+// GetMinorBlockResponse answers GetMinorBlockRequest. NotServed is set if the
+// responder does not run the shard, NotFound if the shard lacks the block.
+type GetMinorBlockResponse struct {
+	NotServed bool
+	NotFound  bool
+	Block     *types.MinorBlock `ser:"nil"`
+}
+
+// RootTipUpdate summarizes the best root block of its sender, it is sent
+// periodically and whenever the tip changes, reorgs included.
+type RootTipUpdate struct {
+	Number          uint32
+	Hash            common.Hash
+	TotalDifficulty *big.Int
+}
+
+// GetAccountDataRequest asks for the latest state of the account of
+// Recipient in the shard of the branch of the message metadata.
+type GetAccountDataRequest struct {
+	Recipient account.Recipient
+}
+
+// GetAccountDataResponse answers GetAccountDataRequest, NotServed is set and
+// Balance left nil if the responder does not run the shard. Accounts which do
+// not exist have no balance, a zero nonce and the hash of empty code.
+type GetAccountDataResponse struct {
+	NotServed bool
+	Balance   *types.TokenBalances `ser:"nil"`
+	Nonce     uint64
+	CodeHash  common.Hash
+}
+
+// GetShardMasksRequest asks which shards the responder serves.
+type GetShardMasksRequest struct{}
+
+// GetShardMasksResponse answers GetShardMasksRequest with the chain masks of
+// the slaves of the responder, which cover the shards it serves.
+type GetShardMasksResponse struct {
+	ChainMaskList []*types.ChainMask `bytesizeofslicelen:"4"`
+}
+
 type NewRootBlockCommand struct {
 	Block *types.RootBlock
 }
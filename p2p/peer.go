@@ -17,14 +17,17 @@
 package p2p
 
 import (
+	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
@@ -35,14 +38,21 @@ import (
 
 var (
 	ErrShuttingDown = errors.New("shutting down")
+	// ErrPeerClosed is returned by the reads of a protocol once the remote
+	// disconnected or ended the stream. The reads return the error which tore
+	// the connection down otherwise.
+	ErrPeerClosed = errors.New("peer closed the connection")
 )
 
 const (
-	baseProtocolVersion    = 5
+	baseProtocolVersion    = 6
 	baseProtocolLength     = uint64(16)
 	baseProtocolMaxMsgSize = 2 * 1024
 
 	snappyProtocolVersion = 5
+	// adaptiveSnappyProtocolVersion flags compressed qkc frames in their
+	// header, so that frames which do not shrink are sent plain.
+	adaptiveSnappyProtocolVersion = 6
 
 	pingInterval = 15 * time.Second
 )
@@ -101,6 +111,8 @@ type PeerEvent struct {
 
 // Peer represents a connected remote node.
 type Peer struct {
+	lastActive int64 // unix nano time of the last message read, atomic
+
 	rw      *conn
 	running map[string]*protoRW
 	log     log.Logger
@@ -109,10 +121,13 @@ type Peer struct {
 	wg       sync.WaitGroup
 	protoErr chan error
 	closed   chan struct{}
+	closeErr error // why the connection closed, set before closed is
 	disc     chan DiscReason
 
 	// events receives message send / receive events if set
 	events *event.Feed
+	// reputation scores the behavior of the peer, nil if it is not tracked
+	reputation *nodefilter.Reputation
 }
 
 // NewPeer returns a peer for testing purposes.
@@ -125,6 +140,32 @@ func NewPeer(id enode.ID, name string, caps []Cap) *Peer {
 	return peer
 }
 
+// NewPeerWithKey returns a peer for testing purposes which authenticated
+// with key.
+func NewPeerWithKey(key *ecdsa.PrivateKey, name string, caps []Cap) *Peer {
+	pipe, _ := net.Pipe()
+	node := enode.NewV4(&key.PublicKey, net.IPv4(127, 0, 0, 1), 0, 0)
+	conn := &conn{fd: pipe, transport: nil, node: node, caps: caps, name: name}
+	peer := newPeer(conn, nil)
+	close(peer.closed) // ensures Disconnect doesn't block
+	return peer
+}
+
+// NewInboundPeer returns a peer for testing purposes which dialed us.
+func NewInboundPeer(id enode.ID, name string, caps []Cap) *Peer {
+	peer := NewPeer(id, name, caps)
+	peer.rw.set(inboundConn, true)
+	return peer
+}
+
+// NewInboundPeerWithKey returns a peer for testing purposes which dialed us
+// and authenticated with key.
+func NewInboundPeerWithKey(key *ecdsa.PrivateKey, name string, caps []Cap) *Peer {
+	peer := NewPeerWithKey(key, name, caps)
+	peer.rw.set(inboundConn, true)
+	return peer
+}
+
 // ID returns the node's public key.
 func (p *Peer) ID() enode.ID {
 	return p.rw.node.ID()
@@ -171,6 +212,76 @@ func (p *Peer) String() string {
 	return fmt.Sprintf("Peer %x %v", id[:8], p.RemoteAddr())
 }
 
+// Snappy reports whether the frames exchanged with the peer are compressed,
+// and whether compression is adaptive.
+func (p *Peer) Snappy() (enabled, adaptive bool) {
+	q, ok := p.rw.transport.(*qkcRlp)
+	if !ok {
+		return false, false
+	}
+	return q.snappy, q.adaptiveSnappy
+}
+
+// ClockSkew returns how far the clock of the peer was ahead of ours in the
+// handshake, it is unknown for peers not sending their clock.
+func (p *Peer) ClockSkew() (time.Duration, bool) {
+	return p.rw.skew, p.rw.skewKnown
+}
+
+// CompressionDict returns the ID of the dictionary the frames exchanged with
+// the peer are deflated with, 0 if there is none.
+func (p *Peer) CompressionDict() uint64 {
+	q, ok := p.rw.transport.(*qkcRlp)
+	if !ok || q.dict == nil {
+		return 0
+	}
+	return q.dict.id
+}
+
+// QKCMetrics returns the traffic counters of the peer, nil if the peer is
+// not connected over a qkc transport.
+func (p *Peer) QKCMetrics() *QKCMetrics {
+	q, ok := p.rw.transport.(*qkcRlp)
+	if !ok {
+		return nil
+	}
+	m := q.Metrics()
+	return &m
+}
+
+// Penalize lowers the reputation of the peer for a protocol violation. The
+// peer is disconnected if it gets banned.
+func (p *Peer) Penalize(penalty int) {
+	if p.reputation == nil {
+		return
+	}
+	if p.reputation.Penalize(p.Node().IP().String(), penalty) {
+		p.log.Warn("Peer banned for misbehaving")
+		p.Disconnect(DiscUselessPeer)
+	}
+}
+
+// Score returns the reputation score of the peer, 0 if it is not tracked.
+func (p *Peer) Score() int {
+	if p.reputation == nil {
+		return 0
+	}
+	return p.reputation.Score(p.Node().IP().String())
+}
+
+// Reward raises the reputation of the peer for good behavior.
+func (p *Peer) Reward(reward int) {
+	if p.reputation == nil {
+		return
+	}
+	p.reputation.Reward(p.Node().IP().String(), reward)
+}
+
+// Idle returns how long the peer has not sent anything.
+func (p *Peer) Idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActive)))
+}
+
 // Inbound returns true if the peer is an inbound connection
 func (p *Peer) Inbound() bool {
 	return p.rw.is(inboundConn)
@@ -185,8 +296,9 @@ func newPeer(conn *conn, protocols []Protocol) *Peer {
 		disc:     make(chan DiscReason),
 		protoErr: make(chan error, len(protomap)+1), // protocols + pingLoop
 		closed:   make(chan struct{}),
-		log:      log.New("id", conn.node.ID(), "conn", conn.flags),
+		log:      log.New("id", conn.node.ID(), "addr", conn.fd.RemoteAddr(), "conn", conn.flags),
 	}
+	p.lastActive = time.Now().UnixNano()
 	return p
 }
 
@@ -237,6 +349,10 @@ loop:
 		}
 	}
 
+	p.closeErr = err
+	if remoteRequested || err == io.EOF {
+		p.closeErr = ErrPeerClosed
+	}
 	close(p.closed)
 	p.rw.close(reason)
 	p.wg.Wait()
@@ -270,6 +386,7 @@ func (p *Peer) readLoop(errc chan<- error) {
 			return
 		}
 		msg.ReceivedAt = time.Now()
+		atomic.StoreInt64(&p.lastActive, msg.ReceivedAt.UnixNano())
 		if err = p.handle(msg); err != nil {
 			errc <- err
 			return
@@ -319,6 +436,19 @@ func countMatchingProtocols(protocols []Protocol, caps []Cap) int {
 	return n
 }
 
+// sharesProtocolName reports whether caps contain any of the protocols,
+// regardless of its version.
+func sharesProtocolName(protocols []Protocol, caps []Cap) bool {
+	for _, cap := range caps {
+		for _, proto := range protocols {
+			if proto.Name == cap.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // matchProtocols creates structures for matching named subprotocols.
 func matchProtocols(protocols []Protocol, caps []Cap, rw MsgReadWriter) map[string]*protoRW {
 	sort.Sort(capsByNameAndVersion(caps))
@@ -349,6 +479,7 @@ func (p *Peer) startProtocols(writeStart <-chan struct{}, writeErr chan<- error)
 	for _, proto := range p.running {
 		proto := proto
 		proto.closed = p.closed
+		proto.closeErr = &p.closeErr
 		proto.wstart = writeStart
 		proto.werr = writeErr
 		var rw MsgReadWriter = proto
@@ -361,7 +492,7 @@ func (p *Peer) startProtocols(writeStart <-chan struct{}, writeErr chan<- error)
 			if err == nil {
 				p.log.Trace(fmt.Sprintf("Protocol %s/%d returned", proto.Name, proto.Version))
 				err = errProtocolReturned
-			} else if err != io.EOF {
+			} else if err != ErrPeerClosed {
 				p.log.Trace(fmt.Sprintf("Protocol %s/%d failed", proto.Name, proto.Version), "err", err)
 			}
 			p.protoErr <- err
@@ -383,12 +514,13 @@ func (p *Peer) getProto(code uint64) (*protoRW, error) {
 
 type protoRW struct {
 	Protocol
-	in     chan Msg        // receives read messages
-	closed <-chan struct{} // receives when peer is shutting down
-	wstart <-chan struct{} // receives when write may start
-	werr   chan<- error    // for write results
-	offset uint64
-	w      MsgWriter
+	in       chan Msg        // receives read messages
+	closed   <-chan struct{} // receives when peer is shutting down
+	closeErr *error          // why the peer shut down, set once closed receives
+	wstart   <-chan struct{} // receives when write may start
+	werr     chan<- error    // for write results
+	offset   uint64
+	w        MsgWriter
 }
 
 func (rw *protoRW) WriteMsg(msg Msg) (err error) {
@@ -410,13 +542,34 @@ func (rw *protoRW) WriteMsg(msg Msg) (err error) {
 	return err
 }
 
+// WriteMsgs writes msgs as one batch, holding the write turn of the peer
+// for all of them.
+func (rw *protoRW) WriteMsgs(msgs []Msg) (err error) {
+	shifted := make([]Msg, len(msgs))
+	for i, msg := range msgs {
+		if msg.Code >= rw.Length {
+			return newPeerError(errInvalidMsgCode, "not handled")
+		}
+		msg.Code += rw.offset
+		shifted[i] = msg
+	}
+	select {
+	case <-rw.wstart:
+		err = WriteMsgs(rw.w, shifted)
+		rw.werr <- err
+	case <-rw.closed:
+		err = ErrShuttingDown
+	}
+	return err
+}
+
 func (rw *protoRW) ReadMsg() (Msg, error) {
 	select {
 	case msg := <-rw.in:
 		msg.Code -= rw.offset
 		return msg, nil
 	case <-rw.closed:
-		return Msg{}, io.EOF
+		return Msg{}, *rw.closeErr
 	}
 }
 
@@ -69,7 +69,8 @@ const (
 	DiscUnexpectedIdentity
 	DiscSelf
 	DiscReadTimeout
-	DiscSubprotocolError = 0x10
+	DiscSubprotocolError            = 0x10
+	DiscTooBusy          DiscReason = 0x11
 )
 
 var discReasonToString = [...]string{
@@ -86,6 +87,7 @@ var discReasonToString = [...]string{
 	DiscSelf:                "connected to self",
 	DiscReadTimeout:         "read timeout",
 	DiscSubprotocolError:    "subprotocol error",
+	DiscTooBusy:             "too many handshakes in flight",
 }
 
 func (d DiscReason) String() string {
@@ -117,3 +119,63 @@ func discReasonForError(err error) DiscReason {
 	}
 	return DiscSubprotocolError
 }
+
+// QKCDiscReason is the reason carried by a qkc DisconnectMsg, sent to the
+// remote peer right before the connection is dropped.
+type QKCDiscReason uint8
+
+const (
+	QKCDiscRequested QKCDiscReason = iota
+	// QKCDiscBadMAC is understood when received, but never sent by us: the
+	// transport drops a connection whose frames fail their MAC before the
+	// protocol sees them, penalizing the peer for it.
+	QKCDiscBadMAC
+	QKCDiscProtocolMismatch
+	QKCDiscUnknownOp
+	QKCDiscTooManyPeers
+	QKCDiscQuitting
+	QKCDiscInvalidHello
+	QKCDiscRateLimited
+	QKCDiscVersionUnsupported
+)
+
+var qkcDiscReasonToString = [...]string{
+	QKCDiscRequested:          "disconnect requested",
+	QKCDiscBadMAC:             "bad MAC",
+	QKCDiscProtocolMismatch:   "protocol mismatch",
+	QKCDiscUnknownOp:          "unknown op",
+	QKCDiscTooManyPeers:       "too many peers",
+	QKCDiscQuitting:           "client quitting",
+	QKCDiscInvalidHello:       "invalid root block header in hello",
+	QKCDiscRateLimited:        "message rate limit exceeded",
+	QKCDiscVersionUnsupported: "protocol version unsupported",
+}
+
+func (d QKCDiscReason) String() string {
+	if int(d) >= len(qkcDiscReasonToString) {
+		return fmt.Sprintf("unknown qkc disconnect reason %d", d)
+	}
+	return qkcDiscReasonToString[d]
+}
+
+func (d QKCDiscReason) Error() string {
+	return d.String()
+}
+
+// DiscReason returns the reason given to the devp2p layer when the
+// connection is dropped for d.
+func (d QKCDiscReason) DiscReason() DiscReason {
+	switch d {
+	case QKCDiscTooManyPeers:
+		return DiscTooManyPeers
+	case QKCDiscQuitting:
+		return DiscQuitting
+	case QKCDiscBadMAC, QKCDiscProtocolMismatch, QKCDiscUnknownOp, QKCDiscInvalidHello:
+		return DiscProtocolError
+	case QKCDiscRateLimited:
+		return DiscSubprotocolError
+	case QKCDiscVersionUnsupported:
+		return DiscIncompatibleVersion
+	}
+	return DiscRequested
+}
@@ -147,6 +147,43 @@ func TestPeerDisconnect(t *testing.T) {
 	}
 }
 
+func TestPeerProtoReadMsgCloseErr(t *testing.T) {
+	errFailed := errors.New("protocol failed")
+	tests := []struct {
+		name  string
+		close func(rw *conn, p *Peer, closer func())
+		want  error
+	}{
+		{"remote disconnect", func(rw *conn, p *Peer, closer func()) { SendItems(rw, discMsg, DiscQuitting) }, ErrPeerClosed},
+		{"remote close", func(rw *conn, p *Peer, closer func()) { closer() }, ErrPeerClosed},
+		{"local disconnect", func(rw *conn, p *Peer, closer func()) { p.Disconnect(DiscReadTimeout) }, DiscReadTimeout},
+		{"protocol failure", func(rw *conn, p *Peer, closer func()) { p.protoErr <- errFailed }, errFailed},
+	}
+	for _, test := range tests {
+		readErr := make(chan error, 1)
+		proto := Protocol{
+			Name:   "a",
+			Length: 5,
+			Run: func(peer *Peer, rw MsgReadWriter) error {
+				_, err := rw.ReadMsg()
+				readErr <- err
+				return err
+			},
+		}
+		closer, rw, p, _ := testPeer([]Protocol{proto})
+		test.close(rw, p, closer)
+		select {
+		case err := <-readErr:
+			if err != test.want {
+				t.Errorf("%s: read returned wrong error: got %v, want %v", test.name, err, test.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: read did not return", test.name)
+		}
+		closer()
+	}
+}
+
 // This test is supposed to verify that Peer can reliably handle
 // multiple causes of disconnection occurring at the same time.
 func TestPeerDisconnectRace(t *testing.T) {
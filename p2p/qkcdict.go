@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// headerDictID identifies the dictionary laid out like block headers.
+	// The dictionary of an ID must never change, peers running different
+	// releases would no longer decode each other's frames. A new layout
+	// takes a new ID.
+	headerDictID = 1
+
+	// dictMinSize is the smallest payload compressed with a dictionary,
+	// much lower than snappyMinSize since the dictionary pays off on the
+	// first bytes of a frame.
+	dictMinSize = 64
+	// frameFlagDict flags frames deflated with the negotiated dictionary.
+	frameFlagDict = 0x02
+)
+
+var errUnexpectedDictFrame = errors.New("dictionary compressed frame without negotiated dictionary")
+
+// compressionDicts are the preset dictionaries offered in the handshake by
+// ID, the highest ID both peers offer is used.
+var compressionDicts = map[uint64][]byte{
+	headerDictID: headerDict(),
+}
+
+// headerDict returns the fixed parts of the serialized root and minor block
+// headers: zero hashes, addresses, the empty bloom and signature and the
+// length prefixes of their variable fields. Headers of consecutive blocks
+// repeat them, and sharing them up front lets even a single header compress.
+func headerDict() []byte {
+	var (
+		b    bytes.Buffer
+		hash = make([]byte, 32)
+	)
+	u32 := func(v uint32) { binary.Write(&b, binary.BigEndian, v) }
+	u64 := func(v uint64) { binary.Write(&b, binary.BigEndian, v) }
+
+	// root block header
+	u32(0)                    // version
+	u32(0)                    // number
+	b.Write(hash)             // parent hash
+	b.Write(hash)             // minor header hash
+	b.Write(hash)             // state root
+	b.Write(make([]byte, 24)) // coinbase
+	u32(1)                    // coinbase amount, one token
+	b.Write(make([]byte, 9))  // token id
+	b.WriteByte(0)            // empty amount
+	u64(0)                    // time
+	b.WriteByte(0)            // difficulty
+	b.WriteByte(0)            // total difficulty
+	u64(0)                    // nonce
+	b.Write([]byte{0, 0})     // extra
+	b.Write(hash)             // mix digest
+	b.Write(make([]byte, 65)) // signature
+
+	// minor block header
+	u32(0)                     // version
+	u32(1)                     // branch
+	u64(0)                     // number
+	b.Write(make([]byte, 24))  // coinbase
+	u32(1)                     // coinbase amount, one token
+	b.Write(make([]byte, 9))   // token id
+	b.WriteByte(0)             // empty amount
+	b.Write(hash)              // parent hash
+	b.Write(hash)              // previous root block hash
+	b.Write(hash)              // gas limit
+	b.Write(hash)              // meta hash
+	u64(0)                     // time
+	b.WriteByte(0)             // difficulty
+	u64(0)                     // nonce
+	b.Write(make([]byte, 256)) // bloom
+	b.Write([]byte{0, 0})      // extra
+	b.Write(hash)              // mix digest
+	return b.Bytes()
+}
+
+// dictHandshake returns the handshake field offering the known dictionaries.
+func dictHandshake() rlp.RawValue {
+	ids := make([]uint64, 0, len(compressionDicts))
+	for id := range compressionDicts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	enc, _ := rlp.EncodeToBytes(ids)
+	return enc
+}
+
+// negotiateDict returns the highest dictionary ID offered in both handshakes,
+// or 0 if they have none in common. The offer is the first of the trailing
+// fields, which older peers leave out.
+func negotiateDict(our, their *protoHandshake) uint64 {
+	offered := func(hs *protoHandshake) map[uint64]bool {
+		var ids []uint64
+		if len(hs.Rest) == 0 || rlp.DecodeBytes(hs.Rest[0], &ids) != nil {
+			return nil
+		}
+		set := make(map[uint64]bool, len(ids))
+		for _, id := range ids {
+			set[id] = true
+		}
+		return set
+	}
+	ours, theirs := offered(our), offered(their)
+	var best uint64
+	for id := range ours {
+		if _, ok := compressionDicts[id]; ok && theirs[id] && id > best {
+			best = id
+		}
+	}
+	return best
+}
+
+// dictCodec deflates and inflates frames with a preset dictionary. Encoding
+// and decoding keep separate state, each must be serialized by its caller.
+type dictCodec struct {
+	id   uint64
+	dict []byte
+
+	w    *flate.Writer
+	wbuf bytes.Buffer
+	r    io.ReadCloser
+}
+
+func newDictCodec(id uint64) *dictCodec {
+	dict := compressionDicts[id]
+	c := &dictCodec{id: id, dict: dict}
+	c.w, _ = flate.NewWriterDict(&c.wbuf, flate.BestSpeed, dict)
+	c.r = flate.NewReaderDict(bytes.NewReader(nil), dict)
+	return c
+}
+
+// encode returns plain deflated on its own, no state is carried from one
+// frame to the next.
+func (c *dictCodec) encode(plain []byte) ([]byte, error) {
+	c.wbuf.Reset()
+	c.w.Reset(&c.wbuf)
+	if _, err := c.w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), c.wbuf.Bytes()...), nil
+}
+
+// decode inflates a frame, failing with errDecodedTooLarge once it exceeds
+// limit bytes.
+func (c *dictCodec) decode(body []byte, limit int) ([]byte, error) {
+	if err := c.r.(flate.Resetter).Reset(bytes.NewReader(body), c.dict); err != nil {
+		return nil, err
+	}
+	plain, err := ioutil.ReadAll(io.LimitReader(c.r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > limit {
+		return nil, errDecodedTooLarge
+	}
+	return plain, nil
+}
@@ -0,0 +1,226 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/account"
+	"github.com/QuarkChain/goquarkchain/core/types"
+	"github.com/QuarkChain/goquarkchain/serialize"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/golang/snappy"
+)
+
+// the dictionaries of released IDs must never change
+func TestHeaderDictStable(t *testing.T) {
+	sum := sha256.Sum256(compressionDicts[headerDictID])
+	if got, want := hex.EncodeToString(sum[:]), "569eb58723e207360ef7c6b30dc057b539b164f2929086e237ade1163aa5bd44"; got != want {
+		t.Fatalf("dictionary %d changed: hash %s, want %s", headerDictID, got, want)
+	}
+}
+
+func TestQKCDictNegotiation(t *testing.T) {
+	offer := []rlp.RawValue{dictHandshake()}
+	unknown, _ := rlp.EncodeToBytes([]uint64{headerDictID + 100})
+	tests := []struct {
+		version1, version2 uint64
+		rest1, rest2       []rlp.RawValue
+		dict               uint64
+	}{
+		{adaptiveSnappyProtocolVersion, adaptiveSnappyProtocolVersion, offer, offer, headerDictID},
+		// either side not offering a dictionary falls back to snappy
+		{adaptiveSnappyProtocolVersion, adaptiveSnappyProtocolVersion, offer, nil, 0},
+		{adaptiveSnappyProtocolVersion, adaptiveSnappyProtocolVersion, nil, offer, 0},
+		{adaptiveSnappyProtocolVersion, adaptiveSnappyProtocolVersion, offer, []rlp.RawValue{unknown}, 0},
+		// dictionary frames are flagged, which needs adaptive snappy
+		{adaptiveSnappyProtocolVersion, snappyProtocolVersion, offer, offer, 0},
+	}
+	for i, tt := range tests {
+		fd1, fd2 := net.Pipe()
+		rw1, rw2 := newTestQKCRlpPair(fd1, fd2)
+		id1 := crypto.FromECDSAPub(&newkey().PublicKey)[1:]
+		id2 := crypto.FromECDSAPub(&newkey().PublicKey)[1:]
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := rw2.doProtoHandshake(&protoHandshake{Version: tt.version2, ID: id2, Rest: tt.rest2})
+			errc <- err
+		}()
+		if _, err := rw1.doProtoHandshake(&protoHandshake{Version: tt.version1, ID: id1, Rest: tt.rest1}); err != nil {
+			t.Fatalf("test %d: handshake error: %v", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: remote handshake error: %v", i, err)
+		}
+		for side, rw := range []*qkcRlp{rw1, rw2} {
+			var got uint64
+			if rw.dict != nil {
+				got = rw.dict.id
+			}
+			if got != tt.dict {
+				t.Errorf("test %d side %d: dictionary %d, want %d", i, side, got, tt.dict)
+			}
+		}
+		fd1.Close()
+		fd2.Close()
+	}
+}
+
+func TestQKCDictFrames(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	for _, rw := range []*qkcRlp{rw1, rw2} {
+		rw.snappy, rw.adaptiveSnappy = true, true
+		rw.dict = newDictCodec(headerDictID)
+	}
+
+	random := make([]byte, 4096)
+	rand.Read(random)
+	headers := testHeaderPayload(1)
+	tests := []struct {
+		payload  []byte
+		deflated bool
+	}{
+		{headers, true},
+		{random, false},
+		{make([]byte, dictMinSize-1), false},
+	}
+	for i, tt := range tests {
+		if err := rw1.writeQKCMsg(Msg{Size: uint32(len(tt.payload)), Payload: bytes.NewReader(tt.payload)}); err != nil {
+			t.Fatalf("test %d: write error: %v", i, err)
+		}
+		if plain := conn.Len() == 32+16+len(tt.payload); plain == tt.deflated {
+			t.Errorf("test %d: frame of %d bytes, deflated %v", i, conn.Len(), tt.deflated)
+		}
+		if tt.deflated {
+			if size := conn.Len() - 32 - 16; size >= len(snappy.Encode(nil, tt.payload)) {
+				t.Errorf("test %d: deflated frame of %d bytes is no smaller than snappy", i, size)
+			}
+		}
+		msg, err := rw2.readQKCMsg()
+		if err != nil {
+			t.Fatalf("test %d: read error: %v", i, err)
+		}
+		if payload, _ := ioutil.ReadAll(msg.Payload); !bytes.Equal(payload, tt.payload) {
+			t.Errorf("test %d: payload mismatch", i)
+		}
+	}
+
+	// a peer which did not negotiate the dictionary rejects its frames
+	rw2.dict = nil
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(headers)), Payload: bytes.NewReader(headers)}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, errUnexpectedDictFrame) {
+		t.Errorf("read error mismatch: got %v, want %v", err, errUnexpectedDictFrame)
+	}
+}
+
+func TestQKCDictDecodedTooLarge(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	for _, rw := range []*qkcRlp{rw1, rw2} {
+		rw.snappy, rw.adaptiveSnappy = true, true
+		rw.dict = newDictCodec(headerDictID)
+	}
+	rw2.SetMaxFrameSize(16 * 1024)
+
+	payload := make([]byte, 256*1024)
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, errDecodedTooLarge) {
+		t.Fatalf("read error mismatch: got %v, want %v", err, errDecodedTooLarge)
+	}
+}
+
+// testHeaderPayload returns a serialized tip carrying n consecutive minor
+// block headers, the way header heavy traffic looks on the wire.
+func testHeaderPayload(n int) []byte {
+	randomHash := func() (h common.Hash) {
+		rand.Read(h[:])
+		return h
+	}
+	coinbase := account.CreatEmptyAddress(1)
+	rand.Read(coinbase.Recipient[:])
+	tip := Tip{RootBlockHeader: &types.RootBlockHeader{
+		Number:          1000,
+		ParentHash:      randomHash(),
+		MinorHeaderHash: randomHash(),
+		Root:            randomHash(),
+		Coinbase:        coinbase,
+		CoinbaseAmount:  types.NewEmptyTokenBalances(),
+		Time:            1560000000,
+		Difficulty:      big.NewInt(1000000),
+		ToTalDifficulty: big.NewInt(1000000000),
+		MixDigest:       randomHash(),
+	}}
+	for i := 0; i < n; i++ {
+		tip.MinorBlockHeaderList = append(tip.MinorBlockHeaderList, &types.MinorBlockHeader{
+			Branch:            account.NewBranch(1),
+			Number:            uint64(5000 + i),
+			Coinbase:          coinbase,
+			CoinbaseAmount:    types.NewEmptyTokenBalances(),
+			ParentHash:        randomHash(),
+			PrevRootBlockHash: tip.RootBlockHeader.ParentHash,
+			GasLimit:          &serialize.Uint256{Value: big.NewInt(12000000)},
+			MetaHash:          randomHash(),
+			Time:              uint64(1560000000 + 10*i),
+			Difficulty:        big.NewInt(10000),
+			Nonce:             uint64(i * 7919),
+			MixDigest:         randomHash(),
+		})
+	}
+	payload, err := serialize.SerializeToBytes(&tip)
+	if err != nil {
+		panic(err)
+	}
+	return payload
+}
+
+// BenchmarkHeaderFrames compares snappy with deflating against the header
+// dictionary on tips of increasing size. Besides the time, it reports the
+// compressed to plain size ratio.
+func BenchmarkHeaderFrames(b *testing.B) {
+	for _, n := range []int{1, 8, 64} {
+		payload := testHeaderPayload(n)
+		b.Run(fmt.Sprintf("snappy/%d", n), func(b *testing.B) {
+			var size int
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				enc := snappy.Encode(nil, payload)
+				if _, err := snappy.Decode(nil, enc); err != nil {
+					b.Fatal(err)
+				}
+				size = len(enc)
+			}
+			b.ReportMetric(float64(size)/float64(len(payload)), "ratio")
+		})
+		b.Run(fmt.Sprintf("dict/%d", n), func(b *testing.B) {
+			var size int
+			c := newDictCodec(headerDictID)
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				enc, err := c.encode(payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := c.decode(enc, len(payload)); err != nil {
+					b.Fatal(err)
+				}
+				size = len(enc)
+			}
+			b.ReportMetric(float64(size)/float64(len(payload)), "ratio")
+		})
+	}
+}
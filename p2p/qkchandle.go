@@ -1,7 +1,7 @@
 package p2p
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/hmac"
@@ -9,6 +9,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/golang/snappy"
 	"io"
@@ -18,8 +20,49 @@ import (
 	"time"
 )
 
+const (
+	// defaultMaxFrameSize is the default upper bound of a qkc frame body,
+	// checked before the frame buffer is allocated.
+	defaultMaxFrameSize = 8 * 1024 * 1024
+	// defaultStreamThreshold is the frame size above which a frame body is
+	// authenticated and decrypted chunk by chunk while it is read.
+	defaultStreamThreshold = 1024 * 1024
+	frameChunkSize         = 64 * 1024
+	// defaultDecodeBufferSize is the largest compressed frame body read into
+	// the buffer a connection reuses across frames.
+	defaultDecodeBufferSize = 1024 * 1024
+
+	// snappyMinSize is the smallest payload compressed with adaptive snappy,
+	// smaller ones rarely shrink enough to pay for it.
+	snappyMinSize = 256
+	// frameFlagsOffset is the header byte after the frame size holding the
+	// frame flags, only used with adaptive snappy.
+	frameFlagsOffset = 4
+	frameFlagSnappy  = 0x01
+
+	// batchBufferSize is the size of the buffer frames written by WriteMsgs
+	// are gathered in, larger frames go through unbuffered.
+	batchBufferSize = 16 * 1024
+)
+
 var (
-	msgHandleLog = "qkcMsgHandle"
+	errFrameTooLarge         = errors.New("frame too large")
+	errInconsistentFrameSize = errors.New("inconsistent frame size")
+	// errDecodedTooLarge is returned when a compressed frame within the size
+	// limit would decompress beyond it.
+	errDecodedTooLarge = errors.New("decoded message too large")
+
+	// ErrReadTimeout is returned when the peer sends nothing within the read
+	// timeout of the connection.
+	ErrReadTimeout = errors.New("read timeout")
+	// ErrWriteTimeout is returned when a frame can not be written within the
+	// write timeout of the connection, the peer not reading fast enough.
+	ErrWriteTimeout = errors.New("write timeout")
+
+	// ErrBadHeaderMAC is returned when a frame header fails authentication.
+	ErrBadHeaderMAC = errors.New("bad header MAC")
+	// ErrBadFrameMAC is returned when a frame body fails authentication.
+	ErrBadFrameMAC = errors.New("bad frame MAC")
 )
 
 func GetPrivateKeyFromConfig(configKey string) (*ecdsa.PrivateKey, error) {
@@ -44,135 +87,373 @@ func GetPrivateKeyFromConfig(configKey string) (*ecdsa.PrivateKey, error) {
 
 type qkcRlp struct {
 	*rlpx
+	maxFrameSize    uint32
+	streamThreshold uint32
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	metrics         *qkcMetrics
+	// adaptiveSnappy is set when both sides flag compressed frames, frames
+	// are then only compressed when it makes them smaller.
+	adaptiveSnappy bool
+	// dict deflates frames with the dictionary negotiated in the handshake,
+	// it needs adaptive snappy to flag them.
+	dict *dictCodec
+	// snappyMinProto, if named, keeps the frames of peers running an older
+	// version of that protocol uncompressed.
+	snappyMinProto Cap
+	// snappy is set when frames are compressed, RLPx negotiated snappy and
+	// the protocol version run with the peer allows it.
+	snappy bool
+	// decodeBufSize caps the compressed frame bodies read into decodeBuf,
+	// larger ones get a buffer of their own. Server.Start maps a zero
+	// DecodeBufferSize to the default, so zero, which allocates every frame,
+	// is only set directly, as the benchmarks do.
+	decodeBufSize uint32
+	// decodeBuf holds the compressed body of the frame being read. Only the
+	// payload decoded from it outlives the read, so it is reused by the next
+	// one, reads being serialized by rmu.
+	decodeBuf []byte
+	// maxMsgSize caps the payload of a message written, whatever size the
+	// message claims.
+	maxMsgSize uint32
 }
 
 // NewQKCRlp new qkc rlp
 func NewQKCRlp(fd net.Conn) transport {
 	rlpx := newRLPX(fd).(*rlpx)
-	return &qkcRlp{rlpx}
+	return &qkcRlp{
+		rlpx:            rlpx,
+		maxFrameSize:    defaultMaxFrameSize,
+		streamThreshold: defaultStreamThreshold,
+		readTimeout:     defaultQKCReadTimeout,
+		writeTimeout:    frameWriteTimeout,
+		metrics:         newQKCMetrics(),
+		decodeBufSize:   defaultDecodeBufferSize,
+		maxMsgSize:      config.DefaultP2PCmddSizeLimit,
+	}
+}
+
+// Metrics returns a snapshot of the traffic counters of the connection.
+func (q *qkcRlp) Metrics() QKCMetrics {
+	return q.metrics.snapshot()
+}
+
+// SetMaxFrameSize sets the largest frame body accepted from the remote peer.
+func (q *qkcRlp) SetMaxFrameSize(size uint32) {
+	q.rmu.Lock()
+	defer q.rmu.Unlock()
+	q.maxFrameSize = size
+}
+
+// SetMaxMessageSize sets the largest message payload written to the remote
+// peer, a payload yielding more bytes fails the write.
+func (q *qkcRlp) SetMaxMessageSize(size uint32) {
+	q.wmu.Lock()
+	defer q.wmu.Unlock()
+	q.maxMsgSize = size
+}
+
+// SetStreamThreshold sets the frame size above which frame bodies are
+// authenticated and decrypted chunk by chunk while they are read. The MAC is
+// the same either way.
+func (q *qkcRlp) SetStreamThreshold(size uint32) {
+	q.rmu.Lock()
+	defer q.rmu.Unlock()
+	q.streamThreshold = size
+}
+
+// SetDecodeBufferSize sets the largest compressed frame body read into the
+// buffer the connection reuses across frames instead of allocating one per
+// frame, zero allocates every frame. The buffer grows up to size as larger
+// frames arrive and is kept as long as the connection. Only the compressed
+// body is read into it, the payload decoded from a frame is allocated anew.
+func (q *qkcRlp) SetDecodeBufferSize(size uint32) {
+	q.rmu.Lock()
+	defer q.rmu.Unlock()
+	q.decodeBufSize = size
+	if uint32(cap(q.decodeBuf)) > size {
+		q.decodeBuf = nil
+	}
+}
+
+// SetReadTimeout sets how long the connection may stay silent before reading
+// from it fails with ErrReadTimeout. Every message received, pongs included,
+// extends the deadline.
+func (q *qkcRlp) SetReadTimeout(timeout time.Duration) {
+	q.rmu.Lock()
+	defer q.rmu.Unlock()
+	q.readTimeout = timeout
+}
+
+// SetWriteTimeout sets how long writing a frame may take before it fails
+// with ErrWriteTimeout, e.g. longer for peers across slow links.
+func (q *qkcRlp) SetWriteTimeout(timeout time.Duration) {
+	q.wmu.Lock()
+	defer q.wmu.Unlock()
+	q.writeTimeout = timeout
+}
+
+// SetSnappyMinProtocol only compresses frames with peers running at least
+// the version of cap of the protocol named by cap, both sides sharing a
+// lower version exchange plain frames. It must be set before the handshake.
+func (q *qkcRlp) SetSnappyMinProtocol(cap Cap) {
+	q.snappyMinProto = cap
 }
 
 func (q *qkcRlp) ReadMsg() (Msg, error) {
 	q.rmu.Lock()
 	defer q.rmu.Unlock()
-	q.fd.SetReadDeadline(time.Time{})
+	q.fd.SetReadDeadline(time.Now().Add(q.readTimeout))
 
-	return q.readQKCMsg()
+	msg, err := q.readQKCMsg()
+	if isTimeout(err) {
+		return msg, fmt.Errorf("%w: %v", ErrReadTimeout, err)
+	}
+	return msg, err
 }
 
 func (q *qkcRlp) WriteMsg(msg Msg) error {
 	q.wmu.Lock()
 	defer q.wmu.Unlock()
-	q.fd.SetWriteDeadline(time.Now().Add(frameWriteTimeout))
-	return q.writeQKCMsg(msg)
+	q.fd.SetWriteDeadline(time.Now().Add(q.writeTimeout))
+	return writeTimeoutError(q.writeQKCMsg(msg))
+}
+
+// WriteMsgs writes msgs as consecutive frames, each framed as by WriteMsg,
+// through a buffer flushed once at the end, so that a burst of small
+// messages takes one write to the connection instead of three each. The
+// frames before a failing message are still sent.
+func (q *qkcRlp) WriteMsgs(msgs []Msg) error {
+	q.wmu.Lock()
+	defer q.wmu.Unlock()
+	buf := bufio.NewWriterSize(q.rw.conn, batchBufferSize)
+	for i, msg := range msgs {
+		q.fd.SetWriteDeadline(time.Now().Add(q.writeTimeout))
+		if err := q.writeQKCMsgTo(buf, msg); err != nil {
+			buf.Flush()
+			return fmt.Errorf("message %d of %d: %w", i, len(msgs), writeTimeoutError(err))
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("write frames: %w", writeTimeoutError(err))
+	}
+	return nil
+}
+
+// isTimeout reports whether err comes from a deadline of the connection.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeTimeoutError wraps err in ErrWriteTimeout if the write deadline
+// passed, so that a stalled peer is told apart from a closed connection.
+func writeTimeoutError(err error) error {
+	if isTimeout(err) {
+		return fmt.Errorf("%w: %v", ErrWriteTimeout, err)
+	}
+	return err
 }
 
 func (q *qkcRlp) readQKCMsg() (msg Msg, err error) {
 	// read the header
 	headBuf := make([]byte, 32)
 	if _, err := io.ReadFull(q.rw.conn, headBuf); err != nil {
-		return msg, err
+		return msg, fmt.Errorf("read frame header: %w", err)
 	}
 
 	// verify header mac
 	shouldMAC := updateMAC(q.rw.ingressMAC, q.rw.macCipher, headBuf[:16])
 	if !hmac.Equal(shouldMAC, headBuf[16:]) {
-		return msg, errors.New("bad header MAC")
+		return msg, fmt.Errorf("check frame header: %w", ErrBadHeaderMAC)
 	}
 
 	q.rw.dec.XORKeyStream(headBuf[:16], headBuf[:16]) // first half is now decrypted
 	fSize := binary.BigEndian.Uint32(headBuf[:4])
+	flags := headBuf[frameFlagsOffset]
+	compressed := q.snappy && (!q.adaptiveSnappy || flags&frameFlagSnappy != 0)
+	deflated := q.adaptiveSnappy && flags&frameFlagDict != 0
+	if deflated && q.dict == nil {
+		return msg, fmt.Errorf("check frame header: %w", errUnexpectedDictFrame)
+	}
+	if fSize > q.maxFrameSize {
+		return msg, fmt.Errorf("check frame header: %w: %d bytes, limit %d", errFrameTooLarge, fSize, q.maxFrameSize)
+	}
+	// every qkc message carries at least its metadata, op and rpc id
+	if fSize == 0 {
+		return msg, fmt.Errorf("check frame header: %w: empty frame", errInconsistentFrameSize)
+	}
 
-	frameBuf := make([]byte, fSize)
-	if _, err := io.ReadFull(q.rw.conn, frameBuf); err != nil {
-		return msg, err
+	frameBuf, err := q.readFrame(fSize, compressed || deflated)
+	if err != nil {
+		return msg, fmt.Errorf("read frame body: %w", err)
 	}
 
 	// read and validate frame MAC. we can re-use headBuf for that.
-	q.rw.ingressMAC.Write(frameBuf)
 	fMacSeed := q.rw.ingressMAC.Sum(nil)
 	if _, err := io.ReadFull(q.rw.conn, headBuf[:16]); err != nil {
-		return msg, err
+		return msg, fmt.Errorf("read frame MAC: %w", err)
 	}
 	shouldMAC = updateMAC(q.rw.ingressMAC, q.rw.macCipher, fMacSeed)
 	if !hmac.Equal(shouldMAC, headBuf[:16]) {
-		return msg, errors.New("bad frame MAC")
+		return msg, fmt.Errorf("check frame MAC: %w", ErrBadFrameMAC)
 	}
 
-	// decrypt frame content
-	q.rw.dec.XORKeyStream(frameBuf, frameBuf)
-
 	// decode message code
-	content := bytes.NewReader(frameBuf[:fSize])
-	msg.Size = uint32(content.Len())
-	msg.Payload = content
+	payload := frameBuf[:fSize]
 
-	// if snappy is enabled, verify and decompress message
-	if q.rw.snappy {
-		payload, err := ioutil.ReadAll(msg.Payload)
+	// if the frame is compressed, verify and decompress message
+	if deflated {
+		payload, err = q.dict.decode(payload, int(q.maxFrameSize))
 		if err != nil {
-			return msg, err
+			if errors.Is(err, errDecodedTooLarge) {
+				q.metrics.markCompressionBomb()
+			}
+			return msg, fmt.Errorf("inflate frame: %w", err)
 		}
+		q.metrics.markSnappy(len(payload), int(fSize))
+	} else if compressed {
 		size, err := snappy.DecodedLen(payload)
 		if err != nil {
-			return msg, err
+			return msg, fmt.Errorf("decompress frame: %w", err)
 		}
 		if size > int(maxUint24) {
-			return msg, errPlainMessageTooLarge
+			return msg, fmt.Errorf("decompress frame: %w", errPlainMessageTooLarge)
 		}
+		// the frame size limit also bounds the memory a message takes once
+		// decompressed
+		if size > int(q.maxFrameSize) {
+			q.metrics.markCompressionBomb()
+			return msg, fmt.Errorf("decompress frame: %w: %d bytes, limit %d", errDecodedTooLarge, size, q.maxFrameSize)
+		}
+		// the payload is handed to the handlers without a copy, so it is
+		// decoded into a buffer of its own rather than a reused one
 		payload, err = snappy.Decode(nil, payload)
 		if err != nil {
-			return msg, err
+			return msg, fmt.Errorf("decompress frame: %w", err)
 		}
-		msg.Size, msg.Payload = uint32(size), bytes.NewReader(payload)
+		q.metrics.markSnappy(size, int(fSize))
+	} else if q.snappy {
+		q.metrics.markSnappySkipped(int(fSize))
 	}
+	q.metrics.markIngress(payload, len(headBuf)+int(fSize)+16)
+	msg.Size, msg.Payload = uint32(len(payload)), newPayloadReader(payload)
 	msg.Code = baseProtocolLength
 	return msg, nil
 }
 
+// readFrame reads a frame body of size bytes, feeding it to the ingress MAC and
+// decrypting it. Frames above the stream threshold are processed in chunks
+// as they arrive, instead of in extra passes over the whole body once it is
+// read. The body must not be used before the frame MAC is verified.
+//
+// The body is always buffered whole, chunked or not: the frame MAC covers
+// all of it and is only checked at the end, and a snappy block can only be
+// decoded whole, so no part of a frame is decoded while it is read.
+//
+// The body of a compressed frame is only read to be decoded into a payload
+// of its own, it is read into the decode buffer of the connection if it fits
+// and then only valid until the next read. The payload is never decoded into
+// a reused buffer as ReadPayload hands it to the handlers without a copy.
+func (q *qkcRlp) readFrame(size uint32, compressed bool) ([]byte, error) {
+	var frameBuf []byte
+	if compressed && size <= q.decodeBufSize {
+		if uint32(cap(q.decodeBuf)) < size {
+			q.decodeBuf = make([]byte, size)
+		}
+		frameBuf = q.decodeBuf[:size]
+	} else {
+		frameBuf = make([]byte, size)
+	}
+	chunk := len(frameBuf)
+	if size > q.streamThreshold {
+		chunk = frameChunkSize
+	}
+	for start := 0; start < len(frameBuf); start += chunk {
+		end := start + chunk
+		if end > len(frameBuf) {
+			end = len(frameBuf)
+		}
+		if _, err := io.ReadFull(q.rw.conn, frameBuf[start:end]); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && start > 0) {
+				return nil, fmt.Errorf("%w: %d bytes declared: %v", errInconsistentFrameSize, size, err)
+			}
+			return nil, err
+		}
+		q.rw.ingressMAC.Write(frameBuf[start:end])
+		q.rw.dec.XORKeyStream(frameBuf[start:end], frameBuf[start:end])
+	}
+	return frameBuf, nil
+}
+
 func (q *qkcRlp) writeQKCMsg(msg Msg) error {
+	return q.writeQKCMsgTo(q.rw.conn, msg)
+}
+
+// writeQKCMsgTo writes the frame of msg to w, which must lead to the
+// connection as frames are chained by the egress MAC.
+func (q *qkcRlp) writeQKCMsgTo(w io.Writer, msg Msg) error {
+	plain, err := ioutil.ReadAll(newLimitedPayload(msg, q.maxMsgSize))
+	if err != nil {
+		return fmt.Errorf("read payload: %w", err)
+	}
+	realBody := plain
+	var flags byte
 	// if snappy is enabled, compress message now
-	if q.rw.snappy {
+	if q.snappy {
 		if msg.Size > maxUint24 {
-			return errPlainMessageTooLarge
+			return fmt.Errorf("compress frame: %w", errPlainMessageTooLarge)
+		}
+		switch {
+		case q.dict != nil && len(plain) >= dictMinSize:
+			if realBody, err = q.dict.encode(plain); err != nil {
+				return fmt.Errorf("deflate frame: %w", err)
+			}
+			flags = frameFlagDict
+		case !q.adaptiveSnappy || len(plain) >= snappyMinSize:
+			realBody = snappy.Encode(nil, plain)
+			flags = frameFlagSnappy
+		}
+		// with adaptive snappy, frames which do not shrink are sent plain
+		if q.adaptiveSnappy && len(realBody) >= len(plain) {
+			realBody, flags = plain, 0
+		}
+		if flags != 0 {
+			q.metrics.markSnappy(len(plain), len(realBody))
+		} else {
+			q.metrics.markSnappySkipped(len(plain))
 		}
-		payload, _ := ioutil.ReadAll(msg.Payload)
-		payload = snappy.Encode(nil, payload)
-
-		msg.Payload = bytes.NewReader(payload)
-		msg.Size = uint32(len(payload))
 	}
 	// write header
 	headBuf := make([]byte, 32)
-	binary.BigEndian.PutUint32(headBuf, msg.Size)
+	binary.BigEndian.PutUint32(headBuf, uint32(len(realBody)))
+	if q.adaptiveSnappy {
+		headBuf[frameFlagsOffset] = flags
+	}
 
 	q.rw.enc.XORKeyStream(headBuf[:16], headBuf[:16]) // first half is now encrypted
 	// write header MAC
 	copy(headBuf[16:], updateMAC(q.rw.egressMAC, q.rw.macCipher, headBuf[:16]))
-	if _, err := q.rw.conn.Write(headBuf); err != nil {
-		return err
+	if _, err := w.Write(headBuf); err != nil {
+		return fmt.Errorf("write frame header: %w", err)
 	}
 
 	// write encrypted frame, updating the egress MAC hash with
 	// the Data written to conn.
-	tee := cipher.StreamWriter{S: q.rw.enc, W: io.MultiWriter(q.rw.conn, q.rw.egressMAC)}
-	realBody, err := ioutil.ReadAll(msg.Payload)
-	if err != nil {
-		return err
-	}
+	tee := cipher.StreamWriter{S: q.rw.enc, W: io.MultiWriter(w, q.rw.egressMAC)}
 	if _, err := tee.Write(realBody); err != nil {
-		return err
-	}
-	if _, err := io.Copy(tee, msg.Payload); err != nil {
-		return err
+		return fmt.Errorf("write frame body: %w", err)
 	}
 
 	// write frame MAC. egress MAC hash is up to date because
 	// frame content was written to it as well.
 	fMacSeed := q.rw.egressMAC.Sum(nil)
 	mac := updateMAC(q.rw.egressMAC, q.rw.macCipher, fMacSeed)
-	_, err = q.rw.conn.Write(mac)
-	return err
+	if _, err := w.Write(mac); err != nil {
+		return fmt.Errorf("write frame MAC: %w", err)
+	}
+	q.metrics.markEgress(plain, len(headBuf)+len(realBody)+len(mac))
+	return nil
 }
 
 func (q *qkcRlp) doProtoHandshake(our *protoHandshake) (their *protoHandshake, err error) {
@@ -180,5 +461,43 @@ func (q *qkcRlp) doProtoHandshake(our *protoHandshake) (their *protoHandshake, e
 	if err != nil {
 		return nil, err
 	}
+	// only compress frames if both sides advertised snappy support, and
+	// run a protocol version compressing them
+	q.rw.snappy = our.Version >= snappyProtocolVersion && perHandshake.Version >= snappyProtocolVersion
+	q.snappy = q.rw.snappy && q.snappyAllowed(our, perHandshake)
+	q.adaptiveSnappy = q.snappy && our.Version >= adaptiveSnappyProtocolVersion && perHandshake.Version >= adaptiveSnappyProtocolVersion
+	// deflate with a dictionary if both sides offer one, plain snappy
+	// otherwise
+	q.dict = nil
+	if id := negotiateDict(our, perHandshake); id != 0 && q.adaptiveSnappy {
+		q.dict = newDictCodec(id)
+	}
 	return perHandshake, nil
 }
+
+// snappyAllowed reports whether the highest version of snappyMinProto both
+// handshakes advertise is recent enough to compress frames.
+func (q *qkcRlp) snappyAllowed(our, their *protoHandshake) bool {
+	if q.snappyMinProto.Name == "" {
+		return true
+	}
+	return sharedVersion(q.snappyMinProto.Name, our.Caps, their.Caps) >= q.snappyMinProto.Version
+}
+
+// sharedVersion returns the highest version of the protocol name in both
+// ours and theirs, 0 if they share none.
+func sharedVersion(name string, ours, theirs []Cap) uint {
+	var best uint
+	for _, our := range ours {
+		if our.Name != name || our.Version <= best {
+			continue
+		}
+		for _, their := range theirs {
+			if their == our {
+				best = our.Version
+				break
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,855 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
+)
+
+// newTestQKCRlpPair creates two qkcRlp transports on top of c1 and c2 whose
+// secrets match, so that messages written by one side can be read by the other.
+func newTestQKCRlpPair(c1, c2 io.ReadWriter) (*qkcRlp, *qkcRlp) {
+	var (
+		aesSecret      = make([]byte, 16)
+		macSecret      = make([]byte, 16)
+		egressMACinit  = make([]byte, 32)
+		ingressMACinit = make([]byte, 32)
+	)
+	for _, s := range [][]byte{aesSecret, macSecret, egressMACinit, ingressMACinit} {
+		rand.Read(s)
+	}
+	return newQKCRlpPairWithSecrets(c1, c2, aesSecret, macSecret, egressMACinit, ingressMACinit)
+}
+
+// newFixedQKCRlpPair is newTestQKCRlpPair with fixed secrets, so that the
+// frames written are always the same bytes.
+func newFixedQKCRlpPair(c1, c2 io.ReadWriter) (*qkcRlp, *qkcRlp) {
+	seq := func(start byte, n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = start + byte(i)
+		}
+		return b
+	}
+	return newQKCRlpPairWithSecrets(c1, c2, seq(0x00, 16), seq(0x10, 16), seq(0x20, 32), seq(0x40, 32))
+}
+
+func newQKCRlpPairWithSecrets(c1, c2 io.ReadWriter, aesSecret, macSecret, egressMACinit, ingressMACinit []byte) (*qkcRlp, *qkcRlp) {
+	s1 := secrets{
+		AES:        aesSecret,
+		MAC:        macSecret,
+		EgressMAC:  sha3.NewKeccak256(),
+		IngressMAC: sha3.NewKeccak256(),
+	}
+	s1.EgressMAC.Write(egressMACinit)
+	s1.IngressMAC.Write(ingressMACinit)
+
+	s2 := secrets{
+		AES:        aesSecret,
+		MAC:        macSecret,
+		EgressMAC:  sha3.NewKeccak256(),
+		IngressMAC: sha3.NewKeccak256(),
+	}
+	s2.EgressMAC.Write(ingressMACinit)
+	s2.IngressMAC.Write(egressMACinit)
+
+	return &qkcRlp{rlpx: &rlpx{rw: newRLPXFrameRW(c1, s1)}, maxFrameSize: defaultMaxFrameSize,
+			streamThreshold: defaultStreamThreshold, readTimeout: defaultQKCReadTimeout, writeTimeout: frameWriteTimeout,
+			metrics: newQKCMetrics()},
+		&qkcRlp{rlpx: &rlpx{rw: newRLPXFrameRW(c2, s2)}, maxFrameSize: defaultMaxFrameSize,
+			streamThreshold: defaultStreamThreshold, readTimeout: defaultQKCReadTimeout, writeTimeout: frameWriteTimeout,
+			metrics: newQKCMetrics()}
+}
+
+func TestQKCMsgWriteBodyOnce(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+
+	payload := []byte("quarkchain qkc message payload")
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+		t.Fatalf("WriteMsg error: %v", err)
+	}
+	// header and header MAC, then the body, then the frame MAC
+	if want := 32 + len(payload) + 16; conn.Len() != want {
+		t.Fatalf("frame length mismatch: got %d, want %d", conn.Len(), want)
+	}
+
+	msg, err := rw2.readQKCMsg()
+	if err != nil {
+		t.Fatalf("ReadMsg error: %v", err)
+	}
+	got, _ := ioutil.ReadAll(msg.Payload)
+	if !bytes.Equal(got, payload) {
+		t.Errorf("msg payload mismatch:\ngot  %x\nwant %x", got, payload)
+	}
+	if conn.Len() != 0 {
+		t.Errorf("%d unexpected bytes left in conn", conn.Len())
+	}
+}
+
+// TestQKCFrameGolden checks the exact bytes of two consecutive frames written
+// with fixed secrets, then reads them back, so that any change to the frame
+// layout, the cipher stream or the chaining of the MACs shows.
+func TestQKCFrameGolden(t *testing.T) {
+	// short enough for snappy to store it as a single literal
+	payload := []byte("quarkchain frame")
+	tests := []struct {
+		name   string
+		snappy bool
+		frames string
+	}{
+		{
+			name: "plain",
+			frames: "c6a13b27878f5b826f4f8162a1c8d8798d7a79b9d2530c562278a23046e1064b" +
+				"023372e7fea3dc7f20159d851795406f518c00f5d4d4d6c76286ce6fca9daff7" +
+				"49d68743999ba68ce3897a686081b09d6f730f1b23f800b0551340e344f10a52" +
+				"c8d84a5c5f09aa5939331638eed69133ea612b728dc136174a61b020c2320510",
+		},
+		{
+			name:   "snappy",
+			snappy: true,
+			frames: "c6a13b25878f5b826f4f8162a1c8d879f872c602a06695fd0ee3156f3a67683f" +
+				"637a62e0f4b2df7d211ad48d45925f6b24b34184a6c2b47d9e915ee49666606b" +
+				"9f4787539989a68ce3897a686081b09db9ad58dfc54a114754525912dd2781f2" +
+				"23c63b12451fa34a3b3e5e3ff5d9dc304202dbba3eb330b0834921d714a58850" +
+				"08bbcca1",
+		},
+	}
+	for _, tt := range tests {
+		conn := new(bytes.Buffer)
+		rw, _ := newFixedQKCRlpPair(conn, nil)
+		rw.snappy = tt.snappy
+		for i := 0; i < 2; i++ {
+			if err := rw.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+				t.Fatalf("%s: write error: %v", tt.name, err)
+			}
+		}
+		if got := hex.EncodeToString(conn.Bytes()); got != tt.frames {
+			t.Errorf("%s: frames mismatch:\ngot  %s\nwant %s", tt.name, got, tt.frames)
+		}
+
+		// the golden frames are read by the side whose ingress MAC starts
+		// from the egress MAC of the writer
+		golden, _ := hex.DecodeString(tt.frames)
+		wire := bytes.NewBuffer(golden)
+		_, rw = newFixedQKCRlpPair(nil, wire)
+		rw.snappy = tt.snappy
+		for i := 0; i < 2; i++ {
+			msg, err := rw.readQKCMsg()
+			if err != nil {
+				t.Fatalf("%s: frame %d: read error: %v", tt.name, i, err)
+			}
+			if got, _ := ioutil.ReadAll(msg.Payload); !bytes.Equal(got, payload) {
+				t.Errorf("%s: frame %d: payload mismatch: got %q", tt.name, i, got)
+			}
+		}
+		if wire.Len() != 0 {
+			t.Errorf("%s: %d unexpected bytes left", tt.name, wire.Len())
+		}
+	}
+}
+
+func TestQKCMetrics(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw1.snappy, rw2.snappy = true, true
+
+	msg, err := MakeMsgWithSerializedData(Ping, 0, Metadata{}, make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw1.writeQKCMsg(msg); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	wireSize := uint64(conn.Len())
+	if _, err := rw2.readQKCMsg(); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+
+	out, in := rw1.Metrics(), rw2.Metrics()
+	if out.MsgsOut != 1 || out.BytesOut != wireSize || out.OpsOut[Ping] != 1 {
+		t.Errorf("egress metrics mismatch: %+v", out)
+	}
+	if in.MsgsIn != 1 || in.BytesIn != wireSize || in.OpsIn[Ping] != 1 {
+		t.Errorf("ingress metrics mismatch: %+v", in)
+	}
+	if out.SnappyRatio <= 0 || out.SnappyRatio >= 1 || out.SnappyRatio != in.SnappyRatio {
+		t.Errorf("snappy ratio mismatch: %v/%v", out.SnappyRatio, in.SnappyRatio)
+	}
+}
+
+func TestQKCAdaptiveSnappy(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw1.snappy, rw2.snappy = true, true
+	rw1.adaptiveSnappy, rw2.adaptiveSnappy = true, true
+
+	random := make([]byte, 4096)
+	rand.Read(random)
+	tests := []struct {
+		payload    []byte
+		compressed bool
+	}{
+		{make([]byte, 4096), true},
+		// compression does not help random data
+		{random, false},
+		// nor is it tried on small payloads
+		{make([]byte, snappyMinSize-1), false},
+	}
+	for i, tt := range tests {
+		if err := rw1.writeQKCMsg(Msg{Size: uint32(len(tt.payload)), Payload: bytes.NewReader(tt.payload)}); err != nil {
+			t.Fatalf("test %d: write error: %v", i, err)
+		}
+		// the header, the frame MAC and the body
+		if plain := conn.Len() == 32+16+len(tt.payload); plain == tt.compressed {
+			t.Errorf("test %d: frame of %d bytes, compressed %v", i, conn.Len(), tt.compressed)
+		}
+		msg, err := rw2.readQKCMsg()
+		if err != nil {
+			t.Fatalf("test %d: read error: %v", i, err)
+		}
+		if payload, _ := ioutil.ReadAll(msg.Payload); !bytes.Equal(payload, tt.payload) {
+			t.Errorf("test %d: payload mismatch", i)
+		}
+	}
+
+	out, in := rw1.Metrics(), rw2.Metrics()
+	if out.SnappySkipped != 2 || in.SnappySkipped != 2 {
+		t.Errorf("skipped frames mismatch: %d/%d", out.SnappySkipped, in.SnappySkipped)
+	}
+	if out.SnappyRatio <= 0 || out.SnappyRatio >= 1 || out.SnappyRatio != in.SnappyRatio {
+		t.Errorf("snappy ratio mismatch: %v/%v", out.SnappyRatio, in.SnappyRatio)
+	}
+}
+
+func TestQKCMsgFrameTooLarge(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw2.SetMaxFrameSize(16)
+
+	payload := make([]byte, 17)
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("read error mismatch: got %v, want %v", err, errFrameTooLarge)
+	}
+	// only the header has been consumed, the oversized body is never read
+	if want := len(payload) + 16; conn.Len() != want {
+		t.Errorf("conn has %d bytes left, want %d", conn.Len(), want)
+	}
+}
+
+func TestQKCMsgDecodedTooLarge(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw1.snappy, rw2.snappy = true, true
+	rw2.SetMaxFrameSize(16 * 1024)
+
+	// zeros compress below the limit but decompress way past it
+	payload := make([]byte, 256*1024)
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if conn.Len() > 16*1024 {
+		t.Fatalf("compressed frame of %d bytes should be within the limit", conn.Len())
+	}
+	_, err := rw2.readQKCMsg()
+	if !errors.Is(err, errDecodedTooLarge) {
+		t.Fatalf("read error mismatch: got %v, want %v", err, errDecodedTooLarge)
+	}
+
+	// repeated attempts from the same IP get it banned
+	reputation := nodefilter.NewReputation()
+	if reputation.Penalize("10.0.0.1", penaltyForError(err)) {
+		t.Fatal("a single compression bomb should not ban the peer")
+	}
+	if !reputation.Penalize("10.0.0.1", penaltyForError(err)) {
+		t.Error("repeated compression bombs should ban the peer")
+	}
+}
+
+func TestQKCMsgPayloadTooLarge(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, _ := newTestQKCRlpPair(conn, conn)
+
+	// the payload claims 16 bytes but yields 1024
+	payload := make([]byte, 1024)
+	for _, snappy := range []bool{false, true} {
+		rw1.snappy = snappy
+		err := rw1.writeQKCMsg(Msg{Size: 16, Payload: bytes.NewReader(payload)})
+		if !errors.Is(err, errPayloadTooLarge) {
+			t.Errorf("snappy %v: write error mismatch: got %v, want %v", snappy, err, errPayloadTooLarge)
+		}
+		if conn.Len() != 0 {
+			t.Errorf("snappy %v: %d bytes written", snappy, conn.Len())
+		}
+	}
+
+	if _, err := ReadPayload(Msg{Size: 16, Payload: bytes.NewReader(payload)}); err != errPayloadTooLarge {
+		t.Errorf("ReadPayload error mismatch: got %v, want %v", err, errPayloadTooLarge)
+	}
+	if err := (Msg{Size: 16, Payload: bytes.NewReader(payload)}).Discard(); err != errPayloadTooLarge {
+		t.Errorf("Discard error mismatch: got %v, want %v", err, errPayloadTooLarge)
+	}
+	// a payload of exactly the claimed size is fine
+	got, err := ReadPayload(Msg{Size: 16, Payload: bytes.NewReader(payload[:16])})
+	if err != nil || len(got) != 16 {
+		t.Errorf("ReadPayload of an exact payload: %d bytes, error %v", len(got), err)
+	}
+
+	// nor more than the configured message size, whatever the size claims
+	rw1.snappy = false
+	rw1.SetMaxMessageSize(16)
+	err = rw1.writeQKCMsg(Msg{Size: 32, Payload: bytes.NewReader(payload[:32])})
+	if !errors.Is(err, errPayloadTooLarge) {
+		t.Errorf("write past the message size: got %v, want %v", err, errPayloadTooLarge)
+	}
+}
+
+// writeTestQKCHeader writes a valid frame header declaring size bytes.
+func writeTestQKCHeader(rw *qkcRlp, size uint32) {
+	headBuf := make([]byte, 32)
+	binary.BigEndian.PutUint32(headBuf, size)
+	rw.rw.enc.XORKeyStream(headBuf[:16], headBuf[:16])
+	copy(headBuf[16:], updateMAC(rw.rw.egressMAC, rw.rw.macCipher, headBuf[:16]))
+	rw.rw.conn.Write(headBuf)
+}
+
+func TestQKCMsgInconsistentFrameSize(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	writeTestQKCHeader(rw1, 0)
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, errInconsistentFrameSize) {
+		t.Errorf("empty frame: got %v, want %v", err, errInconsistentFrameSize)
+	}
+
+	conn.Reset()
+	rw1, rw2 = newTestQKCRlpPair(conn, conn)
+	// the header claims more bytes than the frame and its MAC hold
+	writeTestQKCHeader(rw1, 100)
+	conn.Write(make([]byte, 30+16))
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, errInconsistentFrameSize) {
+		t.Errorf("truncated frame: got %v, want %v", err, errInconsistentFrameSize)
+	}
+}
+
+func TestQKCSnappyNegotiation(t *testing.T) {
+	tests := []struct {
+		version1, version2 uint64
+		snappy, adaptive   bool
+	}{
+		{snappyProtocolVersion, snappyProtocolVersion, true, false},
+		{snappyProtocolVersion - 1, snappyProtocolVersion, false, false},
+		{snappyProtocolVersion, snappyProtocolVersion - 1, false, false},
+		{adaptiveSnappyProtocolVersion, adaptiveSnappyProtocolVersion, true, true},
+		{adaptiveSnappyProtocolVersion, snappyProtocolVersion, true, false},
+	}
+	for i, tt := range tests {
+		fd1, fd2 := net.Pipe()
+		rw1, rw2 := newTestQKCRlpPair(fd1, fd2)
+		id1 := crypto.FromECDSAPub(&newkey().PublicKey)[1:]
+		id2 := crypto.FromECDSAPub(&newkey().PublicKey)[1:]
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := rw2.doProtoHandshake(&protoHandshake{Version: tt.version2, ID: id2})
+			errc <- err
+		}()
+		if _, err := rw1.doProtoHandshake(&protoHandshake{Version: tt.version1, ID: id1}); err != nil {
+			t.Fatalf("test %d: handshake error: %v", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: remote handshake error: %v", i, err)
+		}
+		if rw1.snappy != tt.snappy || rw2.snappy != tt.snappy {
+			t.Errorf("test %d: snappy mismatch: got %v/%v, want %v", i, rw1.snappy, rw2.snappy, tt.snappy)
+		}
+		if rw1.adaptiveSnappy != tt.adaptive || rw2.adaptiveSnappy != tt.adaptive {
+			t.Errorf("test %d: adaptive snappy mismatch: got %v/%v, want %v", i, rw1.adaptiveSnappy, rw2.adaptiveSnappy, tt.adaptive)
+		}
+		fd1.Close()
+		fd2.Close()
+	}
+}
+
+func TestQKCSnappyProtocolVersion(t *testing.T) {
+	qkc := func(versions ...uint) []Cap {
+		caps := []Cap{{"other", 9}}
+		for _, v := range versions {
+			caps = append(caps, Cap{"qkc", v})
+		}
+		return caps
+	}
+	tests := []struct {
+		caps1, caps2 []Cap
+		min          Cap
+		snappy       bool
+	}{
+		// no minimum version, RLPx alone decides
+		{qkc(1), qkc(1), Cap{}, true},
+		{qkc(1), qkc(2), Cap{}, true},
+		{qkc(2), qkc(2), Cap{"qkc", 2}, true},
+		{qkc(1, 2), qkc(2, 3), Cap{"qkc", 2}, true},
+		// the shared version is the one run with the peer
+		{qkc(1, 2), qkc(1), Cap{"qkc", 2}, false},
+		{qkc(1), qkc(1), Cap{"qkc", 2}, false},
+		{qkc(2), qkc(3), Cap{"qkc", 2}, false},
+		{qkc(), qkc(), Cap{"qkc", 1}, false},
+	}
+	for i, tt := range tests {
+		fd1, fd2 := net.Pipe()
+		rw1, rw2 := newTestQKCRlpPair(fd1, fd2)
+		rw1.SetSnappyMinProtocol(tt.min)
+		rw2.SetSnappyMinProtocol(tt.min)
+		id1 := crypto.FromECDSAPub(&newkey().PublicKey)[1:]
+		id2 := crypto.FromECDSAPub(&newkey().PublicKey)[1:]
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := rw2.doProtoHandshake(&protoHandshake{Version: adaptiveSnappyProtocolVersion, ID: id2, Caps: tt.caps2})
+			errc <- err
+		}()
+		if _, err := rw1.doProtoHandshake(&protoHandshake{Version: adaptiveSnappyProtocolVersion, ID: id1, Caps: tt.caps1}); err != nil {
+			t.Fatalf("test %d: handshake error: %v", i, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: remote handshake error: %v", i, err)
+		}
+		if !rw1.rw.snappy || !rw2.rw.snappy {
+			t.Errorf("test %d: RLPx snappy not negotiated", i)
+		}
+		if rw1.snappy != tt.snappy || rw2.snappy != tt.snappy {
+			t.Errorf("test %d: snappy mismatch: got %v/%v, want %v", i, rw1.snappy, rw2.snappy, tt.snappy)
+		}
+		if rw1.adaptiveSnappy != tt.snappy || rw2.adaptiveSnappy != tt.snappy {
+			t.Errorf("test %d: adaptive snappy mismatch: got %v/%v, want %v", i, rw1.adaptiveSnappy, rw2.adaptiveSnappy, tt.snappy)
+		}
+
+		// frames cross in either mode
+		payload := make([]byte, 1024)
+		go func() {
+			errc <- rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+		}()
+		msg, err := rw2.readQKCMsg()
+		if err != nil {
+			t.Fatalf("test %d: read error: %v", i, err)
+		}
+		if got, _ := ioutil.ReadAll(msg.Payload); !bytes.Equal(got, payload) {
+			t.Errorf("test %d: payload mismatch", i)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: write error: %v", i, err)
+		}
+		fd1.Close()
+		fd2.Close()
+	}
+}
+
+func TestQKCMsgBadMAC(t *testing.T) {
+	payload := make([]byte, 64)
+	tests := []struct {
+		offset func(n int) int // offset of the corrupted byte within n written bytes
+		want   error
+	}{
+		{offset: func(n int) int { return 16 }, want: ErrBadHeaderMAC},
+		{offset: func(n int) int { return n - 1 }, want: ErrBadFrameMAC},
+	}
+	for i, test := range tests {
+		conn := new(bytes.Buffer)
+		rw1, rw2 := newTestQKCRlpPair(conn, conn)
+		if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+			t.Fatalf("test %d: write error: %v", i, err)
+		}
+		conn.Bytes()[test.offset(conn.Len())] ^= 0xff
+		if _, err := rw2.readQKCMsg(); !errors.Is(err, test.want) {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+	}
+}
+
+func TestQKCMsgErrorPhases(t *testing.T) {
+	payload := make([]byte, 64)
+	tests := []struct {
+		corrupt func(conn *bytes.Buffer)
+		want    error
+		phase   string
+	}{
+		{func(conn *bytes.Buffer) { conn.Truncate(20) }, io.ErrUnexpectedEOF, "read frame header"},
+		{func(conn *bytes.Buffer) { conn.Bytes()[16] ^= 0xff }, ErrBadHeaderMAC, "check frame header"},
+		{func(conn *bytes.Buffer) { conn.Truncate(32 + 10) }, errInconsistentFrameSize, "read frame body"},
+		{func(conn *bytes.Buffer) { conn.Truncate(conn.Len() - 8) }, io.ErrUnexpectedEOF, "read frame MAC"},
+		{func(conn *bytes.Buffer) { conn.Bytes()[conn.Len()-1] ^= 0xff }, ErrBadFrameMAC, "check frame MAC"},
+	}
+	for i, tt := range tests {
+		conn := new(bytes.Buffer)
+		rw1, rw2 := newTestQKCRlpPair(conn, conn)
+		if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+			t.Fatalf("test %d: write error: %v", i, err)
+		}
+		tt.corrupt(conn)
+		_, err := rw2.readQKCMsg()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("test %d: got %v, want %v", i, err, tt.want)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), tt.phase+": ") {
+			t.Errorf("test %d: error %q does not name phase %q", i, err, tt.phase)
+		}
+	}
+
+	// the penalties of the server see through the wrapping
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw2.SetMaxFrameSize(16)
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	_, err := rw2.readQKCMsg()
+	if !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("got %v, want %v", err, errFrameTooLarge)
+	}
+	if penalty := penaltyForError(err); penalty == 0 {
+		t.Error("oversized frame not penalized")
+	}
+}
+
+func TestQKCMsgStreamedFrame(t *testing.T) {
+	payload := make([]byte, 3*frameChunkSize+100)
+	rand.Read(payload)
+	for _, snappy := range []bool{false, true} {
+		conn := new(bytes.Buffer)
+		rw1, rw2 := newTestQKCRlpPair(conn, conn)
+		rw1.snappy, rw2.snappy = snappy, snappy
+		rw2.streamThreshold = frameChunkSize
+		if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+			t.Fatalf("snappy %v: write error: %v", snappy, err)
+		}
+		msg, err := rw2.readQKCMsg()
+		if err != nil {
+			t.Fatalf("snappy %v: read error: %v", snappy, err)
+		}
+		got, err := ReadPayload(msg)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("snappy %v: payload mismatch, err %v", snappy, err)
+		}
+	}
+
+	// a corrupted chunk still fails the frame MAC
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw2.streamThreshold = frameChunkSize
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	conn.Bytes()[32+2*frameChunkSize] ^= 0xff
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, ErrBadFrameMAC) {
+		t.Errorf("got %v, want %v", err, ErrBadFrameMAC)
+	}
+}
+
+func TestQKCDecodeBuffer(t *testing.T) {
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw1.snappy, rw2.snappy = true, true
+	rw2.SetDecodeBufferSize(4096)
+
+	payloads := [][]byte{bytes.Repeat([]byte{1}, 8192), bytes.Repeat([]byte{2}, 8192), make([]byte, 8192)}
+	rand.Read(payloads[2])
+	for _, msg := range newTestMsgs(payloads) {
+		if err := rw1.writeQKCMsg(msg); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	var got [][]byte
+	for i := range payloads {
+		msg, err := rw2.readQKCMsg()
+		if err != nil {
+			t.Fatalf("message %d: read error: %v", i, err)
+		}
+		payload, err := ReadPayload(msg)
+		if err != nil {
+			t.Fatalf("message %d: payload error: %v", i, err)
+		}
+		got = append(got, payload)
+	}
+	// the payloads read earlier are left alone by the later reads
+	for i, payload := range payloads {
+		if !bytes.Equal(got[i], payload) {
+			t.Errorf("message %d: payload mismatch", i)
+		}
+	}
+	// the random payload does not compress into the buffer
+	if size := cap(rw2.decodeBuf); size == 0 || size > 4096 {
+		t.Errorf("decode buffer of %d bytes, want up to 4096", size)
+	}
+
+	rw2.SetDecodeBufferSize(0)
+	if rw2.decodeBuf != nil {
+		t.Error("decode buffer kept past its size")
+	}
+}
+
+func TestQKCStreamedFrameMAC(t *testing.T) {
+	payloads := [][]byte{make([]byte, 3*frameChunkSize+100), make([]byte, 100)}
+	for _, p := range payloads {
+		rand.Read(p)
+	}
+	// both paths read the same bytes, the MAC and cipher states must stay
+	// identical for the following frame to verify
+	var macs [][]byte
+	for _, threshold := range []uint32{defaultStreamThreshold, frameChunkSize} {
+		conn := new(bytes.Buffer)
+		rw1, rw2 := newTestQKCRlpPair(conn, conn)
+		rw2.SetStreamThreshold(threshold)
+		for _, p := range payloads {
+			if err := rw1.writeQKCMsg(Msg{Size: uint32(len(p)), Payload: bytes.NewReader(p)}); err != nil {
+				t.Fatalf("threshold %d: write error: %v", threshold, err)
+			}
+		}
+		for i, p := range payloads {
+			msg, err := rw2.readQKCMsg()
+			if err != nil {
+				t.Fatalf("threshold %d: read %d error: %v", threshold, i, err)
+			}
+			if got, err := ReadPayload(msg); err != nil || !bytes.Equal(got, p) {
+				t.Errorf("threshold %d: payload %d mismatch, err %v", threshold, i, err)
+			}
+		}
+		macs = append(macs, rw2.rw.ingressMAC.Sum(nil))
+	}
+	if !bytes.Equal(macs[0], macs[1]) {
+		t.Errorf("ingress MAC mismatch:\nbuffered: %x\nstreamed: %x", macs[0], macs[1])
+	}
+
+	// a truncated streamed frame fails at the missing chunk
+	conn := new(bytes.Buffer)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw2.SetStreamThreshold(frameChunkSize)
+	if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payloads[0])), Payload: bytes.NewReader(payloads[0])}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	conn.Truncate(32 + frameChunkSize + 10)
+	if _, err := rw2.readQKCMsg(); !errors.Is(err, errInconsistentFrameSize) {
+		t.Errorf("truncated frame: got %v, want %v", err, errInconsistentFrameSize)
+	}
+}
+
+func TestQKCReadTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, rw2 := newTestQKCRlpPair(c1, c2)
+	rw2.fd = c2
+	rw2.SetReadTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := rw2.ReadMsg(); !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrReadTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read returned after %v", elapsed)
+	}
+	if penalty := penaltyForError(ErrReadTimeout); penalty != 0 {
+		t.Errorf("read timeout penalized by %d", penalty)
+	}
+}
+
+func TestQKCWriteTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	rw1, _ := newTestQKCRlpPair(c1, c2)
+	rw1.fd = c1
+	rw1.SetWriteTimeout(50 * time.Millisecond)
+
+	// nobody reads c2, the frame is stuck until the deadline
+	payload := []byte("quarkchain frame")
+	start := time.Now()
+	err := rw1.WriteMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+	if !errors.Is(err, ErrWriteTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrWriteTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write returned after %v", elapsed)
+	}
+	if penalty := penaltyForError(err); penalty != 0 {
+		t.Errorf("write timeout penalized by %d", penalty)
+	}
+
+	// a closed connection is not a timeout
+	c2.Close()
+	rw1.SetWriteTimeout(time.Second)
+	err = rw1.WriteMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)})
+	if err == nil || errors.Is(err, ErrWriteTimeout) {
+		t.Fatalf("got %v, want a closed connection error", err)
+	}
+}
+
+// bufferConn is an in memory connection counting the writes to it.
+type bufferConn struct {
+	net.Conn
+	buf    bytes.Buffer
+	writes int
+}
+
+func (c *bufferConn) Read(b []byte) (int, error) { return c.buf.Read(b) }
+
+func (c *bufferConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.buf.Write(b)
+}
+
+func (c *bufferConn) SetWriteDeadline(time.Time) error { return nil }
+
+func newTestPayloads(n, size int) [][]byte {
+	payloads := make([][]byte, n)
+	for i := range payloads {
+		payloads[i] = make([]byte, size)
+		rand.Read(payloads[i])
+	}
+	return payloads
+}
+
+func newTestMsgs(payloads [][]byte) []Msg {
+	msgs := make([]Msg, len(payloads))
+	for i, payload := range payloads {
+		msgs[i] = Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}
+	}
+	return msgs
+}
+
+func TestQKCWriteMsgs(t *testing.T) {
+	conn := new(bufferConn)
+	rw1, rw2 := newTestQKCRlpPair(conn, conn)
+	rw1.fd = conn
+
+	payloads := newTestPayloads(8, 100)
+	if err := rw1.WriteMsgs(newTestMsgs(payloads)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if conn.writes != 1 {
+		t.Errorf("batch written in %d writes", conn.writes)
+	}
+	// each message is a frame of its own, followed by the single frames
+	// continuing the MAC chain
+	single := newTestPayloads(1, 100)
+	if err := rw1.WriteMsg(newTestMsgs(single)[0]); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	for i, payload := range append(payloads, single...) {
+		msg, err := rw2.readQKCMsg()
+		if err != nil {
+			t.Fatalf("message %d: read error: %v", i, err)
+		}
+		if got, _ := ioutil.ReadAll(msg.Payload); !bytes.Equal(got, payload) {
+			t.Errorf("message %d: payload mismatch", i)
+		}
+	}
+
+	// the frames before a failing message are sent
+	msgs := newTestMsgs(newTestPayloads(3, 100))
+	msgs[1].Size--
+	if err := rw1.WriteMsgs(msgs); !errors.Is(err, errPayloadTooLarge) || !strings.Contains(err.Error(), "message 1 of 3") {
+		t.Fatalf("got %v, want %v", err, errPayloadTooLarge)
+	}
+	if _, err := rw2.readQKCMsg(); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if conn.buf.Len() != 0 {
+		t.Errorf("%d unexpected bytes left in conn", conn.buf.Len())
+	}
+}
+
+// BenchmarkQKCWriteMsgs compares writing a burst of small messages one at a
+// time with writing them as a batch, over a loopback TCP connection.
+func BenchmarkQKCWriteMsgs(b *testing.B) {
+	const burst = 32
+	payloads := newTestPayloads(burst, 128)
+	for _, batch := range []bool{false, true} {
+		name := "single"
+		if batch {
+			name = "batch"
+		}
+		b.Run(name, func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			rw, _ := newTestQKCRlpPair(conn, conn)
+			rw.fd = conn
+
+			b.SetBytes(burst * 128)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msgs := newTestMsgs(payloads)
+				if batch {
+					err = rw.WriteMsgs(msgs)
+				} else {
+					for _, msg := range msgs {
+						if err = rw.WriteMsg(msg); err != nil {
+							break
+						}
+					}
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkQKCReadCompressed compares reading snappy frames of header
+// traffic with and without the decode buffer of the connection. The buffer
+// only saves the allocation of the compressed body, the decoded payload is
+// allocated per frame either way.
+func BenchmarkQKCReadCompressed(b *testing.B) {
+	payload := testHeaderPayload(8)
+	for _, size := range []uint32{0, defaultDecodeBufferSize} {
+		b.Run(fmt.Sprintf("buffer/%d", size), func(b *testing.B) {
+			conn := new(bytes.Buffer)
+			rw1, rw2 := newTestQKCRlpPair(conn, conn)
+			rw1.snappy, rw2.snappy = true, true
+			rw2.SetDecodeBufferSize(size)
+			for i := 0; i < b.N; i++ {
+				if err := rw1.writeQKCMsg(Msg{Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rw2.readQKCMsg(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+	qkcIngressOpMeterPrefix = "p2p/qkc/ingress/op/"
+	qkcEgressOpMeterPrefix  = "p2p/qkc/egress/op/"
+)
+
+var (
+	qkcIngressMsgMeter     = metrics.NewRegisteredMeter("p2p/qkc/ingress/msgs", nil)
+	qkcIngressTrafficMeter = metrics.NewRegisteredMeter("p2p/qkc/ingress/bytes", nil)
+	qkcEgressMsgMeter      = metrics.NewRegisteredMeter("p2p/qkc/egress/msgs", nil)
+	qkcEgressTrafficMeter  = metrics.NewRegisteredMeter("p2p/qkc/egress/bytes", nil)
+	qkcSnappyPlainCounter  = metrics.NewRegisteredCounter("p2p/qkc/snappy/plain", nil)
+	qkcSnappyCompCounter   = metrics.NewRegisteredCounter("p2p/qkc/snappy/compressed", nil)
+	qkcSnappyRatioGauge    = metrics.NewRegisteredGaugeFloat64("p2p/qkc/snappy/ratio", nil)
+	qkcSnappySkipCounter   = metrics.NewRegisteredCounter("p2p/qkc/snappy/skipped", nil)
+	handshakesGauge        = metrics.NewRegisteredGauge("p2p/handshakes/inflight", nil)
+
+	// qkcCompressionBombCounter counts the compressed frames rejected for
+	// decoding past the frame size limit, any of them is worth an alert.
+	qkcCompressionBombCounter = metrics.NewRegisteredCounter("p2p/qkc/compression/bombs", nil)
+)
+
+// QKCMetrics is a snapshot of the traffic sent and received over a qkc
+// connection. Byte counts are measured on the wire, after compression.
+type QKCMetrics struct {
+	MsgsIn   uint64
+	MsgsOut  uint64
+	BytesIn  uint64
+	BytesOut uint64
+	OpsIn    map[P2PCommandOp]uint64
+	OpsOut   map[P2PCommandOp]uint64
+	// SnappyRatio is the compressed to plain size ratio of the snappy
+	// encoded payloads, 0 if nothing was compressed.
+	SnappyRatio float64
+	// SnappySkipped is the number of frames sent or received plain because
+	// compressing them did not pay off.
+	SnappySkipped uint64
+}
+
+// qkcMetrics accumulates the traffic of a single qkc connection.
+type qkcMetrics struct {
+	lock       sync.Mutex
+	stats      QKCMetrics
+	plain      uint64
+	compressed uint64
+}
+
+func newQKCMetrics() *qkcMetrics {
+	return &qkcMetrics{stats: QKCMetrics{
+		OpsIn:  make(map[P2PCommandOp]uint64),
+		OpsOut: make(map[P2PCommandOp]uint64),
+	}}
+}
+
+// payloadOp returns the op of an encoded qkc message, ok is false if the
+// payload is too short to carry one.
+func payloadOp(payload []byte) (op P2PCommandOp, ok bool) {
+	if len(payload) < PreP2PLength {
+		return 0, false
+	}
+	return P2PCommandOp(payload[MetadataLength]), true
+}
+
+func (m *qkcMetrics) markIngress(payload []byte, wireSize int) {
+	op, ok := payloadOp(payload)
+
+	m.lock.Lock()
+	m.stats.MsgsIn++
+	m.stats.BytesIn += uint64(wireSize)
+	if ok {
+		m.stats.OpsIn[op]++
+	}
+	m.lock.Unlock()
+
+	qkcIngressMsgMeter.Mark(1)
+	qkcIngressTrafficMeter.Mark(int64(wireSize))
+	if ok {
+		metrics.GetOrRegisterMeter(qkcIngressOpMeterPrefix+op.String(), nil).Mark(1)
+	}
+}
+
+func (m *qkcMetrics) markEgress(payload []byte, wireSize int) {
+	op, ok := payloadOp(payload)
+
+	m.lock.Lock()
+	m.stats.MsgsOut++
+	m.stats.BytesOut += uint64(wireSize)
+	if ok {
+		m.stats.OpsOut[op]++
+	}
+	m.lock.Unlock()
+
+	qkcEgressMsgMeter.Mark(1)
+	qkcEgressTrafficMeter.Mark(int64(wireSize))
+	if ok {
+		metrics.GetOrRegisterMeter(qkcEgressOpMeterPrefix+op.String(), nil).Mark(1)
+	}
+}
+
+// markSnappy records the plain and compressed size of a snappy payload.
+func (m *qkcMetrics) markSnappy(plain, compressed int) {
+	m.lock.Lock()
+	m.plain += uint64(plain)
+	m.compressed += uint64(compressed)
+	if m.plain > 0 {
+		m.stats.SnappyRatio = float64(m.compressed) / float64(m.plain)
+	}
+	m.lock.Unlock()
+
+	qkcSnappyPlainCounter.Inc(int64(plain))
+	qkcSnappyCompCounter.Inc(int64(compressed))
+	if total := qkcSnappyPlainCounter.Count(); total > 0 {
+		qkcSnappyRatioGauge.Update(float64(qkcSnappyCompCounter.Count()) / float64(total))
+	}
+}
+
+// markSnappySkipped records a frame of size bytes left uncompressed, it counts
+// towards the achieved ratio as is.
+func (m *qkcMetrics) markSnappySkipped(size int) {
+	m.lock.Lock()
+	m.stats.SnappySkipped++
+	m.lock.Unlock()
+
+	qkcSnappySkipCounter.Inc(1)
+	m.markSnappy(size, size)
+}
+
+// markCompressionBomb records a compressed frame rejected for decoding past
+// the frame size limit. The connection is dropped right after, the server
+// keeps the count of each peer IP.
+func (m *qkcMetrics) markCompressionBomb() {
+	qkcCompressionBombCounter.Inc(1)
+}
+
+// snapshot returns a copy of the current counters.
+func (m *qkcMetrics) snapshot() QKCMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stats := m.stats
+	stats.OpsIn = make(map[P2PCommandOp]uint64, len(m.stats.OpsIn))
+	for op, n := range m.stats.OpsIn {
+		stats.OpsIn[op] = n
+	}
+	stats.OpsOut = make(map[P2PCommandOp]uint64, len(m.stats.OpsOut))
+	for op, n := range m.stats.OpsOut {
+		stats.OpsOut[op] = n
+	}
+	return stats
+}
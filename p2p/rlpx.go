@@ -597,7 +597,10 @@ func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
 		if msg.Size > maxUint24 {
 			return errPlainMessageTooLarge
 		}
-		payload, _ := ioutil.ReadAll(msg.Payload)
+		payload, err := ioutil.ReadAll(newLimitedPayload(msg, maxUint24))
+		if err != nil {
+			return err
+		}
 		payload = snappy.Encode(nil, payload)
 
 		msg.Payload = bytes.NewReader(payload)
@@ -625,7 +628,7 @@ func (rw *rlpxFrameRW) WriteMsg(msg Msg) error {
 	if _, err := tee.Write(ptype); err != nil {
 		return err
 	}
-	if _, err := io.Copy(tee, msg.Payload); err != nil {
+	if _, err := io.Copy(tee, newLimitedPayload(msg, maxUint24)); err != nil {
 		return err
 	}
 	if padding := fsize % 16; padding > 0 {
@@ -651,7 +654,7 @@ func (rw *rlpxFrameRW) ReadMsg() (msg Msg, err error) {
 	// verify header mac
 	shouldMAC := updateMAC(rw.ingressMAC, rw.macCipher, headbuf[:16])
 	if !hmac.Equal(shouldMAC, headbuf[16:]) {
-		return msg, errors.New("bad header MAC")
+		return msg, ErrBadHeaderMAC
 	}
 	rw.dec.XORKeyStream(headbuf[:16], headbuf[:16]) // first half is now decrypted
 	fsize := readInt24(headbuf)
@@ -675,7 +678,7 @@ func (rw *rlpxFrameRW) ReadMsg() (msg Msg, err error) {
 	}
 	shouldMAC = updateMAC(rw.ingressMAC, rw.macCipher, fmacseed)
 	if !hmac.Equal(shouldMAC, headbuf[:16]) {
-		return msg, errors.New("bad frame MAC")
+		return msg, ErrBadFrameMAC
 	}
 
 	// decrypt frame content
@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/QuarkChain/goquarkchain/serialize"
+)
+
+// DefaultSerializerName is the name of DefaultSerializer, every peer runs it.
+const DefaultSerializerName = "qkc"
+
+// Serializer encodes the commands carried by qkc messages. The header of the
+// messages is the same whatever the serializer, only their data differs.
+type Serializer interface {
+	Encode(op P2PCommandOp, v interface{}) ([]byte, error)
+	Decode(op P2PCommandOp, data []byte, v interface{}) error
+}
+
+// qkcSerializer is the serialize encoding of the quarkchain protocol.
+type qkcSerializer struct{}
+
+func (qkcSerializer) Encode(op P2PCommandOp, v interface{}) ([]byte, error) {
+	return serialize.SerializeToBytes(v)
+}
+
+func (qkcSerializer) Decode(op P2PCommandOp, data []byte, v interface{}) error {
+	return serialize.DeserializeFromBytes(data, v)
+}
+
+// DefaultSerializer is the serializer run with peers which negotiated no
+// other one.
+var DefaultSerializer Serializer = qkcSerializer{}
+
+var (
+	serializerLock sync.RWMutex
+	serializers    = make(map[string]Serializer)
+)
+
+// RegisterNamedSerializer makes s available to the peers which advertise name
+// in their hello as well, e.g. for interop experiments with other encodings.
+func RegisterNamedSerializer(name string, s Serializer) error {
+	serializerLock.Lock()
+	defer serializerLock.Unlock()
+	if name == "" || name == DefaultSerializerName {
+		return fmt.Errorf("serializer name %q is reserved", name)
+	}
+	if _, ok := serializers[name]; ok {
+		return fmt.Errorf("serializer %q is already registered", name)
+	}
+	serializers[name] = s
+	return nil
+}
+
+// UnregisterNamedSerializer removes the serializer registered under name, the
+// peers already running it keep it until they disconnect.
+func UnregisterNamedSerializer(name string) {
+	serializerLock.Lock()
+	defer serializerLock.Unlock()
+	delete(serializers, name)
+}
+
+// SerializerNames returns the sorted names of the registered serializers, the
+// default one excepted, as advertised in our hellos.
+func SerializerNames() []string {
+	serializerLock.RLock()
+	defer serializerLock.RUnlock()
+	names := make([]string, 0, len(serializers))
+	for name := range serializers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NegotiateSerializer returns the serializer run with a peer advertising
+// theirs: the registered one of the lowest name the peer runs as well, so
+// that both sides agree on it, the default one if there is none.
+func NegotiateSerializer(theirs []string) (string, Serializer) {
+	names := append([]string(nil), theirs...)
+	sort.Strings(names)
+	serializerLock.RLock()
+	defer serializerLock.RUnlock()
+	for _, name := range names {
+		if s, ok := serializers[name]; ok {
+			return name, s
+		}
+	}
+	return DefaultSerializerName, DefaultSerializer
+}
+
+// Transcode re-encodes the data of an op message from one serializer to
+// another, through the command of op for a peer negotiated at version. The
+// data of ops without a command is returned as is.
+func Transcode(op P2PCommandOp, version uint32, data []byte, from, to Serializer) ([]byte, error) {
+	cmd, ok := GetSerializer(op, version)
+	if !ok {
+		return data, nil
+	}
+	val := reflect.New(reflect.TypeOf(cmd))
+	if err := from.Decode(op, data, val.Interface()); err != nil {
+		return nil, fmt.Errorf("decode op %d: %w", op, err)
+	}
+	return to.Encode(op, val.Interface())
+}
+
+// TranscodeMsg is Transcode for an encoded qkc message, its header is kept.
+func TranscodeMsg(msg Msg, version uint32, from, to Serializer) (Msg, error) {
+	payload, err := ReadPayload(msg)
+	if err != nil {
+		return Msg{}, err
+	}
+	qkcMsg, err := DecodeQKCMsg(payload)
+	if err != nil {
+		return Msg{}, err
+	}
+	data, err := Transcode(qkcMsg.Op, version, qkcMsg.Data, from, to)
+	if err != nil {
+		return Msg{}, err
+	}
+	body, err := Encrypt(qkcMsg.MetaData, qkcMsg.Op, qkcMsg.RpcID, data)
+	if err != nil {
+		return Msg{}, err
+	}
+	return Msg{Code: msg.Code, Size: uint32(len(body)), Payload: bytes.NewReader(body), ReceivedAt: msg.ReceivedAt}, nil
+}
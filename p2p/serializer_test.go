@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/QuarkChain/goquarkchain/serialize"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// jsonSerializer encodes the commands as JSON.
+type jsonSerializer struct{}
+
+func (jsonSerializer) Encode(op P2PCommandOp, v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Decode(op P2PCommandOp, data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestDefaultSerializer(t *testing.T) {
+	ping := PingPongCommand{Message: common.Hash{1}}
+	want, err := serialize.SerializeToBytes(ping)
+	assert.NoError(t, err)
+	data, err := DefaultSerializer.Encode(Ping, ping)
+	assert.NoError(t, err)
+	assert.Equal(t, want, data)
+
+	var got PingPongCommand
+	assert.NoError(t, DefaultSerializer.Decode(Ping, data, &got))
+	assert.Equal(t, ping, got)
+}
+
+func TestNegotiateSerializer(t *testing.T) {
+	assert.Error(t, RegisterNamedSerializer(DefaultSerializerName, jsonSerializer{}))
+	assert.NoError(t, RegisterNamedSerializer("test-json", jsonSerializer{}))
+	defer UnregisterNamedSerializer("test-json")
+	assert.NoError(t, RegisterNamedSerializer("test-json2", jsonSerializer{}))
+	defer UnregisterNamedSerializer("test-json2")
+	assert.Error(t, RegisterNamedSerializer("test-json", jsonSerializer{}))
+	assert.Subset(t, SerializerNames(), []string{"test-json", "test-json2"})
+
+	name, _ := NegotiateSerializer(nil)
+	assert.Equal(t, DefaultSerializerName, name)
+	name, _ = NegotiateSerializer([]string{"unknown"})
+	assert.Equal(t, DefaultSerializerName, name)
+	// both sides pick the lowest name they share, whatever the order
+	theirs := []string{"unknown", "test-json2", "test-json"}
+	name, s := NegotiateSerializer(theirs)
+	assert.Equal(t, "test-json", name)
+	assert.Equal(t, jsonSerializer{}, s)
+	assert.Equal(t, []string{"unknown", "test-json2", "test-json"}, theirs)
+}
+
+func TestTranscodeMsg(t *testing.T) {
+	ping := PingPongCommand{Message: common.Hash{1}}
+	msg, err := MakeMsg(Ping, 7, Metadata{Branch: 3}, ping)
+	assert.NoError(t, err)
+
+	msg, err = TranscodeMsg(msg, 0, DefaultSerializer, jsonSerializer{})
+	assert.NoError(t, err)
+	payload, err := ReadPayload(msg)
+	assert.NoError(t, err)
+	qkcMsg, err := DecodeQKCMsg(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, Ping, qkcMsg.Op)
+	assert.Equal(t, uint64(7), qkcMsg.RpcID)
+	assert.Equal(t, uint32(3), qkcMsg.MetaData.Branch)
+	var got PingPongCommand
+	assert.NoError(t, json.Unmarshal(qkcMsg.Data, &got))
+	assert.Equal(t, ping, got)
+
+	// back to the default serializer the message is the same again
+	data, err := Transcode(Ping, 0, qkcMsg.Data, jsonSerializer{}, DefaultSerializer)
+	assert.NoError(t, err)
+	want, err := serialize.SerializeToBytes(ping)
+	assert.NoError(t, err)
+	assert.Equal(t, want, data)
+
+	// the data of ops without a command is left alone
+	data, err = Transcode(MaxOPNum+150, 0, []byte{1, 2}, jsonSerializer{}, DefaultSerializer)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2}, data)
+	_, err = Transcode(Ping, 0, []byte{1, 2}, jsonSerializer{}, DefaultSerializer)
+	assert.Error(t, err)
+}
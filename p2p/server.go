@@ -29,6 +29,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/QuarkChain/goquarkchain/cluster/config"
 	"github.com/QuarkChain/goquarkchain/p2p/discover"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/mclock"
@@ -41,6 +42,7 @@ import (
 	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/ethereum/go-ethereum/p2p/netutil"
 	"github.com/ethereum/go-ethereum/rlp"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 const (
@@ -49,6 +51,7 @@ const (
 	// Connectivity defaults.
 	maxActiveDialTasks     = 16
 	defaultMaxPendingPeers = 50
+	defaultMaxHandshakes   = 100
 	defaultDialRatio       = 3
 
 	// Maximum time allowed for reading a complete message.
@@ -57,9 +60,21 @@ const (
 
 	// Maximum amount of time allowed for writing a complete message.
 	frameWriteTimeout = 20 * time.Second
+
+	// defaultQKCReadTimeout is how long a qkc connection may stay silent
+	// before it is dropped.
+	defaultQKCReadTimeout = time.Minute
+
+	// The compression bombs are counted for the last maxCompressionBombIPs
+	// peer IPs to send one, and forgotten compressionBombTTL after the last.
+	maxCompressionBombIPs = 1024
+	compressionBombTTL    = time.Hour
 )
 
-var errServerStopped = errors.New("server stopped")
+var (
+	errServerStopped = errors.New("server stopped")
+	errPeerBanned    = errors.New("peer is banned")
+)
 
 // Config holds Server options.
 type Config struct {
@@ -70,11 +85,75 @@ type Config struct {
 	// connected. It must be greater than zero.
 	MaxPeers int
 
+	// PeerEviction is the policy making room for a peer connecting while the
+	// peer limits are reached: EvictNone rejects it, EvictIdle drops the peer
+	// silent for the longest and EvictReputation the one with the lowest
+	// score, unless that peer scores better than the new one. Inbound peers
+	// are dropped before dialed ones, trusted and static ones never.
+	PeerEviction string `toml:",omitempty"`
+
+	// MinEvictIdle is how long a peer must have been silent to be dropped by
+	// the EvictIdle policy.
+	MinEvictIdle time.Duration `toml:",omitempty"`
+
 	// MaxPendingPeers is the maximum number of peers that can be pending in the
 	// handshake phase, counted separately for inbound and outbound connections.
 	// Zero defaults to preset values.
 	MaxPendingPeers int `toml:",omitempty"`
 
+	// MaxHandshakes is the maximum number of connections, inbound or dialed,
+	// running their handshakes at the same time. Inbound connections beyond
+	// it are rejected at once, dials wait for a slot. Zero defaults to preset
+	// values.
+	MaxHandshakes int `toml:",omitempty"`
+
+	// ReadTimeout is how long a qkc connection may stay silent before it is
+	// dropped, it should exceed the keepalive ping interval. Zero defaults to
+	// preset values.
+	ReadTimeout time.Duration `toml:",omitempty"`
+
+	// WriteTimeout is how long writing a qkc frame may take before the
+	// connection is dropped, longer for peers across slow links. Zero
+	// defaults to preset values.
+	WriteTimeout time.Duration `toml:",omitempty"`
+
+	// StreamThreshold is the qkc frame size above which the frame MAC is
+	// computed chunk by chunk as the frame arrives, rather than in a pass
+	// over the body once it is read. The body is buffered whole either way
+	// and its MAC checked at the end. Zero defaults to preset values.
+	StreamThreshold uint32 `toml:",omitempty"`
+
+	// MaxMessageSize is the largest message payload written to a qkc
+	// connection, a payload yielding more bytes than its message claims is
+	// cut off there. Zero defaults to the command size limit.
+	MaxMessageSize uint32 `toml:",omitempty"`
+
+	// DecodeBufferSize is the largest compressed qkc frame read into a
+	// buffer each connection reuses, rather than allocating one per frame,
+	// which saves garbage under heavy header traffic. The payloads decoded
+	// from the frames are still allocated per frame. Zero defaults to preset
+	// values, the reuse cannot be turned off.
+	DecodeBufferSize uint32 `toml:",omitempty"`
+
+	// CompressionDict offers the preset compression dictionaries in the
+	// handshake. Frames are deflated with a dictionary both peers offer,
+	// and compressed with plain snappy otherwise.
+	CompressionDict bool `toml:",omitempty"`
+
+	// SnappyMinProtocol, if named, only compresses the frames of peers
+	// running at least its version of that protocol, peers on older versions
+	// exchange plain frames even though both support snappy. Both sides must
+	// agree on it, it is a constant of the named protocol.
+	SnappyMinProtocol Cap `toml:",omitempty"`
+
+	// ClockSkewWarn is the offset between the clock a peer sends in the
+	// handshake and ours above which a warning is logged, 0 never warns.
+	ClockSkewWarn time.Duration `toml:",omitempty"`
+
+	// MaxClockSkew is the offset between the clock of a peer and ours above
+	// which the peer is rejected, 0 accepts any offset.
+	MaxClockSkew time.Duration `toml:",omitempty"`
+
 	// DialRatio controls the ratio of inbound to dialed connections.
 	// Example: a DialRatio of 2 allows 1/2 of connections to be dialed.
 	// Setting DialRatio to zero defaults it to 3.
@@ -97,6 +176,12 @@ type Config struct {
 	// BootstrapNodes | preferedNodes
 	WhitelistNodes map[string]*enode.Node
 
+	// AllowedNodes, if not empty, are the only nodes allowed to connect.
+	AllowedNodes []enode.ID `toml:",omitempty"`
+
+	// DeniedNodes are never allowed to connect.
+	DeniedNodes []enode.ID `toml:",omitempty"`
+
 	// BootstrapNodes are used to establish connectivity
 	// with the rest of the network.
 	BootstrapNodes []*enode.Node
@@ -165,6 +250,7 @@ type Server struct {
 	// the whole protocol stack.
 	newTransport func(net.Conn) transport
 	newPeerHook  func(*Peer)
+	clock        func() time.Time
 
 	lock    sync.Mutex // protects running
 	running bool
@@ -182,6 +268,13 @@ type Server struct {
 	peerOpDone chan struct{}
 
 	blackNodeFilter nodefilter.BlackFilter
+	reputation      *nodefilter.Reputation
+	idFilter        *nodefilter.IDFilter
+
+	compressionBombs *lru.Cache // rejected compression bombs per peer IP
+
+	handshakes chan struct{} // semaphore of the handshakes in flight
+	inflight   int32         // number of handshakes in flight
 
 	quit          chan struct{}
 	addstatic     chan *enode.Node
@@ -223,6 +316,10 @@ type conn struct {
 	cont  chan error // The run loop uses cont to signal errors to SetupConn.
 	caps  []Cap      // valid after the protocol handshake
 	name  string     // valid after the protocol handshake
+	// skew is how far the clock of the peer is ahead of ours, measured in
+	// the protocol handshake if skewKnown is set.
+	skew      time.Duration
+	skewKnown bool
 }
 
 type transport interface {
@@ -248,6 +345,11 @@ func (c *conn) String() string {
 	return s
 }
 
+// WriteMsgs writes msgs as one batch if the transport supports it.
+func (c *conn) WriteMsgs(msgs []Msg) error {
+	return WriteMsgs(c.transport, msgs)
+}
+
 func (f connFlag) String() string {
 	s := ""
 	if f&trustedConn != 0 {
@@ -352,6 +454,17 @@ func (srv *Server) RemoveTrustedPeer(node *enode.Node) {
 	}
 }
 
+// SetNodeLists replaces the allowlist and the denylist of the server, they
+// apply to the connections set up from then on.
+func (srv *Server) SetNodeLists(allow, deny []enode.ID) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.AllowedNodes, srv.DeniedNodes = allow, deny
+	if srv.idFilter != nil {
+		srv.idFilter.Update(allow, deny)
+	}
+}
+
 // SubscribePeers subscribes the given channel to peer events
 func (srv *Server) SubscribeEvents(ch chan *PeerEvent) event.Subscription {
 	return srv.peerFeed.Subscribe(ch)
@@ -435,8 +548,40 @@ func (srv *Server) Start() (err error) {
 	if srv.PrivateKey == nil {
 		return errors.New("Server.PrivateKey must be set to a non-nil key")
 	}
+	if srv.clock == nil {
+		srv.clock = time.Now
+	}
 	if srv.newTransport == nil {
-		srv.newTransport = NewQKCRlp
+		readTimeout := srv.ReadTimeout
+		if readTimeout <= 0 {
+			readTimeout = defaultQKCReadTimeout
+		}
+		writeTimeout := srv.WriteTimeout
+		if writeTimeout <= 0 {
+			writeTimeout = frameWriteTimeout
+		}
+		streamThreshold := srv.StreamThreshold
+		if streamThreshold == 0 {
+			streamThreshold = defaultStreamThreshold
+		}
+		decodeBufferSize := srv.DecodeBufferSize
+		if decodeBufferSize == 0 {
+			decodeBufferSize = defaultDecodeBufferSize
+		}
+		maxMessageSize := srv.MaxMessageSize
+		if maxMessageSize == 0 {
+			maxMessageSize = config.DefaultP2PCmddSizeLimit
+		}
+		srv.newTransport = func(fd net.Conn) transport {
+			q := NewQKCRlp(fd).(*qkcRlp)
+			q.SetReadTimeout(readTimeout)
+			q.SetWriteTimeout(writeTimeout)
+			q.SetStreamThreshold(streamThreshold)
+			q.SetDecodeBufferSize(decodeBufferSize)
+			q.SetMaxMessageSize(maxMessageSize)
+			q.SetSnappyMinProtocol(srv.SnappyMinProtocol)
+			return q
+		}
 	}
 	if srv.Dialer == nil {
 		srv.Dialer = TCPDialer{&net.Dialer{Timeout: defaultDialTimeout}}
@@ -452,6 +597,14 @@ func (srv *Server) Start() (err error) {
 	srv.peerOp = make(chan peerOpFunc)
 	srv.peerOpDone = make(chan struct{})
 	srv.blackNodeFilter = nodefilter.NewBlackList(srv.WhitelistNodes)
+	srv.reputation = nodefilter.NewReputation()
+	srv.compressionBombs, _ = lru.New(maxCompressionBombIPs)
+	srv.idFilter = nodefilter.NewIDFilter(srv.AllowedNodes, srv.DeniedNodes)
+	maxHandshakes := defaultMaxHandshakes
+	if srv.MaxHandshakes > 0 {
+		maxHandshakes = srv.MaxHandshakes
+	}
+	srv.handshakes = make(chan struct{}, maxHandshakes)
 
 	if err := srv.setupLocalNode(); err != nil {
 		return err
@@ -476,6 +629,9 @@ func (srv *Server) setupLocalNode() error {
 	// Create the devp2p handshake.
 	pubkey := crypto.FromECDSAPub(&srv.PrivateKey.PublicKey)
 	srv.ourHandshake = &protoHandshake{Version: baseProtocolVersion, Name: srv.Name, ID: pubkey[1:]}
+	if srv.CompressionDict {
+		srv.ourHandshake.Rest = []rlp.RawValue{dictHandshake()}
+	}
 	for _, p := range srv.Protocols {
 		srv.ourHandshake.Caps = append(srv.ourHandshake.Caps, p.cap())
 	}
@@ -615,6 +771,8 @@ func (srv *Server) run(dialstate dialer) {
 	var (
 		peers        = make(map[enode.ID]*Peer)
 		inboundCount = 0
+		// evicted holds the peers dropped to make room until they are gone
+		evicted      = make(map[enode.ID]*Peer)
 		trusted      = make(map[enode.ID]bool, len(srv.TrustedNodes))
 		taskdone     = make(chan task, maxActiveDialTasks)
 		runningTasks []task
@@ -733,8 +891,21 @@ running:
 				c.flags |= trustedConn
 			}
 			// TODO: track in-progress inbound node IDs (pre-Peer) to avoid dialing them.
+			err := srv.encHandshakeChecks(peers, inboundCount, c)
+			if err == DiscTooManyPeers {
+				if victim := srv.evictionCandidate(peers, inboundCount, c); victim != nil {
+					victim.log.Info("Evicting p2p peer to make room", "policy", srv.PeerEviction, "newcomer", c.node.ID())
+					victim.Disconnect(DiscTooManyPeers)
+					delete(peers, victim.ID())
+					evicted[victim.ID()] = victim
+					if victim.Inbound() {
+						inboundCount--
+					}
+					err = srv.encHandshakeChecks(peers, inboundCount, c)
+				}
+			}
 			select {
-			case c.cont <- srv.encHandshakeChecks(peers, inboundCount, c):
+			case c.cont <- err:
 			case <-srv.quit:
 				break running
 			}
@@ -745,6 +916,7 @@ running:
 			if err == nil && !srv.blackNodeFilter.ChkDialoutBlacklist(c.node.IP().String()) {
 				// The handshakes are done and it passed all checks.
 				p := newPeer(c, srv.Protocols)
+				p.reputation = srv.reputation
 				// If message events are enabled, pass the peerFeed
 				// to the peer
 				if srv.EnableMsgEvents {
@@ -773,7 +945,22 @@ running:
 				srv.blackNodeFilter.AddDialoutBlacklist(pd.Node().IP().String())
 				pd.log.Warn("Add this peer to black list", "peer id", pd.Peer.ID().String(), "remote ip", pd.Node().IP().String(), "err", pd.err)
 			}
+			if penalty := penaltyForError(pd.err); penalty > 0 {
+				pd.Penalize(penalty)
+			}
+			if errors.Is(pd.err, errDecodedTooLarge) {
+				// the reputation of the IP keeps track of repeated attempts
+				ip := pd.Node().IP().String()
+				bombs := srv.markCompressionBomb(ip)
+				pd.log.Warn("Rejected compression bomb", "ip", ip, "bombs", bombs, "score", pd.Score())
+			}
 			d := common.PrettyDuration(mclock.Now() - pd.created)
+			if evicted[pd.ID()] == pd.Peer {
+				// the slot of an evicted peer was given up when it was evicted
+				pd.log.Debug("Removing evicted p2p peer", "duration", d, "err", pd.err)
+				delete(evicted, pd.ID())
+				continue
+			}
 			pd.log.Debug("Removing p2p peer", "duration", d, "peers", len(peers)-1, "req", pd.requested, "err", pd.err)
 			delete(peers, pd.ID())
 			if pd.Inbound() {
@@ -798,16 +985,25 @@ running:
 	// Wait for peers to shut down. Pending connections and tasks are
 	// not handled here and will terminate soon-ish because srv.quit
 	// is closed.
-	for len(peers) > 0 {
+	for len(peers)+len(evicted) > 0 {
 		p := <-srv.delpeer
 		p.log.Trace("<-delpeer (spindown)", "remainingTasks", len(runningTasks))
-		delete(peers, p.ID())
+		if evicted[p.ID()] == p.Peer {
+			delete(evicted, p.ID())
+		} else {
+			delete(peers, p.ID())
+		}
 	}
 }
 
 func (srv *Server) protoHandshakeChecks(peers map[enode.ID]*Peer, inboundCount int, c *conn) error {
 	// Drop connections with no matching protocols.
 	if len(srv.Protocols) > 0 && countMatchingProtocols(srv.Protocols, c.caps) == 0 {
+		// tell apart peers running our protocols in versions we do not support
+		if sharesProtocolName(srv.Protocols, c.caps) {
+			srv.log.Debug("Rejecting peer with unsupported protocol versions", "id", c.node.ID(), "caps", c.caps)
+			return DiscIncompatibleVersion
+		}
 		return DiscUselessPeer
 	}
 	// Repeat the encryption handshake checks because the
@@ -823,6 +1019,8 @@ func (srv *Server) encHandshakeChecks(peers map[enode.ID]*Peer, inboundCount int
 		return DiscTooManyPeers
 	case peers[c.node.ID()] != nil:
 		return DiscAlreadyConnected
+	case srv.reputation != nil && srv.reputation.Banned(c.node.IP().String()):
+		return errPeerBanned
 	case c.node.ID() == srv.localnode.ID():
 		return DiscSelf
 	default:
@@ -830,6 +1028,67 @@ func (srv *Server) encHandshakeChecks(peers map[enode.ID]*Peer, inboundCount int
 	}
 }
 
+// penaltyForError returns the reputation penalty of a peer whose connection
+// failed with err, 0 if the failure is not its fault.
+func penaltyForError(err error) int {
+	switch {
+	case errors.Is(err, ErrBadHeaderMAC), errors.Is(err, ErrBadFrameMAC):
+		return nodefilter.PenaltyBadMAC
+	case errors.Is(err, errFrameTooLarge), errors.Is(err, errInconsistentFrameSize):
+		return nodefilter.PenaltyBadFrameSize
+	case errors.Is(err, errDecodedTooLarge):
+		return nodefilter.PenaltyCompressionBomb
+	case errors.Is(err, ErrReadTimeout), errors.Is(err, ErrWriteTimeout):
+		// a dead or slow connection is not a protocol violation
+		return 0
+	}
+	return 0
+}
+
+// PeerScores returns the reputation score of each peer IP seen by the server.
+func (srv *Server) PeerScores() map[string]int {
+	return srv.reputation.Scores()
+}
+
+// compressionBombCount is the number of compression bombs rejected from a peer
+// IP, and when the last one was.
+type compressionBombCount struct {
+	n    uint64
+	last time.Time
+}
+
+// markCompressionBomb counts a compression bomb rejected from ip and returns
+// the count of ip, which starts over once the previous bomb expired.
+func (srv *Server) markCompressionBomb(ip string) uint64 {
+	now := srv.clock()
+	count := compressionBombCount{n: 1, last: now}
+	if v, ok := srv.compressionBombs.Get(ip); ok {
+		if prev := v.(compressionBombCount); now.Sub(prev.last) < compressionBombTTL {
+			count.n = prev.n + 1
+		}
+	}
+	srv.compressionBombs.Add(ip, count)
+	return count.n
+}
+
+// CompressionBombs returns the number of compression bombs rejected from each
+// peer IP, across all its connections. Only the IPs which sent one recently
+// are kept.
+func (srv *Server) CompressionBombs() map[string]uint64 {
+	now := srv.clock()
+	bombs := make(map[string]uint64)
+	for _, key := range srv.compressionBombs.Keys() {
+		v, ok := srv.compressionBombs.Peek(key)
+		if !ok {
+			continue
+		}
+		if count := v.(compressionBombCount); now.Sub(count.last) < compressionBombTTL {
+			bombs[key.(string)] = count.n
+		}
+	}
+	return bombs
+}
+
 func (srv *Server) maxInboundConns() int {
 	return srv.MaxPeers - srv.maxDialedConns()
 }
@@ -918,6 +1177,11 @@ func (srv *Server) setupConn(c *conn, flags connFlag, dialDest *enode.Node) erro
 	if !running {
 		return errServerStopped
 	}
+	if err := srv.acquireHandshake(flags); err != nil {
+		srv.log.Debug("Rejected conn before handshake", "addr", c.fd.RemoteAddr(), "err", err)
+		return err
+	}
+	defer srv.releaseHandshake()
 	// If dialing, figure out the remote public key.
 	var dialPubkey *ecdsa.PublicKey
 	if dialDest != nil {
@@ -942,13 +1206,26 @@ func (srv *Server) setupConn(c *conn, flags connFlag, dialDest *enode.Node) erro
 		c.node = nodeFromConn(remotePubkey, c.fd)
 	}
 	clog := srv.log.New("id", c.node.ID(), "addr", c.fd.RemoteAddr(), "conn", c.flags)
+	// a node listing itself among its peers ends up dialing itself, the
+	// loopback is dropped before it takes a slot or exchanges any hello
+	if c.node.ID() == srv.localnode.ID() {
+		clog.Debug("Rejected self-connection")
+		return DiscSelf
+	}
+	// the identity is known, listed peers are dropped before any protocol
+	// message is exchanged
+	if err := srv.idFilter.Check(c.node.ID()); err != nil {
+		clog.Debug("Rejected peer by node list", "err", err)
+		return err
+	}
 	err = srv.checkpoint(c, srv.posthandshake)
 	if err != nil {
 		clog.Trace("Rejected peer before protocol handshake", "err", err)
 		return err
 	}
 	// Run the protocol handshake
-	phs, err := c.doProtoHandshake(srv.ourHandshake)
+	sent := srv.clock()
+	phs, err := c.doProtoHandshake(withHandshakeTime(srv.ourHandshake, sent))
 	if err != nil {
 		clog.Trace("Failed proto handshake", "err", err)
 		return err
@@ -957,6 +1234,17 @@ func (srv *Server) setupConn(c *conn, flags connFlag, dialDest *enode.Node) erro
 		clog.Trace("Wrong devp2p handshake identity", "phsid", hex.EncodeToString(phs.ID))
 		return DiscUnexpectedIdentity
 	}
+	if skew, ok := clockSkew(phs, sent, srv.clock()); ok {
+		c.skew, c.skewKnown = skew, true
+		warn, err := srv.checkClockSkew(skew)
+		if err != nil {
+			clog.Warn("Rejected peer with skewed clock", "skew", skew)
+			return err
+		}
+		if warn {
+			clog.Warn("Peer clock is skewed", "skew", skew)
+		}
+	}
 	c.caps, c.name = phs.Caps, phs.Name
 	err = srv.checkpoint(c, srv.addpeer)
 	if err != nil {
@@ -986,6 +1274,38 @@ func truncateName(s string) string {
 	return s
 }
 
+// acquireHandshake takes a handshake slot for a new connection. Inbound
+// connections fail with DiscTooBusy if none is free, so that a flood of
+// connections can not pile up handshake work.
+func (srv *Server) acquireHandshake(flags connFlag) error {
+	if flags&inboundConn != 0 {
+		select {
+		case srv.handshakes <- struct{}{}:
+		default:
+			return DiscTooBusy
+		}
+	} else {
+		select {
+		case srv.handshakes <- struct{}{}:
+		case <-srv.quit:
+			return errServerStopped
+		}
+	}
+	handshakesGauge.Update(int64(atomic.AddInt32(&srv.inflight, 1)))
+	return nil
+}
+
+func (srv *Server) releaseHandshake() {
+	handshakesGauge.Update(int64(atomic.AddInt32(&srv.inflight, -1)))
+	<-srv.handshakes
+}
+
+// HandshakesInFlight returns the number of connections running their
+// handshakes.
+func (srv *Server) HandshakesInFlight() int {
+	return int(atomic.LoadInt32(&srv.inflight))
+}
+
 // checkpoint sends the conn to run, which performs the
 // post-handshake checks for the stage (posthandshake, addpeer).
 func (srv *Server) checkpoint(c *conn, stage chan<- *conn) error {
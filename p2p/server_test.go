@@ -19,11 +19,14 @@ package p2p
 import (
 	"crypto/ecdsa"
 	"errors"
+	"fmt"
 	"github.com/QuarkChain/goquarkchain/p2p/nodefilter"
+	"io"
 	"math/rand"
 	"net"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -584,6 +587,354 @@ func TestServerSetupConn(t *testing.T) {
 	}
 }
 
+func TestServerSetupConnNodeLists(t *testing.T) {
+	var (
+		clientkey, srvkey = newkey(), newkey()
+		clientpub         = &clientkey.PublicKey
+		clientID          = enode.NewV4(clientpub, nil, 0, 0).ID()
+		otherID           = enode.NewV4(&newkey().PublicKey, nil, 0, 0).ID()
+	)
+	tests := []struct {
+		allow, deny []enode.ID
+		reload      bool
+
+		wantCloseErr error
+		wantCalls    string
+	}{
+		{
+			deny:         []enode.ID{clientID},
+			wantCalls:    "doEncHandshake,close,",
+			wantCloseErr: nodefilter.ErrNodeDenied,
+		},
+		{
+			allow:        []enode.ID{otherID},
+			wantCalls:    "doEncHandshake,close,",
+			wantCloseErr: nodefilter.ErrNodeNotAllowed,
+		},
+		{
+			allow:        []enode.ID{clientID},
+			wantCalls:    "doEncHandshake,doProtoHandshake,close,",
+			wantCloseErr: DiscUselessPeer,
+		},
+		{
+			deny:         []enode.ID{clientID},
+			reload:       true,
+			wantCalls:    "doEncHandshake,close,",
+			wantCloseErr: nodefilter.ErrNodeDenied,
+		},
+	}
+
+	for i, test := range tests {
+		tt := &setupTransport{pubkey: clientpub, phs: protoHandshake{ID: crypto.FromECDSAPub(clientpub)[1:]}}
+		srv := &Server{
+			Config: Config{
+				PrivateKey: srvkey,
+				MaxPeers:   10,
+				NoDial:     true,
+				Protocols:  []Protocol{discard},
+			},
+			newTransport: func(fd net.Conn) transport { return tt },
+			log:          log.New(),
+		}
+		if !test.reload {
+			srv.AllowedNodes, srv.DeniedNodes = test.allow, test.deny
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatalf("couldn't start server: %v", err)
+		}
+		if test.reload {
+			srv.SetNodeLists(test.allow, test.deny)
+		}
+		p1, _ := net.Pipe()
+		srv.SetupConn(p1, inboundConn, nil)
+		if tt.closeErr != test.wantCloseErr {
+			t.Errorf("test %d: close error mismatch: got %q, want %q", i, tt.closeErr, test.wantCloseErr)
+		}
+		if tt.calls != test.wantCalls {
+			t.Errorf("test %d: calls mismatch: got %q, want %q", i, tt.calls, test.wantCalls)
+		}
+		srv.Stop()
+	}
+}
+
+// idleTransport is a setupTransport whose connection stays silent once set
+// up, until it is closed.
+type idleTransport struct {
+	*setupTransport
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newIdleTransport(key *ecdsa.PrivateKey) *idleTransport {
+	return &idleTransport{
+		setupTransport: &setupTransport{
+			pubkey: &key.PublicKey,
+			phs:    protoHandshake{ID: crypto.FromECDSAPub(&key.PublicKey)[1:], Caps: []Cap{discard.cap()}},
+		},
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *idleTransport) close(err error) {
+	c.once.Do(func() {
+		c.setupTransport.close(err)
+		close(c.closed)
+	})
+}
+
+func (c *idleTransport) ReadMsg() (Msg, error) {
+	<-c.closed
+	return Msg{}, io.EOF
+}
+
+func (c *idleTransport) WriteMsg(Msg) error {
+	return nil
+}
+
+func TestServerEvictPeer(t *testing.T) {
+	transports := make(chan transport, 1)
+	added := make(chan *Peer, 4)
+	srv := &Server{
+		Config: Config{
+			PrivateKey:   newkey(),
+			MaxPeers:     2,
+			NoDial:       true,
+			Protocols:    []Protocol{discard},
+			PeerEviction: EvictIdle,
+			MinEvictIdle: time.Minute,
+		},
+		newTransport: func(fd net.Conn) transport { return <-transports },
+		newPeerHook:  func(p *Peer) { added <- p },
+		log:          log.New(),
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("couldn't start server: %v", err)
+	}
+	defer srv.Stop()
+
+	connect := func(inbound bool) (*idleTransport, error) {
+		key := newkey()
+		tp := newIdleTransport(key)
+		transports <- tp
+		flags, dialDest := dynDialedConn, enode.NewV4(&key.PublicKey, nil, 0, 0)
+		if inbound {
+			flags, dialDest = inboundConn, nil
+		}
+		fd, _ := net.Pipe()
+		return tp, srv.SetupConn(fd, flags, dialDest)
+	}
+	outbound, err := connect(false)
+	if err != nil {
+		t.Fatalf("outbound peer rejected: %v", err)
+	}
+	outboundPeer := <-added
+	inbound, err := connect(true)
+	if err != nil {
+		t.Fatalf("inbound peer rejected: %v", err)
+	}
+	inboundPeer := <-added
+
+	// the peers are active, the newcomer is turned away
+	if tp, err := connect(false); err != DiscTooManyPeers || tp.closeErr != DiscTooManyPeers {
+		t.Fatalf("got %v, want %v", err, DiscTooManyPeers)
+	}
+
+	// the outbound peer idles longer, yet the inbound one makes room
+	atomic.StoreInt64(&outboundPeer.lastActive, time.Now().Add(-2*time.Hour).UnixNano())
+	atomic.StoreInt64(&inboundPeer.lastActive, time.Now().Add(-time.Hour).UnixNano())
+	if _, err := connect(false); err != nil {
+		t.Fatalf("newcomer rejected: %v", err)
+	}
+	<-added
+	select {
+	case <-inbound.closed:
+		if inbound.closeErr != DiscTooManyPeers {
+			t.Errorf("evicted with %v, want %v", inbound.closeErr, DiscTooManyPeers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("inbound peer not evicted")
+	}
+	select {
+	case <-outbound.closed:
+		t.Fatal("outbound peer evicted")
+	default:
+	}
+	if n := srv.PeerCount(); n != 2 {
+		t.Errorf("%d peers, want 2", n)
+	}
+}
+
+func TestServerCompressionBombs(t *testing.T) {
+	transports := make(chan transport, 1)
+	var elapsed int64
+	srv := &Server{
+		Config: Config{
+			PrivateKey: newkey(),
+			MaxPeers:   10,
+			NoDial:     true,
+			Protocols: []Protocol{{
+				Name:    discard.Name,
+				Version: discard.Version,
+				Length:  discard.Length,
+				Run: func(p *Peer, rw MsgReadWriter) error {
+					return fmt.Errorf("snappy: %w", errDecodedTooLarge)
+				},
+			}},
+		},
+		newTransport: func(fd net.Conn) transport { return <-transports },
+		clock:        func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&elapsed))) },
+		log:          log.New(),
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("couldn't start server: %v", err)
+	}
+	defer srv.Stop()
+
+	// each connection of the same IP sends a bomb, under a new node ID
+	ip := net.ParseIP("10.0.0.1")
+	for i := uint64(1); i <= 2; i++ {
+		key := newkey()
+		transports <- newIdleTransport(key)
+		fd, _ := net.Pipe()
+		if err := srv.SetupConn(fd, dynDialedConn, enode.NewV4(&key.PublicKey, ip, 30303, 30303)); err != nil {
+			t.Fatalf("connection %d rejected: %v", i, err)
+		}
+		for j := 0; srv.CompressionBombs()[ip.String()] != i; j++ {
+			if j == 100 {
+				t.Fatalf("compression bombs of %v: got %d, want %d", ip, srv.CompressionBombs()[ip.String()], i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if !srv.reputation.Banned(ip.String()) {
+		t.Error("repeated compression bombs should ban the peer")
+	}
+	key := newkey()
+	transports <- newIdleTransport(key)
+	fd, _ := net.Pipe()
+	if err := srv.SetupConn(fd, dynDialedConn, enode.NewV4(&key.PublicKey, ip, 30303, 30303)); err != errPeerBanned {
+		t.Errorf("connection of the banned IP: got %v, want %v", err, errPeerBanned)
+	}
+	if n := srv.PeerCount(); n != 0 {
+		t.Errorf("%d peers, want 0", n)
+	}
+
+	// the counts expire, and only the most recent IPs are kept
+	atomic.StoreInt64(&elapsed, int64(compressionBombTTL))
+	if bombs := srv.CompressionBombs(); len(bombs) != 0 {
+		t.Errorf("expired compression bombs: %v", bombs)
+	}
+	if n := srv.markCompressionBomb(ip.String()); n != 1 {
+		t.Errorf("compression bombs after expiry: got %d, want 1", n)
+	}
+	for i := 0; i < maxCompressionBombIPs; i++ {
+		srv.markCompressionBomb(fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	if bombs := srv.CompressionBombs(); len(bombs) != maxCompressionBombIPs || bombs[ip.String()] != 0 {
+		t.Errorf("%d IPs counted, want %d without %v", len(bombs), maxCompressionBombIPs, ip)
+	}
+}
+
+func TestServerSetupConnSelf(t *testing.T) {
+	srvkey := newkey()
+	self := enode.NewV4(&srvkey.PublicKey, nil, 0, 0)
+	tests := []struct {
+		flags    connFlag
+		dialDest *enode.Node
+		allow    []enode.ID
+	}{
+		{flags: inboundConn},
+		{flags: staticDialedConn, dialDest: self},
+		// rejected as a self-connection before any other check
+		{flags: inboundConn, allow: []enode.ID{randomID()}},
+	}
+	for i, test := range tests {
+		tt := &setupTransport{pubkey: &srvkey.PublicKey, phs: protoHandshake{ID: crypto.FromECDSAPub(&srvkey.PublicKey)[1:]}}
+		srv := &Server{
+			Config: Config{
+				PrivateKey:   srvkey,
+				MaxPeers:     10,
+				NoDial:       true,
+				Protocols:    []Protocol{discard},
+				AllowedNodes: test.allow,
+			},
+			newTransport: func(fd net.Conn) transport { return tt },
+			log:          log.New(),
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatalf("couldn't start server: %v", err)
+		}
+		p1, _ := net.Pipe()
+		srv.SetupConn(p1, test.flags, test.dialDest)
+		if tt.closeErr != DiscSelf {
+			t.Errorf("test %d: close error mismatch: got %q, want %q", i, tt.closeErr, DiscSelf)
+		}
+		if want := "doEncHandshake,close,"; tt.calls != want {
+			t.Errorf("test %d: calls mismatch: got %q, want %q", i, tt.calls, want)
+		}
+		srv.Stop()
+	}
+}
+
+func TestServerSetupConnClockSkew(t *testing.T) {
+	var (
+		clientkey, srvkey = newkey(), newkey()
+		clientpub         = &clientkey.PublicKey
+		now               = time.Unix(1560000000, 0)
+	)
+	tests := []struct {
+		skew     time.Duration
+		stamped  bool
+		warn     bool
+		closeErr error
+	}{
+		{skew: 0, stamped: true, closeErr: DiscUselessPeer},
+		{skew: -15 * time.Second, stamped: true, warn: true, closeErr: DiscUselessPeer},
+		{skew: 30 * time.Second, stamped: true, warn: true, closeErr: errClockSkew},
+		{skew: -30 * time.Second, stamped: true, warn: true, closeErr: errClockSkew},
+		// peers not sending their clock are accepted
+		{stamped: false, closeErr: DiscUselessPeer},
+	}
+	for i, test := range tests {
+		phs := &protoHandshake{ID: crypto.FromECDSAPub(clientpub)[1:]}
+		if test.stamped {
+			phs = withHandshakeTime(phs, now.Add(test.skew))
+		}
+		tt := &setupTransport{pubkey: clientpub, phs: *phs}
+		srv := &Server{
+			Config: Config{
+				PrivateKey:    srvkey,
+				MaxPeers:      10,
+				NoDial:        true,
+				Protocols:     []Protocol{discard},
+				ClockSkewWarn: 10 * time.Second,
+				MaxClockSkew:  20 * time.Second,
+			},
+			newTransport: func(fd net.Conn) transport { return tt },
+			clock:        func() time.Time { return now },
+			log:          log.New(),
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatalf("couldn't start server: %v", err)
+		}
+		p1, _ := net.Pipe()
+		srv.SetupConn(p1, inboundConn, nil)
+		if tt.closeErr != test.closeErr {
+			t.Errorf("test %d: close error mismatch: got %q, want %q", i, tt.closeErr, test.closeErr)
+		}
+		if sent, ok := handshakeTime(tt.our); !ok || !sent.Equal(now) {
+			t.Errorf("test %d: our handshake time %v, want %v", i, sent, now)
+		}
+		if test.stamped {
+			warn, _ := srv.checkClockSkew(test.skew)
+			if warn != test.warn {
+				t.Errorf("test %d: warning %v, want %v", i, warn, test.warn)
+			}
+		}
+		srv.Stop()
+	}
+}
+
 type setupTransport struct {
 	pubkey            *ecdsa.PublicKey
 	encHandshakeErr   error
@@ -592,6 +943,7 @@ type setupTransport struct {
 
 	calls    string
 	closeErr error
+	our      *protoHandshake
 }
 
 func (c *setupTransport) doEncHandshake(prv *ecdsa.PrivateKey, dialDest *ecdsa.PublicKey) (*ecdsa.PublicKey, error) {
@@ -601,6 +953,7 @@ func (c *setupTransport) doEncHandshake(prv *ecdsa.PrivateKey, dialDest *ecdsa.P
 
 func (c *setupTransport) doProtoHandshake(our *protoHandshake) (*protoHandshake, error) {
 	c.calls += "doProtoHandshake,"
+	c.our = our
 	if c.protoHandshakeErr != nil {
 		return nil, c.protoHandshakeErr
 	}
@@ -633,3 +986,68 @@ func randomID() (id enode.ID) {
 	}
 	return id
 }
+
+func TestServerProtoHandshakeVersions(t *testing.T) {
+	srv := &Server{Config: Config{
+		MaxPeers:  10,
+		Protocols: []Protocol{{Name: "qkc", Version: 1}, {Name: "qkc", Version: 2}},
+	}, log: log.New()}
+	node := enode.NewV4(&newkey().PublicKey, nil, 0, 0)
+	peers := make(map[enode.ID]*Peer)
+
+	tests := []struct {
+		caps []Cap
+		want error
+	}{
+		{caps: []Cap{{"qkc", 3}}, want: DiscIncompatibleVersion},
+		{caps: []Cap{{"eth", 63}}, want: DiscUselessPeer},
+	}
+	for i, test := range tests {
+		c := &conn{node: node, caps: test.caps}
+		if err := srv.protoHandshakeChecks(peers, 0, c); err != test.want {
+			t.Errorf("test %d: got %v, want %v", i, err, test.want)
+		}
+	}
+	// the highest version shared with the peer is run
+	protos := matchProtocols(srv.Protocols, []Cap{{"qkc", 1}, {"qkc", 2}, {"qkc", 3}}, nil)
+	if proto := protos["qkc"]; proto == nil || proto.Version != 2 {
+		t.Errorf("matched protocol %v, want qkc/2", proto)
+	}
+}
+
+func TestServerHandshakeLimit(t *testing.T) {
+	tt := &setupTransport{pubkey: &newkey().PublicKey}
+	srv := &Server{
+		Config: Config{
+			PrivateKey:    newkey(),
+			MaxPeers:      10,
+			MaxHandshakes: 1,
+			NoDial:        true,
+		},
+		newTransport: func(fd net.Conn) transport { return tt },
+		log:          log.New(),
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("couldn't start server: %v", err)
+	}
+	defer srv.Stop()
+
+	// a dial holds the only handshake slot
+	if err := srv.acquireHandshake(dynDialedConn); err != nil {
+		t.Fatalf("acquire handshake: %v", err)
+	}
+	if n := srv.HandshakesInFlight(); n != 1 {
+		t.Errorf("handshakes in flight %d, want 1", n)
+	}
+	p1, _ := net.Pipe()
+	if err := srv.SetupConn(p1, inboundConn, nil); err != DiscTooBusy {
+		t.Errorf("got %v, want %v", err, DiscTooBusy)
+	}
+	if tt.calls != "close," || tt.closeErr != DiscTooBusy {
+		t.Errorf("inbound conn should be closed before the handshake, calls %q, err %v", tt.calls, tt.closeErr)
+	}
+	srv.releaseHandshake()
+	if n := srv.HandshakesInFlight(); n != 0 {
+		t.Errorf("handshakes in flight %d, want 0", n)
+	}
+}